@@ -0,0 +1,365 @@
+// Package cli implements "redislogger cli", an interactive client that
+// talks to Redis through the proxy and shows how the proxy classifies and
+// logs each command
+package cli
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/term"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+	"github.com/gregyjames/RedisLogger/proxy"
+)
+
+// client is a connection to the proxy
+type client struct {
+	conn   net.Conn
+	reader *protocol.ReplyReader
+}
+
+// Run starts the REPL with the given command line arguments
+func Run(args []string) error {
+	flags := flag.NewFlagSet("cli", flag.ContinueOnError)
+	configPath := flags.String("config", "config.json", "proxy configuration, used for the address and to classify commands")
+	addr := flags.String("addr", "", "proxy address; defaults to listen_addr")
+	user := flags.String("user", "", "user to authenticate as with the proxy")
+	password := flags.String("password", "", "password to authenticate with")
+	name := flags.String("name", "redislogger-cli", "client name the connection is tagged with")
+	useTLS := flags.Bool("tls", false, "connect over TLS")
+	certFile := flags.String("cert", "", "client certificate, for an identity under mutual TLS")
+	keyFile := flags.String("key", "", "client certificate key")
+	caFile := flags.String("ca", "", "CA bundle to verify the proxy certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *addr == "" {
+		listen := cfg.ListenAddr
+		for _, l := range cfg.Listeners {
+			if listen != "" {
+				break
+			}
+			if !strings.HasPrefix(l.Addr, "unix:") {
+				listen = l.Addr
+			}
+		}
+		*addr = dialableAddr(listen)
+	}
+
+	conn, err := dial(*addr, *useTLS, *certFile, *keyFile, *caFile)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", *addr, err)
+	}
+	c := &client{conn: conn, reader: protocol.NewReplyReader(conn)}
+	defer conn.Close()
+
+	if *password != "" {
+		authArgs := []string{"AUTH", *password}
+		if *user != "" {
+			authArgs = []string{"AUTH", *user, *password}
+		}
+		if err := c.expectOK(authArgs...); err != nil {
+			return err
+		}
+	}
+	if err := c.expectOK("CLIENT", "SETNAME", *name); err != nil {
+		return err
+	}
+
+	classifier := proxy.New(cfg, zap.NewNop())
+	authUser := *user
+	if authUser == "" && *password != "" {
+		authUser = "default"
+	}
+	return repl(c, classifier, authUser, *addr)
+}
+
+// dialableAddr turns a listen address such as ":9000" into one to connect to
+func dialableAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || (host != "" && host != "0.0.0.0" && host != "::") {
+		return listen
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func dial(addr string, useTLS bool, certFile, keyFile, caFile string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !useTLS && certFile == "" {
+		return dialer.Dial("tcp", addr)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		tlsConfig.ServerName = host
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
+func (c *client) do(args ...string) (*protocol.Reply, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.reader.ReadReply()
+}
+
+func (c *client) expectOK(args ...string) error {
+	reply, err := c.do(args...)
+	if err != nil {
+		return err
+	}
+	if reply.IsError() {
+		return fmt.Errorf("%s failed: %s", args[0], reply.Str)
+	}
+	return nil
+}
+
+// repl reads commands until EOF or "quit", with line editing and command
+// completion when stdin is a terminal
+func repl(c *client, classifier *proxy.Proxy, user, addr string) error {
+	prompt := addr + "> "
+	var readLine func() (string, error)
+	var out io.Writer = os.Stdout
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, prompt)
+		t.AutoCompleteCallback = completer(t)
+		readLine, out = t.ReadLine, t
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(out, "(error) %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "quit", "exit":
+			return nil
+		case "help":
+			fmt.Fprintln(out, "Commands are sent through the proxy. Before each reply, the fields the proxy logs the\ncommand with and its classification are shown. Press Tab to complete command names.")
+			continue
+		}
+
+		describe(out, classifier.Describe(user, args))
+		reply, err := c.do(args...)
+		if err != nil {
+			return fmt.Errorf("connection to the proxy lost: %w", err)
+		}
+		fmt.Fprint(out, formatReply(reply, ""))
+	}
+}
+
+// describe prints how the proxy logs and classifies a command
+func describe(out io.Writer, d *proxy.Description) {
+	keys := make([]string, 0, len(d.Fields))
+	for key := range d.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%v", key, d.Fields[key]))
+	}
+	fmt.Fprintf(out, "  logged  %s\n", strings.Join(fields, " "))
+
+	class := strings.Join(d.Flags, ",")
+	if class == "" {
+		class = "unclassified"
+	}
+	if len(d.Keys) > 0 {
+		class += fmt.Sprintf("  keys=%s  slot=%d", strings.Join(d.Keys, ","), d.Slot)
+	}
+	fmt.Fprintf(out, "  class   %s  %s\n", class, d.Verdict)
+}
+
+// completer completes command names from the proxy's command table
+func completer(t *term.Terminal) func(string, int, rune) (string, int, bool) {
+	names := protocol.CommandNames()
+	sort.Strings(names)
+
+	return func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' || strings.ContainsAny(line[:pos], " ") {
+			return "", 0, false
+		}
+		prefix := strings.ToUpper(line[:pos])
+		var matches []string
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				matches = append(matches, name)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return "", 0, false
+		case 1:
+			completed := matches[0] + " " + line[pos:]
+			return completed, len(matches[0]) + 1, true
+		}
+
+		common := matches[0]
+		for _, m := range matches[1:] {
+			for !strings.HasPrefix(m, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		if len(common) == len(prefix) {
+			fmt.Fprintf(t, "%s\n", strings.Join(matches, "  "))
+		}
+		return common + line[pos:], len(common), true
+	}
+}
+
+// splitArgs splits a line into arguments, honouring single and double
+// quotes as redis-cli does
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unbalanced quotes")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// formatReply renders a reply the way redis-cli does
+func formatReply(r *protocol.Reply, indent string) string {
+	switch {
+	case r.Null:
+		return "(nil)\n"
+	case r.IsError():
+		return "(error) " + r.Str + "\n"
+	}
+	switch r.Type {
+	case '+':
+		return r.Str + "\n"
+	case ':':
+		return "(integer) " + r.Str + "\n"
+	case ',':
+		return "(double) " + r.Str + "\n"
+	case '#':
+		return fmt.Sprintf("(boolean) %t\n", r.Str == "t")
+	case '(':
+		return "(big number) " + r.Str + "\n"
+	case '$', '=':
+		return fmt.Sprintf("%q\n", r.Str)
+	}
+
+	if len(r.Elems) == 0 {
+		return "(empty array)\n"
+	}
+	var b strings.Builder
+	step := 1
+	if r.Type == '%' {
+		step = 2
+	}
+	width := len(fmt.Sprint(len(r.Elems) / step))
+	for i := 0; i < len(r.Elems); i += step {
+		if i > 0 {
+			b.WriteString(indent)
+		}
+		prefix := fmt.Sprintf("%*d) ", width, i/step+1)
+		b.WriteString(prefix)
+		nested := indent + strings.Repeat(" ", len(prefix))
+		if step == 2 {
+			b.WriteString(strings.TrimSuffix(formatReply(r.Elems[i], nested), "\n") + " => ")
+			b.WriteString(formatReply(r.Elems[i+1], nested))
+		} else {
+			b.WriteString(formatReply(r.Elems[i], nested))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	redislogger "github.com/gregyjames/RedisLogger"
+	"github.com/gregyjames/RedisLogger/cli"
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/top"
+)
+
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "cli" || os.Args[1] == "top") {
+		run := cli.Run
+		if os.Args[1] == "top" {
+			run = top.Run
+		}
+		if err := run(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Log to stderr until the configuration sets the log outputs
+	logger, _ := zap.NewDevelopment(zap.IncreaseLevel(zap.DebugLevel))
+	defer logger.Sync()
+
+	logger.Debug("Starting Redis proxy")
+
+	// Load configuration
+	cfg, err := config.Load("config.json")
+	if err != nil {
+		logger.Fatal("Failed to load config", zap.Error(err))
+	}
+	if cfg.Log != nil {
+		configured, closeOutputs, err := redislogger.NewLogger(cfg.Log)
+		if err != nil {
+			logger.Fatal("Failed to open log outputs", zap.Error(err))
+		}
+		defer closeOutputs()
+		logger = configured
+		defer logger.Sync()
+	}
+	logger.Debug("Configuration loaded",
+		zap.String("listen_addr", cfg.ListenAddr),
+		zap.String("redis_addr", cfg.RedisAddr),
+		zap.Strings("sources", cfg.Sources),
+	)
+	if cfg.Lint != "off" {
+		for _, warning := range cfg.Warnings() {
+			logger.Warn("Risky configuration", zap.String("lint", warning))
+		}
+	}
+
+	// Create the server, which tees log output into any partitioned and
+	// legal hold files
+	srv, err := redislogger.NewServer(cfg, redislogger.WithLogger(logger))
+	if err != nil {
+		logger.Fatal("Failed to create server", zap.Error(err))
+	}
+	defer srv.Close()
+	logger = srv.Logger()
+	logger.Debug("Proxy instance created")
+
+	// Create context that can be cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle shutdown signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// An upgrade signal hands the listeners off to a new process, after
+	// which this one drains as on shutdown
+	upgradeChan := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeChan, upgradeSignals...)
+	}
+	logger.Debug("Signal handlers registered")
+
+	// Start proxy in a goroutine
+	errChan := make(chan error, 1)
+	go func() {
+		logger.Debug("Starting proxy server")
+		errChan <- srv.ListenAndServe(ctx)
+	}()
+
+	// Wait for either a signal or an error
+	var sig os.Signal
+wait:
+	for {
+		select {
+		case sig = <-upgradeChan:
+			logger.Info("Received signal", zap.String("signal", sig.String()))
+			if err := srv.Handoff(); err != nil {
+				logger.Error("Socket handoff failed", zap.Error(err))
+				continue
+			}
+			break wait
+		case sig = <-sigChan:
+			logger.Info("Received signal", zap.String("signal", sig.String()))
+			break wait
+		case err := <-errChan:
+			if err != nil {
+				logger.Fatal("Proxy error", zap.Error(err))
+			}
+			break wait
+		}
+	}
+	// A second signal closes the remaining connections straight away
+	drainCtx, stopDrain := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-sigChan:
+			stopDrain()
+		case <-drainCtx.Done():
+		}
+	}()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		logger.Error("Failed to save proxy state", zap.Error(err))
+	}
+	stopDrain()
+	cancel()
+	logger.Debug("Shutting down")
+}
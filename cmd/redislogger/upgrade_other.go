@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty where listeners cannot be handed off
+var upgradeSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals hand the listeners off to a new process of the binary
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fragmentDir returns the directory of fragments merged over a config
+// file, "config.d" for "config.json"
+func fragmentDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+}
+
+// loadSources reads the config file and then every fragment in its
+// fragment directory in lexical order, merging each over the result so far
+func loadSources(path string) (map[string]any, []string, error) {
+	merged := make(map[string]any)
+	var sources []string
+
+	dir := fragmentDir(path)
+	entries, dirErr := os.ReadDir(dir)
+	if dirErr != nil && !os.IsNotExist(dirErr) {
+		return nil, nil, fmt.Errorf("error reading config directory: %v", dirErr)
+	}
+
+	base, err := readFragment(path)
+	switch {
+	case err == nil:
+		merge(merged, base)
+		sources = append(sources, path)
+	case !os.IsNotExist(err) || dirErr != nil:
+		// The base file may only be left out when fragments exist
+		return nil, nil, fmt.Errorf("error opening config file: %v", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".yaml", ".yml":
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fragmentPath := filepath.Join(dir, name)
+		fragment, err := readFragment(fragmentPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading config fragment %s: %v", fragmentPath, err)
+		}
+		merge(merged, fragment)
+		sources = append(sources, fragmentPath)
+	}
+	return merged, sources, nil
+}
+
+func readFragment(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fragment := make(map[string]any)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &fragment)
+	default:
+		err = json.Unmarshal(data, &fragment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fragment, nil
+}
+
+// merge copies src over dst, merging nested objects key by key; lists and
+// scalars from src replace those in dst
+func merge(dst, src map[string]any) {
+	for key, value := range src {
+		if srcMap, ok := value.(map[string]any); ok {
+			if dstMap, ok := dst[key].(map[string]any); ok {
+				merge(dstMap, srcMap)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Warnings reports settings that are valid but risky in combination, such as
+// an admin API reachable from the network without a token
+func (c *Config) Warnings() []string {
+	var warnings []string
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	if c.ListenAddr != "" && c.TLSListen == nil && !isLoopback(c.ListenAddr) {
+		warn("listen_addr %s accepts plaintext connections from the network; logged commands and values travel unencrypted", c.ListenAddr)
+	}
+	for _, l := range c.Listeners {
+		if !l.TLS && !isLoopback(l.Addr) && !strings.HasPrefix(l.Addr, "unix:") {
+			warn("listener %s accepts plaintext connections from the network; logged commands and values travel unencrypted", l.Addr)
+		}
+	}
+
+	if c.Admin != nil && c.Admin.Token == "" && !isLoopback(c.Admin.Addr) {
+		warn("admin API on %s has no token; anyone who can reach it can approve commands and grant elevated access", c.Admin.Addr)
+	}
+
+	if c.RedisTLS != nil && c.RedisTLS.InsecureSkipVerify {
+		warn("redis_tls.insecure_skip_verify disables verification of the Redis server certificate")
+	}
+
+	if len(c.IdentityACLs) > 0 {
+		fallback, hasFallback := c.IdentityACLs["default"]
+		switch {
+		case c.TLSListen == nil || c.TLSListen.ClientCAFile == "":
+			warn("identity_acls without tls_listen.client_ca_file apply only their \"default\" entry, to every client")
+		case c.TLSListen.ClientAuth == "optional" && hasFallback && len(fallback.Allow) == 0:
+			warn("identity_acls with tls_listen.client_auth \"optional\" give clients without a certificate the \"default\" entry, which only denies some commands")
+		}
+	}
+
+	if c.RedisPassword != "" && c.RedisTLS == nil && !isLoopback(c.RedisAddr) {
+		warn("redis_password is sent to %s over plaintext; set redis_tls to encrypt it", c.RedisAddr)
+	}
+
+	if c.ProxyProtocol != nil && c.ProxyProtocol.Accept && len(c.ProxyProtocol.TrustedCIDRs) == 0 {
+		warn("proxy_protocol.accept without trusted_cidrs lets any client spoof its logged address")
+	}
+
+	if len(c.Backends) > 1 && c.Sharding == nil && c.Balance != "failover" {
+		warn("balancing connections across %d backends without read-your-writes pinning; writes and later reads may reach different servers", len(c.Backends))
+	}
+
+	if c.Approvals != nil && strings.HasPrefix(c.Approvals.WebhookURL, "http://") {
+		warn("approvals.webhook_url sends command arguments over plaintext HTTP")
+	}
+
+	// The cache is invalidated by the writes it sees, as Redis's client
+	// tracking isn't used
+	if c.Cache != nil {
+		ttl := c.Cache.TTLMs
+		if ttl == 0 {
+			ttl = 1000
+		}
+		warn("cache is only invalidated by writes through this proxy; values written to Redis by other clients or proxies may be served stale for up to %dms", ttl)
+	}
+
+	if !c.RedactValues && len(c.RedactRules) == 0 {
+		warn("neither redact_values nor redact_rules is set, so command values, including any secrets, are logged in full")
+	}
+
+	if c.Chaos != nil && len(c.Chaos.Faults) > 0 {
+		warn("chaos injects %d fault(s) into client traffic; do not use in production", len(c.Chaos.Faults))
+	}
+
+	return warnings
+}
+
+// isLoopback reports whether a listen address only accepts local
+// connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,104 @@
+package glob
+
+// Match reports whether subject matches a Redis-style glob pattern. The
+// pattern supports "*", "?", character classes such as "[a-z]" and "[^0-9]",
+// and backslash escapes; unlike path.Match, "*" also matches "/".
+func Match(pattern, subject string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse consecutive stars
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(subject); i++ {
+				if Match(pattern[1:], subject[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(subject) == 0 {
+				return false
+			}
+			subject = subject[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(subject) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], subject[0])
+			if !matched {
+				return false
+			}
+			subject = subject[1:]
+			pattern = rest
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(subject) == 0 || pattern[0] != subject[0] {
+				return false
+			}
+			subject = subject[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(subject) == 0
+}
+
+// MatchAny reports whether subject matches any of the patterns
+func MatchAny(patterns []string, subject string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchClass matches c against the character class at the start of
+// pattern, which follows the opening bracket, and returns the pattern
+// remaining after the closing bracket
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		// Skip the closing bracket
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
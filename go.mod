@@ -1,10 +1,23 @@
-module redislogger
+module github.com/gregyjames/RedisLogger
 
-go 1.23
+go 1.23.0
 
-require go.uber.org/zap v1.27.0
+require (
+	github.com/tetratelabs/wazero v1.10.1
+	github.com/yuin/gopher-lua v1.1.1
+	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.26.0
+	golang.org/x/term v0.25.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.36.10
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/stretchr/testify v1.10.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
 )
@@ -0,0 +1,76 @@
+package redislogger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// NewLogger builds the logger cfg configures, writing to each output the
+// entries at or above its level, as JSON lines by default to files and in
+// the console format to stdout and stderr. The returned function closes
+// the outputs.
+func NewLogger(cfg *config.LogConfig) (*zap.Logger, func(), error) {
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = []config.LogOutput{{Path: "stderr"}}
+	}
+	var cores []zapcore.Core
+	var closers []func()
+	closeAll := func() {
+		for _, closeOutput := range closers {
+			closeOutput()
+		}
+	}
+	for _, out := range outputs {
+		console := out.Path == "stdout" || out.Path == "stderr"
+		if !console {
+			if err := os.MkdirAll(filepath.Dir(out.Path), 0o755); err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("failed to create log directory: %w", err)
+			}
+		}
+		sink, closeOutput, err := zap.Open(out.Path)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open log output %s: %w", out.Path, err)
+		}
+		closers = append(closers, closeOutput)
+		cores = append(cores, zapcore.NewCore(logEncoder(cfg, out, console), sink, logLevel(out.Level, cfg.Level)))
+	}
+	logger := zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+	return logger, closeAll, nil
+}
+
+func logEncoder(cfg *config.LogConfig, out config.LogOutput, console bool) zapcore.Encoder {
+	if out.Format == "console" || out.Format == "" && console {
+		encoderConfig := zap.NewDevelopmentEncoderConfig()
+		if cfg.TimeFormat != "" {
+			// Validated when the config is loaded
+			encoderConfig.EncodeTime.UnmarshalText([]byte(cfg.TimeFormat))
+		}
+		return zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	if cfg.TimeFormat != "" {
+		encoderConfig.EncodeTime.UnmarshalText([]byte(cfg.TimeFormat))
+	}
+	return zapcore.NewJSONEncoder(encoderConfig)
+}
+
+// logLevel returns the first level set, or debug
+func logLevel(levels ...string) zapcore.Level {
+	for _, level := range levels {
+		if level != "" {
+			// Validated when the config is loaded
+			l, _ := zapcore.ParseLevel(level)
+			return l
+		}
+	}
+	return zapcore.DebugLevel
+}
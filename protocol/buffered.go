@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// BufferedParser parses Redis protocol messages from a buffered reader,
+// avoiding the byte-at-a-time reads of Parser
+type BufferedParser struct {
+	reader *bufio.Reader
+}
+
+// NewBuffered creates a new buffered Redis protocol parser
+func NewBuffered(reader io.Reader) *BufferedParser {
+	return &BufferedParser{reader: bufio.NewReader(reader)}
+}
+
+// Buffered returns the number of bytes read from the connection but not yet
+// consumed by a command
+func (p *BufferedParser) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// ReadCommand reads and parses the next Redis command
+func (p *BufferedParser) ReadCommand() (*Command, error) {
+	var raw []byte
+	line, err := p.readLine(&raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty command line")
+	}
+
+	cmd := &Command{}
+	switch line[0] {
+	case '*': // Array
+		argCount, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument count: %q", line[1:])
+		}
+		if err := checkArgCount(argCount); err != nil {
+			return nil, err
+		}
+		name, err := p.readBulk(&raw)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Name = string(name)
+		cmd.Args = make([]string, 0, argCount-1)
+		for i := 1; i < argCount; i++ {
+			arg, err := p.readBulk(&raw)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Args = append(cmd.Args, string(arg))
+		}
+	case '$': // Bulk string
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %q", line[1:])
+		}
+		if length == -1 {
+			cmd.Name = "nil"
+			break
+		}
+		if err := checkBulkLength(length); err != nil {
+			return nil, err
+		}
+		data, err := p.readData(&raw, length)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Name = string(data)
+	case '+', ':': // Simple string, integer
+		cmd.Name = string(line[1:])
+	case '-': // Error
+		cmd.Name = "ERROR: " + string(line[1:])
+	default:
+		return nil, fmt.Errorf("unknown protocol type: %c", line[0])
+	}
+
+	cmd.Message = raw
+	return cmd, nil
+}
+
+// readBulk reads a "$<length>" header followed by its data
+func (p *BufferedParser) readBulk(raw *[]byte) ([]byte, error) {
+	line, err := p.readLine(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("expected bulk string, got %q", line)
+	}
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bulk length: %q", line[1:])
+	}
+	if err := checkBulkLength(length); err != nil {
+		return nil, err
+	}
+	return p.readData(raw, length)
+}
+
+// readData reads length bytes of data and the CRLF that terminates them
+func (p *BufferedParser) readData(raw *[]byte, length int) ([]byte, error) {
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(p.reader, data); err != nil {
+		return nil, err
+	}
+	*raw = append(*raw, data...)
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, fmt.Errorf("bulk data not terminated by CRLF")
+	}
+	return data[:length], nil
+}
+
+// readLine reads a CRLF terminated line, recording it in raw and returning
+// it without the terminator
+func (p *BufferedParser) readLine(raw *[]byte) ([]byte, error) {
+	line, err := p.reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	*raw = append(*raw, line...)
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
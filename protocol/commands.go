@@ -0,0 +1,456 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Command flags describing how a command behaves
+const (
+	FlagWrite = 1 << iota
+	FlagReadOnly
+	FlagAdmin
+	FlagPubSub
+	FlagBlocking
+)
+
+// CommandSpec describes the key positions and behaviour of a command,
+// mirroring the layout of COMMAND INFO where the command name is argument 0
+type CommandSpec struct {
+	Flags    int
+	FirstKey int
+	LastKey  int
+	Step     int
+	// keys locates keys for commands whose key positions depend on their
+	// arguments, such as a numkeys argument
+	keys func(args []string) []int
+}
+
+func spec(flags, first, last, step int) *CommandSpec {
+	return &CommandSpec{Flags: flags, FirstKey: first, LastKey: last, Step: step}
+}
+
+func numkeysSpec(flags, numkeysPos int) *CommandSpec {
+	return &CommandSpec{Flags: flags, keys: func(args []string) []int {
+		return numkeys(args, numkeysPos)
+	}}
+}
+
+const (
+	read  = FlagReadOnly
+	write = FlagWrite
+	admin = FlagAdmin
+)
+
+var commandSpecs = map[string]*CommandSpec{
+	// Strings
+	"GET":         spec(read, 1, 1, 1),
+	"MGET":        spec(read, 1, -1, 1),
+	"STRLEN":      spec(read, 1, 1, 1),
+	"GETRANGE":    spec(read, 1, 1, 1),
+	"SUBSTR":      spec(read, 1, 1, 1),
+	"LCS":         spec(read, 1, 2, 1),
+	"SET":         spec(write, 1, 1, 1),
+	"SETNX":       spec(write, 1, 1, 1),
+	"SETEX":       spec(write, 1, 1, 1),
+	"PSETEX":      spec(write, 1, 1, 1),
+	"GETSET":      spec(write, 1, 1, 1),
+	"GETDEL":      spec(write, 1, 1, 1),
+	"GETEX":       spec(write, 1, 1, 1),
+	"APPEND":      spec(write, 1, 1, 1),
+	"SETRANGE":    spec(write, 1, 1, 1),
+	"MSET":        spec(write, 1, -1, 2),
+	"MSETNX":      spec(write, 1, -1, 2),
+	"INCR":        spec(write, 1, 1, 1),
+	"DECR":        spec(write, 1, 1, 1),
+	"INCRBY":      spec(write, 1, 1, 1),
+	"DECRBY":      spec(write, 1, 1, 1),
+	"INCRBYFLOAT": spec(write, 1, 1, 1),
+
+	// Bitmaps and HyperLogLog
+	"GETBIT":      spec(read, 1, 1, 1),
+	"BITCOUNT":    spec(read, 1, 1, 1),
+	"BITPOS":      spec(read, 1, 1, 1),
+	"BITFIELD_RO": spec(read, 1, 1, 1),
+	"SETBIT":      spec(write, 1, 1, 1),
+	"BITFIELD":    spec(write, 1, 1, 1),
+	"BITOP":       spec(write, 2, -1, 1),
+	"PFCOUNT":     spec(read, 1, -1, 1),
+	"PFADD":       spec(write, 1, 1, 1),
+	"PFMERGE":     spec(write, 1, -1, 1),
+
+	// Generic keyspace
+	"EXISTS":      spec(read, 1, -1, 1),
+	"TYPE":        spec(read, 1, 1, 1),
+	"TTL":         spec(read, 1, 1, 1),
+	"PTTL":        spec(read, 1, 1, 1),
+	"EXPIRETIME":  spec(read, 1, 1, 1),
+	"PEXPIRETIME": spec(read, 1, 1, 1),
+	"DUMP":        spec(read, 1, 1, 1),
+	"TOUCH":       spec(read, 1, -1, 1),
+	"OBJECT":      spec(read, 2, 2, 1),
+	"MEMORY":      spec(read, 2, 2, 1),
+	"SORT_RO":     spec(read, 1, 1, 1),
+	"KEYS":        spec(read, 0, 0, 0),
+	"SCAN":        spec(read, 0, 0, 0),
+	"RANDOMKEY":   spec(read, 0, 0, 0),
+	"DBSIZE":      spec(read, 0, 0, 0),
+	"DEL":         spec(write, 1, -1, 1),
+	"UNLINK":      spec(write, 1, -1, 1),
+	"EXPIRE":      spec(write, 1, 1, 1),
+	"PEXPIRE":     spec(write, 1, 1, 1),
+	"EXPIREAT":    spec(write, 1, 1, 1),
+	"PEXPIREAT":   spec(write, 1, 1, 1),
+	"PERSIST":     spec(write, 1, 1, 1),
+	"RENAME":      spec(write, 1, 2, 1),
+	"RENAMENX":    spec(write, 1, 2, 1),
+	"COPY":        spec(write, 1, 2, 1),
+	"MOVE":        spec(write, 1, 1, 1),
+	"RESTORE":     spec(write, 1, 1, 1),
+	"SORT":        {Flags: write, keys: sortKeys},
+
+	// Hashes
+	"HGET":         spec(read, 1, 1, 1),
+	"HMGET":        spec(read, 1, 1, 1),
+	"HGETALL":      spec(read, 1, 1, 1),
+	"HKEYS":        spec(read, 1, 1, 1),
+	"HVALS":        spec(read, 1, 1, 1),
+	"HLEN":         spec(read, 1, 1, 1),
+	"HEXISTS":      spec(read, 1, 1, 1),
+	"HSTRLEN":      spec(read, 1, 1, 1),
+	"HRANDFIELD":   spec(read, 1, 1, 1),
+	"HSCAN":        spec(read, 1, 1, 1),
+	"HSET":         spec(write, 1, 1, 1),
+	"HSETNX":       spec(write, 1, 1, 1),
+	"HMSET":        spec(write, 1, 1, 1),
+	"HDEL":         spec(write, 1, 1, 1),
+	"HINCRBY":      spec(write, 1, 1, 1),
+	"HINCRBYFLOAT": spec(write, 1, 1, 1),
+
+	// Lists
+	"LRANGE":     spec(read, 1, 1, 1),
+	"LINDEX":     spec(read, 1, 1, 1),
+	"LLEN":       spec(read, 1, 1, 1),
+	"LPOS":       spec(read, 1, 1, 1),
+	"LPUSH":      spec(write, 1, 1, 1),
+	"RPUSH":      spec(write, 1, 1, 1),
+	"LPUSHX":     spec(write, 1, 1, 1),
+	"RPUSHX":     spec(write, 1, 1, 1),
+	"LPOP":       spec(write, 1, 1, 1),
+	"RPOP":       spec(write, 1, 1, 1),
+	"LSET":       spec(write, 1, 1, 1),
+	"LREM":       spec(write, 1, 1, 1),
+	"LTRIM":      spec(write, 1, 1, 1),
+	"LINSERT":    spec(write, 1, 1, 1),
+	"RPOPLPUSH":  spec(write, 1, 2, 1),
+	"LMOVE":      spec(write, 1, 2, 1),
+	"LMPOP":      numkeysSpec(write, 1),
+	"BLPOP":      spec(write|FlagBlocking, 1, -2, 1),
+	"BRPOP":      spec(write|FlagBlocking, 1, -2, 1),
+	"BRPOPLPUSH": spec(write|FlagBlocking, 1, 2, 1),
+	"BLMOVE":     spec(write|FlagBlocking, 1, 2, 1),
+	"BLMPOP":     numkeysSpec(write|FlagBlocking, 2),
+
+	// Sets
+	"SMEMBERS":    spec(read, 1, 1, 1),
+	"SISMEMBER":   spec(read, 1, 1, 1),
+	"SMISMEMBER":  spec(read, 1, 1, 1),
+	"SCARD":       spec(read, 1, 1, 1),
+	"SRANDMEMBER": spec(read, 1, 1, 1),
+	"SSCAN":       spec(read, 1, 1, 1),
+	"SINTER":      spec(read, 1, -1, 1),
+	"SUNION":      spec(read, 1, -1, 1),
+	"SDIFF":       spec(read, 1, -1, 1),
+	"SINTERCARD":  numkeysSpec(read, 1),
+	"SADD":        spec(write, 1, 1, 1),
+	"SREM":        spec(write, 1, 1, 1),
+	"SPOP":        spec(write, 1, 1, 1),
+	"SMOVE":       spec(write, 1, 2, 1),
+	"SINTERSTORE": spec(write, 1, -1, 1),
+	"SUNIONSTORE": spec(write, 1, -1, 1),
+	"SDIFFSTORE":  spec(write, 1, -1, 1),
+
+	// Sorted sets
+	"ZRANGE":           spec(read, 1, 1, 1),
+	"ZRANGEBYSCORE":    spec(read, 1, 1, 1),
+	"ZREVRANGE":        spec(read, 1, 1, 1),
+	"ZREVRANGEBYSCORE": spec(read, 1, 1, 1),
+	"ZRANGEBYLEX":      spec(read, 1, 1, 1),
+	"ZREVRANGEBYLEX":   spec(read, 1, 1, 1),
+	"ZRANK":            spec(read, 1, 1, 1),
+	"ZREVRANK":         spec(read, 1, 1, 1),
+	"ZSCORE":           spec(read, 1, 1, 1),
+	"ZMSCORE":          spec(read, 1, 1, 1),
+	"ZCARD":            spec(read, 1, 1, 1),
+	"ZCOUNT":           spec(read, 1, 1, 1),
+	"ZLEXCOUNT":        spec(read, 1, 1, 1),
+	"ZSCAN":            spec(read, 1, 1, 1),
+	"ZRANDMEMBER":      spec(read, 1, 1, 1),
+	"ZUNION":           numkeysSpec(read, 1),
+	"ZINTER":           numkeysSpec(read, 1),
+	"ZDIFF":            numkeysSpec(read, 1),
+	"ZINTERCARD":       numkeysSpec(read, 1),
+	"ZADD":             spec(write, 1, 1, 1),
+	"ZINCRBY":          spec(write, 1, 1, 1),
+	"ZREM":             spec(write, 1, 1, 1),
+	"ZREMRANGEBYSCORE": spec(write, 1, 1, 1),
+	"ZREMRANGEBYRANK":  spec(write, 1, 1, 1),
+	"ZREMRANGEBYLEX":   spec(write, 1, 1, 1),
+	"ZPOPMIN":          spec(write, 1, 1, 1),
+	"ZPOPMAX":          spec(write, 1, 1, 1),
+	"ZRANGESTORE":      spec(write, 1, 2, 1),
+	"ZUNIONSTORE":      storeNumkeysSpec(),
+	"ZINTERSTORE":      storeNumkeysSpec(),
+	"ZDIFFSTORE":       storeNumkeysSpec(),
+	"ZMPOP":            numkeysSpec(write, 1),
+	"BZPOPMIN":         spec(write|FlagBlocking, 1, -2, 1),
+	"BZPOPMAX":         spec(write|FlagBlocking, 1, -2, 1),
+	"BZMPOP":           numkeysSpec(write|FlagBlocking, 2),
+
+	// Geospatial
+	"GEOPOS":               spec(read, 1, 1, 1),
+	"GEODIST":              spec(read, 1, 1, 1),
+	"GEOHASH":              spec(read, 1, 1, 1),
+	"GEOSEARCH":            spec(read, 1, 1, 1),
+	"GEORADIUS_RO":         spec(read, 1, 1, 1),
+	"GEORADIUSBYMEMBER_RO": spec(read, 1, 1, 1),
+	"GEOADD":               spec(write, 1, 1, 1),
+	"GEOSEARCHSTORE":       spec(write, 1, 2, 1),
+	"GEORADIUS":            {Flags: write, keys: georadiusKeys(5)},
+	"GEORADIUSBYMEMBER":    {Flags: write, keys: georadiusKeys(4)},
+
+	// Streams
+	"XRANGE":     spec(read, 1, 1, 1),
+	"XREVRANGE":  spec(read, 1, 1, 1),
+	"XLEN":       spec(read, 1, 1, 1),
+	"XPENDING":   spec(read, 1, 1, 1),
+	"XINFO":      spec(read, 2, 2, 1),
+	"XREAD":      {Flags: read | FlagBlocking, keys: streamKeys},
+	"XADD":       spec(write, 1, 1, 1),
+	"XDEL":       spec(write, 1, 1, 1),
+	"XTRIM":      spec(write, 1, 1, 1),
+	"XACK":       spec(write, 1, 1, 1),
+	"XCLAIM":     spec(write, 1, 1, 1),
+	"XAUTOCLAIM": spec(write, 1, 1, 1),
+	"XSETID":     spec(write, 1, 1, 1),
+	"XGROUP":     spec(write, 2, 2, 1),
+	"XREADGROUP": {Flags: write | FlagBlocking, keys: streamKeys},
+
+	// Scripting and functions
+	"EVAL":       numkeysSpec(write, 2),
+	"EVALSHA":    numkeysSpec(write, 2),
+	"EVAL_RO":    numkeysSpec(read, 2),
+	"EVALSHA_RO": numkeysSpec(read, 2),
+	"FCALL":      numkeysSpec(write, 2),
+	"FCALL_RO":   numkeysSpec(read, 2),
+	"SCRIPT":     spec(admin, 0, 0, 0),
+	"FUNCTION":   spec(admin, 0, 0, 0),
+
+	// Pub/sub
+	"PUBLISH":      spec(FlagPubSub, 0, 0, 0),
+	"SPUBLISH":     spec(FlagPubSub, 0, 0, 0),
+	"SUBSCRIBE":    spec(FlagPubSub, 0, 0, 0),
+	"PSUBSCRIBE":   spec(FlagPubSub, 0, 0, 0),
+	"SSUBSCRIBE":   spec(FlagPubSub, 0, 0, 0),
+	"UNSUBSCRIBE":  spec(FlagPubSub, 0, 0, 0),
+	"PUNSUBSCRIBE": spec(FlagPubSub, 0, 0, 0),
+	"SUNSUBSCRIBE": spec(FlagPubSub, 0, 0, 0),
+	"PUBSUB":       spec(FlagPubSub, 0, 0, 0),
+
+	// Transactions
+	"WATCH":   spec(0, 1, -1, 1),
+	"UNWATCH": spec(0, 0, 0, 0),
+	"MULTI":   spec(0, 0, 0, 0),
+	"EXEC":    spec(0, 0, 0, 0),
+	"DISCARD": spec(0, 0, 0, 0),
+
+	// Server administration
+	"FLUSHDB":      spec(write|admin, 0, 0, 0),
+	"FLUSHALL":     spec(write|admin, 0, 0, 0),
+	"SWAPDB":       spec(write|admin, 0, 0, 0),
+	"MIGRATE":      spec(write|admin, 0, 0, 0),
+	"CONFIG":       spec(admin, 0, 0, 0),
+	"DEBUG":        spec(admin, 0, 0, 0),
+	"SHUTDOWN":     spec(admin, 0, 0, 0),
+	"SAVE":         spec(admin, 0, 0, 0),
+	"BGSAVE":       spec(admin, 0, 0, 0),
+	"BGREWRITEAOF": spec(admin, 0, 0, 0),
+	"REPLICAOF":    spec(admin, 0, 0, 0),
+	"SLAVEOF":      spec(admin, 0, 0, 0),
+	"FAILOVER":     spec(admin, 0, 0, 0),
+	"MONITOR":      spec(admin, 0, 0, 0),
+	"SLOWLOG":      spec(admin, 0, 0, 0),
+	"ACL":          spec(admin, 0, 0, 0),
+	"MODULE":       spec(admin, 0, 0, 0),
+	"CLUSTER":      spec(admin, 0, 0, 0),
+	"CLIENT":       spec(admin, 0, 0, 0),
+	"LATENCY":      spec(admin, 0, 0, 0),
+	"INFO":         spec(0, 0, 0, 0),
+	"ROLE":         spec(0, 0, 0, 0),
+	"TIME":         spec(0, 0, 0, 0),
+	"LASTSAVE":     spec(0, 0, 0, 0),
+	"COMMAND":      spec(0, 0, 0, 0),
+	"WAIT":         spec(0, 0, 0, 0),
+
+	// Connection
+	"PING":   spec(0, 0, 0, 0),
+	"ECHO":   spec(0, 0, 0, 0),
+	"AUTH":   spec(0, 0, 0, 0),
+	"HELLO":  spec(0, 0, 0, 0),
+	"SELECT": spec(0, 0, 0, 0),
+	"QUIT":   spec(0, 0, 0, 0),
+	"RESET":  spec(0, 0, 0, 0),
+}
+
+func storeNumkeysSpec() *CommandSpec {
+	return &CommandSpec{Flags: write, keys: func(args []string) []int {
+		if len(args) == 0 {
+			return nil
+		}
+		return append([]int{0}, numkeys(args, 2)...)
+	}}
+}
+
+// LookupCommand returns the spec of a command, or nil when it is unknown
+func LookupCommand(name string) *CommandSpec {
+	return commandSpecs[strings.ToUpper(name)]
+}
+
+// CommandNames returns the names of every known command
+func CommandNames() []string {
+	names := make([]string, 0, len(commandSpecs))
+	for name := range commandSpecs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Keys returns the keys the command operates on
+func (c *Command) Keys() []string {
+	positions := c.KeyPositions()
+	if positions == nil {
+		return nil
+	}
+	keys := make([]string, len(positions))
+	for i, pos := range positions {
+		keys[i] = c.Args[pos]
+	}
+	return keys
+}
+
+// KeyPositions returns the indexes in Args of the keys the command operates
+// on, so that they can be rewritten in place
+func (c *Command) KeyPositions() []int {
+	spec := LookupCommand(c.Name)
+	if spec == nil {
+		return nil
+	}
+	if spec.keys != nil {
+		return spec.keys(c.Args)
+	}
+	if spec.FirstKey == 0 || spec.FirstKey > len(c.Args) {
+		return nil
+	}
+
+	// Positions count the command name, Args does not
+	last := spec.LastKey
+	if last < 0 {
+		last = len(c.Args) + 1 + last
+	}
+	if last > len(c.Args) {
+		last = len(c.Args)
+	}
+
+	positions := make([]int, 0, last-spec.FirstKey+1)
+	for i := spec.FirstKey; i <= last; i += spec.Step {
+		positions = append(positions, i-1)
+	}
+	return positions
+}
+
+// IsWrite reports whether the command may modify the dataset
+func (c *Command) IsWrite() bool {
+	spec := LookupCommand(c.Name)
+	return spec != nil && spec.Flags&FlagWrite != 0
+}
+
+// numkeys locates the keys following a numkeys argument at position pos
+func numkeys(args []string, pos int) []int {
+	if pos > len(args) {
+		return nil
+	}
+	count, err := strconv.Atoi(args[pos-1])
+	if err != nil || count < 0 {
+		return nil
+	}
+	// Clamped before adding, as a huge count would overflow the end
+	return positions(pos, pos+min(count, len(args)-pos))
+}
+
+// streamKeys locates the keys listed after the STREAMS option of XREAD and
+// XREADGROUP, which is followed by one ID per key
+func streamKeys(args []string) []int {
+	for i, arg := range args {
+		if strings.EqualFold(arg, "STREAMS") {
+			start := i + 1
+			return positions(start, start+(len(args)-start)/2)
+		}
+	}
+	return nil
+}
+
+// sortKeys locates the key of SORT and the destination of its STORE
+// option, skipping the arguments of the other options
+func sortKeys(args []string) []int {
+	if len(args) == 0 {
+		return nil
+	}
+	keys := []int{0}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BY", "GET":
+			i++
+		case "LIMIT":
+			i += 2
+		case "STORE":
+			if i+1 < len(args) {
+				keys = append(keys, i+1)
+			}
+			i++
+		}
+	}
+	return keys
+}
+
+// georadiusKeys locates the key of GEORADIUS and GEORADIUSBYMEMBER and the
+// destinations of their STORE and STOREDIST options, which follow the
+// arguments up to from
+func georadiusKeys(from int) func(args []string) []int {
+	return func(args []string) []int {
+		if len(args) == 0 {
+			return nil
+		}
+		keys := []int{0}
+		for i := from; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "COUNT":
+				i++
+			case "STORE", "STOREDIST":
+				if i+1 < len(args) {
+					keys = append(keys, i+1)
+				}
+				i++
+			}
+		}
+		return keys
+	}
+}
+
+// positions returns the indexes from start up to end
+func positions(start, end int) []int {
+	indexes := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// Hash returns a stable identifier of the command and its arguments. It
+// does not depend on the wire framing or the case of the command name, so
+// the same command seen by several proxies hashes identically.
+func (c *Command) Hash() string {
+	h := sha256.New()
+	var length [8]byte
+	write := func(s string) {
+		// Length prefixes keep ("ab", "c") distinct from ("a", "bc")
+		binary.BigEndian.PutUint64(length[:], uint64(len(s)))
+		h.Write(length[:])
+		h.Write([]byte(s))
+	}
+
+	write(strings.ToUpper(c.Name))
+	for _, arg := range c.Args {
+		write(arg)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -6,6 +6,30 @@ import (
 	"strings"
 )
 
+// Redis's limits on a request: the length of a bulk string and the number
+// of arguments of a command. Longer requests are refused before anything
+// is allocated for them.
+const (
+	maxBulkLength = 512 * 1024 * 1024
+	maxArgCount   = 1024 * 1024
+)
+
+// checkArgCount refuses argument counts out of range
+func checkArgCount(n int) error {
+	if n < 1 || n > maxArgCount {
+		return fmt.Errorf("invalid argument count: %d", n)
+	}
+	return nil
+}
+
+// checkBulkLength refuses bulk lengths out of range
+func checkBulkLength(n int) error {
+	if n < 0 || n > maxBulkLength {
+		return fmt.Errorf("invalid bulk length: %d", n)
+	}
+	return nil
+}
+
 // Parser parses Redis protocol messages
 type Parser struct {
 	reader io.Reader
@@ -23,6 +47,11 @@ type Command struct {
 	Args    []string
 }
 
+// Buffered always returns 0 as Parser never reads past the end of a command
+func (p *Parser) Buffered() int {
+	return 0
+}
+
 // ReadCommand reads and parses the next Redis command
 func (p *Parser) ReadCommand() (*Command, error) {
 	// Read the first byte which indicates the message type
@@ -59,8 +88,8 @@ func (p *Parser) parseArray(buf *strings.Builder) (*Command, error) {
 	}
 	buf.WriteString(fmt.Sprintf("%d\r\n", argCount))
 
-	if argCount < 1 {
-		return nil, fmt.Errorf("invalid argument count: %d", argCount)
+	if err := checkArgCount(argCount); err != nil {
+		return nil, err
 	}
 
 	// Read the command name
@@ -69,6 +98,9 @@ func (p *Parser) parseArray(buf *strings.Builder) (*Command, error) {
 		return nil, err
 	}
 	buf.WriteString(fmt.Sprintf("$%d\r\n", cmdLen))
+	if err := checkBulkLength(cmdLen); err != nil {
+		return nil, err
+	}
 
 	cmd := make([]byte, cmdLen)
 	if _, err := io.ReadFull(p.reader, cmd); err != nil {
@@ -76,7 +108,7 @@ func (p *Parser) parseArray(buf *strings.Builder) (*Command, error) {
 	}
 	buf.Write(cmd)
 
-	if _, err := p.reader.Read(make([]byte, 2)); err != nil {
+	if _, err := io.ReadFull(p.reader, make([]byte, 2)); err != nil {
 		return nil, err
 	}
 	buf.WriteString("\r\n")
@@ -89,6 +121,9 @@ func (p *Parser) parseArray(buf *strings.Builder) (*Command, error) {
 			return nil, err
 		}
 		buf.WriteString(fmt.Sprintf("$%d\r\n", argLen))
+		if err := checkBulkLength(argLen); err != nil {
+			return nil, err
+		}
 
 		arg := make([]byte, argLen)
 		if _, err := io.ReadFull(p.reader, arg); err != nil {
@@ -97,7 +132,7 @@ func (p *Parser) parseArray(buf *strings.Builder) (*Command, error) {
 		buf.Write(arg)
 		args = append(args, string(arg))
 
-		if _, err := p.reader.Read(make([]byte, 2)); err != nil {
+		if _, err := io.ReadFull(p.reader, make([]byte, 2)); err != nil {
 			return nil, err
 		}
 		buf.WriteString("\r\n")
@@ -123,6 +158,9 @@ func (p *Parser) parseBulkString(buf *strings.Builder) (*Command, error) {
 			Message: []byte(buf.String()),
 		}, nil
 	}
+	if err := checkBulkLength(length); err != nil {
+		return nil, err
+	}
 
 	str := make([]byte, length)
 	if _, err := io.ReadFull(p.reader, str); err != nil {
@@ -130,7 +168,7 @@ func (p *Parser) parseBulkString(buf *strings.Builder) (*Command, error) {
 	}
 	buf.Write(str)
 
-	if _, err := p.reader.Read(make([]byte, 2)); err != nil {
+	if _, err := io.ReadFull(p.reader, make([]byte, 2)); err != nil {
 		return nil, err
 	}
 	buf.WriteString("\r\n")
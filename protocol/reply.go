@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Reply represents a parsed Redis reply
+type Reply struct {
+	Type    byte
+	Message []byte
+	Str     string
+	Elems   []*Reply
+	Null    bool
+	// Attrs holds the key and value pairs of a RESP3 attribute sent ahead
+	// of the reply; the attribute stays part of Message
+	Attrs []*Reply
+}
+
+// IsError reports whether the reply is a simple or bulk error
+func (r *Reply) IsError() bool {
+	return r.Type == '-' || r.Type == '!'
+}
+
+// ReplyReader reads replies sent by a Redis server
+type ReplyReader struct {
+	reader *bufio.Reader
+}
+
+// NewReplyReader creates a new Redis reply reader
+func NewReplyReader(reader io.Reader) *ReplyReader {
+	return &ReplyReader{reader: bufio.NewReader(reader)}
+}
+
+// ReadReply reads the next complete RESP2 or RESP3 reply
+func (r *ReplyReader) ReadReply() (*Reply, error) {
+	var raw []byte
+	reply, err := r.read(&raw)
+	if err != nil {
+		return nil, err
+	}
+	reply.Message = raw
+	return reply, nil
+}
+
+// Buffered returns the number of bytes read from the connection but not yet
+// consumed by a reply
+func (r *ReplyReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+func (r *ReplyReader) read(raw *[]byte) (*Reply, error) {
+	line, err := r.readLine(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply line")
+	}
+
+	if line[0] == '|' {
+		return r.readAttributed(raw, line)
+	}
+
+	reply := &Reply{Type: line[0]}
+	switch line[0] {
+	case '+', '-', ':', ',', '(', '#':
+		reply.Str = string(line[1:])
+	case '_':
+		reply.Null = true
+	case '$', '!', '=':
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %q", line[1:])
+		}
+		if length < 0 {
+			reply.Null = true
+			return reply, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		*raw = append(*raw, data...)
+		reply.Str = string(data[:length])
+	case '*', '~', '>', '%':
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregate length: %q", line[1:])
+		}
+		if count < 0 {
+			reply.Null = true
+			return reply, nil
+		}
+		// Maps carry a key and a value per entry
+		if line[0] == '%' {
+			count *= 2
+		}
+		reply.Elems = make([]*Reply, 0, count)
+		for i := 0; i < count; i++ {
+			elem, err := r.read(raw)
+			if err != nil {
+				return nil, err
+			}
+			reply.Elems = append(reply.Elems, elem)
+		}
+	default:
+		return nil, fmt.Errorf("unknown reply type: %c", line[0])
+	}
+	return reply, nil
+}
+
+// readAttributed reads an attribute map and the reply it annotates
+func (r *ReplyReader) readAttributed(raw *[]byte, line []byte) (*Reply, error) {
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid attribute length: %q", line[1:])
+	}
+	attrs := make([]*Reply, 0, count*2)
+	for i := 0; i < count*2; i++ {
+		elem, err := r.read(raw)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, elem)
+	}
+	reply, err := r.read(raw)
+	if err != nil {
+		return nil, err
+	}
+	reply.Attrs = append(attrs, reply.Attrs...)
+	return reply, nil
+}
+
+// readLine reads a CRLF terminated line, recording it in raw and returning
+// it without the terminator
+func (r *ReplyReader) readLine(raw *[]byte) ([]byte, error) {
+	line, err := r.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	*raw = append(*raw, line...)
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
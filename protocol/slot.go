@@ -0,0 +1,39 @@
+package protocol
+
+import "strings"
+
+// SlotCount is the number of hash slots in a Redis Cluster
+const SlotCount = 16384
+
+// KeySlot returns the Redis Cluster hash slot of a key, honouring hash tags
+// so that "{user:1}.name" and "{user:1}.email" share a slot
+func KeySlot(key string) int {
+	return int(crc16(HashTag(key))) % SlotCount
+}
+
+// HashTag returns the part of a key that is hashed: the text between the
+// first "{" and the next "}" when non-empty, otherwise the whole key
+func HashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// crc16 is the CRC-16/XMODEM checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
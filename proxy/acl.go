@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// commandACL is a compiled allow/deny command list
+type commandACL struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newCommandACL(cfg config.CommandACL) *commandACL {
+	acl := &commandACL{allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, name := range cfg.Allow {
+		acl.allow[strings.ToUpper(name)] = true
+	}
+	for _, name := range cfg.Deny {
+		acl.deny[strings.ToUpper(name)] = true
+	}
+	return acl
+}
+
+// permits reports whether the upper-cased command name is allowed
+func (a *commandACL) permits(name string) bool {
+	if a.deny[name] {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow[name]
+}
+
+func newIdentityACLs(cfg map[string]config.CommandACL) map[string]*commandACL {
+	acls := make(map[string]*commandACL, len(cfg))
+	for identity, acl := range cfg {
+		acls[identity] = newCommandACL(acl)
+	}
+	return acls
+}
+
+// defaultIdentityACL names the identity_acls entry for clients without an
+// identity or whose identity has no entry of its own
+const defaultIdentityACL = "default"
+
+// checkIdentityACL applies the ACL configured for the client certificate
+// identity of the connection
+func (p *Proxy) checkIdentityACL(s *session, req *request) []byte {
+	if p.permitsIdentity(s.identity, req.name) {
+		return nil
+	}
+	if req.elevation != nil {
+		s.logger.Warn("Elevated command",
+			zap.String("command", req.cmd.Name),
+			zap.String("elevation_id", req.elevation.ID),
+			zap.String("granted_by", req.elevation.Operator),
+		)
+		return nil
+	}
+
+	s.logger.Warn("Command denied by identity ACL", zap.String("command", req.cmd.Name))
+	identity := s.identity
+	if identity == "" {
+		identity = defaultIdentityACL
+	}
+	return noPermission(identity, req.cmd.Name)
+}
+
+// permitsIdentity reports whether the ACL of a client identity allows a
+// command. Clients without an identity, or with one that has no entry, get
+// the "default" entry, and are denied everything when there is none.
+func (p *Proxy) permitsIdentity(identity, name string) bool {
+	if len(p.identityACLs) == 0 {
+		return true
+	}
+	acl, ok := p.identityACLs[identity]
+	if !ok || identity == "" {
+		acl, ok = p.identityACLs[defaultIdentityACL]
+	}
+	return ok && acl.permits(name)
+}
+
+// elevationFor returns the grant that lets a session run a command its
+// identity ACL denies
+func (p *Proxy) elevationFor(s *session, req *request) *elevation {
+	if p.permitsIdentity(s.identity, req.name) {
+		return nil
+	}
+	return p.elevations.find(s.identity, req.name)
+}
+
+// noPermission returns the -NOPERM reply Redis sends for ACL denials
+func noPermission(user, command string) []byte {
+	return []byte(fmt.Sprintf("-NOPERM User %s has no permissions to run the '%s' command\r\n",
+		user, strings.ToLower(command)))
+}
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// acmeCheckInterval is how often the certificate's expiry is checked
+const acmeCheckInterval = 12 * time.Hour
+
+// acmeManager obtains and renews the listener certificate from an ACME CA
+// such as Let's Encrypt, answering challenges over HTTP-01 or DNS-01
+type acmeManager struct {
+	logger      *zap.Logger
+	cfg         *config.ACMEConfig
+	renewBefore time.Duration
+	client      *acme.Client
+	solver      challengeSolver
+	// listen opens the HTTP-01 listener, taking it over from a previous
+	// process after a socket handoff
+	listen func(addr string) (net.Listener, error)
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// challengeSolver publishes the response to an ACME challenge and removes
+// it once the challenge is done
+type challengeSolver interface {
+	kind() string
+	present(ctx context.Context, domain string, chal *acme.Challenge) error
+	cleanup(domain string, chal *acme.Challenge)
+}
+
+func newACMEManager(logger *zap.Logger, cfg *config.ACMEConfig) *acmeManager {
+	if cfg == nil {
+		return nil
+	}
+	m := &acmeManager{
+		logger:      logger.With(zap.String("component", "acme"), zap.Strings("domains", cfg.Domains)),
+		cfg:         cfg,
+		renewBefore: 30 * 24 * time.Hour,
+		client:      &acme.Client{DirectoryURL: cfg.DirectoryURL},
+	}
+	if m.client.DirectoryURL == "" {
+		m.client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if cfg.RenewBeforeDays > 0 {
+		m.renewBefore = time.Duration(cfg.RenewBeforeDays) * 24 * time.Hour
+	}
+	return m
+}
+
+// start loads the cached certificate, or obtains one before the listener
+// opens, and keeps it renewed until the context is cancelled
+func (m *acmeManager) start(ctx context.Context) error {
+	if err := os.MkdirAll(m.cfg.CacheDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create ACME cache directory: %w", err)
+	}
+
+	switch m.cfg.Challenge {
+	case "dns-01":
+		m.solver = &dnsSolver{
+			client:         m.client,
+			logger:         m.logger,
+			presentCommand: m.cfg.DNSPresentCommand,
+			cleanupCommand: m.cfg.DNSCleanupCommand,
+		}
+	default:
+		solver := newHTTPSolver(m.client)
+		addr := m.cfg.HTTPAddr
+		if addr == "" {
+			addr = ":80"
+		}
+		listener, err := m.listen(addr)
+		if err != nil {
+			return fmt.Errorf("failed to start ACME HTTP-01 listener: %w", err)
+		}
+		solver.serve(ctx, listener)
+		m.solver = solver
+	}
+
+	if cert, err := m.loadCached(); err == nil {
+		m.cert.Store(cert)
+		m.logger.Info("Loaded cached certificate", zap.Time("not_after", cert.Leaf.NotAfter))
+	}
+	if m.dueForRenewal() {
+		if err := m.obtain(ctx); err != nil {
+			if m.cert.Load() == nil {
+				return err
+			}
+			m.logger.Error("Failed to renew certificate", zap.Error(err))
+		}
+	}
+
+	go m.renewLoop(ctx)
+	return nil
+}
+
+// getCertificate serves the current certificate to every handshake,
+// whatever server name the client sent
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := m.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("no certificate obtained yet")
+}
+
+func (m *acmeManager) dueForRenewal() bool {
+	cert := m.cert.Load()
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < m.renewBefore
+}
+
+func (m *acmeManager) renewLoop(ctx context.Context) {
+	ticker := time.NewTicker(acmeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !m.dueForRenewal() {
+			continue
+		}
+		if err := m.obtain(ctx); err != nil {
+			m.logger.Error("Failed to renew certificate", zap.Error(err))
+		}
+	}
+}
+
+// obtain runs an ACME order for the configured domains and caches the
+// issued certificate
+func (m *acmeManager) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	if err := m.register(ctx); err != nil {
+		return err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create ACME order: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("ACME order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.cfg.Domains}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize ACME order: %w", err)
+	}
+
+	cert, err := m.store(chain, key)
+	if err != nil {
+		return err
+	}
+	m.cert.Store(cert)
+	m.logger.Info("Certificate issued",
+		zap.String("challenge", m.solver.kind()),
+		zap.Time("not_after", cert.Leaf.NotAfter),
+	)
+	return nil
+}
+
+// register loads or creates the account key and registers it, which is a
+// no-op for an account that already exists
+func (m *acmeManager) register(ctx context.Context) error {
+	if m.client.Key != nil {
+		return nil
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	m.client.Key = key
+
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		m.client.Key = nil
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	return nil
+}
+
+// authorize completes the challenge of one pending authorization
+func (m *acmeManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.solver.kind() {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME server offered no %s challenge for %s", m.solver.kind(), authz.Identifier.Value)
+	}
+
+	domain := authz.Identifier.Value
+	if err := m.solver.present(ctx, domain, chal); err != nil {
+		return fmt.Errorf("failed to present %s challenge for %s: %w", chal.Type, domain, err)
+	}
+	defer m.solver.cleanup(domain, chal)
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	if _, err := m.client.WaitAuthorization(ctx, url); err != nil {
+		return fmt.Errorf("ACME authorization for %s failed: %w", domain, err)
+	}
+	return nil
+}
+
+func (m *acmeManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.cfg.CacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid ACME account key %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// store writes the certificate chain and key to the cache
+func (m *acmeManager) store(chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(filepath.Join(m.cfg.CacheDir, "cert.pem"), certPEM, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to cache certificate: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.cfg.CacheDir, "key.pem"), keyPEM, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to cache certificate key: %w", err)
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+func (m *acmeManager) loadCached() (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(filepath.Join(m.cfg.CacheDir, "cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(m.cfg.CacheDir, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// httpSolver answers HTTP-01 challenges on a dedicated listener, which must
+// be reachable on port 80 of every domain
+type httpSolver struct {
+	client *acme.Client
+
+	mu        sync.Mutex
+	responses map[string]string
+}
+
+func newHTTPSolver(client *acme.Client) *httpSolver {
+	return &httpSolver{client: client, responses: make(map[string]string)}
+}
+
+func (h *httpSolver) kind() string { return "http-01" }
+
+func (h *httpSolver) serve(ctx context.Context, listener net.Listener) {
+	server := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+}
+
+func (h *httpSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	h.mu.Lock()
+	response, found := h.responses[token]
+	h.mu.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+func (h *httpSolver) present(_ context.Context, _ string, chal *acme.Challenge) error {
+	response, err := h.client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.responses[chal.Token] = response
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *httpSolver) cleanup(_ string, chal *acme.Challenge) {
+	h.mu.Lock()
+	delete(h.responses, chal.Token)
+	h.mu.Unlock()
+}
+
+// dnsSolver answers DNS-01 challenges through commands that create and
+// remove the TXT record with the operator's DNS provider. The commands get
+// ACME_DOMAIN, ACME_FQDN and ACME_VALUE in their environment.
+type dnsSolver struct {
+	client         *acme.Client
+	logger         *zap.Logger
+	presentCommand string
+	cleanupCommand string
+}
+
+func (d *dnsSolver) kind() string { return "dns-01" }
+
+func (d *dnsSolver) present(ctx context.Context, domain string, chal *acme.Challenge) error {
+	return d.run(ctx, d.presentCommand, domain, chal)
+}
+
+func (d *dnsSolver) cleanup(domain string, chal *acme.Challenge) {
+	if d.cleanupCommand == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := d.run(ctx, d.cleanupCommand, domain, chal); err != nil {
+		d.logger.Warn("DNS-01 cleanup command failed", zap.String("domain", domain), zap.Error(err))
+	}
+}
+
+func (d *dnsSolver) run(ctx context.Context, command, domain string, chal *acme.Challenge) error {
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ACME_DOMAIN="+domain,
+		"ACME_FQDN=_acme-challenge."+strings.TrimPrefix(domain, "*.")+".",
+		"ACME_VALUE="+value,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
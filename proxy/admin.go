@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startAdmin serves the admin HTTP API until the context is cancelled. The
+// listener is opened before it returns, so that one handed off by a
+// previous process is taken over before the rest are released.
+func (p *Proxy) startAdmin(ctx context.Context) {
+	listener, err := p.listen(p.config.Admin.Addr)
+	if err != nil {
+		p.logger.Error("Admin API failed", zap.Error(err))
+		return
+	}
+	server := &http.Server{
+		Handler:           p.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// Closing the server leaves hijacked connections, such as event
+		// streams, open, so they watch the request context instead
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	p.logger.Info("Admin API started", zap.String("admin_addr", p.config.Admin.Addr), zap.Bool("pprof", p.config.Admin.Pprof))
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			p.logger.Error("Admin API failed", zap.Error(err))
+		}
+	}()
+}
+
+// adminHandler routes the admin API, requiring the configured bearer token
+// on every request
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if p.approvals != nil {
+		mux.HandleFunc("GET /approvals", p.approvals.handleList)
+		mux.HandleFunc("POST /approvals/{id}/approve", p.approvals.handleDecision(true))
+		mux.HandleFunc("POST /approvals/{id}/deny", p.approvals.handleDecision(false))
+	}
+
+	if p.pool != nil {
+		mux.HandleFunc("GET /backends", p.pool.handleStatus)
+	}
+	if p.mux != nil {
+		mux.HandleFunc("GET /multiplex", p.mux.handleStatus)
+	}
+	if p.slowlog != nil {
+		mux.HandleFunc("GET /slowlog", p.slowlog.handleList)
+		mux.HandleFunc("DELETE /slowlog", p.slowlog.handleReset)
+	}
+	if p.latencies != nil {
+		mux.HandleFunc("GET /latency", p.latencies.handleList)
+		mux.HandleFunc("DELETE /latency", p.latencies.handleReset)
+	}
+	if p.cache != nil {
+		mux.HandleFunc("GET /cache", p.cache.handleStatus)
+	}
+	if p.canary != nil {
+		mux.HandleFunc("GET /canary", p.canary.handleStatus)
+	}
+	if p.mirror != nil {
+		mux.HandleFunc("GET /mirror", p.mirror.handleStatus)
+	}
+	mux.HandleFunc("GET /connections", p.handleConnections)
+	mux.HandleFunc("GET /connections/count", p.connLimit.handleStatus)
+	mux.HandleFunc("GET /metrics", p.handleMetrics)
+	mux.HandleFunc("DELETE /connections", p.handleKill)
+	mux.HandleFunc("DELETE /connections/{id}", p.handleKill)
+	mux.HandleFunc("GET /flags", p.flags.handleList)
+	// Anyone reaching the admin API could otherwise reroute connections
+	if p.config.Admin.Token != "" {
+		mux.HandleFunc("PUT /flags/{name}", p.flags.handleUpdate)
+	}
+	mux.HandleFunc("GET /mode", p.mode.handleStatus)
+	mux.HandleFunc("PUT /mode", p.mode.handleUpdate)
+	// Anyone reaching the admin API could otherwise grant themselves access
+	if p.config.Admin.Token != "" {
+		mux.HandleFunc("GET /elevations", p.elevations.handleList)
+		mux.HandleFunc("POST /elevations", p.elevations.handleGrant)
+		mux.HandleFunc("DELETE /elevations/{id}", p.elevations.handleRevoke)
+	}
+	mux.Handle("GET /stream", p.streamHandler())
+	if p.config.Admin.Pprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	}
+
+	token := p.config.Admin.Token
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := []byte(r.Header.Get("Authorization"))
+			// Browsers cannot set headers on WebSocket requests
+			if r.URL.Path == "/stream" && len(given) == 0 && r.URL.Query().Has("access_token") {
+				given = []byte("Bearer " + r.URL.Query().Get("access_token"))
+			}
+			if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// approvals parks configured destructive commands until an operator
+// approves or denies them through the admin API
+type approvals struct {
+	logger  *zap.Logger
+	rules   [][]string
+	timeout time.Duration
+	webhook string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*approval
+}
+
+// approval is a parked command awaiting a decision
+type approval struct {
+	ID             string    `json:"id"`
+	Command        string    `json:"command"`
+	Args           []string  `json:"args"`
+	ClientAddr     string    `json:"client_addr"`
+	ClientIdentity string    `json:"client_identity,omitempty"`
+	RequestedAt    time.Time `json:"requested_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+
+	decision chan decision
+}
+
+type decision struct {
+	approved bool
+	operator string
+}
+
+func newApprovals(logger *zap.Logger, cfg *config.ApprovalConfig) *approvals {
+	if cfg == nil {
+		return nil
+	}
+	a := &approvals{
+		logger:  logger.With(zap.String("component", "approvals")),
+		timeout: 5 * time.Minute,
+		webhook: cfg.WebhookURL,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		pending: make(map[string]*approval),
+	}
+	if cfg.TimeoutSeconds > 0 {
+		a.timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	for _, rule := range cfg.Commands {
+		a.rules = append(a.rules, strings.Fields(strings.ToUpper(rule)))
+	}
+	return a
+}
+
+// requires reports whether a command matches an approval rule
+func (a *approvals) requires(req *request) bool {
+	return matchesCommandRule(a.rules, req)
+}
+
+// matchesCommandRule reports whether a command matches any of rules, each
+// a command name and leading arguments such as "FLUSHALL" or "CONFIG SET
+// maxmemory" split into upper-cased words
+func matchesCommandRule(rules [][]string, req *request) bool {
+	for _, rule := range rules {
+		if len(rule) == 0 || rule[0] != req.name || len(req.cmd.Args) < len(rule)-1 {
+			continue
+		}
+		matched := true
+		for i, word := range rule[1:] {
+			if !strings.EqualFold(req.cmd.Args[i], word) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// await parks a command that requires approval, returning an error reply
+// unless an operator approves it in time
+func (a *approvals) await(s *session, req *request) []byte {
+	if a == nil || !a.requires(req) {
+		return nil
+	}
+
+	now := time.Now()
+	pending := &approval{
+		ID:             randomID(),
+		Command:        req.name,
+		Args:           s.proxy.values.args(req.cmd),
+		ClientAddr:     s.client.RemoteAddr().String(),
+		ClientIdentity: s.identity,
+		RequestedAt:    now,
+		ExpiresAt:      now.Add(a.timeout),
+		decision:       make(chan decision, 1),
+	}
+	a.mu.Lock()
+	a.pending[pending.ID] = pending
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, pending.ID)
+		a.mu.Unlock()
+	}()
+
+	logger := s.logger.With(zap.String("approval_id", pending.ID), zap.String("command", req.name))
+	logger.Warn("Command parked for approval",
+		zap.Strings("args", pending.Args),
+		zap.Time("expires_at", pending.ExpiresAt),
+	)
+	if a.webhook != "" {
+		go a.notify(pending)
+	}
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case d := <-pending.decision:
+		fields := []zap.Field{
+			zap.String("operator", d.operator),
+			zap.Duration("waited", time.Since(now)),
+		}
+		if d.approved {
+			logger.Warn("Command approved", fields...)
+			return nil
+		}
+		logger.Warn("Command denied", fields...)
+		return []byte("-ERR command denied by operator\r\n")
+	case <-timer.C:
+		logger.Warn("Command approval timed out", zap.Duration("waited", time.Since(now)))
+		return []byte("-ERR command approval timed out\r\n")
+	case <-s.done:
+		logger.Warn("Command approval abandoned by client disconnect")
+		return []byte("-ERR command approval abandoned\r\n")
+	}
+}
+
+// decide records an operator's decision, reporting whether the approval
+// was still pending
+func (a *approvals) decide(id string, approved bool, operator string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending, ok := a.pending[id]
+	if !ok {
+		return false
+	}
+	delete(a.pending, id)
+	pending.decision <- decision{approved: approved, operator: operator}
+	return true
+}
+
+// list returns the approvals still pending, oldest first
+func (a *approvals) list() []*approval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]*approval, 0, len(a.pending))
+	for _, pending := range a.pending {
+		list = append(list, pending)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.Before(list[j].RequestedAt) })
+	return list
+}
+
+// notify posts a parked command to the approval webhook
+func (a *approvals) notify(pending *approval) {
+	body, err := json.Marshal(pending)
+	if err != nil {
+		return
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		a.logger.Warn("Failed to send approval webhook", zap.String("approval_id", pending.ID), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		a.logger.Warn("Approval webhook rejected request",
+			zap.String("approval_id", pending.ID),
+			zap.Int("status", resp.StatusCode),
+		)
+	}
+}
+
+// randomID returns an identifier for approvals and grants
+func randomID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func (a *approvals) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.list())
+}
+
+func (a *approvals) handleDecision(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		operator := r.Header.Get("X-Operator")
+		if operator == "" {
+			http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+			return
+		}
+		if !a.decide(r.PathValue("id"), approved, operator) {
+			http.Error(w, "no pending approval with that id", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
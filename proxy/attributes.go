@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// logAttributes logs the RESP3 attributes Redis attached to a reply, such
+// as key popularity hints, which clients are free to ignore
+func (s *session) logAttributes(command string, reply *protocol.Reply) {
+	if len(reply.Attrs) == 0 {
+		return
+	}
+	s.logger.Info("Reply attributes",
+		zap.String("command", command),
+		zap.Object("attributes", replyMap(reply.Attrs)),
+	)
+}
+
+// replyMap logs alternating key and value replies as an object
+type replyMap []*protocol.Reply
+
+func (m replyMap) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for i := 0; i+1 < len(m); i += 2 {
+		if err := addReply(enc, m[i].Str, m[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replyArray logs aggregate elements as an array
+type replyArray []*protocol.Reply
+
+func (a replyArray) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, elem := range a {
+		var err error
+		switch {
+		case elem.Null:
+			enc.AppendReflected(nil)
+		case elem.Type == '%':
+			err = enc.AppendObject(replyMap(elem.Elems))
+		case elem.Elems != nil:
+			err = enc.AppendArray(replyArray(elem.Elems))
+		default:
+			enc.AppendString(elem.Str)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addReply(enc zapcore.ObjectEncoder, key string, value *protocol.Reply) error {
+	switch {
+	case value.Null:
+		return enc.AddReflected(key, nil)
+	case value.Type == '%':
+		return enc.AddObject(key, replyMap(value.Elems))
+	case value.Elems != nil:
+		return enc.AddArray(key, replyArray(value.Elems))
+	default:
+		enc.AddString(key, value.Str)
+		return nil
+	}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// auditBatchSize bounds the entries added in one pipelined write
+const auditBatchSize = 100
+
+// auditStream XADDs an entry for every command to a Redis Stream on a
+// separate audit Redis. Entries are queued and written in batches by a
+// single sender, so that a slow audit Redis never holds up clients; while
+// it is unreachable the queue fills and further entries are dropped.
+type auditStream struct {
+	stream   string
+	maxLen   int64
+	username string
+	password string
+	db       int
+	logger   *zap.Logger
+	client   *upstreamClient
+	queue    chan []string
+	dropped  atomic.Uint64
+}
+
+func newAuditStream(logger *zap.Logger, cfg *config.AuditStreamConfig) *auditStream {
+	if cfg == nil {
+		return nil
+	}
+	a := &auditStream{
+		stream:   cfg.Stream,
+		maxLen:   cfg.MaxLen,
+		username: cfg.Username,
+		password: cfg.Password,
+		db:       cfg.DB,
+		logger:   logger.With(zap.String("audit_stream", cfg.Addr)),
+	}
+	if a.stream == "" {
+		a.stream = "redislogger:audit"
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 10000
+	}
+	a.queue = make(chan []string, queueSize)
+	network, address := upstreamAddr(cfg.Addr)
+	a.client = &upstreamClient{
+		dial: func() (net.Conn, error) {
+			return net.DialTimeout(network, address, defaultDialTimeout)
+		},
+		timeout: defaultDialTimeout,
+	}
+	return a
+}
+
+// OnEvent queues the XADD of a command's entry, dropping it when the queue
+// is full
+func (a *auditStream) OnEvent(e Event) {
+	ce, ok := e.(*CommandEvent)
+	if !ok {
+		return
+	}
+	select {
+	case a.queue <- a.xadd(ce):
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// xadd returns the XADD adding a command's entry. Arguments are masked and
+// redacted as they are in the log.
+func (a *auditStream) xadd(ce *CommandEvent) []string {
+	args, _ := json.Marshal(ce.session.proxy.values.args(ce.req.cmd))
+	cmd := []string{"XADD", a.stream}
+	if a.maxLen > 0 {
+		cmd = append(cmd, "MAXLEN", "~", strconv.FormatInt(a.maxLen, 10))
+	}
+	cmd = append(cmd, "*",
+		"time", ce.Time.UTC().Format(time.RFC3339Nano),
+		"connection_id", strconv.FormatUint(ce.Conn.ID, 10),
+		"client_addr", ce.Conn.ClientAddr,
+		"command", ce.req.name,
+		"args", string(args),
+	)
+	optional := [][2]string{
+		{"client_identity", ce.Conn.Identity},
+		{"user", ce.User},
+		{"tenant", ce.Tenant},
+		{"service", ce.Service},
+		{"shard", ce.Shard},
+	}
+	for _, f := range optional {
+		if f[1] != "" {
+			cmd = append(cmd, f[0], f[1])
+		}
+	}
+	if ce.DB >= 0 {
+		cmd = append(cmd, "db", strconv.FormatInt(ce.DB, 10))
+	}
+	if ce.Held {
+		cmd = append(cmd, "legal_hold", "1")
+	}
+	return cmd
+}
+
+// run writes the queued entries until the context is cancelled
+func (a *auditStream) run(ctx context.Context) {
+	defer a.client.close()
+	batch := make([][]string, 0, auditBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-a.queue:
+			batch = append(batch[:0], cmd)
+		}
+	fill:
+		for len(batch) < auditBatchSize {
+			select {
+			case cmd := <-a.queue:
+				batch = append(batch, cmd)
+			default:
+				break fill
+			}
+		}
+		a.write(ctx, batch)
+	}
+}
+
+// write adds a batch of entries, retrying with backoff while the audit
+// Redis is unreachable. Entries it rejects are dropped.
+func (a *auditStream) write(ctx context.Context, batch [][]string) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := a.send(batch)
+		if err == nil {
+			if n := a.dropped.Swap(0); n > 0 {
+				a.logger.Warn("Audit stream queue full, entries dropped", zap.Uint64("dropped", n))
+			}
+			return
+		}
+		if attempt == 1 {
+			a.logger.Warn("Failed to write audit stream entries, retrying", zap.Int("entries", len(batch)), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// send pipelines a batch of XADDs, authenticating and selecting the
+// database first on a new connection. Only connection failures are
+// returned; error replies are logged.
+func (a *auditStream) send(batch [][]string) error {
+	var setup [][]string
+	if a.client.conn == nil {
+		if a.password != "" {
+			auth := []string{"AUTH", a.password}
+			if a.username != "" {
+				auth = []string{"AUTH", a.username, a.password}
+			}
+			setup = append(setup, auth)
+		}
+		if a.db != 0 {
+			setup = append(setup, []string{"SELECT", strconv.Itoa(a.db)})
+		}
+	}
+	replies, err := a.client.pipeline(append(setup, batch...))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies[:len(setup)] {
+		if reply.IsError() {
+			a.client.close()
+			return fmt.Errorf("audit Redis rejected the connection: %s", reply.Str)
+		}
+	}
+	rejected := 0
+	var last string
+	for _, reply := range replies[len(setup):] {
+		if reply.IsError() {
+			rejected++
+			last = reply.Str
+		}
+	}
+	if rejected > 0 {
+		a.logger.Warn("Audit stream entries rejected", zap.Int("entries", rejected), zap.String("error", last))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// clientAuth validates the credentials clients present with AUTH or HELLO,
+// so that nothing reaches Redis from a client that has not authenticated
+type clientAuth struct {
+	passwords map[string]string
+}
+
+func newClientAuth(cfg *config.AuthConfig) *clientAuth {
+	if cfg == nil {
+		return nil
+	}
+	a := &clientAuth{passwords: make(map[string]string, len(cfg.Users)+1)}
+	for user, password := range cfg.Users {
+		a.passwords[user] = password
+	}
+	if cfg.RequirePass != "" {
+		a.passwords["default"] = cfg.RequirePass
+	}
+	return a
+}
+
+// verify reports whether the password is correct for the user
+func (a *clientAuth) verify(user, password string) bool {
+	expected, ok := a.passwords[user]
+	// Compare even for unknown users, so the reply takes as long
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return ok && match
+}
+
+// checkAuth answers AUTH itself and rejects every other command with
+// -NOAUTH until the client has authenticated. Credentials given with HELLO
+// are checked and stripped before HELLO is forwarded.
+func (p *Proxy) checkAuth(s *session, req *request) []byte {
+	if p.auth == nil {
+		return nil
+	}
+
+	switch req.name {
+	case "AUTH":
+		var user, password string
+		switch len(req.cmd.Args) {
+		case 1:
+			user, password = "default", req.cmd.Args[0]
+		case 2:
+			user, password = req.cmd.Args[0], req.cmd.Args[1]
+		default:
+			return []byte("-ERR wrong number of arguments for 'auth' command\r\n")
+		}
+		if !p.login(s, user, password) {
+			return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		}
+		return []byte("+OK\r\n")
+	case "HELLO":
+		args := req.cmd.Args
+		for i := 1; i+2 < len(args); i++ {
+			if !strings.EqualFold(args[i], "AUTH") {
+				continue
+			}
+			if !p.login(s, args[i+1], args[i+2]) {
+				return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			}
+			stripped := append(append([]string{req.cmd.Name}, args[:i]...), args[i+3:]...)
+			req.cmd.Args = stripped[1:]
+			req.cmd.Message = encodeCommand(stripped...)
+			// The forwarded frame no longer matches what the client sent
+			req.checksum = nil
+			return nil
+		}
+		if !s.authenticated {
+			return []byte("-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n")
+		}
+	case "QUIT":
+		return nil
+	case "RESET":
+		// As in Redis, RESET logs the client out
+		s.authenticated, s.user = false, ""
+		return nil
+	}
+
+	if !s.authenticated {
+		return []byte("-NOAUTH Authentication required.\r\n")
+	}
+	return nil
+}
+
+// login checks a client's credentials, logging failed attempts
+func (p *Proxy) login(s *session, user, password string) bool {
+	if !p.auth.verify(user, password) {
+		s.logger.Warn("Client authentication failed", zap.String("user", user))
+		return false
+	}
+	s.authenticated, s.user = true, user
+	s.logger.Info("Client authenticated", zap.String("user", user))
+	return true
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dialRetry dials Redis for a new client, retrying with exponential
+// backoff and jitter while the client is held, when reconnect is configured.
+// addr overrides the configured Redis when set.
+func (p *Proxy) dialRetry(ctx context.Context, logger *zap.Logger, addr string, header []byte) (net.Conn, error) {
+	dial := func() (net.Conn, error) {
+		if addr != "" {
+			return p.dialAddr(ctx, addr, header)
+		}
+		return p.dial(ctx, header)
+	}
+	cfg := p.config.Reconnect
+	if cfg == nil {
+		return dial()
+	}
+
+	attempts := max(cfg.MaxAttempts, 1)
+	backoff := time.Duration(cfg.InitialBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxBackoff := time.Duration(cfg.MaxBackoffMs) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = 2 * time.Second
+	}
+	var deadline time.Time
+	if cfg.MaxHoldMs > 0 {
+		deadline = time.Now().Add(time.Duration(cfg.MaxHoldMs) * time.Millisecond)
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dial()
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("Connected to Redis after retrying", zap.Int("attempts", attempt))
+			}
+			return conn, nil
+		}
+		if attempt >= attempts {
+			return nil, err
+		}
+
+		// Half the backoff plus a random share of the other half keeps
+		// clients that failed together from retrying in lockstep
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		logger.Warn("Failed to connect to Redis, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// batchShutdownTimeout bounds the last send of a batch at shutdown
+const batchShutdownTimeout = 10 * time.Second
+
+// batcher is the queue and single sender shared by the analytics sinks.
+// Items are queued without blocking, and those arriving while the queue is
+// full are dropped and counted. The sender gathers queued items into the
+// sink's batch, and has the sink send it once it is full or its first item
+// has waited the flush interval, or with no interval, as soon as the queue
+// is empty. A last send of the batch gathered is attempted at shutdown.
+type batcher[T any] struct {
+	sink     batchSink[T]
+	interval time.Duration
+	queue    chan T
+	dropped  atomic.Uint64
+	logger   *zap.Logger
+	// dropMessage is logged with the count of items dropped
+	dropMessage string
+}
+
+// batchSink is a sink sending batches through a batcher
+type batchSink[T any] interface {
+	// add adds an item to the batch being gathered, reporting whether the
+	// batch is full
+	add(item T) bool
+	// send sends the batch gathered and starts a new one
+	send(ctx context.Context)
+}
+
+func newBatcher[T any](logger *zap.Logger, sink batchSink[T], queueSize int, interval time.Duration, dropMessage string) *batcher[T] {
+	return &batcher[T]{
+		sink:        sink,
+		interval:    interval,
+		queue:       make(chan T, queueSize),
+		logger:      logger,
+		dropMessage: dropMessage,
+	}
+}
+
+// enqueue queues an item, dropping it when the queue is full
+func (b *batcher[T]) enqueue(item T) {
+	select {
+	case b.queue <- item:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// sent is called by the sink once a batch is sent, and logs the items
+// dropped since the last time
+func (b *batcher[T]) sent() {
+	if n := b.dropped.Swap(0); n > 0 {
+		b.logger.Warn(b.dropMessage, zap.Uint64("dropped", n))
+	}
+}
+
+// run sends the queued items until the context is cancelled, then sends
+// the batch already gathered
+func (b *batcher[T]) run(ctx context.Context) {
+	var pending bool
+	var deadline <-chan time.Time
+	send := func(ctx context.Context) {
+		if pending {
+			b.sink.send(ctx)
+			pending, deadline = false, nil
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			shutdown, cancel := context.WithTimeout(context.Background(), batchShutdownTimeout)
+			send(shutdown)
+			cancel()
+			return
+		case item := <-b.queue:
+			if !pending && b.interval > 0 {
+				deadline = time.After(b.interval)
+			}
+			pending = true
+			if b.sink.add(item) || b.interval == 0 && len(b.queue) == 0 {
+				send(ctx)
+			}
+		case <-deadline:
+			send(ctx)
+		}
+	}
+}
+
+// retry calls send until it succeeds, fails in a way it reports not worth
+// retrying, or has been called attempts times, unless attempts is 0. The
+// backoff between calls doubles from initial up to limit. It returns the
+// calls made and the last error.
+func retry(ctx context.Context, attempts int, initial, limit time.Duration, send func() (bool, error)) (int, error) {
+	backoff := initial
+	for attempt := 1; ; attempt++ {
+		again, err := send()
+		if err == nil || !again || attempts > 0 && attempt >= attempts {
+			return attempt, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, limit)
+	}
+}
+
+// sinkRecord is a command as the analytics sinks record it. The S3 archive
+// records commands as they are received; the other sinks record those
+// forwarded to Redis once the reply arrives, with the reply's latency, size
+// and error.
+type sinkRecord struct {
+	Time         time.Time `json:"time"`
+	ConnectionID uint64    `json:"connection_id"`
+	ClientAddr   string    `json:"client_addr"`
+	Identity     string    `json:"client_identity,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Service      string    `json:"service,omitempty"`
+	Command      string    `json:"command"`
+	Args         []string  `json:"args"`
+	Keys         []string  `json:"keys,omitempty"`
+	DB           int64     `json:"db"`
+	Shard        string    `json:"shard,omitempty"`
+	Held         bool      `json:"legal_hold,omitempty"`
+	LatencyUs    int64     `json:"latency_us,omitempty"`
+	ReplyBytes   int       `json:"reply_bytes,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Seq          uint64    `json:"seq,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+}
+
+// commandRecord records a command as received. Arguments are masked and
+// redacted as they are in the log.
+func commandRecord(ce *CommandEvent) *sinkRecord {
+	return newSinkRecord(ce.Conn, ce.session, ce.req, ce.Time)
+}
+
+// responseRecord records a forwarded command once its reply arrived
+func responseRecord(re *ResponseEvent) *sinkRecord {
+	r := newSinkRecord(re.Conn, re.session, re.req, re.Time)
+	r.LatencyUs = re.Latency.Microseconds()
+	r.ReplyBytes = len(re.Reply)
+	r.Error = re.Error
+	return r
+}
+
+func newSinkRecord(conn *ConnInfo, s *session, req *request, at time.Time) *sinkRecord {
+	r := &sinkRecord{
+		Time:         at.UTC(),
+		ConnectionID: conn.ID,
+		ClientAddr:   conn.ClientAddr,
+		Identity:     conn.Identity,
+		User:         req.user,
+		Tenant:       req.tenant,
+		Service:      req.service,
+		Command:      req.name,
+		Args:         slices.Clone(s.proxy.values.args(req.cmd)),
+		Keys:         req.cmd.Keys(),
+		DB:           req.db,
+		Shard:        req.shard,
+		Held:         req.held,
+	}
+	r.Seq, r.RequestID = req.correlationIDs()
+	return r
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// defaultBigKeyBytes is the size threshold when big_keys sets none
+const defaultBigKeyBytes = 1 << 20
+
+// bigKeys catches big-key antipatterns, such as a SET of a 1 MB value or
+// an LRANGE returning 5 MB, by logging commands and replies beyond a size
+type bigKeys struct {
+	request int
+	reply   int
+}
+
+func newBigKeys(cfg *config.BigKeysConfig) *bigKeys {
+	if cfg == nil {
+		return nil
+	}
+	b := &bigKeys{request: cfg.RequestBytes, reply: cfg.ReplyBytes}
+	if b.request == 0 {
+		b.request = defaultBigKeyBytes
+	}
+	if b.reply == 0 {
+		b.reply = defaultBigKeyBytes
+	}
+	return b
+}
+
+// checkRequest logs a command whose encoded size is beyond the threshold
+func (b *bigKeys) checkRequest(s *session, req *request) {
+	if b == nil || len(req.cmd.Message) <= b.request {
+		return
+	}
+	s.logger.Warn("Big value in command", bigKeyFields(req, len(req.cmd.Message))...)
+}
+
+// checkReply logs a reply whose encoded size is beyond the threshold
+func (b *bigKeys) checkReply(s *session, req *request, size int) {
+	if b == nil || size <= b.reply {
+		return
+	}
+	s.logger.Warn("Big reply", bigKeyFields(req, size)...)
+}
+
+func bigKeyFields(req *request, size int) []zap.Field {
+	fields := []zap.Field{
+		zap.String("command", req.cmd.Name),
+		zap.Int("size_bytes", size),
+	}
+	if keys := req.cmd.Keys(); len(keys) > 0 {
+		fields = append(fields, zap.String("key", keys[0]))
+	}
+	return fields
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// defaultBlockedCommands are blocked when block_commands lists none
+var defaultBlockedCommands = []string{"FLUSHALL", "FLUSHDB", "KEYS", "CONFIG", "DEBUG", "SHUTDOWN"}
+
+func newBlockedCommands(cfg *config.BlockCommandsConfig) map[string]bool {
+	if cfg == nil {
+		return nil
+	}
+	commands := cfg.Commands
+	if len(commands) == 0 {
+		commands = defaultBlockedCommands
+	}
+	blocked := make(map[string]bool, len(commands))
+	for _, name := range commands {
+		blocked[strings.ToUpper(name)] = true
+	}
+	return blocked
+}
+
+// checkBlocked refuses dangerous commands for every client
+func (p *Proxy) checkBlocked(s *session, req *request) []byte {
+	if !p.blocked[req.name] {
+		return nil
+	}
+	s.logger.Warn("Blocked dangerous command", zap.String("command", req.cmd.Name))
+	return []byte("-ERR command blocked by proxy\r\n")
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// Event is a ConnectionEvent, CommandEvent or ResponseEvent published on
+// the proxy's event bus
+type Event interface {
+	event()
+}
+
+// Subscriber receives the events the proxy publishes, which include the
+// events its own log output is written from. OnEvent is called
+// synchronously from the connection an event concerns, so a connection's
+// events arrive in order, but a subscriber doing slow work such as I/O
+// should hand them off to a goroutine of its own.
+type Subscriber interface {
+	OnEvent(e Event)
+}
+
+// SubscriberFunc adapts a function to a Subscriber
+type SubscriberFunc func(e Event)
+
+func (f SubscriberFunc) OnEvent(e Event) { f(e) }
+
+// ConnectionEvent is published when a client connection opens, once it
+// is accepted, and when it closes
+type ConnectionEvent struct {
+	Time time.Time
+	Conn *ConnInfo
+	// Closed is set for the event published when the connection closes
+	Closed bool
+	// Fields are the fields the event is logged with, such as the
+	// connection's byte and command counts when it closes
+	Fields []zap.Field
+
+	session *session
+}
+
+// CommandEvent is published for every command received from a client,
+// before the proxy's policies run
+type CommandEvent struct {
+	Time    time.Time
+	Conn    *ConnInfo
+	Command *protocol.Command
+	// DB is the database the client selected, or -1 until it sends SELECT
+	DB      int64
+	User    string
+	Tenant  string
+	Service string
+	// Shard is the node the command is routed to in cluster and sharded
+	// mode
+	Shard string
+	// Held marks commands under legal hold
+	Held bool
+	// Logged is unset for commands left out of the log by sampling or the
+	// log filter, or held back until they fail by errors_only
+	Logged bool
+	// Fields are the fields the command is logged with
+	Fields []zap.Field
+	// Seq numbers the command among those received on its connection
+	Seq uint64
+	// RequestID identifies the command across proxies when
+	// correlation_ids is enabled, and is empty otherwise
+	RequestID string
+
+	session *session
+	req     *request
+}
+
+// ResponseEvent is published for every command forwarded to Redis once
+// its reply arrives
+type ResponseEvent struct {
+	// Time is when the command was forwarded
+	Time    time.Time
+	Conn    *ConnInfo
+	Command *protocol.Command
+	DB      int64
+	User    string
+	Shard   string
+	// Latency is the round trip to Redis
+	Latency time.Duration
+	// Reply is the raw reply, valid only during OnEvent
+	Reply []byte
+	// Error is Redis's error reply, if the command failed
+	Error string
+	// Seq and RequestID are those of the command's CommandEvent
+	Seq       uint64
+	RequestID string
+
+	session *session
+	req     *request
+}
+
+func (*ConnectionEvent) event() {}
+func (*CommandEvent) event()    {}
+func (*ResponseEvent) event()   {}
+
+// Subscribe adds subscribers to the event bus, which receive events in
+// the order they are added, after the proxy's log output. It must be
+// called before Start.
+func (p *Proxy) Subscribe(subs ...Subscriber) {
+	p.subscribers = append(p.subscribers, subs...)
+}
+
+func (p *Proxy) publish(e Event) {
+	for _, sub := range p.subscribers {
+		sub.OnEvent(e)
+	}
+}
+
+// publishResponse publishes the reply to a forwarded command
+func (s *session) publishResponse(req *request, latency time.Duration, reply []byte) {
+	e := &ResponseEvent{
+		Time:      time.Now().Add(-latency),
+		Conn:      s.info,
+		Command:   req.cmd,
+		DB:        req.db,
+		User:      req.user,
+		Shard:     req.shard,
+		Latency:   latency,
+		Reply:     reply,
+		Error:     responseError(req, reply),
+		Seq:       req.seq,
+		RequestID: req.id,
+		session:   s,
+		req:       req,
+	}
+	s.proxy.publish(e)
+}
+
+// replyError returns the message of an error reply, or "" for any other
+// reply
+func replyError(reply []byte) string {
+	if len(reply) == 0 {
+		return ""
+	}
+	switch reply[0] {
+	case '-':
+		line, _, _ := bytes.Cut(reply[1:], []byte("\r\n"))
+		return string(line)
+	case '!', '|':
+		// RESP3 blob errors carry their length, and attributes may come
+		// ahead of an error
+		parsed, err := protocol.NewReplyReader(bytes.NewReader(reply)).ReadReply()
+		if err == nil && parsed.IsError() {
+			return parsed.Str
+		}
+	}
+	return ""
+}
+
+// responseError returns the error of a reply to a forwarded command. The
+// reply to EXEC is an array of the replies to the queued commands, so its
+// error is that of the first of them to fail.
+func responseError(req *request, reply []byte) string {
+	if req.name != "EXEC" || len(reply) == 0 || reply[0] != '*' {
+		return replyError(reply)
+	}
+	parsed, err := protocol.NewReplyReader(bytes.NewReader(reply)).ReadReply()
+	if err != nil {
+		return ""
+	}
+	for i, elem := range parsed.Elems {
+		if elem.IsError() {
+			return fmt.Sprintf("%s (command %d of the transaction)", elem.Str, i+1)
+		}
+	}
+	return ""
+}
+
+// logSink writes the proxy's log output for the events it publishes
+type logSink struct{}
+
+func (logSink) OnEvent(e Event) {
+	switch e := e.(type) {
+	case *ConnectionEvent:
+		if e.Closed {
+			e.session.logger.Info("Connection closed", e.Fields...)
+		}
+	case *CommandEvent:
+		if !e.Logged {
+			return
+		}
+		e.session.logger.Log(e.session.commandLevel(e.req), "Received command", e.Fields...)
+	case *ResponseEvent:
+		e.session.logFailure(e.req, e.Error)
+		e.session.logReply(e.req, e.Reply, e.Error, zap.Duration("latency", e.Latency))
+	}
+}
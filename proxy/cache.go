@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+const (
+	defaultCacheTTL       = time.Second
+	defaultCacheMaxMemory = 64 << 20
+
+	// cacheEntryOverhead approximates the memory of an entry beyond its
+	// key and value
+	cacheEntryOverhead = 96
+
+	// cacheBuckets is the number of invalidation generations keys are
+	// hashed to; a write bumps its keys' buckets so that GET replies in
+	// flight at the time are not cached
+	cacheBuckets = 4096
+)
+
+// responseCache is an LRU cache of GET and MGET results, invalidated by
+// the writes passing through the proxy. Only sessions on database 0 use
+// it, and only non-nil values are cached. Entries are scoped to the Redis
+// and the proxy user they were read by, so neither listeners with their
+// own Redis nor users with different ACLs share values.
+type responseCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	mu sync.Mutex
+	// entries are indexed by key, then by scope
+	entries map[string]map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	gens    [cacheBuckets]uint64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+	evictions     atomic.Uint64
+}
+
+type cacheEntry struct {
+	key     string
+	scope   string
+	value   string
+	expires time.Time
+}
+
+func newResponseCache(cfg *config.CacheConfig) *responseCache {
+	if cfg == nil {
+		return nil
+	}
+	c := &responseCache{
+		ttl:      time.Duration(cfg.TTLMs) * time.Millisecond,
+		maxBytes: cfg.MaxMemoryBytes,
+		entries:  make(map[string]map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if c.ttl == 0 {
+		c.ttl = defaultCacheTTL
+	}
+	if c.maxBytes == 0 {
+		c.maxBytes = defaultCacheMaxMemory
+	}
+	return c
+}
+
+// cacheable reports whether the session may be answered from the cache.
+// Clients that authenticated with Redis itself are not, since the cache
+// can't apply Redis's ACLs.
+func (c *responseCache) cacheable(s *session, req *request) bool {
+	if c == nil || req.name != "GET" && req.name != "MGET" || len(req.cmd.Args) == 0 {
+		return false
+	}
+	return s.enabled(flagCache) && s.db.Load() <= 0 && !s.multi && !s.subscribed.Load() && !s.redisAuth && (s.replyMode == "" || s.replyMode == "ON")
+}
+
+// cacheScope is the scope of the entries a session reads and fills
+func cacheScope(s *session) string {
+	return s.backend + "\x00" + s.user
+}
+
+// lookup answers a GET, or an MGET whose every key is cached, from the
+// cache
+func (c *responseCache) lookup(s *session, req *request) []byte {
+	if !c.cacheable(s, req) {
+		return nil
+	}
+	keys := req.cmd.Args
+	if req.name == "GET" {
+		keys = keys[:1]
+	}
+
+	scope := cacheScope(s)
+	now := time.Now()
+	values := make([]string, len(keys))
+	c.mu.Lock()
+	for i, key := range keys {
+		elem, ok := c.entries[key][scope]
+		if !ok || now.After(elem.Value.(*cacheEntry).expires) {
+			c.mu.Unlock()
+			c.misses.Add(1)
+			return nil
+		}
+		c.lru.MoveToFront(elem)
+		values[i] = elem.Value.(*cacheEntry).value
+	}
+	c.mu.Unlock()
+	c.hits.Add(1)
+
+	var reply []byte
+	if req.name == "MGET" {
+		reply = append(reply, "*"+strconv.Itoa(len(values))+"\r\n"...)
+	}
+	for _, v := range values {
+		reply = append(reply, "$"+strconv.Itoa(len(v))+"\r\n"...)
+		reply = append(reply, v...)
+		reply = append(reply, "\r\n"...)
+	}
+	return reply
+}
+
+// observe is called for every command forwarded to Redis. Writes
+// invalidate their keys, those queued in a transaction once EXEC runs
+// them, and cacheable reads take the generations their reply must be
+// filled under.
+func (c *responseCache) observe(s *session, req *request) {
+	if c == nil {
+		return
+	}
+	if req.name == "AUTH" || req.name == "HELLO" && slices.ContainsFunc(req.cmd.Args, func(arg string) bool {
+		return strings.EqualFold(arg, "AUTH")
+	}) {
+		s.redisAuth = true
+	}
+	switch req.name {
+	case "EXEC":
+		if s.multiClears {
+			c.clear()
+		} else if len(s.multiWrites) > 0 {
+			c.invalidate(s.multiWrites)
+		}
+		fallthrough
+	case "DISCARD", "RESET":
+		s.multiWrites, s.multiClears = nil, false
+		return
+	}
+	// Commands missing from the command table may write any key
+	if req.cmd.IsWrite() || protocol.LookupCommand(req.name) == nil {
+		// Writes without keys, such as FLUSHDB or EVAL with no declared
+		// keys, may touch any key
+		keys := req.cmd.Keys()
+		switch {
+		case s.multi && len(keys) > 0:
+			s.multiWrites = append(s.multiWrites, keys...)
+		case s.multi:
+			s.multiClears = true
+		case len(keys) > 0:
+			c.invalidate(keys)
+		default:
+			c.clear()
+		}
+		return
+	}
+	if c.cacheable(s, req) {
+		keys := req.cmd.Args
+		if req.name == "GET" {
+			keys = keys[:1]
+		}
+		req.cacheScope = cacheScope(s)
+		req.cacheGens = make([]uint64, len(keys))
+		c.mu.Lock()
+		for i, key := range keys {
+			req.cacheGens[i] = c.gens[cacheBucket(key)]
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fill caches the values of a GET or MGET reply whose keys were not
+// written while it was in flight
+func (c *responseCache) fill(req *request, reply *protocol.Reply) {
+	if c == nil || req.cacheGens == nil || reply.IsError() {
+		return
+	}
+	var values []*protocol.Reply
+	switch {
+	case req.name == "GET" && reply.Type == '$':
+		values = []*protocol.Reply{reply}
+	case req.name == "MGET" && reply.Type == '*' && len(reply.Elems) == len(req.cmd.Args):
+		values = reply.Elems
+	default:
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range values {
+		key := req.cmd.Args[i]
+		if v.Null || v.Type != '$' || c.gens[cacheBucket(key)] != req.cacheGens[i] {
+			continue
+		}
+		c.store(&cacheEntry{key: key, scope: req.cacheScope, value: v.Str, expires: expires})
+	}
+}
+
+// store adds an entry, evicting the least recently used ones beyond the
+// memory limit; the caller holds the mutex
+func (c *responseCache) store(e *cacheEntry) {
+	size := entrySize(e)
+	if size > c.maxBytes {
+		return
+	}
+	if elem, ok := c.entries[e.key][e.scope]; ok {
+		c.remove(elem)
+	}
+	if c.entries[e.key] == nil {
+		c.entries[e.key] = make(map[string]*list.Element)
+	}
+	c.entries[e.key][e.scope] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries[e.key], e.scope)
+	if len(c.entries[e.key]) == 0 {
+		delete(c.entries, e.key)
+	}
+	c.bytes -= entrySize(e)
+}
+
+func (c *responseCache) invalidate(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.gens[cacheBucket(key)]++
+		for _, elem := range c.entries[key] {
+			c.remove(elem)
+			c.invalidations.Add(1)
+		}
+	}
+}
+
+// clear empties the cache after a write that may touch any key
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.gens {
+		c.gens[i]++
+	}
+	c.invalidations.Add(uint64(c.lru.Len()))
+	c.entries = make(map[string]map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// cachedEntry is an entry saved in the state file, with its key, scope
+// and value as bytes since they need not be UTF-8
+type cachedEntry struct {
+	Key     []byte    `json:"key"`
+	Scope   []byte    `json:"scope"`
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// save lists the unexpired entries, least recently used first
+func (c *responseCache) save() []cachedEntry {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []cachedEntry
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		if e := elem.Value.(*cacheEntry); e.expires.After(now) {
+			entries = append(entries, cachedEntry{Key: []byte(e.key), Scope: []byte(e.scope), Value: []byte(e.value), Expires: e.expires})
+		}
+	}
+	return entries
+}
+
+// restore adds saved entries that have yet to expire, returning how many
+func (c *responseCache) restore(entries []cachedEntry) int {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		if e.Expires.After(now) {
+			c.store(&cacheEntry{key: string(e.Key), scope: string(e.Scope), value: string(e.Value), expires: e.Expires})
+		}
+	}
+	return c.lru.Len()
+}
+
+func (c *responseCache) handleStatus(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	entries, bytes := c.lru.Len(), c.bytes
+	c.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries":       entries,
+		"bytes":         bytes,
+		"max_bytes":     c.maxBytes,
+		"hits":          c.hits.Load(),
+		"misses":        c.misses.Load(),
+		"invalidations": c.invalidations.Load(),
+		"evictions":     c.evictions.Load(),
+	})
+}
+
+func entrySize(e *cacheEntry) int64 {
+	return int64(len(e.key) + len(e.value) + cacheEntryOverhead)
+}
+
+func cacheBucket(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % cacheBuckets
+}
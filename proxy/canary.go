@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// canaryScript writes and reads back a key, exercising the Lua engine
+const canaryScript = "redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2]) return redis.call('GET', KEYS[1])"
+
+// canaryTTL bounds how long canary keys outlive a stopped proxy
+const canaryTTL = "60000"
+
+// canarySteps are the operations a canary run can execute, in order
+var canarySteps = []string{"set", "get", "del", "eval", "stream"}
+
+// canary continuously runs a small synthetic workload against each
+// upstream so that upstream degradation is detected even when client
+// traffic is quiet
+type canary struct {
+	interval time.Duration
+	prefix   string
+	steps    []string
+	targets  []*canaryTarget
+}
+
+// canaryTarget is an upstream the workload runs against, with its own
+// connection and results
+type canaryTarget struct {
+	canary   *canary
+	upstream string
+	labels   labels
+	logger   *zap.Logger
+	client   *upstreamClient
+
+	runs     atomic.Uint64
+	failures atomic.Uint64
+
+	mu      sync.Mutex
+	last    *canaryRun
+	latency histogram
+}
+
+// canaryRun is the outcome of the last run against an upstream
+type canaryRun struct {
+	time    time.Time
+	steps   []canaryStep
+	latency time.Duration
+	failed  *canaryStep
+}
+
+// canaryStep is the outcome of one operation of a canary run
+type canaryStep struct {
+	name    string
+	latency time.Duration
+	err     error
+}
+
+// canaryStatus is an upstream's canary as reported by the admin API
+type canaryStatus struct {
+	Upstream      string             `json:"upstream"`
+	Labels        labels             `json:"labels,omitempty"`
+	Runs          uint64             `json:"runs"`
+	Failures      uint64             `json:"failures"`
+	LastRun       *time.Time         `json:"last_run,omitempty"`
+	LastSuccess   bool               `json:"last_success"`
+	LastLatencyMs float64            `json:"last_latency_ms"`
+	LastStepsMs   map[string]float64 `json:"last_steps_ms,omitempty"`
+	FailedStep    string             `json:"failed_step,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	P50Ms         float64            `json:"p50_ms"`
+	P99Ms         float64            `json:"p99_ms"`
+}
+
+func newCanary(p *Proxy, cfg *config.CanaryConfig) *canary {
+	if cfg == nil {
+		return nil
+	}
+	c := &canary{
+		interval: 10 * time.Second,
+		prefix:   "redislogger:canary:",
+		steps:    canarySteps,
+	}
+	if cfg.Interval > 0 {
+		c.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.KeyPrefix != "" {
+		c.prefix = cfg.KeyPrefix
+	}
+	if len(cfg.Steps) > 0 {
+		c.steps = cfg.Steps
+	}
+	timeout := 2 * time.Second
+	if cfg.TimeoutMs > 0 {
+		timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+
+	for _, addr := range canaryUpstreams(p.config) {
+		t := &canaryTarget{canary: c, upstream: addr, client: newUpstreamClient(p, timeout)}
+		if addr == "" {
+			// The Redis of redis_addr or Sentinel, dialed as clients' are
+			t.upstream = p.config.RedisAddr
+			if p.sentinel != nil {
+				t.upstream = "sentinel:" + p.config.Sentinel.MasterName
+			}
+		} else {
+			t.client.dial = func() (net.Conn, error) { return p.dialAddr(context.Background(), addr, nil) }
+		}
+		t.labels = p.labels.upstream(addr)
+		t.logger = p.logger.With(zap.String("component", "canary"), zap.String("upstream", t.upstream))
+		c.targets = append(c.targets, t)
+	}
+	return c
+}
+
+// canaryUpstreams lists the addresses of the upstreams, with "" for the
+// Redis of redis_addr when there is a single one
+func canaryUpstreams(cfg *config.Config) []string {
+	var addrs []string
+	if len(cfg.Backends) > 1 || cfg.Sharding != nil {
+		for _, b := range cfg.Backends {
+			addrs = append(addrs, b.Addr)
+		}
+	} else {
+		addrs = append(addrs, "")
+	}
+	if cfg.Sharding != nil {
+		for _, route := range cfg.Sharding.Routes {
+			addrs = append(addrs, route.Addr)
+		}
+	}
+	for _, l := range cfg.Listeners {
+		if l.RedisAddr != "" {
+			addrs = append(addrs, l.RedisAddr)
+		}
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs)
+}
+
+// run executes the workload against every upstream each interval until
+// the context is cancelled
+func (c *canary) run(ctx context.Context) {
+	for _, t := range c.targets {
+		go t.run(ctx)
+	}
+}
+
+// run executes the workload every interval until the context is
+// cancelled, so that a slow upstream delays only its own runs
+func (t *canaryTarget) run(ctx context.Context) {
+	ticker := time.NewTicker(t.canary.interval)
+	defer ticker.Stop()
+	defer t.client.close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.report(t.execute())
+	}
+}
+
+// execute runs each configured step, stopping at the first failure
+func (t *canaryTarget) execute() []canaryStep {
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	key := t.canary.prefix + "key"
+
+	results := make([]canaryStep, 0, len(t.canary.steps))
+	for _, name := range t.canary.steps {
+		start := time.Now()
+		var err error
+		switch name {
+		case "set":
+			err = t.expect("OK", "SET", key, value, "PX", canaryTTL)
+		case "get":
+			err = t.expect(value, "GET", key)
+		case "del":
+			_, err = t.do("DEL", key)
+		case "eval":
+			err = t.expect(value, "EVAL", canaryScript, "1", t.canary.prefix+"script", value, canaryTTL)
+		case "stream":
+			err = t.stream(value)
+		}
+		results = append(results, canaryStep{name: name, latency: time.Since(start), err: err})
+		if err != nil {
+			break
+		}
+	}
+	return results
+}
+
+// stream appends an entry to a capped stream and reads it back
+func (t *canaryTarget) stream(value string) error {
+	key := t.canary.prefix + "stream"
+	reply, err := t.do("XADD", key, "MAXLEN", "~", "100", "*", "value", value)
+	if err != nil {
+		return err
+	}
+	id := reply.Str
+	if _, err := t.do("PEXPIRE", key, canaryTTL); err != nil {
+		return err
+	}
+
+	reply, err = t.do("XRANGE", key, id, id)
+	if err != nil {
+		return err
+	}
+	if len(reply.Elems) != 1 {
+		return fmt.Errorf("XRANGE returned %d entries for %s", len(reply.Elems), id)
+	}
+	return nil
+}
+
+// do runs a command, treating error replies as failures
+func (t *canaryTarget) do(args ...string) (*protocol.Reply, error) {
+	reply, err := t.client.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	if reply.IsError() {
+		return nil, fmt.Errorf("%s: %s", args[0], reply.Str)
+	}
+	return reply, nil
+}
+
+// expect runs a command and checks that it replied with want
+func (t *canaryTarget) expect(want string, args ...string) error {
+	reply, err := t.do(args...)
+	if err != nil {
+		return err
+	}
+	if reply.Str != want {
+		return fmt.Errorf("%s returned %q, expected %q", args[0], reply.Str, want)
+	}
+	return nil
+}
+
+func (t *canaryTarget) report(results []canaryStep) {
+	t.runs.Add(1)
+	run := &canaryRun{time: time.Now(), steps: results}
+	fields := make([]zap.Field, 0, len(results)+5)
+	for i := range results {
+		run.latency += results[i].latency
+		fields = append(fields, zap.Duration(results[i].name+"_latency", results[i].latency))
+		if results[i].err != nil {
+			run.failed = &results[i]
+		}
+	}
+	if run.failed != nil {
+		t.failures.Add(1)
+	}
+	t.mu.Lock()
+	t.last = run
+	if run.failed == nil {
+		t.latency.record(run.latency)
+	}
+	t.mu.Unlock()
+
+	fields = append(fields,
+		zap.Bool("success", run.failed == nil),
+		zap.Duration("latency", run.latency),
+		zap.Uint64("runs_total", t.runs.Load()),
+		zap.Uint64("failures_total", t.failures.Load()),
+	)
+	if run.failed != nil {
+		fields = append(fields, zap.String("failed_step", run.failed.name), zap.Error(run.failed.err))
+		t.logger.Warn("Canary run failed", fields...)
+		return
+	}
+	t.logger.Info("Canary run", fields...)
+}
+
+// target returns the canary of an upstream
+func (c *canary) target(upstream string) *canaryTarget {
+	for _, t := range c.targets {
+		if t.upstream == upstream {
+			return t
+		}
+	}
+	return nil
+}
+
+func (c *canary) status() []canaryStatus {
+	list := make([]canaryStatus, 0, len(c.targets))
+	for _, t := range c.targets {
+		status := canaryStatus{
+			Upstream: t.upstream,
+			Labels:   t.labels,
+			Runs:     t.runs.Load(),
+			Failures: t.failures.Load(),
+		}
+		t.mu.Lock()
+		if run := t.last; run != nil {
+			status.LastRun = &run.time
+			status.LastSuccess = run.failed == nil
+			status.LastLatencyMs = ms(run.latency)
+			status.LastStepsMs = make(map[string]float64, len(run.steps))
+			for _, step := range run.steps {
+				status.LastStepsMs[step.name] = ms(step.latency)
+			}
+			if run.failed != nil {
+				status.FailedStep, status.Error = run.failed.name, run.failed.err.Error()
+			}
+		}
+		status.P50Ms, status.P99Ms = ms(t.latency.quantile(0.5)), ms(t.latency.quantile(0.99))
+		t.mu.Unlock()
+		list = append(list, status)
+	}
+	return list
+}
+
+func (c *canary) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.status())
+}
+
+// writeMetrics writes each upstream's run counts, the outcome and step
+// latencies of its last run, and a histogram of its successful runs
+func (c *canary) writeMetrics(b *strings.Builder) {
+	if c == nil {
+		return
+	}
+	series := make([]string, len(c.targets))
+	for i, t := range c.targets {
+		merged := map[string]string{"upstream": t.upstream}
+		for key, value := range t.labels {
+			merged["upstream_"+promName(key)] = value
+		}
+		series[i] = promLabels(merged)
+	}
+
+	b.WriteString("# HELP redislogger_canary_runs_total Canary runs against the upstream.\n")
+	b.WriteString("# TYPE redislogger_canary_runs_total counter\n")
+	for i, t := range c.targets {
+		fmt.Fprintf(b, "redislogger_canary_runs_total{%s} %d\n", series[i], t.runs.Load())
+	}
+	b.WriteString("# HELP redislogger_canary_failures_total Canary runs against the upstream that failed.\n")
+	b.WriteString("# TYPE redislogger_canary_failures_total counter\n")
+	for i, t := range c.targets {
+		fmt.Fprintf(b, "redislogger_canary_failures_total{%s} %d\n", series[i], t.failures.Load())
+	}
+
+	b.WriteString("# HELP redislogger_canary_success Whether the last canary run against the upstream succeeded.\n")
+	b.WriteString("# TYPE redislogger_canary_success gauge\n")
+	var steps strings.Builder
+	for i, t := range c.targets {
+		t.mu.Lock()
+		run := t.last
+		t.mu.Unlock()
+		if run == nil {
+			continue
+		}
+		success := 0
+		if run.failed == nil {
+			success = 1
+		}
+		fmt.Fprintf(b, "redislogger_canary_success{%s} %d\n", series[i], success)
+		for _, step := range run.steps {
+			fmt.Fprintf(&steps, "redislogger_canary_step_latency_seconds{%s,step=\"%s\"} %g\n", series[i], step.name, step.latency.Seconds())
+		}
+	}
+	b.WriteString("# HELP redislogger_canary_step_latency_seconds Latency of each step of the last canary run against the upstream.\n")
+	b.WriteString("# TYPE redislogger_canary_step_latency_seconds gauge\n")
+	b.WriteString(steps.String())
+
+	b.WriteString("# HELP redislogger_canary_latency_seconds Latency of successful canary runs against the upstream.\n")
+	b.WriteString("# TYPE redislogger_canary_latency_seconds histogram\n")
+	for i, t := range c.targets {
+		t.mu.Lock()
+		h := t.latency
+		t.mu.Unlock()
+		for _, le := range latencyBuckets {
+			fmt.Fprintf(b, "redislogger_canary_latency_seconds_bucket{%s,le=\"%g\"} %d\n", series[i], le, h.below(time.Duration(le*float64(time.Second))))
+		}
+		fmt.Fprintf(b, "redislogger_canary_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", series[i], h.total)
+		fmt.Fprintf(b, "redislogger_canary_latency_seconds_sum{%s} %g\n", series[i], h.sum.Seconds())
+		fmt.Fprintf(b, "redislogger_canary_latency_seconds_count{%s} %d\n", series[i], h.total)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// defaultChaosError is the reply of error faults that configure none
+const defaultChaosError = "ERR chaos: injected fault"
+
+// chaos injects latency, dropped connections and error replies into the
+// commands clients send, so that teams can test how their applications
+// cope with a misbehaving Redis
+type chaos struct {
+	faults []chaosFault
+}
+
+type chaosFault struct {
+	kind        string
+	probability float64
+	latency     time.Duration
+	reply       []byte
+	commands    map[string]bool
+}
+
+func newChaos(cfg *config.ChaosConfig) *chaos {
+	if cfg == nil || len(cfg.Faults) == 0 {
+		return nil
+	}
+	c := &chaos{}
+	for _, f := range cfg.Faults {
+		fault := chaosFault{
+			kind:        f.Type,
+			probability: f.Probability,
+			latency:     time.Duration(f.LatencyMs) * time.Millisecond,
+		}
+		if f.Type == "error" {
+			message := f.Error
+			if message == "" {
+				message = defaultChaosError
+			}
+			fault.reply = []byte("-" + message + "\r\n")
+		}
+		if len(f.Commands) > 0 {
+			fault.commands = make(map[string]bool, len(f.Commands))
+			for _, name := range f.Commands {
+				fault.commands[strings.ToUpper(name)] = true
+			}
+		}
+		c.faults = append(c.faults, fault)
+	}
+	return c
+}
+
+// injectFault rolls for every fault matching a command that passed the
+// other checks. Latency delays the command, an error fault answers it in
+// place of Redis and a drop closes the connection.
+func (p *Proxy) injectFault(s *session, req *request) []byte {
+	if p.chaos == nil {
+		return nil
+	}
+	for _, fault := range p.chaos.faults {
+		if fault.commands != nil && !fault.commands[req.name] {
+			continue
+		}
+		if rand.Float64() >= fault.probability {
+			continue
+		}
+		s.logger.Warn("Chaos fault injected",
+			zap.String("fault", fault.kind),
+			zap.String("command", req.cmd.Name),
+		)
+		switch fault.kind {
+		case "latency":
+			time.Sleep(fault.latency)
+		case "error":
+			return fault.reply
+		case "drop":
+			// The empty reply stops the command being forwarded; the
+			// caller sees the session closed
+			s.close()
+			return []byte{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// captureReader records the bytes read through it so the exact frames
+// consumed by a parser can be checksummed independently of how the parser
+// reconstructs them
+type captureReader struct {
+	reader io.Reader
+	buf    []byte
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	return n, err
+}
+
+// take removes and returns the captured bytes, leaving behind the trailing
+// unread bytes still held in the parser's buffer
+func (c *captureReader) take(unread int) []byte {
+	n := len(c.buf) - unread
+	frame := make([]byte, n)
+	copy(frame, c.buf[:n])
+	c.buf = append(c.buf[:0], c.buf[n:]...)
+	return frame
+}
+
+// frameChecksum is the checksum of a frame as it was read off the wire
+type frameChecksum struct {
+	sum  uint32
+	size int
+}
+
+func checksumOf(frame []byte) frameChecksum {
+	return frameChecksum{sum: crc32.Checksum(frame, castagnoli), size: len(frame)}
+}
+
+// verify compares the bytes about to be written against the checksum taken
+// when the frame was read, logging any mismatch
+func (s *session) verify(direction, command string, read frameChecksum, written []byte) {
+	write := checksumOf(written)
+	if write == read {
+		return
+	}
+	s.proxy.checksumMismatches.Add(1)
+	s.logger.Error("Checksum mismatch",
+		zap.String("direction", direction),
+		zap.String("command", command),
+		zap.Uint32("read_crc", read.sum),
+		zap.Uint32("write_crc", write.sum),
+		zap.Int("read_bytes", read.size),
+		zap.Int("write_bytes", write.size),
+		zap.Uint64("mismatches_total", s.proxy.checksumMismatches.Load()),
+	)
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// clickHouse bulk-inserts a row for every forwarded command into a
+// ClickHouse table over its HTTP interface. Rows are queued and inserted
+// in batches by a single sender, once a batch is full or the flush
+// interval has passed; while ClickHouse is unreachable the queue fills and
+// further rows are dropped.
+type clickHouse struct {
+	*batcher[*sinkRecord]
+	endpoint  string
+	user      string
+	password  string
+	batchSize int
+	attempts  int
+	logger    *zap.Logger
+	client    *http.Client
+	// body holds the rows of the batch being gathered, in JSONEachRow
+	// format
+	body bytes.Buffer
+	rows int
+}
+
+func newClickHouse(logger *zap.Logger, cfg *config.ClickHouseConfig) *clickHouse {
+	if cfg == nil {
+		return nil
+	}
+	// Validated when the config is loaded
+	u, _ := url.Parse(cfg.DSN)
+	c := &clickHouse{
+		batchSize: cfg.BatchSize,
+		attempts:  4,
+		logger:    logger.With(zap.String("clickhouse", u.Host)),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+		u.User = nil
+	}
+	table := cfg.Table
+	if table == "" {
+		table = "redis_commands"
+	}
+	query := u.Query()
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		query.Set("database", db)
+	}
+	query.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+	query.Set("date_time_input_format", "best_effort")
+	// Tables need not have a column for every field
+	query.Set("input_format_skip_unknown_fields", "1")
+	u.Path, u.RawQuery = "/", query.Encode()
+	c.endpoint = u.String()
+
+	if c.batchSize == 0 {
+		c.batchSize = 1000
+	}
+	interval := time.Duration(cfg.FlushIntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = time.Second
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 100000
+	}
+	c.batcher = newBatcher(c.logger, c, queueSize, interval, "ClickHouse queue full, rows dropped")
+	return c
+}
+
+// OnEvent queues the row of a forwarded command once its reply arrives,
+// dropping it when the queue is full
+func (c *clickHouse) OnEvent(e Event) {
+	if re, ok := e.(*ResponseEvent); ok {
+		c.enqueue(responseRecord(re))
+	}
+}
+
+func (c *clickHouse) add(row *sinkRecord) bool {
+	line, err := json.Marshal(row)
+	if err != nil {
+		c.logger.Warn("Failed to encode ClickHouse row", zap.Error(err))
+		return false
+	}
+	c.body.Write(append(line, '\n'))
+	c.rows++
+	return c.rows >= c.batchSize
+}
+
+// send inserts the batch, retrying with exponential backoff after network
+// errors and 5xx responses
+func (c *clickHouse) send(ctx context.Context) {
+	defer func() {
+		c.body.Reset()
+		c.rows = 0
+	}()
+	if c.rows == 0 {
+		return
+	}
+	attempts, err := retry(ctx, c.attempts, 500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		return c.post(ctx, c.body.Bytes())
+	})
+	if err != nil {
+		c.logger.Warn("Failed to insert ClickHouse rows",
+			zap.Int("rows", c.rows),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		return
+	}
+	c.logger.Debug("ClickHouse rows inserted", zap.Int("rows", c.rows), zap.Int("attempts", attempts))
+	c.sent()
+}
+
+// post sends a batch once, reporting whether a failure is worth retrying
+func (c *clickHouse) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// ClickHouse explains the failure in the body
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode >= 500, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return false, nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// upstreamClient issues commands of the proxy's own on a dedicated
+// connection to Redis, reconnecting after any error
+type upstreamClient struct {
+	dial    func() (net.Conn, error)
+	timeout time.Duration
+
+	conn   net.Conn
+	reader *protocol.ReplyReader
+}
+
+func newUpstreamClient(p *Proxy, timeout time.Duration) *upstreamClient {
+	return &upstreamClient{dial: p.dialUpstream, timeout: timeout}
+}
+
+// do sends a command and reads its reply. Error replies are returned as
+// replies; only connection failures are returned as errors.
+func (c *upstreamClient) do(args ...string) (*protocol.Reply, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands in a single write and reads their replies in
+// order, as do does for one
+func (c *upstreamClient) pipeline(cmds [][]string) ([]*protocol.Reply, error) {
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = protocol.NewReplyReader(conn)
+	}
+
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, encodeCommand(args...)...)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		c.close()
+		return nil, err
+	}
+	replies := make([]*protocol.Reply, len(cmds))
+	for i := range replies {
+		reply, err := c.reader.ReadReply()
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (c *upstreamClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
+
+// encodeCommand encodes a command as a RESP array of bulk strings
+func encodeCommand(args ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
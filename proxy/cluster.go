@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// maxRedirects bounds how many MOVED and ASK redirections are followed for
+// a single command
+const maxRedirects = 5
+
+// cluster maintains the slot map of a Redis Cluster so that the proxy can
+// present the whole cluster as a single endpoint
+type cluster struct {
+	proxy  *Proxy
+	logger *zap.Logger
+	seeds  []string
+
+	mu    sync.RWMutex
+	slots [protocol.SlotCount]string
+
+	refreshing atomic.Bool
+}
+
+func newCluster(p *Proxy, cfg *config.ClusterConfig) *cluster {
+	if cfg == nil {
+		return nil
+	}
+	c := &cluster{
+		proxy:  p,
+		logger: p.logger.With(zap.String("component", "cluster")),
+		seeds:  cfg.Seeds,
+	}
+	if len(c.seeds) == 0 {
+		c.seeds = []string{p.config.RedisAddr}
+	}
+	return c
+}
+
+// refresh rebuilds the slot map from CLUSTER SLOTS, asking the known nodes
+// and then the seeds until one answers
+func (c *cluster) refresh() error {
+	var lastErr error
+	for _, addr := range append(c.nodes(), c.seeds...) {
+		slots, err := c.querySlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+
+		nodes := c.nodes()
+		var covered int
+		for _, node := range slots {
+			if node != "" {
+				covered++
+			}
+		}
+		c.logger.Info("Cluster slot map refreshed",
+			zap.String("source", addr),
+			zap.Strings("nodes", nodes),
+			zap.Int("slots_covered", covered),
+		)
+		return nil
+	}
+	return fmt.Errorf("failed to load cluster slot map: %w", lastErr)
+}
+
+func (c *cluster) querySlots(addr string) ([protocol.SlotCount]string, error) {
+	var slots [protocol.SlotCount]string
+	client := &upstreamClient{
+		dial:    func() (net.Conn, error) { return c.proxy.dialAddr(context.Background(), addr, nil) },
+		timeout: 2 * time.Second,
+	}
+	defer client.close()
+
+	reply, err := client.do("CLUSTER", "SLOTS")
+	if err != nil {
+		return slots, err
+	}
+	if reply.IsError() {
+		return slots, fmt.Errorf("CLUSTER SLOTS on %s: %s", addr, reply.Str)
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	for _, entry := range reply.Elems {
+		if len(entry.Elems) < 3 || len(entry.Elems[2].Elems) < 2 {
+			continue
+		}
+		start, err1 := strconv.Atoi(entry.Elems[0].Str)
+		end, err2 := strconv.Atoi(entry.Elems[1].Str)
+		if err1 != nil || err2 != nil || start < 0 || end >= protocol.SlotCount {
+			continue
+		}
+		master := entry.Elems[2].Elems
+		nodeHost := master[0].Str
+		if nodeHost == "" || nodeHost == "?" {
+			// An unknown endpoint means the node is reachable on the same
+			// host the reply came from
+			nodeHost = host
+		}
+		node := net.JoinHostPort(nodeHost, master[1].Str)
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = node
+		}
+	}
+	return slots, nil
+}
+
+// nodes returns the distinct masters in the slot map
+func (c *cluster) nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	nodes := make([]string, 0)
+	for _, node := range c.slots {
+		if node != "" && !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// node returns the master serving a slot
+func (c *cluster) node(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if node := c.slots[slot]; node != "" {
+		return node
+	}
+	return c.seeds[0]
+}
+
+// moved records a slot that has migrated, and refreshes the whole map in
+// the background since a MOVED usually means more than one slot changed
+func (c *cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+	c.refreshAsync()
+}
+
+// refreshAsync refreshes the slot map in the background unless a refresh
+// is already running
+func (c *cluster) refreshAsync() {
+	if c.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer c.refreshing.Store(false)
+			if err := c.refresh(); err != nil {
+				c.logger.Warn("Failed to refresh cluster slot map", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// route returns the slot and node for a command. Commands without keys
+// are sent to the node serving slot 0.
+func (c *cluster) route(cmd *protocol.Command) (slot int, node string, reply []byte) {
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return -1, c.node(0), nil
+	}
+	slot = protocol.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if protocol.KeySlot(key) != slot {
+			return slot, "", []byte("-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+		}
+	}
+	return slot, c.node(slot), nil
+}
+
+// routed reports whether commands are routed to nodes by key, in cluster
+// or sharded mode
+func (p *Proxy) routed() bool {
+	return p.cluster != nil || p.shards != nil
+}
+
+// route returns the slot and node for a command in cluster or sharded mode
+func (p *Proxy) route(cmd *protocol.Command) (slot int, node string, reply []byte) {
+	if p.shards != nil {
+		return p.shards.route(cmd)
+	}
+	return p.cluster.route(cmd)
+}
+
+// clusterUnsupported reports commands that cannot be proxied across nodes
+// by a single connection
+func clusterUnsupported(req *request) bool {
+	switch req.name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE",
+		"MONITOR", "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH", "SELECT":
+		return true
+	case "CLIENT":
+		return len(req.cmd.Args) > 0 && strings.EqualFold(req.cmd.Args[0], "REPLY")
+	}
+	return false
+}
+
+// parseRedirect parses "MOVED <slot> <addr>" and "ASK <slot> <addr>" errors
+func parseRedirect(msg string) (kind string, slot int, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= protocol.SlotCount {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// clusterNode is a session's connection to one cluster node
+type clusterNode struct {
+	conn   net.Conn
+	reader *protocol.ReplyReader
+}
+
+// serveCluster proxies a client connection across the cluster or shards,
+// routing each command to the node that owns its keys
+func (s *session) serveCluster() {
+	defer s.close()
+
+	parser := s.newCommandReader(s.client)
+	for {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			if err != io.EOF && !s.closed() && !s.proxy.isDraining() {
+				s.logger.Error("Failed to read command", zap.Error(err))
+			}
+			return
+		}
+
+		req := &request{cmd: cmd, name: strings.ToUpper(cmd.Name)}
+		s.intercept(req)
+		cmd = req.cmd
+		slot, node, reply := s.proxy.route(cmd)
+		req.shard, req.slot = node, slot
+		s.publishCommand(req)
+
+		if reply == nil {
+			reply = s.check(req)
+			if s.closed() {
+				return
+			}
+			// Namespaced keys may hash to another slot or match another
+			// route than the keys the client sent
+			if reply == nil && req.namespace != "" {
+				slot, node, reply = s.proxy.route(cmd)
+				req.shard, req.slot = node, slot
+			}
+		}
+		if reply == nil {
+			reply = s.proxy.cache.lookup(s, req)
+		}
+		if reply == nil && clusterUnsupported(req) {
+			mode := "cluster"
+			if s.proxy.shards != nil {
+				mode = "sharded"
+			}
+			reply = []byte(fmt.Sprintf("-ERR %s is not supported by the proxy in %s mode\r\n", req.name, mode))
+		}
+		if reply == nil {
+			s.proxy.cache.observe(s, req)
+			req.journal = s.proxy.journal.begin(s, req)
+			start := time.Now()
+			s.inFlight.Add(1)
+			reply = s.clusterDo(req)
+			s.inFlight.Add(-1)
+			s.proxy.slowlog.observe(s, req, time.Since(start))
+			s.proxy.latencies.observe(s, req, time.Since(start))
+			s.publishResponse(req, time.Since(start), reply)
+			s.proxy.bigKeys.checkReply(s, req, len(reply))
+			if req.cacheGens != nil || req.call != nil {
+				if r, err := protocol.NewReplyReader(bytes.NewReader(reply)).ReadReply(); err == nil {
+					s.onResponse(req, r)
+					s.proxy.cache.fill(req, r)
+				}
+			}
+			s.proxy.journal.end(req.journal)
+			s.proxy.mirror.send(req)
+			if req.namespace != "" && keyNamingReplies[req.name] {
+				if r, err := protocol.NewReplyReader(bytes.NewReader(reply)).ReadReply(); err == nil {
+					if stripped := stripNamespace(req, r); stripped != nil {
+						reply = stripped
+					}
+				}
+			}
+		} else {
+			s.logAnswer(req, reply)
+		}
+
+		s.stats.countReply(reply)
+		if _, err := s.client.Write(reply); err != nil {
+			s.logger.Error("Failed to write to client", zap.Error(err))
+			return
+		}
+	}
+}
+
+// clusterDo sends a command to its node, following redirections, and
+// returns the raw reply for the client
+func (s *session) clusterDo(req *request) []byte {
+	addr := req.shard
+	asking := false
+	timeout := s.proxy.timeouts.of(req)
+	for redirects := 0; ; redirects++ {
+		req.sent = time.Now()
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = req.sent.Add(timeout)
+		}
+		reply, err := s.nodeDo(addr, asking, req.cmd.Message, deadline)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// The node connection was dropped, so that the late reply
+				// is discarded with it and the next command redials
+				s.logTimeout(req, timeout, zap.String("shard", addr))
+				return timeoutReply
+			}
+			if isConnClosed(err) {
+				s.logger.Warn("Upstream closed connection",
+					zap.String("shard", addr),
+					zap.String("last_command", req.name),
+				)
+			} else {
+				s.logger.Error("Failed to reach node", zap.String("shard", addr), zap.Error(err))
+			}
+			if s.proxy.cluster != nil {
+				s.proxy.cluster.refreshAsync()
+			}
+			return []byte(fmt.Sprintf("-ERR proxy failed to reach node %s\r\n", addr))
+		}
+
+		// Only a Redis Cluster redirects, so sharded mode replies as is
+		kind, slot, target, ok := parseRedirect(reply.Str)
+		if !reply.IsError() || !ok || redirects >= maxRedirects || s.proxy.cluster == nil {
+			s.proxy.persistence.observe(req)
+			s.handleReply(req, reply)
+			s.logAttributes(req.cmd.Name, reply)
+			if !reply.IsError() && isSessionCommand(req) {
+				s.replayHandshake(addr, req.cmd.Message)
+			}
+			return reply.Message
+		}
+
+		s.logger.Debug("Cluster redirect",
+			zap.String("command", req.cmd.Name),
+			zap.String("redirect", kind),
+			zap.Int("slot", slot),
+			zap.String("from", addr),
+			zap.String("to", target),
+		)
+		if kind == "MOVED" {
+			s.proxy.cluster.moved(slot, target)
+		}
+		asking = kind == "ASK"
+		addr = target
+	}
+}
+
+// nodeDo sends a command on the session's connection to a node, preceded
+// by ASKING when following an ASK redirection, and waits for the reply
+// until deadline if set
+func (s *session) nodeDo(addr string, asking bool, message []byte, deadline time.Time) (*protocol.Reply, error) {
+	node, err := s.clusterNode(addr)
+	if err != nil {
+		return nil, err
+	}
+	node.conn.SetReadDeadline(deadline)
+	if asking {
+		message = append(encodeCommand("ASKING"), message...)
+	}
+	if _, err := node.conn.Write(message); err != nil {
+		s.dropNode(addr)
+		return nil, err
+	}
+	if asking {
+		if _, err := node.reader.ReadReply(); err != nil {
+			s.dropNode(addr)
+			return nil, err
+		}
+	}
+	reply, err := node.reader.ReadReply()
+	if err != nil {
+		s.dropNode(addr)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// clusterNode returns the session's connection to a node, dialing it and
+// replaying the connection handshake on first use
+func (s *session) clusterNode(addr string) (*clusterNode, error) {
+	if node, ok := s.nodes[addr]; ok {
+		return node, nil
+	}
+
+	conn, err := s.proxy.dialAddr(context.Background(), addr, s.proxy.proxyProto.header(s.client))
+	if err != nil {
+		return nil, err
+	}
+	node := &clusterNode{conn: conn, reader: protocol.NewReplyReader(conn)}
+	for _, message := range s.handshake {
+		if _, err := conn.Write(message); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := node.reader.ReadReply(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	s.nodes[addr] = node
+	return node, nil
+}
+
+func (s *session) dropNode(addr string) {
+	if node, ok := s.nodes[addr]; ok {
+		node.conn.Close()
+		delete(s.nodes, addr)
+	}
+}
+
+// isSessionCommand reports commands that change connection state and must
+// therefore be applied to every node the session talks to
+func isSessionCommand(req *request) bool {
+	switch req.name {
+	case "AUTH", "HELLO":
+		return true
+	case "CLIENT":
+		return len(req.cmd.Args) > 0 && strings.EqualFold(req.cmd.Args[0], "SETNAME")
+	}
+	return false
+}
+
+// replayHandshake records a successful session command and applies it to
+// the session's other open node connections
+func (s *session) replayHandshake(done string, message []byte) {
+	s.handshake = append(s.handshake, message)
+	for addr, node := range s.nodes {
+		if addr == done {
+			continue
+		}
+		if _, err := node.conn.Write(message); err != nil {
+			s.dropNode(addr)
+			continue
+		}
+		if _, err := node.reader.ReadReply(); err != nil {
+			s.dropNode(addr)
+		}
+	}
+}
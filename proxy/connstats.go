@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connStats are the counters of one client connection
+type connStats struct {
+	started  time.Time
+	commands atomic.Uint64
+	errors   atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	// lastActive is when the client last sent or received anything, in
+	// Unix nanoseconds
+	lastActive atomic.Int64
+}
+
+// countingConn counts the bytes read from and written to a client
+type countingConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.bytesIn.Add(uint64(n))
+		c.stats.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.stats.bytesOut.Add(uint64(n))
+		c.stats.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// countReply counts an error reply sent to the client, whether from Redis
+// or the proxy
+func (st *connStats) countReply(reply []byte) {
+	if len(reply) > 0 && (reply[0] == '-' || reply[0] == '!') {
+		st.errors.Add(1)
+	}
+}
+
+func (st *connStats) fields() []zap.Field {
+	return []zap.Field{
+		zap.Uint64("commands", st.commands.Load()),
+		zap.Uint64("errors", st.errors.Load()),
+		zap.Uint64("bytes_in", st.bytesIn.Load()),
+		zap.Uint64("bytes_out", st.bytesOut.Load()),
+		zap.Duration("duration", time.Since(st.started)),
+	}
+}
+
+// connectionStatus is a live connection as reported by the admin API
+type connectionStatus struct {
+	ID          uint64    `json:"id"`
+	ClientAddr  string    `json:"client_addr"`
+	Listener    string    `json:"listen_addr"`
+	Identity    string    `json:"client_identity,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	DurationMs  int64     `json:"duration_ms"`
+	Commands    uint64    `json:"commands"`
+	Errors      uint64    `json:"errors"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+}
+
+func (p *Proxy) handleConnections(w http.ResponseWriter, r *http.Request) {
+	sessions := p.activeSessions()
+	slices.SortFunc(sessions, func(a, b *session) int { return int(a.id) - int(b.id) })
+	list := make([]connectionStatus, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, connectionStatus{
+			ID:          s.id,
+			ClientAddr:  s.client.RemoteAddr().String(),
+			Listener:    s.listener,
+			Identity:    s.identity,
+			ConnectedAt: s.stats.started,
+			DurationMs:  time.Since(s.stats.started).Milliseconds(),
+			Commands:    s.stats.commands.Load(),
+			Errors:      s.stats.errors.Load(),
+			BytesIn:     s.stats.bytesIn.Load(),
+			BytesOut:    s.stats.bytesOut.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
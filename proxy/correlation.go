@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newRunID returns a random identifier for the process, which prefixes
+// request IDs so they stay unique across proxies and restarts
+func newRunID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// correlationFields are the fields joining a command's log entry to its
+// reply's, when correlation_ids is enabled
+func (s *session) correlationFields(req *request) []zap.Field {
+	if !s.proxy.config.CorrelationIDs {
+		return nil
+	}
+	return []zap.Field{zap.Uint64("seq", req.seq), zap.String("request_id", req.id)}
+}
+
+// commandLevel is the level a received command and its reply are logged
+// at. Individual scan iterations are summarized once the scan completes,
+// so they are logged at debug level, but commands under legal hold are
+// always logged.
+func (s *session) commandLevel(req *request) zapcore.Level {
+	if s.scans != nil && isScan(req.name) && !req.held {
+		return zapcore.DebugLevel
+	}
+	level := s.proxy.commandLevel
+	if req.held {
+		level = max(level, zapcore.InfoLevel)
+	}
+	return level
+}
+
+// correlationIDs returns the sequence number and request ID sinks carry,
+// which are left out unless correlation_ids is enabled
+func (req *request) correlationIDs() (uint64, string) {
+	if req.id == "" {
+		return 0, ""
+	}
+	return req.seq, req.id
+}
+
+// logReply logs the reply to a logged command when correlation_ids is
+// enabled, with the command's sequence number and request ID. Commands held
+// back by errors_only count as logged once they fail.
+func (s *session) logReply(req *request, reply []byte, replyErr string, fields ...zap.Field) {
+	if !s.proxy.config.CorrelationIDs || !req.logged && (req.failureFields == nil || replyErr == "") {
+		return
+	}
+	fields = append(append(s.correlationFields(req), zap.String("command", req.cmd.Name)), fields...)
+	fields = append(fields, zap.Int("reply_bytes", len(reply)))
+	level := s.commandLevel(req)
+	if replyErr != "" {
+		fields = append(fields, zap.String("error", replyErr))
+		if !req.logged {
+			level = zapcore.WarnLevel
+		}
+	}
+	s.logger.Log(level, "Received reply", fields...)
+}
+
+// logAnswer logs the reply the proxy gave a command itself, such as a
+// rejection or a cached value, as logSink does for replies from Redis
+func (s *session) logAnswer(req *request, reply []byte) {
+	replyErr := replyError(reply)
+	s.logFailure(req, replyErr)
+	s.logReply(req, reply, replyErr, zap.Bool("proxy_reply", true))
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// Description is how the proxy classifies a command and the fields it logs
+// it with, for tools that show the effect of the configured policies
+type Description struct {
+	// Fields are those of the "Received command" log entry
+	Fields map[string]any
+	// Flags are the command's categories, such as read or write
+	Flags []string
+	Keys  []string
+	// Slot is the cluster hash slot of the first key, or -1
+	Slot int
+	// Verdict is "forwarded", or the policy that answers the command
+	// instead of Redis
+	Verdict string
+}
+
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{protocol.FlagReadOnly, "read"},
+	{protocol.FlagWrite, "write"},
+	{protocol.FlagAdmin, "admin"},
+	{protocol.FlagPubSub, "pubsub"},
+	{protocol.FlagBlocking, "blocking"},
+}
+
+// Describe classifies a command as sent by a client authenticated as user,
+// which may be empty. Policies depending on the connection, such as the
+// identity ACLs and approvals, are not evaluated.
+func (p *Proxy) Describe(user string, args []string) *Description {
+	cmd := &protocol.Command{Name: args[0], Args: args[1:], Message: encodeCommand(args...)}
+	name := strings.ToUpper(cmd.Name)
+
+	tenant, service := p.partitions.resolve(nil, cmd)
+	fields := append(commandFields(cmd, p.values), partitionFields(tenant, service)...)
+	if p.config.CommandHash {
+		fields = append(fields, zap.String("command_hash", cmd.Hash()))
+	}
+	if user != "" {
+		fields = append(fields, zap.String("user", user))
+	}
+	if p.legalHold.matches(tenant, cmd) {
+		fields = append(fields, zap.Bool("legal_hold", true))
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+
+	d := &Description{Fields: enc.Fields, Keys: cmd.Keys(), Slot: -1, Verdict: "forwarded"}
+	if spec := protocol.LookupCommand(name); spec != nil {
+		for _, f := range flagNames {
+			if spec.Flags&f.flag != 0 {
+				d.Flags = append(d.Flags, f.name)
+			}
+		}
+	}
+	if len(d.Keys) > 0 {
+		d.Slot = protocol.KeySlot(d.Keys[0])
+	}
+
+	acl := p.userACLs[user]
+	access := "read"
+	if cmd.IsWrite() {
+		access = "write"
+	}
+	mode := p.mode.current.Load().Mode
+	switch {
+	case mode == modeMaintenance && name != "QUIT":
+		d.Verdict = "refused in maintenance mode"
+	case mode == modeReadOnly && cmd.IsWrite():
+		d.Verdict = "refused in read-only mode"
+	case p.blocked[name]:
+		d.Verdict = "blocked by proxy"
+	case acl != nil && !acl.permitsCommand(cmd, name):
+		d.Verdict = "denied by user ACL"
+	case acl != nil:
+		if key, denied := acl.deniedKey(cmd); denied && key == "" {
+			d.Verdict = "unknown keys denied by user ACL"
+		} else if denied {
+			d.Verdict = "key " + key + " denied by user ACL"
+		}
+	}
+	if d.Verdict == "forwarded" && protocol.LookupCommand(name) == nil && p.keyRulesApply(user) {
+		d.Verdict = "unknown keys denied by key rules"
+	}
+	if d.Verdict == "forwarded" {
+		for _, key := range d.Keys {
+			if _, allowed := p.keyAllowed(key, access, user); !allowed {
+				d.Verdict = "key " + key + " denied by key rule"
+				break
+			}
+		}
+	}
+	return d
+}
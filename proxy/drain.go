@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultDrainTimeout bounds a drain unless drain_timeout_seconds is set
+const defaultDrainTimeout = 30 * time.Second
+
+// Drain stops accepting connections and lets the open ones finish the
+// commands they have in flight before closing. Connections still open
+// when the drain timeout passes, or ctx is cancelled, are closed.
+func (p *Proxy) Drain(ctx context.Context) {
+	timeout := defaultDrainTimeout
+	if p.config.DrainTimeoutSeconds > 0 {
+		timeout = time.Duration(p.config.DrainTimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Every listener is closed, as after a socket handoff the new process
+	// serves them
+	p.mu.Lock()
+	p.draining = true
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	p.mu.Unlock()
+
+	p.logger.Info("Draining connections",
+		zap.Int64("connections", p.connLimit.current.Load()),
+		zap.Duration("drain_timeout", timeout),
+	)
+	for _, s := range p.activeSessions() {
+		s.stopReading()
+	}
+
+	// Counted from accept, so connections still being set up are waited
+	// for too
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for p.connLimit.current.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			remaining := p.activeSessions()
+			p.logger.Warn("Drain timed out, closing connections", zap.Int("remaining", len(remaining)))
+			for _, s := range remaining {
+				s.close()
+			}
+			return
+		}
+	}
+	p.logger.Info("Connections drained")
+}
+
+// stopReading ends the session once the commands it has already read are
+// answered. Blocked reads of the client return at once, while commands
+// already buffered are still forwarded.
+func (s *session) stopReading() {
+	s.client.SetReadDeadline(time.Now())
+}
+
+// isDraining reports whether the proxy is draining its connections
+func (p *Proxy) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// dualWrite is the live migration mode: writes are sent to both the
+// primary and the target, over a second connection per session, and
+// answered once both have replied
+type dualWrite struct {
+	addr        string
+	replyTarget bool
+}
+
+func newDualWrite(cfg *config.DualWriteConfig) *dualWrite {
+	if cfg == nil {
+		return nil
+	}
+	return &dualWrite{addr: cfg.TargetAddr, replyTarget: cfg.Reply == "target"}
+}
+
+// targetAddr is the second backend of dual-write and shadow reads, which
+// share one connection per session
+func (p *Proxy) targetAddr() string {
+	switch {
+	case p.dualWrite != nil:
+		return p.dualWrite.addr
+	case p.shadowReads != nil:
+		return p.shadowReads.addr
+	}
+	return ""
+}
+
+// dialTarget connects a session to the target, if there is one
+func (p *Proxy) dialTarget(ctx context.Context) (net.Conn, error) {
+	addr := p.targetAddr()
+	if addr == "" {
+		return nil, nil
+	}
+	return p.dialAddr(ctx, addr, nil)
+}
+
+// dualWritten reports whether a forwarded command also goes to the target.
+// Transactions and the selected database are mirrored with the writes so
+// that both connections stay in the same state.
+func dualWritten(req *request) bool {
+	switch req.name {
+	case "MULTI", "EXEC", "DISCARD", "SELECT", "HELLO":
+		return true
+	}
+	if spec := protocol.LookupCommand(req.name); spec != nil && spec.Flags&protocol.FlagBlocking != 0 {
+		return false
+	}
+	return req.cmd.IsWrite()
+}
+
+// routeTarget decides whether a forwarded command also goes to the target
+func (s *session) routeTarget(req *request, expectsReply bool) {
+	if s.target != nil && expectsReply && s.sendsToTarget(req) {
+		req.target = make(chan *protocol.Reply, 1)
+	}
+}
+
+func (s *session) sendsToTarget(req *request) bool {
+	if s.proxy.dualWrite != nil && dualWritten(req) {
+		return true
+	}
+	// The shadow follows the client's database and protocol
+	if req.name == "SELECT" || req.name == "HELLO" {
+		return true
+	}
+	return s.proxy.shadowReads.compares(s, req)
+}
+
+// writeTarget sends a write to the target after it was sent to the primary
+func (s *session) writeTarget(req *request) bool {
+	select {
+	case s.targetPending <- req:
+	case <-s.done:
+		return false
+	}
+	if _, err := s.target.Write(req.cmd.Message); err != nil {
+		s.logger.Error("Failed to write to target", zap.String("target_addr", s.proxy.targetAddr()), zap.Error(err))
+		s.close()
+		return false
+	}
+	return true
+}
+
+// readTargetReplies hands each reply from the target to the request it
+// answers, in order
+func (s *session) readTargetReplies() {
+	reader := protocol.NewReplyReader(s.target)
+	for {
+		reply, err := reader.ReadReply()
+		if err != nil {
+			if !s.closed() {
+				s.logger.Error("Lost connection to target", zap.String("target_addr", s.proxy.targetAddr()), zap.Error(err))
+				s.close()
+			}
+			return
+		}
+		select {
+		case req := <-s.targetPending:
+			req.target <- reply
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// resolveTarget waits for the target's reply to a command, compares it
+// with the primary's and returns the one for the client: the configured
+// one for dual writes, and the primary's for shadow reads
+func (s *session) resolveTarget(req *request, primary *protocol.Reply) (*protocol.Reply, bool) {
+	var target *protocol.Reply
+	select {
+	case target = <-req.target:
+	case <-s.done:
+		return nil, false
+	}
+
+	dual := s.proxy.dualWrite != nil && dualWritten(req)
+	switch {
+	case req.name == "HELLO":
+		// Server details always differ
+	case dual:
+		s.compareStatus(req, primary, target)
+	default:
+		s.diffShadowRead(req, primary, target)
+	}
+	if dual && s.proxy.dualWrite.replyTarget {
+		return target, true
+	}
+	return primary, true
+}
+
+// compareStatus logs when one backend failed a dual write and the other
+// did not
+func (s *session) compareStatus(req *request, primary, target *protocol.Reply) {
+	if primary.IsError() != target.IsError() {
+		fields := []zap.Field{
+			zap.String("command", req.cmd.Name),
+			zap.String("primary", replyStatus(primary)),
+			zap.String("target", replyStatus(target)),
+		}
+		if keys := req.cmd.Keys(); len(keys) > 0 {
+			fields = append(fields, zap.String("key", keys[0]))
+		}
+		s.logger.Warn("Dual-write replies diverged", fields...)
+	}
+}
+
+// replyStatus is "ok" for a successful reply and the error otherwise
+func replyStatus(r *protocol.Reply) string {
+	if r.IsError() {
+		return r.Str
+	}
+	return "ok"
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// elasticsearch indexes a document for every forwarded command through
+// the bulk API of Elasticsearch or OpenSearch. Documents are queued and
+// indexed in batches by a single sender, once a batch is full or the flush
+// interval has passed. Documents that can't be indexed are appended to the
+// dead-letter file, when set.
+type elasticsearch struct {
+	*batcher[*sinkRecord]
+	url        string
+	username   string
+	password   string
+	apiKey     string
+	index      string
+	batchSize  int
+	attempts   int
+	deadLetter string
+	logger     *zap.Logger
+	client     *http.Client
+	batch      []*esItem
+}
+
+// esDocument is a command as indexed, with its time under the name the
+// Elastic Common Schema gives it
+type esDocument sinkRecord
+
+func (d *esDocument) MarshalJSON() ([]byte, error) {
+	type record sinkRecord
+	return json.Marshal(struct {
+		Timestamp time.Time `json:"@timestamp"`
+		// Time hides the record's own time field
+		Time *struct{} `json:"time,omitempty"`
+		*record
+	}{Timestamp: d.Time, record: (*record)(d)})
+}
+
+// esItem is a document of a batch, encoded as the action and source lines
+// of a bulk request
+type esItem struct {
+	lines []byte
+}
+
+func newElasticsearch(logger *zap.Logger, cfg *config.ElasticsearchConfig) *elasticsearch {
+	if cfg == nil {
+		return nil
+	}
+	es := &elasticsearch{
+		url:        strings.TrimSuffix(cfg.URL, "/") + "/_bulk",
+		username:   cfg.Username,
+		password:   cfg.Password,
+		apiKey:     cfg.APIKey,
+		index:      cfg.Index,
+		batchSize:  cfg.BatchSize,
+		attempts:   cfg.MaxAttempts,
+		deadLetter: cfg.DeadLetterFile,
+		logger:     logger.With(zap.String("elasticsearch", cfg.URL)),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	if es.index == "" {
+		es.index = "redislogger-{date}"
+	}
+	if es.batchSize == 0 {
+		es.batchSize = 500
+	}
+	interval := time.Duration(cfg.FlushIntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = time.Second
+	}
+	if es.attempts == 0 {
+		es.attempts = 4
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 100000
+	}
+	es.batcher = newBatcher(es.logger, es, queueSize, interval, "Elasticsearch queue full, documents dropped")
+	return es
+}
+
+// OnEvent queues the document of a forwarded command once its reply
+// arrives, dropping it when the queue is full
+func (es *elasticsearch) OnEvent(e Event) {
+	if re, ok := e.(*ResponseEvent); ok {
+		es.enqueue(responseRecord(re))
+	}
+}
+
+// indexName renders the index template for a document's date
+func (es *elasticsearch) indexName(at time.Time) string {
+	return strings.NewReplacer(
+		"{date}", at.Format("2006.01.02"),
+		"{month}", at.Format("2006.01"),
+		"{year}", at.Format("2006"),
+	).Replace(es.index)
+}
+
+func (es *elasticsearch) add(doc *sinkRecord) bool {
+	item, err := es.encode(doc)
+	if err != nil {
+		es.logger.Warn("Failed to encode Elasticsearch document", zap.Error(err))
+		return false
+	}
+	es.batch = append(es.batch, item)
+	return len(es.batch) >= es.batchSize
+}
+
+func (es *elasticsearch) encode(doc *sinkRecord) (*esItem, error) {
+	action, err := json.Marshal(map[string]any{"index": map[string]string{"_index": es.indexName(doc.Time)}})
+	if err != nil {
+		return nil, err
+	}
+	source, err := json.Marshal((*esDocument)(doc))
+	if err != nil {
+		return nil, err
+	}
+	lines := append(append(append(action, '\n'), source...), '\n')
+	return &esItem{lines: lines}, nil
+}
+
+// send indexes the batch, retrying with exponential backoff the whole
+// request after network errors, 429s and 5xx responses, and the documents
+// rejected with a 429 or 5xx status of their own. Documents rejected
+// otherwise, or still failing after the last attempt, are dead-lettered.
+func (es *elasticsearch) send(ctx context.Context) {
+	batch := es.batch
+	es.batch = nil
+	if len(batch) == 0 {
+		return
+	}
+	pending := batch
+	attempts, err := retry(ctx, es.attempts, 500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		retryable, rejected, again, err := es.post(ctx, pending)
+		if err != nil {
+			return again, err
+		}
+		if len(rejected) > 0 {
+			es.logger.Warn("Elasticsearch documents rejected",
+				zap.Int("documents", len(rejected)),
+				zap.String("error", rejected[0].reason),
+			)
+			es.deadLetterItems(rejectedItems(rejected))
+		}
+		if len(retryable) > 0 {
+			pending = retryable
+			return true, errors.New("throttled or unavailable")
+		}
+		return false, nil
+	})
+	if err != nil {
+		es.logger.Warn("Failed to index Elasticsearch documents",
+			zap.Int("documents", len(pending)),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		es.deadLetterItems(pending)
+		return
+	}
+	es.logger.Debug("Elasticsearch documents indexed", zap.Int("documents", len(batch)), zap.Int("attempts", attempts))
+	es.sent()
+}
+
+// esRejection is a document the cluster refused to index
+type esRejection struct {
+	item   *esItem
+	reason string
+}
+
+func rejectedItems(rejected []esRejection) []*esItem {
+	items := make([]*esItem, len(rejected))
+	for i, r := range rejected {
+		items[i] = r.item
+	}
+	return items
+}
+
+// esBulkResponse is the part of a bulk response telling which documents
+// failed
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// post sends a bulk request once. When it succeeds, it returns the
+// documents worth retrying and those rejected for good; when it fails, it
+// reports whether the failure is worth retrying.
+func (es *elasticsearch) post(ctx context.Context, items []*esItem) ([]*esItem, []esRejection, bool, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.lines)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, es.url, &body)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case es.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+es.apiKey)
+	case es.username != "":
+		req.SetBasicAuth(es.username, es.password)
+	}
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, nil, retry, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, true, fmt.Errorf("invalid bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil, nil, false, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, nil, true, fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(items))
+	}
+	var retryable []*esItem
+	var rejected []esRejection
+	for i, outcome := range result.Items {
+		for _, r := range outcome {
+			switch {
+			case r.Error == nil:
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retryable = append(retryable, items[i])
+			default:
+				rejected = append(rejected, esRejection{item: items[i], reason: r.Error.Type + ": " + r.Error.Reason})
+			}
+		}
+	}
+	return retryable, rejected, false, nil
+}
+
+// deadLetterItems appends documents to the dead-letter file as a bulk
+// request body
+func (es *elasticsearch) deadLetterItems(items []*esItem) {
+	if es.deadLetter == "" || len(items) == 0 {
+		return
+	}
+	f, err := os.OpenFile(es.deadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		es.logger.Error("Failed to open Elasticsearch dead-letter file", zap.Error(err))
+		return
+	}
+	defer f.Close()
+	for _, item := range items {
+		if _, err := f.Write(item.lines); err != nil {
+			es.logger.Error("Failed to write Elasticsearch dead-letter file", zap.Error(err))
+			return
+		}
+	}
+	es.logger.Info("Elasticsearch documents dead-lettered", zap.Int("documents", len(items)), zap.String("file", es.deadLetter))
+}
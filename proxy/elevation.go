@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxElevation bounds how long an operator may grant elevated access for
+const maxElevation = 24 * time.Hour
+
+// elevations are temporary grants letting a client identity run commands
+// its ACL denies
+type elevations struct {
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	grants map[string]*elevation
+}
+
+// elevation is one time-boxed grant
+type elevation struct {
+	ID        string    `json:"id"`
+	Identity  string    `json:"identity"`
+	Commands  []string  `json:"commands"`
+	Operator  string    `json:"operator"`
+	Reason    string    `json:"reason,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	timer *time.Timer
+}
+
+func newElevations(logger *zap.Logger) *elevations {
+	return &elevations{
+		logger: logger.With(zap.String("component", "elevated_access")),
+		grants: make(map[string]*elevation),
+	}
+}
+
+// grant gives an identity temporary access to commands, revoking it
+// automatically at expiry
+func (e *elevations) grant(g *elevation) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.grants[g.ID] = g
+	g.timer = time.AfterFunc(time.Until(g.ExpiresAt), func() {
+		if e.remove(g.ID) != nil {
+			e.logger.Warn("Elevated access expired", g.fields()...)
+		}
+	})
+	e.logger.Warn("Elevated access granted", g.fields()...)
+}
+
+// revoke ends a grant early, reporting whether it was still active
+func (e *elevations) revoke(id, operator string) bool {
+	g := e.remove(id)
+	if g == nil {
+		return false
+	}
+	g.timer.Stop()
+	e.logger.Warn("Elevated access revoked", append(g.fields(), zap.String("revoked_by", operator))...)
+	return true
+}
+
+func (e *elevations) remove(id string) *elevation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	g, ok := e.grants[id]
+	if !ok {
+		return nil
+	}
+	delete(e.grants, id)
+	return g
+}
+
+// find returns an active grant allowing an identity to run a command
+func (e *elevations) find(identity, name string) *elevation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	for _, g := range e.grants {
+		if g.Identity != identity || now.After(g.ExpiresAt) {
+			continue
+		}
+		for _, command := range g.Commands {
+			if command == name {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+func (e *elevations) list() []*elevation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]*elevation, 0, len(e.grants))
+	for _, g := range e.grants {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].GrantedAt.Before(list[j].GrantedAt) })
+	return list
+}
+
+func (g *elevation) fields() []zap.Field {
+	return []zap.Field{
+		zap.String("elevation_id", g.ID),
+		zap.String("identity", g.Identity),
+		zap.Strings("commands", g.Commands),
+		zap.String("operator", g.Operator),
+		zap.String("reason", g.Reason),
+		zap.Time("expires_at", g.ExpiresAt),
+	}
+}
+
+func (e *elevations) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.list())
+}
+
+func (e *elevations) handleGrant(w http.ResponseWriter, r *http.Request) {
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Identity        string   `json:"identity"`
+		Commands        []string `json:"commands"`
+		DurationSeconds int      `json:"duration_seconds"`
+		Reason          string   `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	duration := time.Duration(body.DurationSeconds) * time.Second
+	if body.Identity == "" || len(body.Commands) == 0 || duration <= 0 || duration > maxElevation {
+		http.Error(w, "identity, commands and a duration of up to 24 hours are required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	g := &elevation{
+		ID:        randomID(),
+		Identity:  body.Identity,
+		Operator:  operator,
+		Reason:    body.Reason,
+		GrantedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	for _, command := range body.Commands {
+		g.Commands = append(g.Commands, strings.ToUpper(command))
+	}
+	e.grant(g)
+	writeJSON(w, http.StatusCreated, g)
+}
+
+func (e *elevations) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+		return
+	}
+	if !e.revoke(r.PathValue("id"), operator) {
+		http.Error(w, "no active elevation with that id", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/glob"
+)
+
+// defaultEventBuffer bounds the events queued for a subscriber unless
+// configured otherwise
+const defaultEventBuffer = 1024
+
+// eventHub fans out an event for every command forwarded to Redis to the
+// subscribers of the event streams. Publishing never blocks: a subscriber
+// too slow to keep up misses the events its buffer has no room for.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*eventSubscriber]struct{}
+	// active is the subscriber count, checked before building an event
+	active atomic.Int64
+}
+
+// commandEvent is a forwarded command once its reply arrived
+type commandEvent struct {
+	Time         time.Time     `json:"time"`
+	ConnectionID uint64        `json:"connection_id"`
+	ClientAddr   string        `json:"client_addr"`
+	Identity     string        `json:"client_identity,omitempty"`
+	User         string        `json:"user,omitempty"`
+	Listener     string        `json:"listener"`
+	Command      string        `json:"command"`
+	Keys         []string      `json:"keys,omitempty"`
+	DB           int64         `json:"db"`
+	Shard        string        `json:"shard,omitempty"`
+	Latency      time.Duration `json:"-"`
+	ReplyBytes   int           `json:"reply_bytes"`
+	Error        string        `json:"error,omitempty"`
+	Seq          uint64        `json:"seq,omitempty"`
+	RequestID    string        `json:"request_id,omitempty"`
+}
+
+// MarshalJSON adds the latency in milliseconds
+func (e *commandEvent) MarshalJSON() ([]byte, error) {
+	type event commandEvent
+	return json.Marshal(struct {
+		*event
+		LatencyMs float64 `json:"latency_ms"`
+	}{(*event)(e), float64(e.Latency) / float64(time.Millisecond)})
+}
+
+// eventFilter selects the events a subscriber receives: those of the
+// given commands, and with a key matching one of the key patterns, where
+// either is set
+type eventFilter struct {
+	commands map[string]bool
+	keys     []string
+}
+
+type eventSubscriber struct {
+	filter  eventFilter
+	events  chan *commandEvent
+	dropped atomic.Uint64
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*eventSubscriber]struct{})}
+}
+
+func newEventFilter(commands, keys []string) eventFilter {
+	f := eventFilter{keys: keys}
+	if len(commands) > 0 {
+		f.commands = make(map[string]bool, len(commands))
+		for _, name := range commands {
+			f.commands[strings.ToUpper(name)] = true
+		}
+	}
+	return f
+}
+
+func (f eventFilter) matches(e *commandEvent) bool {
+	if f.commands != nil && !f.commands[e.Command] {
+		return false
+	}
+	if len(f.keys) == 0 {
+		return true
+	}
+	for _, key := range e.Keys {
+		for _, pattern := range f.keys {
+			if glob.Match(pattern, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscribe adds a subscriber buffering up to bufferSize events, or the
+// default when 0. It must be passed to unsubscribe once done.
+func (h *eventHub) subscribe(filter eventFilter, bufferSize int) *eventSubscriber {
+	if bufferSize == 0 {
+		bufferSize = defaultEventBuffer
+	}
+	sub := &eventSubscriber{filter: filter, events: make(chan *commandEvent, bufferSize)}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	h.active.Add(1)
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+	h.active.Add(-1)
+}
+
+// OnEvent sends the event of a forwarded command's reply to the
+// subscribers matching it
+func (h *eventHub) OnEvent(ev Event) {
+	re, ok := ev.(*ResponseEvent)
+	if !ok || h.active.Load() == 0 {
+		return
+	}
+	e := &commandEvent{
+		Time:         re.Time,
+		ConnectionID: re.Conn.ID,
+		ClientAddr:   re.Conn.ClientAddr,
+		Identity:     re.Conn.Identity,
+		User:         re.User,
+		Listener:     re.Conn.Listener,
+		Command:      re.req.name,
+		Keys:         re.Command.Keys(),
+		DB:           re.DB,
+		Shard:        re.Shard,
+		Latency:      re.Latency,
+		ReplyBytes:   len(re.Reply),
+		Error:        re.Error,
+	}
+	e.Seq, e.RequestID = re.req.correlationIDs()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
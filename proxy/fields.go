@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// commandFields builds the structured log fields for a parsed command,
+// logging the values it carries as the value policy decides
+func commandFields(cmd *protocol.Command, policy *valuePolicy) []zap.Field {
+	v := policy.forCommand(cmd)
+	if v != nil {
+		cmd = v.cmd
+	}
+	fields := []zap.Field{
+		zap.String("command", cmd.Name),
+	}
+
+	// Add command-specific fields
+	if len(cmd.Args) > 0 {
+		switch strings.ToUpper(cmd.Name) {
+		case "SET":
+			if len(cmd.Args) >= 2 {
+				fields = append(fields, zap.String("key", cmd.Args[0]))
+				fields = append(fields, v.value("value", cmd.Args[0], cmd.Args[1])...)
+				// Add SET options if present
+				if len(cmd.Args) > 2 {
+					options := make([]string, 0)
+					for i := 2; i < len(cmd.Args); i++ {
+						opt := strings.ToUpper(cmd.Args[i])
+						switch opt {
+						case "EX", "PX", "EXAT", "PXAT":
+							if i+1 < len(cmd.Args) {
+								options = append(options, fmt.Sprintf("%s=%s", opt, cmd.Args[i+1]))
+								i++ // Skip the next argument as it's the value for this option
+							}
+						case "NX", "XX", "KEEPTTL":
+							options = append(options, opt)
+						}
+					}
+					if len(options) > 0 {
+						fields = append(fields, zap.Strings("options", options))
+					}
+				}
+			}
+		case "GET", "MGET":
+			fields = append(fields, zap.Strings("keys", cmd.Args))
+		case "DEL", "EXISTS", "EXPIRE", "TTL", "PTTL", "PERSIST", "TYPE":
+			fields = append(fields, zap.String("key", cmd.Args[0]))
+		case "INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT":
+			if len(cmd.Args) >= 2 {
+				fields = append(fields,
+					zap.String("key", cmd.Args[0]),
+					zap.String("amount", cmd.Args[1]),
+				)
+			}
+		case "HSET", "HGET", "HDEL", "HEXISTS", "HINCRBY", "HINCRBYFLOAT":
+			if len(cmd.Args) >= 2 {
+				fields = append(fields,
+					zap.String("key", cmd.Args[0]),
+					zap.String("field", cmd.Args[1]),
+				)
+				if len(cmd.Args) > 2 {
+					fields = append(fields, v.fieldValue("value", cmd.Args[0], cmd.Args[1], cmd.Args[2])...)
+				}
+			}
+		case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
+			if len(cmd.Args) >= 2 {
+				fields = append(fields, zap.String("key", cmd.Args[0]))
+				fields = append(fields, v.values("values", "value", cmd.Args[0], cmd.Args[1:])...)
+			}
+		case "SADD", "SREM", "SISMEMBER", "SCARD", "SPOP", "SRANDMEMBER":
+			if len(cmd.Args) >= 1 {
+				fields = append(fields, zap.String("key", cmd.Args[0]))
+				if len(cmd.Args) > 1 {
+					if cmd.Name == "SPOP" || cmd.Name == "SRANDMEMBER" {
+						fields = append(fields, zap.String("count", cmd.Args[1]))
+					} else {
+						fields = append(fields, v.values("members", "member", cmd.Args[0], cmd.Args[1:])...)
+					}
+				}
+			}
+		case "ZADD":
+			if len(cmd.Args) >= 3 {
+				fields = append(fields, zap.String("key", cmd.Args[0]))
+				fields = append(fields, v.pairs("score_member_pairs", "member", cmd.Args[0], cmd.Args[1:])...)
+			}
+		case "FT.SEARCH", "FT.AGGREGATE":
+			fields = append(fields, searchFields(cmd.Args, v)...)
+		case "FT.CREATE":
+			fields = append(fields, indexFields(cmd.Args)...)
+		case "GEOADD":
+			fields = append(fields, geoAddFields(cmd.Args, v)...)
+		case "GEOSEARCH", "GEOSEARCHSTORE":
+			fields = append(fields, geoSearchFields(strings.ToUpper(cmd.Name), cmd.Args, v)...)
+		case "GEODIST":
+			if len(cmd.Args) >= 3 {
+				fields = append(fields, zap.String("key", cmd.Args[0]))
+				fields = append(fields, v.values("members", "member", cmd.Args[0], cmd.Args[1:3])...)
+				if len(cmd.Args) > 3 {
+					fields = append(fields, zap.String("unit", cmd.Args[3]))
+				}
+			}
+		case "GEOPOS", "GEOHASH":
+			fields = append(fields, zap.String("key", cmd.Args[0]))
+			fields = append(fields, v.values("members", "member", cmd.Args[0], cmd.Args[1:])...)
+		case "SETBIT", "GETBIT":
+			fields = append(fields, zap.String("key", cmd.Args[0]))
+			if len(cmd.Args) > 1 {
+				fields = append(fields, zap.String("offset", cmd.Args[1]))
+			}
+			if len(cmd.Args) > 2 {
+				fields = append(fields, zap.String("bit", cmd.Args[2]))
+			}
+		case "BITCOUNT", "BITPOS":
+			fields = append(fields, bitRangeFields(strings.ToUpper(cmd.Name), cmd.Args)...)
+		case "BITFIELD", "BITFIELD_RO":
+			fields = append(fields,
+				zap.String("key", cmd.Args[0]),
+				zap.Strings("operations", bitfieldOperations(cmd.Args[1:])),
+			)
+		case "BITOP":
+			if len(cmd.Args) >= 3 {
+				fields = append(fields,
+					zap.String("operation", strings.ToUpper(cmd.Args[0])),
+					zap.String("destination", cmd.Args[1]),
+					zap.Strings("keys", cmd.Args[2:]),
+				)
+			}
+		case "PFADD":
+			fields = append(fields,
+				zap.String("key", cmd.Args[0]),
+				zap.Int("member_count", len(cmd.Args)-1),
+			)
+		case "PFCOUNT":
+			fields = append(fields, zap.Strings("keys", cmd.Args))
+		case "PFMERGE":
+			fields = append(fields,
+				zap.String("destination", cmd.Args[0]),
+				zap.Strings("sources", cmd.Args[1:]),
+			)
+		case "FCALL", "FCALL_RO":
+			fields = append(fields, fcallFields(cmd)...)
+		case "FUNCTION":
+			fields = append(fields, functionFields(cmd.Args)...)
+		default:
+			fields = append(fields, v.argFields(cmd)...)
+		}
+	}
+
+	return fields
+}
+
+// searchFields extracts the index, query and paging options of FT.SEARCH
+// and FT.AGGREGATE. The query is redacted along with the values of keys.
+func searchFields(args []string, v *commandValues) []zap.Field {
+	fields := []zap.Field{zap.String("index", args[0])}
+	if len(args) < 2 {
+		return fields
+	}
+	fields = append(fields, v.value("query", "", args[1])...)
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LIMIT":
+			if i+2 < len(args) {
+				fields = append(fields,
+					zap.String("limit_offset", args[i+1]),
+					zap.String("limit_num", args[i+2]),
+				)
+				i += 2
+			}
+		case "SORTBY":
+			if i+1 < len(args) {
+				fields = append(fields, zap.String("sortby", args[i+1]))
+				i++
+			}
+		case "DIALECT":
+			if i+1 < len(args) {
+				fields = append(fields, zap.String("dialect", args[i+1]))
+				i++
+			}
+		}
+	}
+	return fields
+}
+
+// indexFields extracts the index name, target type, key prefixes and schema
+// field names of FT.CREATE
+func indexFields(args []string) []zap.Field {
+	fields := []zap.Field{zap.String("index", args[0])}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ON":
+			if i+1 < len(args) {
+				fields = append(fields, zap.String("on", strings.ToUpper(args[i+1])))
+				i++
+			}
+		case "PREFIX":
+			if i+1 < len(args) {
+				var count int
+				fmt.Sscanf(args[i+1], "%d", &count)
+				end := i + 2 + count
+				if count < 0 || end > len(args) {
+					end = len(args)
+				}
+				fields = append(fields, zap.Strings("prefixes", args[i+2:end]))
+				i = end - 1
+			}
+		case "SCHEMA":
+			// Schema entries are "name [AS alias] type [options...]", so
+			// field names are found by looking back from each type keyword
+			schema := make([]string, 0)
+			for j := i + 2; j < len(args); j++ {
+				switch strings.ToUpper(args[j]) {
+				case "TEXT", "TAG", "NUMERIC", "GEO", "VECTOR", "GEOSHAPE":
+					if j-3 > i && strings.ToUpper(args[j-2]) == "AS" {
+						schema = append(schema, args[j-3])
+					} else {
+						schema = append(schema, args[j-1])
+					}
+				}
+			}
+			fields = append(fields, zap.Strings("schema_fields", schema))
+			return fields
+		}
+	}
+	return fields
+}
+
+// geoAddFields extracts the key, options and longitude/latitude/member
+// triples of GEOADD
+func geoAddFields(args []string, v *commandValues) []zap.Field {
+	fields := []zap.Field{zap.String("key", args[0])}
+
+	i := 1
+	options := make([]string, 0)
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt != "NX" && opt != "XX" && opt != "CH" {
+			break
+		}
+		options = append(options, opt)
+	}
+	if len(options) > 0 {
+		fields = append(fields, zap.Strings("options", options))
+	}
+
+	members := make([]string, 0)
+	coordinates := make([]string, 0)
+	for ; i+2 < len(args); i += 3 {
+		coordinates = append(coordinates, fmt.Sprintf("%s,%s", args[i], args[i+1]))
+		members = append(members, args[i+2])
+	}
+	fields = append(fields, v.values("members", "member", args[0], members)...)
+	if v.redacts(args[0], "") {
+		return fields
+	}
+	return append(fields, zap.Strings("coordinates", coordinates))
+}
+
+// geoSearchFields extracts the key, search origin and radius/box shape of
+// GEOSEARCH and GEOSEARCHSTORE
+func geoSearchFields(name string, args []string, v *commandValues) []zap.Field {
+	fields := make([]zap.Field, 0)
+	if name == "GEOSEARCHSTORE" {
+		if len(args) < 2 {
+			return fields
+		}
+		fields = append(fields, zap.String("destination", args[0]))
+		args = args[1:]
+	}
+	fields = append(fields, zap.String("key", args[0]))
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "FROMMEMBER":
+			if i+1 < len(args) {
+				fields = append(fields, v.value("from_member", args[0], args[i+1])...)
+				i++
+			}
+		case "FROMLONLAT":
+			if i+2 < len(args) {
+				fields = append(fields, v.value("from_coordinates", args[0], fmt.Sprintf("%s,%s", args[i+1], args[i+2]))...)
+				i += 2
+			}
+		case "BYRADIUS":
+			if i+2 < len(args) {
+				fields = append(fields,
+					zap.String("radius", args[i+1]),
+					zap.String("unit", args[i+2]),
+				)
+				i += 2
+			}
+		case "BYBOX":
+			if i+3 < len(args) {
+				fields = append(fields,
+					zap.String("box_width", args[i+1]),
+					zap.String("box_height", args[i+2]),
+					zap.String("unit", args[i+3]),
+				)
+				i += 3
+			}
+		case "COUNT":
+			if i+1 < len(args) {
+				fields = append(fields, zap.String("count", args[i+1]))
+				i++
+			}
+		}
+	}
+	return fields
+}
+
+// bitRangeFields extracts the key and optional range of BITCOUNT and BITPOS
+func bitRangeFields(name string, args []string) []zap.Field {
+	fields := []zap.Field{zap.String("key", args[0])}
+
+	rest := args[1:]
+	if name == "BITPOS" && len(rest) > 0 {
+		fields = append(fields, zap.String("bit", rest[0]))
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		fields = append(fields, zap.String("start", rest[0]))
+	}
+	if len(rest) > 1 {
+		fields = append(fields, zap.String("end", rest[1]))
+	}
+	if len(rest) > 2 {
+		fields = append(fields, zap.String("unit", strings.ToUpper(rest[2])))
+	}
+	return fields
+}
+
+// bitfieldOperations renders each BITFIELD subcommand as a single string,
+// such as "SET u8 #0 255"
+func bitfieldOperations(args []string) []string {
+	operations := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		op := strings.ToUpper(args[i])
+		arity := 0
+		switch op {
+		case "GET":
+			arity = 2
+		case "SET", "INCRBY":
+			arity = 3
+		case "OVERFLOW":
+			arity = 1
+		}
+		if arity == 0 || i+arity >= len(args) {
+			operations = append(operations, args[i])
+			continue
+		}
+		operations = append(operations, op+" "+strings.Join(args[i+1:i+1+arity], " "))
+		i += arity
+	}
+	return operations
+}
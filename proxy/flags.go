@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// Feature flags. buffered_parser switches connections still on the legacy
+// parser to the buffered parser, and cache and multiplex limit the
+// response cache and multiplexing to the connections they are enabled for.
+const (
+	flagBufferedParser = "buffered_parser"
+	flagCache          = "cache"
+	flagMultiplex      = "multiplex"
+)
+
+// flagDefaultPercent is the share of connections a flag is enabled for
+// when it isn't configured. Subsystems that are configured apply to every
+// connection unless their flag limits them.
+var flagDefaultPercent = map[string]float64{
+	flagCache:     100,
+	flagMultiplex: 100,
+}
+
+// featureFlags decide per connection which risky subsystems it uses. A
+// connection keeps the flags it was given for its lifetime, so changes only
+// affect new connections.
+type featureFlags struct {
+	logger *zap.Logger
+	// names are the flags of the subsystems configured, in the order of
+	// config.FeatureFlagNames
+	names []string
+	flags map[string]*featureFlag
+}
+
+// featureFlag is the rollout state and metrics of one flag
+type featureFlag struct {
+	mu      sync.Mutex
+	percent float64
+	clients []string
+
+	evaluated atomic.Uint64
+	enabled   atomic.Uint64
+	active    atomic.Int64
+	// activeDisabled counts the active connections the flag is off for
+	activeDisabled atomic.Int64
+}
+
+// flagStatus is a flag as reported by the admin API
+type flagStatus struct {
+	Name      string   `json:"name"`
+	Percent   float64  `json:"percent"`
+	Clients   []string `json:"clients"`
+	Evaluated uint64   `json:"connections_evaluated"`
+	Enabled   uint64   `json:"connections_enabled"`
+	Disabled  uint64   `json:"connections_disabled"`
+	Active    int64    `json:"active_connections"`
+	// ActiveDisabled are the active connections not using the flag
+	ActiveDisabled int64 `json:"active_connections_disabled"`
+}
+
+func newFeatureFlags(logger *zap.Logger, cfg *config.Config) *featureFlags {
+	f := &featureFlags{
+		logger: logger.With(zap.String("component", "feature_flags")),
+		flags:  make(map[string]*featureFlag, len(config.FeatureFlagNames)),
+	}
+	for _, name := range config.FeatureFlagNames {
+		if name == flagCache && cfg.Cache == nil || name == flagMultiplex && cfg.Multiplex == nil {
+			continue
+		}
+		flag := &featureFlag{percent: flagDefaultPercent[name]}
+		if c, ok := cfg.FeatureFlags[name]; ok {
+			flag.percent, flag.clients = c.Percent, c.Clients
+		}
+		f.names = append(f.names, name)
+		f.flags[name] = flag
+	}
+	return f
+}
+
+// evaluate returns the flags enabled for a new connection, which must be
+// passed to release when it closes
+func (f *featureFlags) evaluate(ip net.IP, identity string) []string {
+	var clientIP string
+	if ip != nil {
+		clientIP = ip.String()
+	}
+	var enabled []string
+	for _, name := range f.names {
+		flag := f.flags[name]
+		flag.mu.Lock()
+		on := (clientIP != "" && slices.Contains(flag.clients, clientIP)) ||
+			(identity != "" && slices.Contains(flag.clients, identity)) ||
+			rand.Float64()*100 < flag.percent
+		flag.mu.Unlock()
+
+		flag.evaluated.Add(1)
+		if on {
+			flag.enabled.Add(1)
+			flag.active.Add(1)
+			enabled = append(enabled, name)
+		} else {
+			flag.activeDisabled.Add(1)
+		}
+	}
+	return enabled
+}
+
+func (f *featureFlags) release(enabled []string) {
+	for _, name := range f.names {
+		if slices.Contains(enabled, name) {
+			f.flags[name].active.Add(-1)
+		} else {
+			f.flags[name].activeDisabled.Add(-1)
+		}
+	}
+}
+
+func (f *featureFlags) status() []flagStatus {
+	list := make([]flagStatus, 0, len(f.flags))
+	for _, name := range f.names {
+		flag := f.flags[name]
+		flag.mu.Lock()
+		evaluated, enabled := flag.evaluated.Load(), flag.enabled.Load()
+		list = append(list, flagStatus{
+			Name:           name,
+			Percent:        flag.percent,
+			Clients:        slices.Clone(flag.clients),
+			Evaluated:      evaluated,
+			Enabled:        enabled,
+			Disabled:       evaluated - enabled,
+			Active:         flag.active.Load(),
+			ActiveDisabled: flag.activeDisabled.Load(),
+		})
+		flag.mu.Unlock()
+	}
+	return list
+}
+
+// enabled reports whether a feature flag is on for the session
+func (s *session) enabled(name string) bool {
+	return slices.Contains(s.flags, name)
+}
+
+func (f *featureFlags) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, f.status())
+}
+
+func (f *featureFlags) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+		return
+	}
+	flag, ok := f.flags[r.PathValue("name")]
+	if !ok {
+		http.Error(w, "unknown feature flag", http.StatusNotFound)
+		return
+	}
+
+	var body config.FeatureFlag
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Percent < 0 || body.Percent > 100 {
+		http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	flag.mu.Lock()
+	flag.percent, flag.clients = body.Percent, body.Clients
+	flag.mu.Unlock()
+	f.logger.Warn("Feature flag updated",
+		zap.String("flag", r.PathValue("name")),
+		zap.Float64("percent", body.Percent),
+		zap.Strings("clients", body.Clients),
+		zap.String("operator", operator),
+	)
+	for _, status := range f.status() {
+		if status.Name == r.PathValue("name") {
+			writeJSON(w, http.StatusOK, status)
+		}
+	}
+}
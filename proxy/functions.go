@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/glob"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// registerFunction matches both forms of redis.register_function in a
+// library's source
+var registerFunction = regexp.MustCompile(`redis\.register_function\s*(?:\(\s*|\{[^}]*?function_name\s*=\s*)['"]([^'"]+)['"]`)
+
+// functionLibrary describes a Redis 7 function library loaded through the
+// proxy or reported by FUNCTION LIST
+type functionLibrary struct {
+	name      string
+	engine    string
+	codeHash  string
+	functions []string
+	loadedBy  string
+	loadedAt  time.Time
+}
+
+// functionInventory tracks the function libraries loaded in Redis
+type functionInventory struct {
+	mu        sync.Mutex
+	libraries map[string]*functionLibrary
+}
+
+func newFunctionInventory() *functionInventory {
+	return &functionInventory{libraries: make(map[string]*functionLibrary)}
+}
+
+// track updates the inventory from the reply to a FUNCTION command
+func (f *functionInventory) track(s *session, req *request, reply *protocol.Reply) {
+	if len(req.cmd.Args) == 0 || reply.IsError() {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(req.cmd.Args[0]) {
+	case "LOAD":
+		code := req.cmd.Args[len(req.cmd.Args)-1]
+		lib := parseLibrary(code)
+		lib.name = reply.Str
+		lib.loadedBy = s.client.RemoteAddr().String()
+		if s.identity != "" {
+			lib.loadedBy = s.identity
+		}
+		lib.loadedAt = time.Now()
+
+		_, replaced := f.libraries[lib.name]
+		f.libraries[lib.name] = lib
+		s.logger.Info("Function library loaded",
+			zap.String("library", lib.name),
+			zap.String("engine", lib.engine),
+			zap.String("code_hash", lib.codeHash),
+			zap.Strings("functions", lib.functions),
+			zap.String("loaded_by", lib.loadedBy),
+			zap.Bool("replaced", replaced),
+		)
+	case "DELETE":
+		if len(req.cmd.Args) < 2 {
+			return
+		}
+		name := req.cmd.Args[1]
+		delete(f.libraries, name)
+		s.logger.Info("Function library deleted", zap.String("library", name))
+	case "FLUSH":
+		s.logger.Info("Function libraries flushed", zap.Int("libraries", len(f.libraries)))
+		f.libraries = make(map[string]*functionLibrary)
+	case "RESTORE":
+		// The payload is opaque, so the inventory is rebuilt by the next
+		// FUNCTION LIST
+		s.logger.Info("Function libraries restored")
+	case "LIST":
+		// LIBRARYNAME limits the listing to the libraries matching a
+		// pattern, which are the only ones it can tell were deleted
+		pattern := "*"
+		for i := 1; i+1 < len(req.cmd.Args); i++ {
+			if strings.EqualFold(req.cmd.Args[i], "LIBRARYNAME") {
+				pattern = req.cmd.Args[i+1]
+				break
+			}
+		}
+		f.reconcile(s.logger, reply, pattern)
+	}
+}
+
+// reconcile replaces the libraries of the inventory whose names match
+// pattern with those reported by FUNCTION LIST, keeping what the proxy
+// knows about who loaded each of them
+func (f *functionInventory) reconcile(logger *zap.Logger, reply *protocol.Reply, pattern string) {
+	listed := make(map[string]*functionLibrary, len(reply.Elems))
+	for name, lib := range f.libraries {
+		if !glob.Match(pattern, name) {
+			listed[name] = lib
+		}
+	}
+	for _, entry := range reply.Elems {
+		lib := &functionLibrary{}
+		fields := entry.Elems
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i].Str {
+			case "library_name":
+				lib.name = fields[i+1].Str
+			case "engine":
+				lib.engine = fields[i+1].Str
+			case "functions":
+				lib.functions = functionNames(fields[i+1])
+			case "library_code":
+				lib.codeHash = codeHash(fields[i+1].Str)
+			}
+		}
+		if lib.name == "" {
+			continue
+		}
+		if known, ok := f.libraries[lib.name]; ok {
+			lib.loadedBy, lib.loadedAt = known.loadedBy, known.loadedAt
+			if lib.codeHash == "" {
+				lib.codeHash = known.codeHash
+			}
+		} else {
+			logger.Info("Function library discovered",
+				zap.String("library", lib.name),
+				zap.String("engine", lib.engine),
+				zap.Strings("functions", lib.functions),
+			)
+		}
+		listed[lib.name] = lib
+	}
+	f.libraries = listed
+
+	inventory := make([]*functionLibrary, 0, len(listed))
+	for _, lib := range listed {
+		inventory = append(inventory, lib)
+	}
+	sort.Slice(inventory, func(i, j int) bool { return inventory[i].name < inventory[j].name })
+	logger.Info("Function inventory", zap.Objects("libraries", inventory))
+}
+
+// MarshalLogObject logs a library as an entry of the function inventory
+func (l *functionLibrary) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", l.name)
+	enc.AddString("engine", l.engine)
+	if l.codeHash != "" {
+		enc.AddString("code_hash", l.codeHash)
+	}
+	if err := enc.AddArray("functions", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, name := range l.functions {
+			arr.AppendString(name)
+		}
+		return nil
+	})); err != nil {
+		return err
+	}
+	if l.loadedBy != "" {
+		enc.AddString("loaded_by", l.loadedBy)
+		enc.AddTime("loaded_at", l.loadedAt)
+	}
+	return nil
+}
+
+// library returns the name of the library registering a function
+func (f *functionInventory) library(function string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, lib := range f.libraries {
+		for _, name := range lib.functions {
+			if name == function {
+				return lib.name
+			}
+		}
+	}
+	return ""
+}
+
+// functionNames extracts the names from the functions array of a FUNCTION
+// LIST entry
+func functionNames(functions *protocol.Reply) []string {
+	names := make([]string, 0, len(functions.Elems))
+	for _, function := range functions.Elems {
+		for i := 0; i+1 < len(function.Elems); i += 2 {
+			if function.Elems[i].Str == "name" {
+				names = append(names, function.Elems[i+1].Str)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseLibrary reads the engine from the shebang of a library's source and
+// the functions it registers
+func parseLibrary(code string) *functionLibrary {
+	lib := &functionLibrary{codeHash: codeHash(code), functions: make([]string, 0)}
+	if shebang, ok := strings.CutPrefix(code, "#!"); ok {
+		line, _, _ := strings.Cut(shebang, "\n")
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lib.engine = fields[0]
+		}
+	}
+	for _, match := range registerFunction.FindAllStringSubmatch(code, -1) {
+		lib.functions = append(lib.functions, match[1])
+	}
+	sort.Strings(lib.functions)
+	return lib
+}
+
+func codeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// functionFields logs FUNCTION subcommands, replacing library source with
+// its hash
+func functionFields(args []string) []zap.Field {
+	fields := []zap.Field{zap.String("subcommand", strings.ToUpper(args[0]))}
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) < 2 {
+			break
+		}
+		code := args[len(args)-1]
+		lib := parseLibrary(code)
+		fields = append(fields,
+			zap.String("engine", lib.engine),
+			zap.String("code_hash", lib.codeHash),
+			zap.Int("code_size", len(code)),
+			zap.Bool("replace", hasOption(args[1:len(args)-1], "REPLACE")),
+		)
+	case "DELETE":
+		if len(args) >= 2 {
+			fields = append(fields, zap.String("library", args[1]))
+		}
+	case "RESTORE":
+		fields = append(fields, zap.Strings("options", args[min(len(args), 2):]))
+	default:
+		if len(args) > 1 {
+			fields = append(fields, zap.Strings("args", args[1:]))
+		}
+	}
+	return fields
+}
+
+// fcallFields logs the function, keys and argument count of FCALL and
+// FCALL_RO
+func fcallFields(cmd *protocol.Command) []zap.Field {
+	fields := []zap.Field{zap.String("function", cmd.Args[0])}
+	keys := cmd.Keys()
+	fields = append(fields,
+		zap.Strings("keys", keys),
+		zap.Int("arg_count", max(len(cmd.Args)-2-len(keys), 0)),
+	)
+	return fields
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/gregyjames/RedisLogger/eventpb"
+)
+
+// eventStream serves the EventStream gRPC service from the event hub
+type eventStream struct {
+	eventpb.UnimplementedEventStreamServer
+	logger     *zap.Logger
+	hub        *eventHub
+	bufferSize int
+}
+
+// startGRPC serves the EventStream service until the context is cancelled
+func (p *Proxy) startGRPC(ctx context.Context) {
+	cfg := p.config.GRPC
+	listener, err := p.listen(cfg.Addr)
+	if err != nil {
+		p.logger.Error("gRPC server failed", zap.Error(err))
+		return
+	}
+	var opts []grpc.ServerOption
+	if cfg.Token != "" {
+		opts = append(opts, grpc.StreamInterceptor(requireToken(cfg.Token)))
+	}
+	server := grpc.NewServer(opts...)
+	eventpb.RegisterEventStreamServer(server, &eventStream{logger: p.logger, hub: p.events, bufferSize: cfg.BufferSize})
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+
+	p.logger.Info("gRPC server started", zap.String("grpc_addr", cfg.Addr))
+	go func() {
+		if err := server.Serve(listener); err != nil && ctx.Err() == nil {
+			p.logger.Error("gRPC server failed", zap.Error(err))
+		}
+	}()
+}
+
+// requireToken rejects calls without the bearer token in their
+// authorization metadata
+func requireToken(token string) grpc.StreamServerInterceptor {
+	want := []byte("Bearer " + token)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		for _, got := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(got), want) == 1 {
+				return handler(srv, ss)
+			}
+		}
+		return status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+	}
+}
+
+func (e *eventStream) Subscribe(req *eventpb.SubscribeRequest, stream eventpb.EventStream_SubscribeServer) error {
+	sub := e.hub.subscribe(newEventFilter(req.Commands, req.KeyPatterns), e.bufferSize)
+	defer e.hub.unsubscribe(sub)
+
+	logger := e.logger
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		logger = logger.With(zap.String("subscriber_addr", p.Addr.String()))
+	}
+	logger.Info("Event stream subscribed",
+		zap.Strings("commands", req.Commands),
+		zap.Strings("key_patterns", req.KeyPatterns),
+	)
+	defer func() {
+		logger.Info("Event stream closed", zap.Uint64("dropped", sub.dropped.Load()))
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-sub.events:
+			if err := stream.Send(commandEventProto(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func commandEventProto(e *commandEvent) *eventpb.CommandEvent {
+	return &eventpb.CommandEvent{
+		Time:           timestamppb.New(e.Time),
+		ConnectionId:   e.ConnectionID,
+		ClientAddr:     e.ClientAddr,
+		ClientIdentity: e.Identity,
+		User:           e.User,
+		Listener:       e.Listener,
+		Command:        e.Command,
+		Keys:           e.Keys,
+		Db:             e.DB,
+		Shard:          e.Shard,
+		Latency:        durationpb.New(e.Latency),
+		ReplyBytes:     uint64(e.ReplyBytes),
+		Error:          e.Error,
+		Seq:            e.Seq,
+		RequestId:      e.RequestID,
+	}
+}
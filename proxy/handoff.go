@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Environment variables through which a socket handoff passes the
+// listening sockets, as addr=fd pairs, and the pipe on which the new
+// process reports it is ready
+const (
+	listenersEnv = "REDISLOGGER_LISTENERS"
+	readyEnv     = "REDISLOGGER_READY_FD"
+)
+
+// handoffTimeout bounds how long a handoff waits for the new process to
+// start accepting connections
+const handoffTimeout = 30 * time.Second
+
+// inheritListeners takes over the sockets a previous process handed off
+func (p *Proxy) inheritListeners() {
+	spec := os.Getenv(listenersEnv)
+	if spec == "" {
+		return
+	}
+	os.Unsetenv(listenersEnv)
+
+	p.inherited = make(map[string]net.Listener)
+	for _, pair := range strings.Split(spec, ",") {
+		addr, fdStr, _ := strings.Cut(pair, "=")
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			p.logger.Warn("Invalid inherited listener", zap.String("listener", pair))
+			continue
+		}
+		file := os.NewFile(uintptr(fd), addr)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			p.logger.Warn("Failed to take over inherited listener", zap.String("addr", addr), zap.Error(err))
+			continue
+		}
+		if unix, ok := listener.(*net.UnixListener); ok {
+			// Now this process's to remove on exit
+			unix.SetUnlinkOnClose(true)
+		}
+		p.inherited[addr] = listener
+	}
+	p.logger.Info("Took over listeners from previous process", zap.Int("listeners", len(p.inherited)))
+}
+
+// listen opens a listener on addr, a TCP address or unix:/path, or takes
+// over the one a previous process handed off for it
+func (p *Proxy) listen(addr string) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	listener, ok := p.inherited[addr]
+	if ok {
+		delete(p.inherited, addr)
+	} else {
+		network, address := upstreamAddr(addr)
+		var lc net.ListenConfig
+		if network == "unix" {
+			// A socket file left behind by a process that did not exit
+			// cleanly would fail the bind, so it is removed as Redis does
+			os.Remove(address)
+		} else if p.config.ReusePort {
+			lc.Control = reusePort
+		}
+		var err error
+		if listener, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+	}
+	if p.listeners == nil {
+		p.listeners = make(map[string]net.Listener)
+	}
+	p.listeners[addr] = listener
+	return listener, nil
+}
+
+// signalReady tells the process that handed off its listeners that this
+// one is accepting connections, so that it can drain
+func (p *Proxy) signalReady() {
+	fdStr := os.Getenv(readyEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+
+	// Listeners nobody asked for, such as one dropped from the config,
+	// would otherwise stay open
+	p.mu.Lock()
+	for addr, listener := range p.inherited {
+		listener.Close()
+		delete(p.inherited, addr)
+	}
+	p.mu.Unlock()
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// Handoff starts a new process of the proxy binary on the same listening
+// sockets, so that the binary can be upgraded without refusing a single
+// connection. It returns once the new process accepts connections, after
+// which this one should drain; on error this process keeps serving.
+func (p *Proxy) Handoff() error {
+	if p.journal != nil {
+		return fmt.Errorf("socket handoff is not supported with a write journal, which both processes would write")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	var files []*os.File
+	var pairs []string
+	for addr, listener := range p.listeners {
+		var file *os.File
+		var err error
+		switch l := listener.(type) {
+		case *net.TCPListener:
+			file, err = l.File()
+		case *net.UnixListener:
+			// The socket file stays for the new process when this one
+			// closes the listener
+			l.SetUnlinkOnClose(false)
+			file, err = l.File()
+		default:
+			continue
+		}
+		if err != nil {
+			p.mu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("failed to duplicate listener %s: %w", addr, err)
+		}
+		// ExtraFiles start at descriptor 3
+		pairs = append(pairs, fmt.Sprintf("%s=%d", addr, 3+len(files)))
+		files = append(files, file)
+	}
+	p.mu.Unlock()
+	defer closeFiles(files)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	// The new process restores the counters this one has so far
+	if err := p.SaveState(); err != nil {
+		p.logger.Warn("Failed to save proxy state before handoff", zap.Error(err))
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(pairs, ","),
+		fmt.Sprintf("%s=%d", readyEnv, 3+len(files)),
+	)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	// The pipe reads EOF if the new process exits before it is ready
+	ready.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process did not become ready: %w", err)
+	}
+	p.logger.Info("Handed off listeners to new process", zap.Int("pid", cmd.Process.Pid))
+	cmd.Process.Release()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// healthChecker PINGs every backend on an interval so that dead backends
+// are taken out of rotation before clients try to connect to them
+type healthChecker struct {
+	proxy    *Proxy
+	logger   *zap.Logger
+	interval time.Duration
+	failures int
+	targets  []*backend
+}
+
+func newHealthChecker(p *Proxy) *healthChecker {
+	if !p.config.HealthCheckEnabled || p.cluster != nil {
+		return nil
+	}
+	h := &healthChecker{
+		proxy:    p,
+		logger:   p.logger.With(zap.String("component", "health_check")),
+		interval: 30 * time.Second,
+		failures: 3,
+	}
+	if p.config.HealthCheckInterval > 0 {
+		h.interval = time.Duration(p.config.HealthCheckInterval) * time.Second
+	}
+	if p.config.HealthCheckFailures > 0 {
+		h.failures = p.config.HealthCheckFailures
+	}
+
+	switch {
+	case p.pool != nil:
+		h.targets = p.pool.backends
+	case p.shards != nil:
+		for _, addr := range p.shards.backends {
+			h.targets = append(h.targets, &backend{addr: addr})
+		}
+	default:
+		// The address is refreshed before each check, as Sentinel may
+		// move the master
+		h.targets = []*backend{{addr: p.redisAddr()}}
+	}
+	return h
+}
+
+// run checks the backends until the context is cancelled
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) checkAll() {
+	if h.proxy.pool == nil && h.proxy.shards == nil {
+		h.targets[0].mu.Lock()
+		h.targets[0].addr = h.proxy.redisAddr()
+		h.targets[0].mu.Unlock()
+	}
+	for _, b := range h.targets {
+		go h.check(b)
+	}
+}
+
+// check PINGs a backend, marking it unhealthy after the configured number
+// of consecutive failures and healthy again after the first success
+func (h *healthChecker) check(b *backend) {
+	b.mu.Lock()
+	addr := b.addr
+	b.mu.Unlock()
+
+	err := h.ping(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.unhealthy {
+			h.logger.Info("Backend healthy", zap.String("backend", addr))
+		}
+		b.failures = 0
+		b.unhealthy = false
+		b.down = false
+		b.lastError = ""
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	h.logger.Debug("Backend health check failed",
+		zap.String("backend", addr),
+		zap.Int("failures", b.failures),
+		zap.Error(err),
+	)
+	if b.failures >= h.failures && !b.unhealthy {
+		b.unhealthy = true
+		h.logger.Warn("Backend unhealthy",
+			zap.String("backend", addr),
+			zap.Int("failures", b.failures),
+			zap.Error(err),
+		)
+	}
+}
+
+// ping opens a fresh connection, so that a backend refusing connections is
+// noticed, and expects a reply to PING. Replies such as -LOADING mean the
+// server is up but cannot serve commands yet.
+func (h *healthChecker) ping(addr string) error {
+	client := &upstreamClient{
+		dial:    func() (net.Conn, error) { return h.proxy.dialAddr(context.Background(), addr, nil) },
+		timeout: min(h.interval, 5*time.Second),
+	}
+	defer client.close()
+
+	reply, err := client.do("PING")
+	if err != nil {
+		return err
+	}
+	if reply.IsError() {
+		for _, prefix := range []string{"LOADING", "BUSY", "MASTERDOWN"} {
+			if strings.HasPrefix(reply.Str, prefix) {
+				return fmt.Errorf("%s", reply.Str)
+			}
+		}
+	}
+	return nil
+}
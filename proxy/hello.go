@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+const (
+	resp3Require = "require"
+	resp3Forbid  = "forbid"
+)
+
+// protocolStats counts protocol negotiation across all connections
+type protocolStats struct {
+	hello2   atomic.Uint64
+	hello3   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// checkProtocol enforces the configured RESP3 policy, returning an error
+// reply when the command must not be forwarded
+func (p *Proxy) checkProtocol(s *session, req *request) []byte {
+	switch p.config.RESP3Policy {
+	case resp3Forbid:
+		if req.name == "HELLO" && helloVersion(req.cmd) == 3 {
+			p.protoStats.rejected.Add(1)
+			s.logger.Warn("Rejected RESP3 negotiation", zap.String("resp3_policy", resp3Forbid))
+			return []byte("-NOPROTO RESP3 is disabled by proxy policy\r\n")
+		}
+	case resp3Require:
+		// Commands pipelined behind HELLO 3 are allowed before its reply
+		if s.protocol.Load() == 3 || s.requested.Load() == 3 {
+			return nil
+		}
+		switch req.name {
+		case "HELLO":
+			if helloVersion(req.cmd) == 3 {
+				s.requested.Store(3)
+				return nil
+			}
+		case "AUTH", "QUIT", "RESET":
+			return nil
+		}
+		p.protoStats.rejected.Add(1)
+		s.logger.Warn("Rejected command before RESP3 negotiation",
+			zap.String("command", req.cmd.Name),
+			zap.String("resp3_policy", resp3Require),
+		)
+		return []byte("-NOPROTO RESP3 is required by proxy policy, send HELLO 3 first\r\n")
+	}
+	return nil
+}
+
+// helloReply records the protocol version once Redis accepts a HELLO
+func (p *Proxy) helloReply(s *session, req *request, reply *protocol.Reply) {
+	if reply.IsError() {
+		s.requested.Store(s.protocol.Load())
+		return
+	}
+	version := helloVersion(req.cmd)
+	if version == 0 {
+		// HELLO without a version only reports the current protocol
+		return
+	}
+
+	s.protocol.Store(int32(version))
+	if version == 3 {
+		p.protoStats.hello3.Add(1)
+	} else {
+		p.protoStats.hello2.Add(1)
+	}
+	s.logger.Debug("Protocol negotiated", zap.Int("protocol", version))
+}
+
+// helloVersion returns the protocol version requested by HELLO, or 0 when
+// none was given
+func helloVersion(cmd *protocol.Command) int {
+	if len(cmd.Args) == 0 {
+		return 0
+	}
+	version, err := strconv.Atoi(cmd.Args[0])
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// reportProtocols periodically logs protocol usage and the clients that
+// are still speaking RESP2
+func (p *Proxy) reportProtocols(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var resp3 int
+		resp2Clients := make([]string, 0)
+		for _, s := range p.activeSessions() {
+			if s.protocol.Load() == 3 {
+				resp3++
+			} else {
+				resp2Clients = append(resp2Clients, s.client.RemoteAddr().String())
+			}
+		}
+
+		p.logger.Info("Protocol version report",
+			zap.String("resp3_policy", policyName(p.config.RESP3Policy)),
+			zap.Int("resp2_connections", len(resp2Clients)),
+			zap.Int("resp3_connections", resp3),
+			zap.Uint64("hello2_total", p.protoStats.hello2.Load()),
+			zap.Uint64("hello3_total", p.protoStats.hello3.Load()),
+			zap.Uint64("rejected_total", p.protoStats.rejected.Load()),
+			zap.Strings("resp2_clients", resp2Clients),
+		)
+	}
+}
+
+func policyName(policy string) string {
+	if policy == "" {
+		return "allow"
+	}
+	return strings.ToLower(policy)
+}
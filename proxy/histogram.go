@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// histogramSubBits splits each power of two into 32 buckets, so a
+	// latency is recorded to within about 3% of its value
+	histogramSubBits = 5
+	histogramSub     = 1 << histogramSubBits
+	// histogramBuckets covers latencies up to 2^36µs, about 19 hours
+	histogramBuckets = (36 - histogramSubBits + 1) * histogramSub
+)
+
+// histogram counts latencies in log-linear buckets of microseconds, in
+// the manner of HdrHistogram, so quantiles take constant memory however
+// many latencies are recorded
+type histogram struct {
+	counts [histogramBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// histogramBucket is the bucket a latency of us microseconds falls in
+func histogramBucket(us uint64) int {
+	if us < histogramSub {
+		return int(us)
+	}
+	shift := bits.Len64(us) - histogramSubBits - 1
+	bucket := (shift+1)*histogramSub + int(us>>shift) - histogramSub
+	return min(bucket, histogramBuckets-1)
+}
+
+// histogramValue is the middle of a bucket, in microseconds
+func histogramValue(bucket int) uint64 {
+	if bucket < histogramSub {
+		return uint64(bucket)
+	}
+	shift := bucket/histogramSub - 1
+	low := uint64(bucket%histogramSub+histogramSub) << shift
+	return low + (uint64(1)<<shift)/2
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[histogramBucket(uint64(max(d.Microseconds(), 0)))]++
+	h.total++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+// below counts the latencies recorded in the buckets below the one d falls
+// in, which are all less than d
+func (h *histogram) below(d time.Duration) uint64 {
+	var n uint64
+	for _, count := range h.counts[:histogramBucket(uint64(max(d.Microseconds(), 0)))] {
+		n += count
+	}
+	return n
+}
+
+// quantile returns the latency at quantile q, such as 0.99; the largest
+// latency recorded bounds it
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.total) + 0.5)
+	rank = min(max(rank, 1), h.total)
+	if rank == h.total {
+		return h.max
+	}
+	var seen uint64
+	for bucket, n := range h.counts {
+		if seen += n; seen >= rank {
+			return min(time.Duration(histogramValue(bucket))*time.Microsecond, h.max)
+		}
+	}
+	return h.max
+}
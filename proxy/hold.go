@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/glob"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// legalHold decides which commands are under legal hold. Held commands are
+// marked with a legal_hold field, bypass any log reduction and are copied
+// to the hold sink.
+type legalHold struct {
+	keyPatterns []string
+	tenants     map[string]bool
+}
+
+func newLegalHold(cfg *config.LegalHoldConfig) *legalHold {
+	if cfg == nil {
+		return nil
+	}
+	h := &legalHold{
+		keyPatterns: cfg.KeyPatterns,
+		tenants:     make(map[string]bool),
+	}
+	for _, tenant := range cfg.Tenants {
+		h.tenants[tenant] = true
+	}
+	return h
+}
+
+// matches reports whether the command belongs to a held tenant or touches
+// a held key
+func (h *legalHold) matches(tenant string, cmd *protocol.Command) bool {
+	if h == nil {
+		return false
+	}
+	if tenant != "" && h.tenants[tenant] {
+		return true
+	}
+	for _, key := range cmd.Keys() {
+		if glob.MatchAny(h.keyPatterns, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+const (
+	// sketchWidth and sketchDepth size each count-min sketch: 4 rows of
+	// 2048 counters overestimate by at most 0.13% of the accesses in the
+	// window with 98% confidence
+	sketchWidth = 2048
+	sketchDepth = 4
+
+	// hotKeySlots is the number of sub-windows the sliding window is
+	// divided into; the oldest is cleared as each one ends
+	hotKeySlots = 6
+
+	// hotKeyCandidates is how many more keys than reported are tracked
+	// with their command mix
+	hotKeyCandidates = 8
+)
+
+// hotKeys finds the most accessed keys without running MONITOR on Redis.
+// Access counts over a sliding window are estimated with one count-min
+// sketch per sub-window, and the keys with the highest estimates are kept
+// as candidates along with the commands that accessed them.
+type hotKeys struct {
+	logger   *zap.Logger
+	interval time.Duration
+	window   time.Duration
+	top      int
+
+	mu sync.Mutex
+	// seed keys the hash of the sketches, so that clients can't pick keys
+	// colliding with others; it is saved with them in the state file
+	seed       uint64
+	slots      [hotKeySlots][sketchDepth][sketchWidth]uint32
+	current    int
+	candidates map[string]map[string]uint64
+	// threshold is the lowest estimate among the candidates when they
+	// are full, which a key must exceed to become one
+	threshold uint32
+}
+
+func newHotKeys(logger *zap.Logger, cfg *config.HotKeysConfig) *hotKeys {
+	if cfg == nil {
+		return nil
+	}
+	h := &hotKeys{
+		logger:     logger.With(zap.String("component", "hot_keys")),
+		interval:   time.Duration(cfg.Interval) * time.Second,
+		window:     time.Duration(cfg.WindowSeconds) * time.Second,
+		top:        cfg.Top,
+		candidates: make(map[string]map[string]uint64),
+	}
+	if h.interval == 0 {
+		h.interval = time.Minute
+	}
+	if h.window == 0 {
+		h.window = h.interval
+	}
+	if h.top == 0 {
+		h.top = 10
+	}
+	h.seed = rand.Uint64()
+	return h
+}
+
+// observe counts an access to each key of a command
+func (h *hotKeys) observe(req *request) {
+	if h == nil {
+		return
+	}
+	keys := req.cmd.Keys()
+	if len(keys) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range keys {
+		for row, col := range h.columns(key) {
+			h.slots[h.current][row][col]++
+		}
+		if commands, ok := h.candidates[key]; ok {
+			commands[req.name]++
+			continue
+		}
+		if estimate := h.estimate(key); len(h.candidates) < h.top*hotKeyCandidates || estimate > h.threshold {
+			h.admit(key, req.name)
+		}
+	}
+}
+
+// columns are the counters of a key in each row of a sketch, derived from
+// the two halves of one seeded hash
+func (h *hotKeys) columns(key string) [sketchDepth]uint64 {
+	hash := fnv.New64a()
+	hash.Write(binary.LittleEndian.AppendUint64(nil, h.seed))
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	var cols [sketchDepth]uint64
+	for row := range cols {
+		cols[row] = (h1 + uint64(row)*h2) % sketchWidth
+	}
+	return cols
+}
+
+// estimate is the key's access count over the window, which may be too
+// high but never too low; the caller holds the mutex
+func (h *hotKeys) estimate(key string) uint32 {
+	var lowest uint32
+	for row, col := range h.columns(key) {
+		var sum uint32
+		for slot := range hotKeySlots {
+			sum += h.slots[slot][row][col]
+		}
+		if row == 0 || sum < lowest {
+			lowest = sum
+		}
+	}
+	return lowest
+}
+
+// admit makes a key a candidate, replacing the candidate with the lowest
+// estimate when they are full
+func (h *hotKeys) admit(key, command string) {
+	if len(h.candidates) >= h.top*hotKeyCandidates {
+		var coldest string
+		var lowest uint32
+		first := true
+		for k := range h.candidates {
+			if e := h.estimate(k); first || e < lowest {
+				coldest, lowest, first = k, e, false
+			}
+		}
+		delete(h.candidates, coldest)
+		h.threshold = lowest
+	}
+	h.candidates[key] = map[string]uint64{command: 1}
+}
+
+// run rotates the sub-windows and reports the hottest keys until the
+// context is cancelled
+func (h *hotKeys) run(ctx context.Context) {
+	rotate := time.NewTicker(h.window / hotKeySlots)
+	defer rotate.Stop()
+	report := time.NewTicker(h.interval)
+	defer report.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rotate.C:
+			h.rotate()
+		case <-report.C:
+			h.report()
+		}
+	}
+}
+
+// rotate starts a new sub-window, dropping the oldest one's counts and the
+// candidates no longer seen in the window
+func (h *hotKeys) rotate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = (h.current + 1) % hotKeySlots
+	h.slots[h.current] = [sketchDepth][sketchWidth]uint32{}
+	for key := range h.candidates {
+		if h.estimate(key) == 0 {
+			delete(h.candidates, key)
+		}
+	}
+	h.threshold = 0
+}
+
+// hotKeysState is the sketches and candidates saved in the state file
+type hotKeysState struct {
+	Seed    uint64 `json:"seed"`
+	Current int    `json:"current"`
+	// Slots are the sketches' counters as little-endian uint32s
+	Slots      []byte                       `json:"slots"`
+	Candidates map[string]map[string]uint64 `json:"candidates"`
+}
+
+func (h *hotKeys) save() *hotKeysState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := &hotKeysState{Seed: h.seed, Current: h.current, Candidates: make(map[string]map[string]uint64, len(h.candidates))}
+	state.Slots = make([]byte, 0, hotKeySlots*sketchDepth*sketchWidth*4)
+	for slot := range h.slots {
+		for row := range h.slots[slot] {
+			for _, n := range h.slots[slot][row] {
+				state.Slots = binary.LittleEndian.AppendUint32(state.Slots, n)
+			}
+		}
+	}
+	for key, commands := range h.candidates {
+		state.Candidates[key] = maps.Clone(commands)
+	}
+	return state
+}
+
+// restore loads saved sketches, then rotates out the sub-windows that
+// ended while the proxy was down
+func (h *hotKeys) restore(state *hotKeysState, savedAt time.Time) bool {
+	if len(state.Slots) != hotKeySlots*sketchDepth*sketchWidth*4 || state.Current < 0 || state.Current >= hotKeySlots {
+		return false
+	}
+	h.mu.Lock()
+	h.seed, h.current = state.Seed, state.Current
+	data := state.Slots
+	for slot := range h.slots {
+		for row := range h.slots[slot] {
+			for col := range h.slots[slot][row] {
+				h.slots[slot][row][col] = binary.LittleEndian.Uint32(data)
+				data = data[4:]
+			}
+		}
+	}
+	for key, commands := range state.Candidates {
+		h.candidates[key] = commands
+	}
+	h.mu.Unlock()
+
+	elapsed := max(time.Since(savedAt), 0)
+	for range min(int(elapsed/(h.window/hotKeySlots)), hotKeySlots) {
+		h.rotate()
+	}
+	return true
+}
+
+// hotKey is a reported key with its estimated accesses and the commands
+// seen accessing it since it became a candidate
+type hotKey struct {
+	key      string
+	accesses uint32
+	commands map[string]uint64
+}
+
+func (h *hotKeys) report() {
+	h.mu.Lock()
+	list := make([]hotKey, 0, len(h.candidates))
+	for key, commands := range h.candidates {
+		list = append(list, hotKey{key: key, accesses: h.estimate(key), commands: maps.Clone(commands)})
+	}
+	h.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b hotKey) int { return int(b.accesses) - int(a.accesses) })
+	for i, k := range list[:min(h.top, len(list))] {
+		h.logger.Info("Hot key",
+			zap.Int("rank", i+1),
+			zap.String("key", k.key),
+			zap.Uint32("estimated_accesses", k.accesses),
+			zap.Duration("window", h.window),
+			zap.Object("commands", commandMix(k.commands)),
+		)
+	}
+}
+
+// commandMix logs the commands that accessed a key with their counts
+type commandMix map[string]uint64
+
+func (m commandMix) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		enc.AddUint64(name, m[name])
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// watchIdle closes the session once the client has been idle for the
+// timeout. As in Redis, clients waiting on a blocking command, subscribed
+// or monitoring are never idle.
+func (s *session) watchIdle(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+
+		if s.busy() {
+			timer.Reset(timeout)
+			continue
+		}
+		idle := time.Since(time.Unix(0, s.stats.lastActive.Load()))
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		s.logger.Info("Closing idle connection",
+			zap.Duration("idle", idle.Round(time.Second)),
+			zap.Duration("idle_timeout", timeout),
+		)
+		s.close()
+		return
+	}
+}
+
+// busy reports whether the client is waiting on Redis rather than idle
+func (s *session) busy() bool {
+	return s.inFlight.Load() > 0 || s.pubsub.Load() || s.monitoring.Load()
+}
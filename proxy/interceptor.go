@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// Interceptor runs custom code on the traffic of every client connection,
+// to reject, rewrite, annotate or measure commands. OnCommand is called
+// from a connection's command reader and OnResponse from its reply writer,
+// so methods may run concurrently, within a connection as well as across
+// connections. Embed NopInterceptor to implement only some of them.
+type Interceptor interface {
+	// OnConnect is called once a client is accepted, before it sends
+	// anything; an error refuses the connection
+	OnConnect(conn *ConnInfo) error
+	// OnCommand is called for each command before it is logged and the
+	// proxy's policies run, so they apply to the command as rewritten. An
+	// error answers the command with an error reply instead of forwarding
+	// it.
+	OnCommand(conn *ConnInfo, call *Call) error
+	// OnResponse is called with Redis's reply to each forwarded command
+	OnResponse(conn *ConnInfo, call *Call, reply *protocol.Reply)
+	// OnClose is called once the connection is closed
+	OnClose(conn *ConnInfo)
+}
+
+// NopInterceptor implements every Interceptor method as a no-op
+type NopInterceptor struct{}
+
+func (NopInterceptor) OnConnect(*ConnInfo) error                    { return nil }
+func (NopInterceptor) OnCommand(*ConnInfo, *Call) error             { return nil }
+func (NopInterceptor) OnResponse(*ConnInfo, *Call, *protocol.Reply) {}
+func (NopInterceptor) OnClose(*ConnInfo)                            {}
+
+// ConnInfo describes a client connection to interceptors and event
+// subscribers
+type ConnInfo struct {
+	ID         uint64 `json:"id"`
+	ClientAddr string `json:"client_addr"`
+	// Listener is the address the client connected to
+	Listener string `json:"listener"`
+	// Identity is the client certificate identity under mutual TLS
+	Identity string `json:"identity,omitempty"`
+}
+
+// Call is a command passing through the proxy
+type Call struct {
+	// Command may be changed by OnCommand to forward another command,
+	// such as one with rewritten keys; its Message is re-encoded from
+	// Name and Args
+	Command *protocol.Command
+	// Sent is when the command was forwarded to Redis, set by the time
+	// OnResponse is called
+	Sent time.Time
+
+	fields []zap.Field
+	// err is the error an interceptor rejected the command with
+	err error
+}
+
+// Annotate adds fields to the command's "Received command" log entry
+func (c *Call) Annotate(fields ...zap.Field) {
+	c.fields = append(c.fields, fields...)
+}
+
+// Use adds interceptors, which run in the order they are added. It must
+// be called before Start.
+func (p *Proxy) Use(interceptors ...Interceptor) {
+	p.interceptors = append(p.interceptors, interceptors...)
+}
+
+// onConnect runs the interceptors on a new session, returning the error
+// to refuse it with
+func (p *Proxy) onConnect(s *session) []byte {
+	for _, i := range p.interceptors {
+		if err := i.OnConnect(s.info); err != nil {
+			s.logger.Warn("Connection refused by interceptor", zap.Error(err))
+			return errorReply(err)
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) onClose(s *session) {
+	for _, i := range p.interceptors {
+		i.OnClose(s.info)
+	}
+}
+
+// intercept runs the interceptors on a command, re-encoding it if one
+// rewrote it. A rejection is answered by checkIntercepted, so that it is
+// logged after the command.
+func (s *session) intercept(req *request) {
+	if len(s.proxy.interceptors) == 0 {
+		return
+	}
+	name, args := req.cmd.Name, slices.Clone(req.cmd.Args)
+	req.call = &Call{Command: req.cmd}
+	for _, i := range s.proxy.interceptors {
+		if req.call.err = i.OnCommand(s.info, req.call); req.call.err != nil {
+			break
+		}
+	}
+
+	cmd := req.call.Command
+	if cmd == nil {
+		return
+	}
+	if cmd != req.cmd || cmd.Name != name || !slices.Equal(cmd.Args, args) {
+		cmd.Message = encodeCommand(append([]string{cmd.Name}, cmd.Args...)...)
+		req.cmd, req.name = cmd, strings.ToUpper(cmd.Name)
+		// The forwarded frame no longer matches what the client sent
+		req.checksum = nil
+	}
+}
+
+// checkIntercepted answers commands an interceptor rejected
+func (s *session) checkIntercepted(req *request) []byte {
+	if req.call == nil || req.call.err == nil {
+		return nil
+	}
+	s.logger.Warn("Command rejected by interceptor", zap.String("command", req.cmd.Name), zap.Error(req.call.err))
+	return errorReply(req.call.err)
+}
+
+// onResponse runs the interceptors on Redis's reply to a command
+func (s *session) onResponse(req *request, reply *protocol.Reply) {
+	if req.call == nil {
+		return
+	}
+	req.call.Sent = req.sent
+	for _, i := range s.proxy.interceptors {
+		i.OnResponse(s.info, req.call, reply)
+	}
+}
+
+// errorReply encodes an error as a RESP error line
+func errorReply(err error) []byte {
+	return []byte(fmt.Sprintf("-ERR %s\r\n", strings.Join(strings.Fields(err.Error()), " ")))
+}
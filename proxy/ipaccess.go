@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// ipAccess is a compiled CIDR allow/deny list for client connections
+type ipAccess struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPAccess(cfg *config.IPAccessConfig) *ipAccess {
+	if cfg == nil {
+		return nil
+	}
+	return &ipAccess{allow: parseCIDRs(cfg.Allow), deny: parseCIDRs(cfg.Deny)}
+}
+
+// parseCIDRs parses CIDRs that were validated when the config was loaded
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// permits reports whether a client may connect. Connections without an IP
+// address, such as over a Unix socket, are always permitted.
+func (a *ipAccess) permits(ip net.IP) bool {
+	if a == nil || ip == nil {
+		return true
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// journalCompactSize is the size beyond which the journal is rewritten with
+// only the writes still in flight
+const journalCompactSize = 1 << 20
+
+// journal is a write-ahead record of the write commands forwarded to Redis
+// and not yet acknowledged. Entries left in it after a crash are the writes
+// whose acknowledgment the client may never have received.
+type journal struct {
+	logger   *zap.Logger
+	path     string
+	interval time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	nextID   uint64
+	inflight map[uint64]*journalEntry
+}
+
+// journalEntry is a begin line of the journal, recording a write forwarded
+// to Redis
+type journalEntry struct {
+	Op         string    `json:"op"`
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	Session    uint64    `json:"session"`
+	ClientAddr string    `json:"client_addr"`
+	Command    string    `json:"command"`
+	Hash       string    `json:"command_hash"`
+	Key        string    `json:"key,omitempty"`
+}
+
+// journalEnd is an end line, recording that Redis acknowledged a write
+type journalEnd struct {
+	Op string `json:"op"`
+	ID uint64 `json:"id"`
+}
+
+func newJournal(logger *zap.Logger, cfg *config.JournalConfig) *journal {
+	if cfg == nil {
+		return nil
+	}
+	j := &journal{
+		logger:   logger.With(zap.String("component", "journal")),
+		path:     cfg.Path,
+		interval: 100 * time.Millisecond,
+		inflight: make(map[uint64]*journalEntry),
+	}
+	if cfg.FsyncIntervalMs > 0 {
+		j.interval = time.Duration(cfg.FsyncIntervalMs) * time.Millisecond
+	}
+	return j
+}
+
+// open reports the writes left in flight by the previous run, which can
+// only remain after a crash, and starts a new journal
+func (j *journal) open() error {
+	if lost := j.recover(); len(lost) > 0 {
+		j.logger.Warn("Proxy did not shut down cleanly",
+			zap.String("path", j.path),
+			zap.Int("writes_in_flight", len(lost)),
+		)
+		for _, e := range lost {
+			j.logger.Warn("Write was in flight at crash", e.fields()...)
+		}
+	}
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.file = file
+	j.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// recover reads the previous journal, returning the writes that were never
+// acknowledged. A torn last line from the crash is ignored.
+func (j *journal) recover() []*journalEntry {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			j.logger.Warn("Failed to read journal", zap.String("path", j.path), zap.Error(err))
+		}
+		return nil
+	}
+	defer file.Close()
+
+	open := make(map[uint64]*journalEntry)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if e.Op == "begin" {
+			open[e.ID] = &e
+		} else {
+			delete(open, e.ID)
+		}
+	}
+
+	lost := make([]*journalEntry, 0, len(open))
+	for _, e := range open {
+		lost = append(lost, e)
+	}
+	sort.Slice(lost, func(a, b int) bool { return lost[a].ID < lost[b].ID })
+	return lost
+}
+
+// begin journals a write command before it is forwarded, returning the id
+// to pass to end, or 0 for commands that are not journaled
+func (j *journal) begin(s *session, req *request) uint64 {
+	if j == nil || !req.cmd.IsWrite() {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.nextID++
+	e := &journalEntry{
+		Op:         "begin",
+		ID:         j.nextID,
+		Time:       time.Now(),
+		Session:    s.id,
+		ClientAddr: s.client.RemoteAddr().String(),
+		Command:    req.cmd.Name,
+		Hash:       req.cmd.Hash(),
+	}
+	if keys := req.cmd.Keys(); len(keys) > 0 {
+		e.Key = keys[0]
+	}
+	j.inflight[e.ID] = e
+	j.append(e)
+	return e.ID
+}
+
+// end records that Redis acknowledged a journaled write
+func (j *journal) end(id uint64) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.inflight[id]; ok {
+		delete(j.inflight, id)
+		j.append(&journalEnd{Op: "end", ID: id})
+	}
+}
+
+// release ends the writes of a closed session, whose outcome was already
+// logged when the connection ended
+func (j *journal) release(session uint64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for id, e := range j.inflight {
+		if e.Session == session {
+			delete(j.inflight, id)
+			j.append(&journalEnd{Op: "end", ID: id})
+		}
+	}
+}
+
+func (j *journal) append(e any) {
+	if j.writer == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	n, _ := j.writer.Write(append(line, '\n'))
+	j.size += int64(n)
+}
+
+// run flushes and syncs the journal on every interval until the context
+// is cancelled
+func (j *journal) run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := j.sync(); err != nil {
+			j.logger.Error("Failed to sync journal", zap.Error(err))
+		}
+	}
+}
+
+func (j *journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.writer == nil {
+		return nil
+	}
+	if j.size > journalCompactSize {
+		return j.compact()
+	}
+	if j.writer.Buffered() == 0 {
+		return nil
+	}
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// compact replaces the journal with one holding only the writes still in
+// flight
+func (j *journal) compact() error {
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	var size int64
+	for _, e := range j.inflight {
+		line, _ := json.Marshal(e)
+		n, _ := writer.Write(append(line, '\n'))
+		size += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		file.Close()
+		return err
+	}
+	j.file.Close()
+	j.file, j.writer, j.size = file, writer, size
+	return nil
+}
+
+// close ends the journal on a clean shutdown, logging the writes cut off
+// by it, so that the next start does not report a crash
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.writer == nil {
+		return
+	}
+	for _, e := range j.inflight {
+		j.logger.Warn("Write was in flight at shutdown", e.fields()...)
+	}
+	j.file.Close()
+	j.writer = nil
+	if err := os.Remove(j.path); err != nil {
+		j.logger.Error("Failed to remove journal", zap.Error(err))
+	}
+}
+
+func (e *journalEntry) fields() []zap.Field {
+	return []zap.Field{
+		zap.Time("sent_at", e.Time),
+		zap.Uint64("session", e.Session),
+		zap.String("client_addr", e.ClientAddr),
+		zap.String("command", e.Command),
+		zap.String("command_hash", e.Hash),
+		zap.String("key", e.Key),
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/glob"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// checkKeyRules applies the key rules to every key of a command, so that
+// clients cannot reach keys outside their tenancy. Commands whose keys are
+// not known are refused to the clients the rules apply to.
+func (p *Proxy) checkKeyRules(s *session, req *request) []byte {
+	if len(p.config.KeyRules) == 0 {
+		return nil
+	}
+	var clientIP string
+	if ip := remoteIP(s.client); ip != nil {
+		clientIP = ip.String()
+	}
+	if protocol.LookupCommand(req.name) == nil {
+		if !p.keyRulesApply(s.user, s.identity, clientIP) {
+			return nil
+		}
+		s.logger.Warn("Command with unknown keys denied by key rules",
+			zap.String("command", req.cmd.Name),
+		)
+		return []byte(fmt.Sprintf("-NOPERM No permissions to run '%s', as its keys are unknown\r\n", req.cmd.Name))
+	}
+	keys := req.cmd.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	access := "read"
+	if req.cmd.IsWrite() {
+		access = "write"
+	}
+
+	for _, key := range keys {
+		rule, allowed := p.keyAllowed(key, access, s.user, s.identity, clientIP)
+		if allowed {
+			continue
+		}
+		pattern := "no allow rule"
+		if rule != nil {
+			pattern = rule.Pattern
+		}
+		s.logger.Warn("Key access denied by key rule",
+			zap.String("command", req.cmd.Name),
+			zap.String("key", key),
+			zap.String("access", access),
+			zap.String("rule", pattern),
+		)
+		return []byte(fmt.Sprintf("-NOPERM No permissions to %s key '%s'\r\n", access, key))
+	}
+	return nil
+}
+
+// keyAllowed reports whether a client may access a key, returning the deny
+// rule that matched when it may not
+func (p *Proxy) keyAllowed(key, access string, clients ...string) (*config.KeyRule, bool) {
+	hasAllow, allowed := false, false
+	for i := range p.config.KeyRules {
+		rule := &p.config.KeyRules[i]
+		if rule.Access != "" && rule.Access != access || !ruleApplies(rule.Clients, clients) {
+			continue
+		}
+		match := glob.Match(rule.Pattern, key)
+		if rule.Action == "deny" {
+			if match {
+				return rule, false
+			}
+			continue
+		}
+		hasAllow = true
+		allowed = allowed || match
+	}
+	return nil, !hasAllow || allowed
+}
+
+// keyRulesApply reports whether any key rule applies to a client
+func (p *Proxy) keyRulesApply(clients ...string) bool {
+	for i := range p.config.KeyRules {
+		if ruleApplies(p.config.KeyRules[i].Clients, clients) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleApplies reports whether a rule limited to ruleClients applies to a
+// client known by any of clients
+func ruleApplies(ruleClients, clients []string) bool {
+	if len(ruleClients) == 0 {
+		return true
+	}
+	for _, client := range clients {
+		if client != "" && slices.Contains(ruleClients, client) {
+			return true
+		}
+	}
+	return false
+}
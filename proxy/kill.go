@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// handleKill closes client connections at an operator's request, either
+// the one with the given id or every connection from client_addr, which
+// may be an ip:port or a bare IP
+func (p *Proxy) handleKill(w http.ResponseWriter, r *http.Request) {
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+		return
+	}
+
+	var match func(s *session) bool
+	if idStr := r.PathValue("id"); idStr != "" {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		match = func(s *session) bool { return s.id == id }
+	} else {
+		addr := r.URL.Query().Get("client_addr")
+		if addr == "" {
+			http.Error(w, "a connection id or client_addr is required", http.StatusBadRequest)
+			return
+		}
+		match = func(s *session) bool { return matchesClientAddr(s.client, addr) }
+	}
+
+	killed := []uint64{}
+	for _, s := range p.activeSessions() {
+		if !match(s) {
+			continue
+		}
+		s.logger.Warn("Connection killed by operator",
+			zap.Uint64("connection_id", s.id),
+			zap.String("operator", operator),
+			zap.String("reason", r.URL.Query().Get("reason")),
+		)
+		s.close()
+		killed = append(killed, s.id)
+	}
+	if len(killed) == 0 {
+		http.Error(w, "no matching connection", http.StatusNotFound)
+		return
+	}
+	slices.Sort(killed)
+	writeJSON(w, http.StatusOK, map[string]any{"killed": killed})
+}
+
+// matchesClientAddr reports whether a client connected from addr, an
+// ip:port or a bare IP matching every port
+func matchesClientAddr(conn net.Conn, addr string) bool {
+	if conn.RemoteAddr().String() == addr {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.Equal(remoteIP(conn))
+}
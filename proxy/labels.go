@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"maps"
+	"slices"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// labels are static key/value pairs, such as env or region, attached to the
+// logs of traffic on a listener or upstream so that fleets can be told
+// apart downstream
+type labels map[string]string
+
+func (l labels) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, key := range slices.Sorted(maps.Keys(l)) {
+		enc.AddString(key, l[key])
+	}
+	return nil
+}
+
+// labelSet holds the configured labels of the listener and of each
+// upstream
+type labelSet struct {
+	listener labels
+	redis    labels
+	backends map[string]labels
+}
+
+func newLabelSet(cfg *config.Config) *labelSet {
+	set := &labelSet{
+		listener: cfg.Labels,
+		redis:    cfg.RedisLabels,
+		backends: make(map[string]labels),
+	}
+	for _, b := range cfg.Backends {
+		if len(b.Labels) == 0 {
+			continue
+		}
+		merged := maps.Clone(cfg.RedisLabels)
+		if merged == nil {
+			merged = make(labels)
+		}
+		maps.Copy(merged, b.Labels)
+		set.backends[b.Addr] = merged
+	}
+	return set
+}
+
+// upstream returns the labels of an upstream address; Sentinel masters and
+// cluster nodes only get redis_labels
+func (ls *labelSet) upstream(addr string) labels {
+	if l, ok := ls.backends[addr]; ok {
+		return l
+	}
+	return ls.redis
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLatencyCommands bounds the histograms kept, since clients may send
+// any command name; the latencies of further names are kept as OTHER
+const maxLatencyCommands = 1000
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// Prometheus histograms
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencies keeps a histogram of the round trip to Redis per command, so
+// that latency regressions can be attributed to the commands behind them.
+// Histograms are kept per listener and upstream too when they have labels,
+// so that the labels can be exported with them.
+type latencies struct {
+	mu       sync.Mutex
+	since    time.Time
+	commands map[latencyKey]*histogram
+	// series holds the labels of each listener and upstream pair seen,
+	// rendered for the exposition format, and labelMaps the same labels
+	// for the admin API
+	series    map[string]string
+	labelMaps map[string]map[string]string
+}
+
+// latencyKey identifies a histogram by command and rendered labels
+type latencyKey struct {
+	command string
+	labels  string
+}
+
+// commandLatency is a command's histogram as reported by the admin API
+type commandLatency struct {
+	Command string            `json:"command"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Count   uint64            `json:"count"`
+	MeanMs  float64           `json:"mean_ms"`
+	P50Ms   float64           `json:"p50_ms"`
+	P90Ms   float64           `json:"p90_ms"`
+	P99Ms   float64           `json:"p99_ms"`
+	P999Ms  float64           `json:"p999_ms"`
+	MaxMs   float64           `json:"max_ms"`
+}
+
+func newLatencies(enabled bool) *latencies {
+	if !enabled {
+		return nil
+	}
+	return &latencies{
+		since:     time.Now(),
+		commands:  make(map[latencyKey]*histogram),
+		series:    make(map[string]string),
+		labelMaps: make(map[string]map[string]string),
+	}
+}
+
+// observe records the round trip of a forwarded command
+func (l *latencies) observe(s *session, req *request, elapsed time.Duration) {
+	if l == nil {
+		return
+	}
+	upstream := s.backend
+	if req.shard != "" {
+		upstream = req.shard
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pair := s.listener + "\x00" + upstream
+	rendered, ok := l.series[pair]
+	if !ok {
+		merged := make(map[string]string)
+		for key, value := range s.labels {
+			merged[promName(key)] = value
+		}
+		for key, value := range s.proxy.labels.upstream(upstream) {
+			merged["upstream_"+promName(key)] = value
+		}
+		rendered = promLabels(merged)
+		l.series[pair] = rendered
+		l.labelMaps[rendered] = merged
+	}
+
+	key := latencyKey{req.name, rendered}
+	h := l.commands[key]
+	if h == nil {
+		if len(l.commands) >= maxLatencyCommands {
+			key.command = "OTHER"
+		}
+		if h = l.commands[key]; h == nil {
+			h = &histogram{}
+			l.commands[key] = h
+		}
+	}
+	h.record(elapsed)
+}
+
+// snapshot copies the histograms, sorted by command and labels
+func (l *latencies) snapshot() (time.Time, []latencyKey, []histogram) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := slices.SortedFunc(maps.Keys(l.commands), func(a, b latencyKey) int {
+		return cmp.Or(cmp.Compare(a.command, b.command), cmp.Compare(a.labels, b.labels))
+	})
+	hists := make([]histogram, len(keys))
+	for i, key := range keys {
+		hists[i] = *l.commands[key]
+	}
+	return l.since, keys, hists
+}
+
+func (l *latencies) handleList(w http.ResponseWriter, r *http.Request) {
+	since, keys, hists := l.snapshot()
+	list := make([]commandLatency, len(keys))
+	l.mu.Lock()
+	for i, h := range hists {
+		list[i] = commandLatency{
+			Command: keys[i].command,
+			Labels:  l.labelMaps[keys[i].labels],
+			Count:   h.total,
+			MeanMs:  ms(h.sum / time.Duration(h.total)),
+			P50Ms:   ms(h.quantile(0.5)),
+			P90Ms:   ms(h.quantile(0.9)),
+			P99Ms:   ms(h.quantile(0.99)),
+			P999Ms:  ms(h.quantile(0.999)),
+			MaxMs:   ms(h.max),
+		}
+	}
+	l.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"since":    since,
+		"commands": list,
+	})
+}
+
+// handleReset empties the histograms, as LATENCY RESET does in Redis
+func (l *latencies) handleReset(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	l.since = time.Now()
+	clear(l.commands)
+	l.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeMetrics writes the histograms as Prometheus histograms in the text
+// exposition format
+func (l *latencies) writeMetrics(b *strings.Builder) {
+	if l == nil {
+		return
+	}
+	_, keys, hists := l.snapshot()
+	b.WriteString("# HELP redislogger_command_latency_seconds Round trip to Redis of forwarded commands.\n")
+	b.WriteString("# TYPE redislogger_command_latency_seconds histogram\n")
+	for i, h := range hists {
+		labels := `command="` + promLabel.Replace(keys[i].command) + `"`
+		if keys[i].labels != "" {
+			labels += "," + keys[i].labels
+		}
+		for _, le := range latencyBuckets {
+			below := h.below(time.Duration(le * float64(time.Second)))
+			fmt.Fprintf(b, "redislogger_command_latency_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, below)
+		}
+		fmt.Fprintf(b, "redislogger_command_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.total)
+		fmt.Fprintf(b, "redislogger_command_latency_seconds_sum{%s} %g\n", labels, h.sum.Seconds())
+		fmt.Fprintf(b, "redislogger_command_latency_seconds_count{%s} %d\n", labels, h.total)
+	}
+}
+
+// promLabel escapes a Prometheus label value
+var promLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName makes a configured label key a valid Prometheus label name
+func promName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// promLabels renders labels as name="value" pairs sorted by name
+func promLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, name+`="`+promLabel.Replace(labels[name])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// connLimit counts the open client connections and enforces
+// max_connections
+type connLimit struct {
+	max  int
+	wait time.Duration
+	// slots holds a token per open connection when a limit is set
+	slots chan struct{}
+
+	current  atomic.Int64
+	peak     atomic.Int64
+	rejected atomic.Uint64
+}
+
+func newConnLimit(max, waitMs int) *connLimit {
+	l := &connLimit{max: max, wait: time.Duration(waitMs) * time.Millisecond}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// admit takes a slot for a new connection, waiting for one to free up if
+// configured, and reports whether the connection may be served
+func (l *connLimit) admit() bool {
+	if l.slots != nil && !l.acquire() {
+		l.rejected.Add(1)
+		return false
+	}
+	n := l.current.Add(1)
+	for peak := l.peak.Load(); n > peak && !l.peak.CompareAndSwap(peak, n); peak = l.peak.Load() {
+	}
+	return true
+}
+
+func (l *connLimit) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// release frees the slot of a closed connection
+func (l *connLimit) release() {
+	l.current.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// refuse answers a connection over the limit with the error Redis sends in
+// the same case, through TLS when the listener uses it
+func (p *Proxy) refuse(conn net.Conn, tlsConfig *tls.Config) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if tlsConfig != nil {
+		conn = tls.Server(conn, tlsConfig)
+	}
+	if _, err := conn.Write([]byte("-ERR max number of clients reached\r\n")); err != nil {
+		return
+	}
+	// Closing with the client's commands unread would reset the
+	// connection and could discard the error before the client reads it
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func (l *connLimit) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"current":  l.current.Load(),
+		"peak":     l.peak.Load(),
+		"max":      l.max,
+		"rejected": l.rejected.Load(),
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// endpoint is a listener the proxy serves clients on, with the TLS
+// configuration, backend and labels of its connections
+type endpoint struct {
+	addr string
+	tls  *tls.Config
+	// redisAddr is the Redis the listener's clients connect to, or "" for
+	// redis_addr
+	redisAddr string
+	labels    labels
+}
+
+// endpoints returns listen_addr, served as configured by tls_listen and
+// labels, followed by the configured listeners
+func (p *Proxy) endpoints() []*endpoint {
+	var eps []*endpoint
+	if p.config.ListenAddr != "" {
+		eps = append(eps, &endpoint{addr: p.config.ListenAddr, tls: p.serverTLS, labels: p.labels.listener})
+	}
+	for _, l := range p.config.Listeners {
+		ep := &endpoint{addr: l.Addr, redisAddr: l.RedisAddr, labels: p.labels.listener}
+		if l.TLS {
+			ep.tls = p.serverTLS
+		}
+		if l.Labels != nil {
+			ep.labels = l.Labels
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
+
+// remoteAddr returns the address of a client connected to the endpoint;
+// Unix domain socket clients are unnamed, so they go by the socket's
+func (ep *endpoint) remoteAddr(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if addr == "" || addr == "@" {
+		return ep.addr
+	}
+	return addr
+}
+
+// listenerBackends reports whether any listener connects its clients to
+// a Redis of its own
+func (p *Proxy) listenerBackends() bool {
+	for _, l := range p.config.Listeners {
+		if l.RedisAddr != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEndpoints accepts connections on every endpoint until ctx is
+// cancelled, or until the proxy drains and its listeners are closed
+func (p *Proxy) serveEndpoints(ctx context.Context, eps []*endpoint, listeners []net.Listener) error {
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.accept(ctx, ep, listeners[i])
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+func (p *Proxy) accept(ctx context.Context, ep *endpoint, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if p.isDraining() || ctx.Err() != nil {
+				return
+			}
+			p.logger.Error("Failed to accept connection", zap.String("listen_addr", ep.addr), zap.Error(err))
+			continue
+		}
+		go p.handleConnection(ctx, ep, conn)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/glob"
+)
+
+// logFilter decides which commands are logged at all, independently of
+// which are forwarded. Commands under legal hold and writes are always
+// logged, so that reads can be quieted without losing the audit trail of
+// changes, as with sampling.
+type logFilter struct {
+	commands [][]string
+	skip     [][]string
+	keys     []string
+	skipKeys []string
+	// errorsOnly holds commands back until their reply is an error
+	errorsOnly bool
+}
+
+func newLogFilter(cfg *config.LogFilterConfig) *logFilter {
+	if cfg == nil {
+		return nil
+	}
+	f := &logFilter{keys: cfg.Keys, skipKeys: cfg.SkipKeys, errorsOnly: cfg.ErrorsOnly}
+	for _, rule := range cfg.Commands {
+		f.commands = append(f.commands, strings.Fields(strings.ToUpper(rule)))
+	}
+	for _, rule := range cfg.SkipCommands {
+		f.skip = append(f.skip, strings.Fields(strings.ToUpper(rule)))
+	}
+	return f
+}
+
+// logs reports whether a command is logged
+func (f *logFilter) logs(req *request) bool {
+	if f == nil || req.held || req.cmd.IsWrite() {
+		return true
+	}
+	if f.commands != nil && !matchesCommandRule(f.commands, req) {
+		return false
+	}
+	if matchesCommandRule(f.skip, req) {
+		return false
+	}
+	if f.keys == nil && f.skipKeys == nil {
+		return true
+	}
+	// Commands without keys are left out by keys but never by skip_keys
+	keys := req.cmd.Keys()
+	if f.keys != nil && !slices.ContainsFunc(keys, func(key string) bool { return glob.MatchAny(f.keys, key) }) {
+		return false
+	}
+	return f.skipKeys == nil || len(keys) == 0 || !allMatch(f.skipKeys, keys)
+}
+
+// deferred reports whether a command logged is held back until it fails
+func (f *logFilter) deferred(req *request) bool {
+	return f != nil && f.errorsOnly && !req.held && !req.cmd.IsWrite()
+}
+
+// logFailure logs a command held back by errors_only once its reply is an
+// error
+func (s *session) logFailure(req *request, reply string) {
+	if req.failureFields == nil || reply == "" {
+		return
+	}
+	s.logger.Warn("Received command", append(req.failureFields, zap.String("error", reply))...)
+}
+
+// commandLevel returns the level received commands are logged at
+func commandLevel(cfg *config.LogConfig) zapcore.Level {
+	if cfg == nil || cfg.CommandLevel == "" {
+		return zapcore.InfoLevel
+	}
+	// Validated when the config is loaded
+	level, _ := zapcore.ParseLevel(cfg.CommandLevel)
+	return level
+}
+
+// allMatch reports whether every key matches one of patterns
+func allMatch(patterns, keys []string) bool {
+	for _, key := range keys {
+		if !glob.MatchAny(patterns, key) {
+			return false
+		}
+	}
+	return true
+}
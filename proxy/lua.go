@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// Defaults for the limits of the Lua script
+const (
+	defaultLuaTimeout = 10 * time.Millisecond
+	defaultLuaStates  = 4
+)
+
+// luaScript is an interceptor running an operator's Lua script. The script
+// defines on_command(cmd, args, conn), which returns nothing or true to let
+// the command through, false and a message to deny it, or a table with
+// deny, command, args and fields, and optionally on_connect(conn), which
+// returns false and a message to refuse the connection.
+type luaScript struct {
+	NopInterceptor
+	logger     *zap.Logger
+	proto      *lua.FunctionProto
+	timeout    time.Duration
+	failClosed bool
+	hasConnect bool
+	hasCommand bool
+
+	// idle holds states free to take a call, and slots a token per state
+	// that may be created
+	idle  chan *luaState
+	slots chan struct{}
+}
+
+// luaState is a Lua interpreter running the script, used by one call at a
+// time
+type luaState struct {
+	L *lua.LState
+	// conn is the connection of the call in progress, for log
+	conn *ConnInfo
+}
+
+// luaVerdict is what a hook returned
+type luaVerdict struct {
+	deny    string
+	denied  bool
+	command []string
+	fields  map[string]any
+}
+
+// loadLua adds the interceptor of the lua script, after the plugins
+func (p *Proxy) loadLua() error {
+	if p.config.Lua == nil {
+		return nil
+	}
+	script, err := newLuaScript(p.logger, p.config.Lua)
+	if err != nil {
+		return fmt.Errorf("failed to load Lua script %s: %w", p.config.Lua.Script, err)
+	}
+	p.interceptors = append(p.interceptors, script)
+	p.logger.Info("Loaded Lua script", zap.String("path", p.config.Lua.Script))
+	return nil
+}
+
+func newLuaScript(logger *zap.Logger, cfg *config.LuaConfig) (*luaScript, error) {
+	f, err := os.Open(cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(bufio.NewReader(f), cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultLuaTimeout
+	if cfg.TimeoutMs > 0 {
+		timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	states := cfg.States
+	if states == 0 {
+		states = defaultLuaStates
+	}
+	l := &luaScript{
+		logger:     logger,
+		proto:      proto,
+		timeout:    timeout,
+		failClosed: cfg.FailClosed,
+		idle:       make(chan *luaState, states),
+		slots:      make(chan struct{}, states),
+	}
+
+	// Run once up front, so that a script failing to load stops the proxy
+	// rather than every command
+	l.slots <- struct{}{}
+	st, err := l.newState()
+	if err != nil {
+		return nil, err
+	}
+	l.hasConnect = st.L.GetGlobal("on_connect").Type() == lua.LTFunction
+	l.hasCommand = st.L.GetGlobal("on_command").Type() == lua.LTFunction
+	if !l.hasConnect && !l.hasCommand {
+		st.L.Close()
+		return nil, errors.New("script defines neither on_command nor on_connect")
+	}
+	l.idle <- st
+	return l, nil
+}
+
+// newState starts an interpreter with the base, table, string and math
+// libraries, without file access, and runs the script in it
+func (l *luaScript) newState() (*luaState, error) {
+	st := &luaState{L: lua.NewState(lua.Options{SkipOpenLibs: true})}
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		st.L.Push(st.L.NewFunction(lib.open))
+		st.L.Push(lua.LString(lib.name))
+		st.L.Call(1, 0)
+	}
+	st.L.SetGlobal("dofile", lua.LNil)
+	st.L.SetGlobal("loadfile", lua.LNil)
+	st.L.SetGlobal("log", st.L.NewFunction(l.log(st)))
+
+	st.L.Push(st.L.NewFunctionFromProto(l.proto))
+	if err := st.L.PCall(0, lua.MultRet, nil); err != nil {
+		st.L.Close()
+		return nil, err
+	}
+	st.L.SetTop(0)
+	return st, nil
+}
+
+// acquire takes an idle state, creating one while under the limit and
+// otherwise waiting for one to be released
+func (l *luaScript) acquire() (*luaState, error) {
+	select {
+	case st := <-l.idle:
+		return st, nil
+	default:
+	}
+	select {
+	case st := <-l.idle:
+		return st, nil
+	case l.slots <- struct{}{}:
+		st, err := l.newState()
+		if err != nil {
+			<-l.slots
+		}
+		return st, err
+	}
+}
+
+// release returns a state after a call, discarding one the call failed in,
+// as it may have been left half way through the script
+func (l *luaScript) release(st *luaState, failed bool) {
+	st.conn = nil
+	if failed {
+		st.L.Close()
+		<-l.slots
+		return
+	}
+	l.idle <- st
+}
+
+func (l *luaScript) OnConnect(conn *ConnInfo) error {
+	if !l.hasConnect {
+		return nil
+	}
+	verdict, err := l.call("on_connect", conn, func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{luaConn(L, conn)}
+	})
+	if err != nil {
+		l.logger.Error("Lua script failed",
+			zap.String("hook", "on_connect"),
+			zap.Uint64("connection_id", conn.ID),
+			zap.Error(err),
+		)
+		if l.failClosed {
+			return errors.New("script failed")
+		}
+		return nil
+	}
+	if verdict != nil && verdict.denied {
+		return errors.New(verdict.deny)
+	}
+	return nil
+}
+
+func (l *luaScript) OnCommand(conn *ConnInfo, call *Call) error {
+	if !l.hasCommand {
+		return nil
+	}
+	verdict, err := l.call("on_command", conn, func(L *lua.LState) []lua.LValue {
+		args := L.CreateTable(len(call.Command.Args), 0)
+		for _, arg := range call.Command.Args {
+			args.Append(lua.LString(arg))
+		}
+		return []lua.LValue{lua.LString(call.Command.Name), args, luaConn(L, conn)}
+	})
+	if err != nil {
+		l.logger.Error("Lua script failed",
+			zap.String("hook", "on_command"),
+			zap.Uint64("connection_id", conn.ID),
+			zap.String("command", call.Command.Name),
+			zap.Error(err),
+		)
+		if l.failClosed {
+			return errors.New("script failed")
+		}
+		return nil
+	}
+	if verdict == nil {
+		return nil
+	}
+
+	for key, value := range verdict.fields {
+		call.Annotate(zap.Any(key, value))
+	}
+	if len(verdict.command) > 0 {
+		call.Command.Name, call.Command.Args = verdict.command[0], verdict.command[1:]
+	}
+	if verdict.denied {
+		return errors.New(verdict.deny)
+	}
+	return nil
+}
+
+// call runs a hook with the arguments args builds and decodes what it
+// returned
+func (l *luaScript) call(hook string, conn *ConnInfo, args func(L *lua.LState) []lua.LValue) (*luaVerdict, error) {
+	st, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	st.conn = conn
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	st.L.SetContext(ctx)
+
+	err = st.L.CallByParam(lua.P{Fn: st.L.GetGlobal(hook), NRet: 2, Protect: true}, args(st.L)...)
+	var verdict *luaVerdict
+	if err == nil {
+		verdict, err = decodeVerdict(st.L.Get(-2), st.L.Get(-1))
+		st.L.Pop(2)
+	}
+	st.L.RemoveContext()
+	l.release(st, err != nil)
+	return verdict, err
+}
+
+// decodeVerdict reads a hook's return values: nothing or true to allow,
+// false and an optional message to deny, or a verdict table
+func decodeVerdict(ret, message lua.LValue) (*luaVerdict, error) {
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		if ret {
+			return nil, nil
+		}
+		deny := "denied by script"
+		if s, ok := message.(lua.LString); ok && s != "" {
+			deny = string(s)
+		}
+		return &luaVerdict{deny: deny, denied: true}, nil
+	case *lua.LTable:
+		verdict := &luaVerdict{}
+		switch deny := ret.RawGetString("deny").(type) {
+		case lua.LString:
+			verdict.deny, verdict.denied = string(deny), true
+		case *lua.LNilType:
+		default:
+			return nil, fmt.Errorf("deny must be a string, not %s", deny.Type())
+		}
+		if name, ok := ret.RawGetString("command").(lua.LString); ok {
+			verdict.command = []string{string(name)}
+			if args, ok := ret.RawGetString("args").(*lua.LTable); ok {
+				for i := 1; i <= args.Len(); i++ {
+					verdict.command = append(verdict.command, args.RawGetInt(i).String())
+				}
+			}
+		} else if ret.RawGetString("args") != lua.LNil {
+			return nil, errors.New("args requires command")
+		}
+		if fields, ok := ret.RawGetString("fields").(*lua.LTable); ok {
+			verdict.fields = map[string]any{}
+			fields.ForEach(func(k, v lua.LValue) {
+				verdict.fields[k.String()] = luaValue(v)
+			})
+		}
+		return verdict, nil
+	default:
+		return nil, fmt.Errorf("hook returned a %s", ret.Type())
+	}
+}
+
+// luaConn describes a connection to the script
+func luaConn(L *lua.LState, conn *ConnInfo) *lua.LTable {
+	t := L.CreateTable(0, 4)
+	t.RawSetString("id", lua.LNumber(conn.ID))
+	t.RawSetString("client_addr", lua.LString(conn.ClientAddr))
+	t.RawSetString("listener", lua.LString(conn.Listener))
+	t.RawSetString("identity", lua.LString(conn.Identity))
+	return t
+}
+
+// luaValue converts a Lua value to log, with tables as arrays when they
+// have a sequence and as objects otherwise
+func luaValue(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if f := float64(v); f == float64(int64(f)) {
+			return int64(f)
+		}
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.Len(); n > 0 {
+			values := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				values = append(values, luaValue(v.RawGetInt(i)))
+			}
+			return values
+		}
+		values := map[string]any{}
+		v.ForEach(func(k, value lua.LValue) {
+			values[k.String()] = luaValue(value)
+		})
+		return values
+	default:
+		return v.String()
+	}
+}
+
+// log is the script's log(message, fields) function
+func (l *luaScript) log(st *luaState) lua.LGFunction {
+	return func(L *lua.LState) int {
+		fields := []zap.Field{zap.String("message", L.CheckString(1))}
+		if t, ok := L.Get(2).(*lua.LTable); ok {
+			t.ForEach(func(k, v lua.LValue) {
+				fields = append(fields, zap.Any(k.String(), luaValue(v)))
+			})
+		}
+		if st.conn != nil {
+			fields = append(fields, zap.Uint64("connection_id", st.conn.ID), zap.String("client_addr", st.conn.ClientAddr))
+		}
+		l.logger.Info("Lua script log", fields...)
+		return 0
+	}
+}
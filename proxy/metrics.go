@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// handleMetrics serves the proxy's metrics in the Prometheus text
+// exposition format
+func (p *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	p.connLimit.writeMetrics(&b)
+	p.latencies.writeMetrics(&b)
+	p.canary.writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// writeMetrics writes the client connection counts
+func (l *connLimit) writeMetrics(b *strings.Builder) {
+	b.WriteString("# HELP redislogger_connections Open client connections.\n")
+	b.WriteString("# TYPE redislogger_connections gauge\n")
+	fmt.Fprintf(b, "redislogger_connections %d\n", l.current.Load())
+	b.WriteString("# HELP redislogger_connections_peak Most client connections open at once since the proxy started.\n")
+	b.WriteString("# TYPE redislogger_connections_peak gauge\n")
+	fmt.Fprintf(b, "redislogger_connections_peak %d\n", l.peak.Load())
+	b.WriteString("# HELP redislogger_connections_rejected_total Client connections refused by max_connections.\n")
+	b.WriteString("# TYPE redislogger_connections_rejected_total counter\n")
+	fmt.Fprintf(b, "redislogger_connections_rejected_total %d\n", l.rejected.Load())
+}
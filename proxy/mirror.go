@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// defaultMirrorQueueSize is the number of writes buffered for the mirror
+// when mirror_queue_size is unset
+const defaultMirrorQueueSize = 10000
+
+// mirror duplicates forwarded writes to a shadow Redis over its own
+// connection, for dark-launch testing with real traffic. Writes are never
+// delayed by it: when the mirror falls behind, they are dropped.
+type mirror struct {
+	proxy  *Proxy
+	logger *zap.Logger
+	addr   string
+	queue  chan []byte
+
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+	overflow atomic.Bool
+}
+
+func newMirror(p *Proxy) *mirror {
+	if p.config.MirrorAddr == "" {
+		return nil
+	}
+	size := p.config.MirrorQueueSize
+	if size == 0 {
+		size = defaultMirrorQueueSize
+	}
+	return &mirror{
+		proxy:  p,
+		logger: p.logger.With(zap.String("component", "mirror"), zap.String("mirror_addr", p.config.MirrorAddr)),
+		addr:   p.config.MirrorAddr,
+		queue:  make(chan []byte, size),
+	}
+}
+
+// send queues a forwarded command for the mirror if it is a write.
+// Blocking commands are not mirrored, as they would stall the mirror's
+// only connection.
+func (m *mirror) send(req *request) {
+	if m == nil || !req.cmd.IsWrite() {
+		return
+	}
+	if spec := protocol.LookupCommand(req.name); spec != nil && spec.Flags&protocol.FlagBlocking != 0 {
+		return
+	}
+
+	select {
+	case m.queue <- req.cmd.Message:
+		if m.overflow.Swap(false) {
+			m.logger.Info("Mirror caught up", zap.Uint64("dropped", m.dropped.Load()))
+		}
+	default:
+		m.dropped.Add(1)
+		if !m.overflow.Swap(true) {
+			m.logger.Warn("Mirror queue full, dropping writes", zap.Int("queue_size", cap(m.queue)))
+		}
+	}
+}
+
+// run keeps a connection to the mirror open, reconnecting with backoff,
+// until the context is cancelled
+func (m *mirror) run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		conn, err := m.proxy.dialAddr(ctx, m.addr, nil)
+		if err != nil {
+			m.logger.Warn("Failed to connect to mirror", zap.Error(err), zap.Duration("retry_in", backoff))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		m.logger.Info("Connected to mirror")
+		err = m.forward(ctx, conn)
+		conn.Close()
+		if ctx.Err() == nil {
+			m.logger.Warn("Lost connection to mirror", zap.Error(err))
+		}
+	}
+}
+
+// forward writes queued commands to the mirror and discards its replies,
+// counting the errors among them
+func (m *mirror) forward(ctx context.Context, conn net.Conn) error {
+	readErr := make(chan error, 1)
+	go func() {
+		replies := protocol.NewReplyReader(conn)
+		for {
+			reply, err := replies.ReadReply()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if reply.IsError() {
+				m.failed.Add(1)
+				m.logger.Debug("Mirror replied with an error", zap.String("error", reply.Str))
+			}
+		}
+	}()
+
+	writer := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case msg := <-m.queue:
+			writer.Write(msg)
+			m.sent.Add(1)
+			// Batch whatever else is already queued into one write
+			for n := len(m.queue); n > 0 && writer.Buffered() < 64<<10; n-- {
+				writer.Write(<-m.queue)
+				m.sent.Add(1)
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *mirror) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"addr":    m.addr,
+		"queued":  len(m.queue),
+		"sent":    m.sent.Load(),
+		"dropped": m.dropped.Load(),
+		"errors":  m.failed.Load(),
+	})
+}
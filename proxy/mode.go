@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// Proxy modes, switched through the admin API around backend maintenance
+const (
+	modeNormal      = "normal"
+	modeReadOnly    = "read-only"
+	modeMaintenance = "maintenance"
+)
+
+// defaultMaintenanceMessage is returned in maintenance mode unless a
+// message is configured
+const defaultMaintenanceMessage = "the proxy is in maintenance mode"
+
+// proxyMode is the mode the proxy serves clients in
+type proxyMode struct {
+	logger *zap.Logger
+	// message is the configured maintenance message, used when an
+	// operator gives none
+	message string
+	current atomic.Pointer[modeState]
+	refused atomic.Uint64
+}
+
+// modeState is a mode as set from the config or by an operator
+type modeState struct {
+	Mode     string
+	Message  string
+	Operator string
+	Since    time.Time
+}
+
+func newProxyMode(logger *zap.Logger, cfg *config.Config) *proxyMode {
+	m := &proxyMode{logger: logger, message: cfg.MaintenanceMessage}
+	mode := cfg.Mode
+	if mode == "" {
+		mode = modeNormal
+	}
+	m.current.Store(m.newState(mode, "", ""))
+	return m
+}
+
+func (m *proxyMode) newState(mode, message, operator string) *modeState {
+	st := &modeState{Mode: mode, Operator: operator, Since: time.Now()}
+	if mode == modeMaintenance {
+		if message == "" {
+			message = m.message
+		}
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		// The message is sent as a single RESP error line
+		st.Message = strings.Join(strings.Fields(message), " ")
+	}
+	return st
+}
+
+// check refuses writes in read-only mode and every command but QUIT in
+// maintenance mode
+func (m *proxyMode) check(s *session, req *request) []byte {
+	st := m.current.Load()
+	switch {
+	case st.Mode == modeReadOnly && req.cmd.IsWrite():
+		m.refused.Add(1)
+		s.logger.Info("Command refused in read-only mode", zap.String("command", req.cmd.Name))
+		return []byte("-READONLY You can't write against a read only proxy.\r\n")
+	case st.Mode == modeMaintenance && req.name != "QUIT":
+		m.refused.Add(1)
+		s.logger.Info("Command refused in maintenance mode", zap.String("command", req.cmd.Name))
+		return []byte(fmt.Sprintf("-ERR %s\r\n", st.Message))
+	}
+	return nil
+}
+
+func (m *proxyMode) status() map[string]any {
+	st := m.current.Load()
+	return map[string]any{
+		"mode":     st.Mode,
+		"message":  st.Message,
+		"operator": st.Operator,
+		"since":    st.Since,
+		"refused":  m.refused.Load(),
+	}
+}
+
+func (m *proxyMode) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.status())
+}
+
+func (m *proxyMode) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		http.Error(w, "X-Operator header is required", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Mode    string `json:"mode"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch body.Mode {
+	case modeNormal, modeReadOnly, modeMaintenance:
+	default:
+		http.Error(w, `mode must be "normal", "read-only" or "maintenance"`, http.StatusBadRequest)
+		return
+	}
+
+	st := m.newState(body.Mode, body.Message, operator)
+	previous := m.current.Swap(st)
+	m.logger.Warn("Proxy mode changed",
+		zap.String("mode", st.Mode),
+		zap.String("previous_mode", previous.Mode),
+		zap.String("message", st.Message),
+		zap.String("operator", operator),
+	)
+	writeJSON(w, http.StatusOK, m.status())
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// defaultMuxConnections is the number of shared connections when
+// multiplex.connections is not set
+const defaultMuxConnections = 8
+
+// multiplexer pipelines the commands of every session over a bounded set
+// of shared Redis connections. Each session is pinned to one of them, so
+// its commands still reach Redis in the order it sent them, and replies
+// are matched to sessions in the order their commands were written.
+type multiplexer struct {
+	proxy *Proxy
+	slots []*muxSlot
+	next  atomic.Uint64
+}
+
+// muxSlot is one of the shared connections, dialed when first used and
+// redialed after it fails
+type muxSlot struct {
+	id       int
+	mux      *multiplexer
+	sessions atomic.Int64
+
+	// mu serializes writes, so that commands reach Redis in the order
+	// their sessions wait for replies. link is only replaced under it.
+	mu   sync.Mutex
+	link atomic.Pointer[muxLink]
+}
+
+// muxLink is a single connection of a slot and the sessions awaiting its
+// replies, one entry per command
+type muxLink struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	waiting []*muxStream
+	failed  bool
+}
+
+func newMultiplexer(p *Proxy, cfg *config.MultiplexConfig) *multiplexer {
+	if cfg == nil {
+		return nil
+	}
+	n := cfg.Connections
+	if n == 0 {
+		n = defaultMuxConnections
+	}
+	m := &multiplexer{proxy: p, slots: make([]*muxSlot, n)}
+	for i := range m.slots {
+		m.slots[i] = &muxSlot{id: i, mux: m}
+	}
+	return m
+}
+
+// stream returns the upstream connection of a new session, pinned to one
+// of the shared connections
+func (m *multiplexer) stream() *muxStream {
+	slot := m.slots[m.next.Add(1)%uint64(len(m.slots))]
+	slot.sessions.Add(1)
+	return &muxStream{slot: slot, ready: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// multiplexUnsupported reports commands that would change the state of a
+// shared connection, or hold it while they block. Commands missing from
+// the command table might do either, so they are reported too.
+func multiplexUnsupported(req *request) bool {
+	if protocol.LookupCommand(req.name) == nil {
+		return true
+	}
+	switch req.name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE",
+		"MONITOR", "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH", "SELECT", "HELLO", "AUTH",
+		"RESET", "READONLY", "READWRITE":
+		return true
+	case "CLIENT":
+		if len(req.cmd.Args) == 0 {
+			return false
+		}
+		switch strings.ToUpper(req.cmd.Args[0]) {
+		case "REPLY", "SETNAME", "SETINFO", "TRACKING", "CACHING", "NO-EVICT", "NO-TOUCH":
+			return true
+		}
+		return false
+	}
+	return blocks(req)
+}
+
+// blocks reports commands that may wait on Redis for data to arrive
+func blocks(req *request) bool {
+	switch req.name {
+	case "WAIT", "WAITAOF":
+		// Wait for replicas or the AOF to catch up
+		return true
+	case "XREAD", "XREADGROUP":
+		// Only blocking with the BLOCK option
+		for _, arg := range req.cmd.Args {
+			if strings.EqualFold(arg, "BLOCK") {
+				return true
+			}
+		}
+		return false
+	}
+	spec := protocol.LookupCommand(req.name)
+	return spec != nil && spec.Flags&protocol.FlagBlocking != 0
+}
+
+// write sends a session's command on the slot's connection, dialing it
+// first if needed
+func (sl *muxSlot) write(s *muxStream, b []byte) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	link := sl.link.Load()
+	if link == nil || link.isFailed() {
+		logger := sl.mux.proxy.logger.With(zap.Int("mux_conn", sl.id))
+		conn, err := sl.mux.proxy.dialRetry(context.Background(), logger, "", nil)
+		if err != nil {
+			return err
+		}
+		logger.Info("Multiplexed connection to Redis established")
+		link = &muxLink{conn: conn}
+		sl.link.Store(link)
+		go sl.readReplies(link, logger)
+	}
+
+	// Queued before writing, as the reply may arrive before Write returns
+	if !link.push(s) {
+		return net.ErrClosed
+	}
+	if _, err := link.conn.Write(b); err != nil {
+		link.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readReplies hands each reply on a link to the session at the head of
+// its queue, until the connection fails
+func (sl *muxSlot) readReplies(link *muxLink, logger *zap.Logger) {
+	reader := protocol.NewReplyReader(link.conn)
+	for {
+		reply, err := reader.ReadReply()
+		if err != nil {
+			if inFlight := link.fail(err); inFlight > 0 || !isConnClosed(err) {
+				logger.Warn("Lost multiplexed connection to Redis", zap.Int("in_flight", inFlight), zap.Error(err))
+			}
+			sl.mux.proxy.upstreamClosed(link.conn)
+			return
+		}
+		s := link.pop()
+		if s == nil {
+			logger.Warn("Dropped reply no session was waiting for", zap.String("reply", truncateValue(renderReply(reply))))
+			continue
+		}
+		s.deliver(reply.Message)
+	}
+}
+
+func (l *muxLink) push(s *muxStream) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return false
+	}
+	l.waiting = append(l.waiting, s)
+	return true
+}
+
+func (l *muxLink) pop() *muxStream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) == 0 {
+		return nil
+	}
+	s := l.waiting[0]
+	l.waiting[0] = nil
+	l.waiting = l.waiting[1:]
+	return s
+}
+
+func (l *muxLink) isFailed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failed
+}
+
+// fail closes the link and ends every session awaiting a reply on it,
+// returning how many replies were lost
+func (l *muxLink) fail(err error) int {
+	l.conn.Close()
+	l.mu.Lock()
+	waiting := l.waiting
+	l.waiting, l.failed = nil, true
+	l.mu.Unlock()
+
+	for _, s := range waiting {
+		s.fail(err)
+	}
+	return len(waiting)
+}
+
+// muxStream is a session's view of its shared connection: writes are
+// pipelined on it and reads return the replies meant for the session
+type muxStream struct {
+	slot  *muxSlot
+	mu    sync.Mutex
+	buf   []byte
+	err   error
+	ready chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			n := copy(p, s.buf)
+			s.buf = s.buf[n:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// Write sends a single command, which Redis answers with exactly one
+// reply
+func (s *muxStream) Write(b []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := s.slot.write(s, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *muxStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.slot.sessions.Add(-1)
+	})
+	return nil
+}
+
+// deliver buffers a reply for the session, dropping it once the session
+// has closed
+func (s *muxStream) deliver(reply []byte) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.mu.Lock()
+	s.buf = append(s.buf, reply...)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *muxStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *muxStream) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return muxAddr(s.slot.id) }
+func (s *muxStream) RemoteAddr() net.Addr { return muxAddr(s.slot.id) }
+
+// Deadlines would apply to every session sharing the connection, so they
+// are not supported
+func (s *muxStream) SetDeadline(time.Time) error      { return nil }
+func (s *muxStream) SetReadDeadline(time.Time) error  { return nil }
+func (s *muxStream) SetWriteDeadline(time.Time) error { return nil }
+
+// muxAddr names the shared connection a session is pinned to
+type muxAddr int
+
+func (a muxAddr) Network() string { return "multiplex" }
+func (a muxAddr) String() string  { return fmt.Sprintf("multiplex/%d", int(a)) }
+
+func (m *multiplexer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	type slotStatus struct {
+		ID        int    `json:"id"`
+		Connected bool   `json:"connected"`
+		Addr      string `json:"addr,omitempty"`
+		Sessions  int64  `json:"sessions"`
+		InFlight  int    `json:"in_flight"`
+	}
+	slots := make([]slotStatus, 0, len(m.slots))
+	for _, sl := range m.slots {
+		status := slotStatus{ID: sl.id, Sessions: sl.sessions.Load()}
+		if link := sl.link.Load(); link != nil {
+			link.mu.Lock()
+			status.Connected = !link.failed
+			status.InFlight = len(link.waiting)
+			link.mu.Unlock()
+			if status.Connected {
+				status.Addr = link.conn.RemoteAddr().String()
+			}
+		}
+		slots = append(slots, status)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"connections": slots})
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// namespaceEscapes reach every key of the database whatever their prefix,
+// name keys the proxy cannot rewrite, or use channels, which namespaces do
+// not cover, so namespaced clients may not send them
+var namespaceEscapes = map[string]bool{
+	"RANDOMKEY": true,
+	"DBSIZE":    true,
+	"FLUSHDB":   true,
+	"FLUSHALL":  true,
+	"SWAPDB":    true,
+	"MIGRATE":   true,
+	// Scripts may compute the names of the keys they access
+	"EVAL": true, "EVALSHA": true, "EVAL_RO": true, "EVALSHA_RO": true,
+	"FCALL": true, "FCALL_RO": true,
+	"PUBLISH": true, "SPUBLISH": true, "PUBSUB": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+}
+
+// keyNamingReplies are the commands whose replies name keys
+var keyNamingReplies = map[string]bool{
+	"KEYS": true, "SCAN": true,
+	"BLPOP": true, "BRPOP": true, "BZPOPMIN": true, "BZPOPMAX": true,
+	"LMPOP": true, "BLMPOP": true, "ZMPOP": true, "BZMPOP": true,
+	"XREAD": true, "XREADGROUP": true,
+}
+
+// namespace returns the key prefix of the session's client, or "" when no
+// namespace applies to it
+func (p *Proxy) namespace(s *session) string {
+	if len(p.config.Namespaces) == 0 {
+		return ""
+	}
+	var clientIP string
+	if ip := remoteIP(s.client); ip != nil {
+		clientIP = ip.String()
+	}
+	clients := []string{s.user, s.identity, clientIP}
+	for _, rule := range p.config.Namespaces {
+		if ruleApplies(rule.Clients, clients) {
+			return rule.Prefix
+		}
+	}
+	return ""
+}
+
+// rewriteKeys places the keys of a command under the client's namespace,
+// re-encoding the frame that is forwarded to Redis. Commands that would
+// reach outside the namespace are refused.
+func (p *Proxy) rewriteKeys(s *session, req *request) []byte {
+	prefix := p.namespace(s)
+	if prefix == "" {
+		return nil
+	}
+	if namespaceEscapes[req.name] || protocol.LookupCommand(req.name) == nil || sortPatterns(req) {
+		s.logger.Warn("Command refused in namespace",
+			zap.String("command", req.cmd.Name),
+			zap.String("namespace", prefix),
+		)
+		return []byte(fmt.Sprintf("-ERR %s is not allowed in a key namespace\r\n", req.name))
+	}
+
+	args := slices.Clone(req.cmd.Args)
+	positions := req.cmd.KeyPositions()
+	for _, pos := range positions {
+		args[pos] = prefix + args[pos]
+	}
+	rewritten := len(positions) > 0
+	switch req.name {
+	case "KEYS":
+		if len(args) > 0 {
+			args[0] = escapeGlob(prefix) + args[0]
+			rewritten = true
+		}
+	case "SCAN":
+		if len(args) > 0 {
+			args = scanInNamespace(args, prefix)
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return nil
+	}
+
+	req.namespace = prefix
+	req.cmd.Args = args
+	req.cmd.Message = encodeCommand(append([]string{req.cmd.Name}, args...)...)
+	// The forwarded frame no longer matches what the client sent
+	req.checksum = nil
+	return nil
+}
+
+// sortPatterns reports whether a SORT names keys through the patterns of
+// its BY or GET options, whose keys are computed from the elements sorted.
+// Patterns without a '*' name no keys.
+func sortPatterns(req *request) bool {
+	if req.name != "SORT" && req.name != "SORT_RO" {
+		return false
+	}
+	args := req.cmd.Args
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BY", "GET":
+			if strings.Contains(args[i+1], "*") {
+				return true
+			}
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return false
+}
+
+// scanInNamespace limits a SCAN to the namespace, prefixing its MATCH
+// pattern or adding one
+func scanInNamespace(args []string, prefix string) []string {
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.EqualFold(args[i], "MATCH") {
+			args[i+1] = escapeGlob(prefix) + args[i+1]
+			return args
+		}
+	}
+	return append(args, "MATCH", escapeGlob(prefix)+"*")
+}
+
+// escapeGlob escapes the characters a Redis glob pattern treats specially
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// stripNamespace removes the namespace prefix from the key names in a
+// reply, returning the frame to send the client instead, or nil when the
+// reply names no keys
+func stripNamespace(req *request, reply *protocol.Reply) []byte {
+	if req.namespace == "" || !keyNamingReplies[req.name] || !isAggregate(reply) {
+		return nil
+	}
+
+	var keys []*protocol.Reply
+	switch req.name {
+	case "KEYS":
+		keys = reply.Elems
+	case "SCAN":
+		if len(reply.Elems) == 2 {
+			keys = reply.Elems[1].Elems
+		}
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX", "LMPOP", "BLMPOP", "ZMPOP", "BZMPOP":
+		// The key popped from comes first
+		if len(reply.Elems) > 0 {
+			keys = reply.Elems[:1]
+		}
+	case "XREAD", "XREADGROUP":
+		// A map of stream names in RESP3, pairs of name and entries in RESP2
+		if reply.Type == '%' {
+			for i := 0; i < len(reply.Elems); i += 2 {
+				keys = append(keys, reply.Elems[i])
+			}
+			break
+		}
+		for _, stream := range reply.Elems {
+			if len(stream.Elems) > 0 {
+				keys = append(keys, stream.Elems[0])
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, key := range keys {
+		key.Str = strings.TrimPrefix(key.Str, req.namespace)
+	}
+	return encodeReply(nil, reply)
+}
+
+// encodeReply appends the RESP encoding of a reply to buf
+func encodeReply(buf []byte, r *protocol.Reply) []byte {
+	if len(r.Attrs) > 0 {
+		buf = append(buf, '|')
+		buf = strconv.AppendInt(buf, int64(len(r.Attrs)/2), 10)
+		buf = append(buf, "\r\n"...)
+		for _, attr := range r.Attrs {
+			buf = encodeReply(buf, attr)
+		}
+	}
+
+	switch {
+	case r.Type == '_':
+		return append(buf, "_\r\n"...)
+	case r.Null:
+		return append(buf, r.Type, '-', '1', '\r', '\n')
+	case r.Type == '$' || r.Type == '!' || r.Type == '=':
+		buf = append(buf, r.Type)
+		buf = strconv.AppendInt(buf, int64(len(r.Str)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, r.Str...)
+		return append(buf, "\r\n"...)
+	case isAggregate(r):
+		count := len(r.Elems)
+		if r.Type == '%' {
+			count /= 2
+		}
+		buf = append(buf, r.Type)
+		buf = strconv.AppendInt(buf, int64(count), 10)
+		buf = append(buf, "\r\n"...)
+		for _, elem := range r.Elems {
+			buf = encodeReply(buf, elem)
+		}
+		return buf
+	default:
+		buf = append(buf, r.Type)
+		buf = append(buf, r.Str...)
+		return append(buf, "\r\n"...)
+	}
+}
@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// natsTimeout bounds connecting to NATS and waiting for JetStream
+// acknowledgments
+const natsTimeout = 5 * time.Second
+
+// natsBatchSize bounds the messages published in one write
+const natsBatchSize = 100
+
+// natsPublisher publishes a message for every forwarded command to NATS,
+// speaking the client protocol on a connection of its own. Messages are
+// queued and published in batches by a single sender. With JetStream, each
+// message carries a reply subject on which the stream acknowledges it, and
+// those left unacknowledged are republished.
+type natsPublisher struct {
+	*batcher[*sinkRecord]
+	url       *url.URL
+	subject   string
+	jetStream bool
+	attempts  int
+	logger    *zap.Logger
+	batch     []*natsPublication
+
+	conn *natsConn
+	// inbox prefixes the reply subjects of JetStream acknowledgments
+	inbox  string
+	nextID uint64
+}
+
+// natsPublication is an encoded message awaiting publication
+type natsPublication struct {
+	subject string
+	payload []byte
+}
+
+// natsConn is a connection to the server. Its reader answers the server's
+// PINGs and delivers JetStream acknowledgments until the connection fails.
+type natsConn struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	w          *bufio.Writer
+	maxPayload int
+	acks       chan natsAck
+	done       chan struct{}
+	err        error
+}
+
+// natsAck is JetStream's answer to the message with the given id
+type natsAck struct {
+	id  uint64
+	err string
+}
+
+func newNATSPublisher(logger *zap.Logger, cfg *config.NATSConfig) *natsPublisher {
+	if cfg == nil {
+		return nil
+	}
+	// Validated when the config is loaded
+	u, _ := url.Parse(cfg.URL)
+	n := &natsPublisher{
+		url:       u,
+		subject:   cfg.Subject,
+		jetStream: cfg.JetStream,
+		attempts:  cfg.MaxAttempts,
+		logger:    logger.With(zap.String("nats", u.Host)),
+	}
+	if n.subject == "" {
+		n.subject = "redislogger.commands"
+	}
+	if n.attempts == 0 {
+		n.attempts = 4
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 10000
+	}
+	n.batcher = newBatcher(n.logger, n, queueSize, 0, "NATS queue full, messages dropped")
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	n.inbox = "_INBOX." + hex.EncodeToString(nonce[:])
+	return n
+}
+
+// OnEvent queues the message of a forwarded command once its reply
+// arrives, dropping it when the queue is full
+func (n *natsPublisher) OnEvent(e Event) {
+	if re, ok := e.(*ResponseEvent); ok {
+		n.enqueue(responseRecord(re))
+	}
+}
+
+// run publishes the queued messages until the context is cancelled
+func (n *natsPublisher) run(ctx context.Context) {
+	defer func() {
+		if n.conn != nil {
+			n.conn.close(nil)
+		}
+	}()
+	n.batcher.run(ctx)
+}
+
+func (n *natsPublisher) add(msg *sinkRecord) bool {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		n.logger.Warn("Failed to encode NATS message", zap.Error(err))
+		return false
+	}
+	n.batch = append(n.batch, &natsPublication{subject: n.subjectFor(msg.Command), payload: payload})
+	return len(n.batch) >= natsBatchSize
+}
+
+// subjectFor renders the subject template for a command. Command names
+// come from clients, so only known ones are substituted and "other" stands
+// in for the rest, keeping spaces and line breaks out of the protocol.
+func (n *natsPublisher) subjectFor(command string) string {
+	name := "other"
+	if protocol.LookupCommand(command) != nil {
+		name = strings.ToLower(command)
+	}
+	return strings.ReplaceAll(n.subject, "{command}", name)
+}
+
+// send publishes the batch, reconnecting with backoff while the server is
+// unreachable. With JetStream, messages left unacknowledged are
+// republished up to the maximum attempts.
+func (n *natsPublisher) send(ctx context.Context) {
+	pending := n.batch
+	n.batch = nil
+	if len(pending) == 0 {
+		return
+	}
+	unacknowledged, failures := 0, 0
+	_, err := retry(ctx, 0, 500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		err := n.ensureConnected()
+		if err == nil {
+			pending, err = n.publish(pending)
+		}
+		if err != nil {
+			if failures == 0 {
+				n.logger.Warn("Failed to publish NATS messages, retrying", zap.Int("messages", len(pending)), zap.Error(err))
+			}
+			failures++
+			return true, err
+		}
+		if len(pending) == 0 {
+			return false, nil
+		}
+		unacknowledged++
+		return unacknowledged < n.attempts, errNATSUnacknowledged
+	})
+	switch {
+	case err == nil:
+		n.sent()
+	case errors.Is(err, errNATSUnacknowledged) && unacknowledged >= n.attempts:
+		n.logger.Warn("JetStream did not acknowledge messages",
+			zap.Int("messages", len(pending)),
+			zap.Int("attempts", unacknowledged),
+		)
+	}
+}
+
+// errNATSUnacknowledged reports messages JetStream did not acknowledge
+var errNATSUnacknowledged = errors.New("unacknowledged by JetStream")
+
+// publish writes a batch and, with JetStream, waits for its
+// acknowledgments, returning the messages left unacknowledged
+func (n *natsPublisher) publish(batch []*natsPublication) ([]*natsPublication, error) {
+	c := n.conn
+	ids := make(map[uint64]*natsPublication, len(batch))
+	c.mu.Lock()
+	for _, pub := range batch {
+		if len(pub.payload) > c.maxPayload {
+			n.logger.Warn("NATS message exceeds the server's max_payload, dropped",
+				zap.String("subject", pub.subject),
+				zap.Int("bytes", len(pub.payload)),
+			)
+			continue
+		}
+		if n.jetStream {
+			n.nextID++
+			ids[n.nextID] = pub
+			fmt.Fprintf(c.w, "PUB %s %s.%d %d\r\n", pub.subject, n.inbox, n.nextID, len(pub.payload))
+		} else {
+			fmt.Fprintf(c.w, "PUB %s %d\r\n", pub.subject, len(pub.payload))
+		}
+		c.w.Write(pub.payload)
+		c.w.WriteString("\r\n")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	err := c.w.Flush()
+	c.mu.Unlock()
+	if err != nil {
+		c.close(err)
+		n.conn = nil
+		return batch, err
+	}
+	if !n.jetStream {
+		return nil, nil
+	}
+
+	// Rejected messages are not republished, as JetStream would reject
+	// them again
+	rejected, reason := 0, ""
+	defer func() {
+		if rejected > 0 {
+			n.logger.Warn("JetStream rejected messages", zap.Int("messages", rejected), zap.String("error", reason))
+		}
+	}()
+	timeout := time.After(natsTimeout)
+	for len(ids) > 0 {
+		select {
+		case ack := <-c.acks:
+			if _, ok := ids[ack.id]; !ok {
+				// Late acknowledgment of an earlier attempt
+				continue
+			}
+			delete(ids, ack.id)
+			if ack.err != "" {
+				rejected, reason = rejected+1, ack.err
+			}
+		case <-c.done:
+			n.conn = nil
+			return slices.Collect(maps.Values(ids)), c.err
+		case <-timeout:
+			return slices.Collect(maps.Values(ids)), nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureConnected connects to the server unless connected
+func (n *natsPublisher) ensureConnected() error {
+	if n.conn != nil {
+		select {
+		case <-n.conn.done:
+			n.conn = nil
+		default:
+			return nil
+		}
+	}
+	c, err := n.connect()
+	if err != nil {
+		return err
+	}
+	n.conn = c
+	n.logger.Debug("Connected to NATS")
+	return nil
+}
+
+// natsInfo is the part of the server's INFO the publisher uses
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// connect opens a connection, upgrading it to TLS when the URL or the
+// server asks for it, and authenticates
+func (n *natsPublisher) connect() (*natsConn, error) {
+	host := n.url.Host
+	if n.url.Port() == "" {
+		host = net.JoinHostPort(n.url.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read NATS INFO: %w", err)
+	}
+	infoJSON, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	var info natsInfo
+	if !ok || json.Unmarshal([]byte(infoJSON), &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(line))
+	}
+	if n.url.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: n.url.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("NATS TLS handshake failed: %w", err)
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	opts := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "redislogger",
+		"lang":     "go",
+		"protocol": 1,
+	}
+	if user := n.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			opts["user"], opts["pass"] = user.Username(), password
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+	if n.jetStream {
+		// Have the server answer at once when no stream is bound to the
+		// subject, rather than leave the message unacknowledged
+		opts["headers"], opts["no_responders"] = true, true
+	}
+	connect, _ := json.Marshal(opts)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\n", connect)
+	if n.jetStream {
+		fmt.Fprintf(w, "SUB %s.* 1\r\n", n.inbox)
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if msg, ok := strings.CutPrefix(line, "-ERR "); ok {
+			conn.Close()
+			return nil, fmt.Errorf("NATS refused the connection: %s", msg)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &natsConn{
+		conn:       conn,
+		w:          w,
+		maxPayload: info.MaxPayload,
+		acks:       make(chan natsAck, natsBatchSize),
+		done:       make(chan struct{}),
+	}
+	if c.maxPayload == 0 {
+		c.maxPayload = 1024 * 1024
+	}
+	go n.read(c, r)
+	return c, nil
+}
+
+// read handles what the server sends until the connection fails: it
+// answers PINGs, logs errors and delivers JetStream acknowledgments
+func (n *natsPublisher) read(c *natsConn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.close(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			c.mu.Lock()
+			c.w.WriteString("PONG\r\n")
+			err = c.w.Flush()
+			c.mu.Unlock()
+			if err != nil {
+				c.close(err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR "):
+			n.logger.Warn("NATS error", zap.String("error", strings.Trim(line[5:], "'")))
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			// MSG <subject> <sid> [reply] <bytes>, or HMSG with the size of
+			// its headers ahead of the total
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 || len(fields) < 4 {
+				c.close(fmt.Errorf("malformed NATS message: %q", line))
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				c.close(err)
+				return
+			}
+			var headers []byte
+			if fields[0] == "HMSG" {
+				hdrSize, err := strconv.Atoi(fields[len(fields)-2])
+				if err != nil || hdrSize < 0 || hdrSize > size {
+					c.close(fmt.Errorf("malformed NATS message: %q", line))
+					return
+				}
+				headers, payload = payload[:hdrSize], payload[hdrSize:]
+				size -= hdrSize
+			}
+			n.deliverAck(c, fields[1], headers, payload[:size])
+		}
+	}
+}
+
+// deliverAck passes on the acknowledgment of a JetStream message, or the
+// reason it was rejected
+func (n *natsPublisher) deliverAck(c *natsConn, subject string, headers, payload []byte) {
+	idStr, ok := strings.CutPrefix(subject, n.inbox+".")
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return
+	}
+	var ack struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	ackErr := ""
+	if status, _, _ := strings.Cut(string(headers), "\r\n"); strings.HasPrefix(status, "NATS/1.0 503") {
+		// No stream is bound to the subject
+		ackErr = "no responders"
+	} else if err := json.Unmarshal(payload, &ack); err != nil {
+		ackErr = "invalid acknowledgment"
+	} else if ack.Error != nil {
+		ackErr = ack.Error.Description
+	}
+	select {
+	case c.acks <- natsAck{id: id, err: ackErr}:
+	default:
+	}
+}
+
+func (c *natsConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if err == nil {
+		err = net.ErrClosed
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// otlpExportMethod is the OTLP/gRPC logs export call
+const otlpExportMethod = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+// OpenTelemetry severity numbers
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+// otlpExporter exports a log record for every forwarded command to an
+// OpenTelemetry collector, over OTLP/gRPC or OTLP/HTTP with protobuf
+// payloads. Records are queued and exported in batches by a single sender,
+// once a batch is full or the flush interval has passed.
+type otlpExporter struct {
+	*batcher[*otlpRecord]
+	protocol  string
+	endpoint  string
+	headers   map[string]string
+	resource  []byte
+	batchSize int
+	attempts  int
+	logger    *zap.Logger
+	http      *http.Client
+	grpc      *grpc.ClientConn
+	batch     []*otlpRecord
+}
+
+// otlpRecord is a command awaiting export, with the time it was queued
+type otlpRecord struct {
+	*sinkRecord
+	observed time.Time
+}
+
+func newOTLPExporter(logger *zap.Logger, cfg *config.OTLPConfig) *otlpExporter {
+	if cfg == nil {
+		return nil
+	}
+	e := &otlpExporter{
+		protocol:  cfg.Protocol,
+		endpoint:  cfg.Endpoint,
+		headers:   cfg.Headers,
+		batchSize: cfg.BatchSize,
+		attempts:  cfg.MaxAttempts,
+		logger:    logger.With(zap.String("otlp", cfg.Endpoint)),
+	}
+	if e.protocol == "" {
+		e.protocol = "grpc"
+	}
+	attrs := map[string]string{"service.name": "redislogger"}
+	maps.Copy(attrs, cfg.ResourceAttributes)
+	e.resource = otlpResource(attrs)
+	if e.batchSize == 0 {
+		e.batchSize = 512
+	}
+	interval := time.Duration(cfg.FlushIntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = time.Second
+	}
+	if e.attempts == 0 {
+		e.attempts = 4
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 10000
+	}
+	e.batcher = newBatcher(e.logger, e, queueSize, interval, "OTLP queue full, log records dropped")
+
+	if e.protocol == "http" {
+		// Validated when the config is loaded
+		if u, _ := url.Parse(e.endpoint); strings.Trim(u.Path, "/") == "" {
+			e.endpoint = strings.TrimSuffix(e.endpoint, "/") + "/v1/logs"
+		}
+		e.http = &http.Client{Timeout: 10 * time.Second}
+		return e
+	}
+	creds := credentials.NewTLS(nil)
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(e.endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		// Only reached with a malformed target, which validation rules out
+		e.logger.Error("Failed to create OTLP client", zap.Error(err))
+		return nil
+	}
+	e.grpc = conn
+	return e
+}
+
+// OnEvent queues the record of a forwarded command once its reply
+// arrives, dropping it when the queue is full
+func (e *otlpExporter) OnEvent(ev Event) {
+	if re, ok := ev.(*ResponseEvent); ok {
+		e.enqueue(&otlpRecord{sinkRecord: responseRecord(re), observed: time.Now()})
+	}
+}
+
+// run exports the queued records until the context is cancelled, then
+// exports those already batched
+func (e *otlpExporter) run(ctx context.Context) {
+	if e.grpc != nil {
+		defer e.grpc.Close()
+	}
+	e.batcher.run(ctx)
+}
+
+func (e *otlpExporter) add(record *otlpRecord) bool {
+	e.batch = append(e.batch, record)
+	return len(e.batch) >= e.batchSize
+}
+
+// send exports the batch, retrying with exponential backoff after failures
+// the OTLP spec deems retryable
+func (e *otlpExporter) send(ctx context.Context) {
+	batch := e.batch
+	e.batch = nil
+	if len(batch) == 0 {
+		return
+	}
+	req := e.request(batch)
+	var resp []byte
+	attempts, err := retry(ctx, e.attempts, 500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		var again bool
+		var err error
+		if e.grpc != nil {
+			resp, again, err = e.exportGRPC(ctx, req)
+		} else {
+			resp, again, err = e.exportHTTP(ctx, req)
+		}
+		return again, err
+	})
+	if err != nil {
+		e.logger.Warn("Failed to export OTLP log records",
+			zap.Int("records", len(batch)),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		return
+	}
+	if rejected, msg := otlpPartialSuccess(resp); rejected > 0 {
+		e.logger.Warn("OTLP collector rejected log records", zap.Int64("records", rejected), zap.String("error", msg))
+	}
+	e.sent()
+}
+
+func (e *otlpExporter) exportGRPC(ctx context.Context, req []byte) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if len(e.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.headers))
+	}
+	var resp []byte
+	err := e.grpc.Invoke(ctx, otlpExportMethod, req, &resp, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange,
+			codes.Unavailable, codes.DataLoss, codes.ResourceExhausted:
+			return nil, true, err
+		}
+		return nil, false, err
+	}
+	return resp, false, nil
+}
+
+func (e *otlpExporter) exportHTTP(ctx context.Context, req []byte) ([]byte, bool, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(req))
+	if err != nil {
+		return nil, false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range e.headers {
+		httpReq.Header.Set(name, value)
+	}
+	resp, err := e.http.Do(httpReq)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 300 {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, true, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil, false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return body, false, nil
+}
+
+// rawCodec passes already encoded protobuf messages through gRPC
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// request encodes an ExportLogsServiceRequest holding a batch
+func (e *otlpExporter) request(batch []*otlpRecord) []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "github.com/gregyjames/RedisLogger")
+
+	var scopeLogs []byte
+	scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+	scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+	for _, record := range batch {
+		scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, record.encode())
+	}
+
+	var resourceLogs []byte
+	resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, e.resource)
+	resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, resourceLogs)
+}
+
+// otlpResource encodes a Resource with string attributes, in a stable
+// order
+func otlpResource(attrs map[string]string) []byte {
+	var resource []byte
+	for _, key := range slices.Sorted(maps.Keys(attrs)) {
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, otlpKeyValue(key, otlpString(attrs[key])))
+	}
+	return resource
+}
+
+// encode encodes the LogRecord of a command. Its body is the command name
+// and its attributes follow the database semantic conventions where they
+// apply.
+func (r *otlpRecord) encode() []byte {
+	severity, severityText := otlpSeverityInfo, "INFO"
+	if r.Error != "" {
+		severity, severityText = otlpSeverityWarn, "WARN"
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(r.Time.UnixNano()))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(severity))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, severityText)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, otlpString(r.Command))
+
+	attr := func(key string, value []byte) {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, otlpKeyValue(key, value))
+	}
+	attr("db.system.name", otlpString("redis"))
+	attr("db.operation.name", otlpString(r.Command))
+	if r.DB >= 0 {
+		attr("db.namespace", otlpString(fmt.Sprint(r.DB)))
+	}
+	attr("redislogger.Args", otlpStrings(r.Args))
+	if len(r.Keys) > 0 {
+		attr("redislogger.Keys", otlpStrings(r.Keys))
+	}
+	attr("client.address", otlpString(r.ClientAddr))
+	attr("redislogger.connection_id", otlpInt(int64(r.ConnectionID)))
+	if r.Identity != "" {
+		attr("redislogger.client_identity", otlpString(r.Identity))
+	}
+	if r.User != "" {
+		attr("enduser.id", otlpString(r.User))
+	}
+	if r.Shard != "" {
+		attr("redislogger.Shard", otlpString(r.Shard))
+	}
+	attr("redislogger.latency_us", otlpInt(r.LatencyUs))
+	attr("redislogger.reply_bytes", otlpInt(int64(r.ReplyBytes)))
+	if r.Error != "" {
+		attr("error.message", otlpString(r.Error))
+	}
+	if r.RequestID != "" {
+		attr("redislogger.seq", otlpInt(int64(r.Seq)))
+		attr("redislogger.request_id", otlpString(r.RequestID))
+	}
+
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, uint64(r.observed.UnixNano()))
+}
+
+func otlpKeyValue(key string, value []byte) []byte {
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	return protowire.AppendBytes(kv, value)
+}
+
+// otlpString encodes a string AnyValue. Protobuf strings must be valid
+// UTF-8, so binary keys and values are encoded as bytes instead.
+func otlpString(s string) []byte {
+	if !utf8.ValidString(s) {
+		v := protowire.AppendTag(nil, 7, protowire.BytesType)
+		return protowire.AppendString(v, s)
+	}
+	v := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendString(v, s)
+}
+
+// otlpInt encodes an integer AnyValue
+func otlpInt(i int64) []byte {
+	v := protowire.AppendTag(nil, 3, protowire.VarintType)
+	return protowire.AppendVarint(v, uint64(i))
+}
+
+// otlpStrings encodes an AnyValue holding an array of strings
+func otlpStrings(ss []string) []byte {
+	var array []byte
+	for _, s := range ss {
+		array = protowire.AppendTag(array, 1, protowire.BytesType)
+		array = protowire.AppendBytes(array, otlpString(s))
+	}
+	v := protowire.AppendTag(nil, 5, protowire.BytesType)
+	return protowire.AppendBytes(v, array)
+}
+
+// otlpPartialSuccess decodes the records an ExportLogsServiceResponse
+// reports rejected, and why
+func otlpPartialSuccess(resp []byte) (int64, string) {
+	partial := otlpField(resp, 1)
+	if partial == nil {
+		return 0, ""
+	}
+	var rejected int64
+	var msg string
+	for len(partial) > 0 {
+		num, typ, n := protowire.ConsumeTag(partial)
+		if n < 0 {
+			break
+		}
+		partial = partial[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(partial)
+			if m < 0 {
+				return rejected, msg
+			}
+			rejected, n = int64(v), m
+		case num == 2 && typ == protowire.BytesType:
+			v, m := protowire.ConsumeString(partial)
+			if m < 0 {
+				return rejected, msg
+			}
+			msg, n = v, m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, partial)
+		}
+		if n < 0 {
+			break
+		}
+		partial = partial[n:]
+	}
+	return rejected, msg
+}
+
+// otlpField returns the last length-delimited field num of a message, or
+// nil
+func otlpField(msg []byte, num protowire.Number) []byte {
+	var field []byte
+	for len(msg) > 0 {
+		n, typ, m := protowire.ConsumeTag(msg)
+		if m < 0 {
+			return nil
+		}
+		msg = msg[m:]
+		if n == num && typ == protowire.BytesType {
+			v, k := protowire.ConsumeBytes(msg)
+			if k < 0 {
+				return nil
+			}
+			field, m = v, k
+		} else {
+			m = protowire.ConsumeFieldValue(n, typ, msg)
+			if m < 0 {
+				return nil
+			}
+		}
+		msg = msg[m:]
+	}
+	return field
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// partitioner assigns a tenant and service to each command so that log
+// output can be split per team
+type partitioner struct {
+	rules []partitionRule
+}
+
+type partitionRule struct {
+	config.PartitionRule
+	networks []*net.IPNet
+}
+
+func newPartitioner(cfg *config.PartitionConfig) *partitioner {
+	if cfg == nil {
+		return nil
+	}
+	p := &partitioner{}
+	for _, rule := range cfg.Rules {
+		compiled := partitionRule{PartitionRule: rule}
+		for _, cidr := range rule.ClientCIDRs {
+			// CIDRs are validated when the config is loaded
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				compiled.networks = append(compiled.networks, network)
+			}
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p
+}
+
+// resolve returns the tenant and service of the first rule matching the
+// client address or the command's first key
+func (p *partitioner) resolve(clientIP net.IP, cmd *protocol.Command) (tenant, service string) {
+	if p == nil {
+		return "", ""
+	}
+
+	var key string
+	if keys := cmd.Keys(); len(keys) > 0 {
+		key = keys[0]
+	}
+
+	for _, rule := range p.rules {
+		if rule.matches(clientIP, key) {
+			return rule.Tenant, rule.Service
+		}
+	}
+	return "", ""
+}
+
+// partitionFields returns the log fields routing an entry to its partition
+func partitionFields(tenant, service string) []zap.Field {
+	fields := make([]zap.Field, 0, 2)
+	if tenant != "" {
+		fields = append(fields, zap.String("tenant", tenant))
+	}
+	if service != "" {
+		fields = append(fields, zap.String("service", service))
+	}
+	return fields
+}
+
+func (r *partitionRule) matches(clientIP net.IP, key string) bool {
+	for _, network := range r.networks {
+		if clientIP != nil && network.Contains(clientIP) {
+			return true
+		}
+	}
+	for _, prefix := range r.KeyPrefixes {
+		if key != "" && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of a connection's peer, or nil for
+// non-IP transports
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// persistenceMonitor polls INFO on a dedicated upstream connection and logs
+// RDB saves, AOF rewrites and forks, flagging those that coincide with
+// latency spikes observed by the proxy
+type persistenceMonitor struct {
+	logger *zap.Logger
+
+	interval         time.Duration
+	forkThreshold    time.Duration
+	stallThreshold   time.Duration
+	latencyThreshold time.Duration
+
+	// slowest reply and number of slow replies seen since the last poll
+	maxLatency  atomic.Int64
+	slowReplies atomic.Uint64
+
+	client  *upstreamClient
+	last    persistenceInfo
+	polled  bool
+	stalled bool
+}
+
+// persistenceInfo holds the fields of INFO persistence and INFO stats that
+// the monitor follows
+type persistenceInfo struct {
+	bgsaveInProgress  bool
+	bgsaveSeconds     int64
+	bgsaveLastStatus  string
+	bgsaveLastSeconds int64
+	rewriteInProgress bool
+	rewriteLastStatus string
+	rewriteLastSecs   int64
+	totalForks        int64
+	latestForkUsec    int64
+}
+
+func newPersistenceMonitor(p *Proxy, cfg *config.PersistenceMonitorConfig) *persistenceMonitor {
+	if cfg == nil {
+		return nil
+	}
+	m := &persistenceMonitor{
+		logger:           p.logger.With(zap.String("component", "persistence_monitor")),
+		interval:         5 * time.Second,
+		forkThreshold:    100 * time.Millisecond,
+		stallThreshold:   10 * time.Minute,
+		latencyThreshold: 100 * time.Millisecond,
+	}
+	if cfg.Interval > 0 {
+		m.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.ForkThresholdMs > 0 {
+		m.forkThreshold = time.Duration(cfg.ForkThresholdMs) * time.Millisecond
+	}
+	if cfg.StallSeconds > 0 {
+		m.stallThreshold = time.Duration(cfg.StallSeconds) * time.Second
+	}
+	if cfg.LatencyThresholdMs > 0 {
+		m.latencyThreshold = time.Duration(cfg.LatencyThresholdMs) * time.Millisecond
+	}
+	m.client = newUpstreamClient(p, m.interval)
+	return m
+}
+
+// observe records the latency of a forwarded command. Blocking commands
+// are skipped since their latency reflects waiting for data.
+func (m *persistenceMonitor) observe(req *request) {
+	if m == nil || req.sent.IsZero() {
+		return
+	}
+	if spec := protocol.LookupCommand(req.name); spec != nil && spec.Flags&protocol.FlagBlocking != 0 {
+		return
+	}
+
+	latency := int64(time.Since(req.sent))
+	if latency < int64(m.latencyThreshold) {
+		return
+	}
+	m.slowReplies.Add(1)
+	for {
+		max := m.maxLatency.Load()
+		if latency <= max || m.maxLatency.CompareAndSwap(max, latency) {
+			return
+		}
+	}
+}
+
+// run polls Redis until the context is cancelled
+func (m *persistenceMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	defer m.client.close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := m.poll()
+		if err != nil {
+			m.logger.Warn("Failed to poll persistence info", zap.Error(err))
+			continue
+		}
+		m.report(info)
+	}
+}
+
+func (m *persistenceMonitor) poll() (persistenceInfo, error) {
+	fields := make(map[string]string)
+	for _, section := range []string{"persistence", "stats"} {
+		reply, err := m.client.do("INFO", section)
+		if err != nil {
+			return persistenceInfo{}, err
+		}
+		if reply.IsError() {
+			return persistenceInfo{}, fmt.Errorf("INFO %s: %s", section, reply.Str)
+		}
+		parseInfo(reply.Str, fields)
+	}
+
+	return persistenceInfo{
+		bgsaveInProgress:  fields["rdb_bgsave_in_progress"] == "1",
+		bgsaveSeconds:     infoInt(fields, "rdb_current_bgsave_time_sec"),
+		bgsaveLastStatus:  fields["rdb_last_bgsave_status"],
+		bgsaveLastSeconds: infoInt(fields, "rdb_last_bgsave_time_sec"),
+		rewriteInProgress: fields["aof_rewrite_in_progress"] == "1",
+		rewriteLastStatus: fields["aof_last_bgrewrite_status"],
+		rewriteLastSecs:   infoInt(fields, "aof_last_rewrite_time_sec"),
+		totalForks:        infoInt(fields, "total_forks"),
+		latestForkUsec:    infoInt(fields, "latest_fork_usec"),
+	}, nil
+}
+
+// report logs the persistence events that happened since the last poll
+func (m *persistenceMonitor) report(info persistenceInfo) {
+	last := m.last
+	m.last = info
+	maxLatency := time.Duration(m.maxLatency.Swap(0))
+	slowReplies := m.slowReplies.Swap(0)
+	if !m.polled {
+		// The first poll only establishes the baseline
+		m.polled = true
+		return
+	}
+
+	var activity []string
+	if info.bgsaveInProgress || last.bgsaveInProgress {
+		activity = append(activity, "rdb_save")
+	}
+	if info.rewriteInProgress || last.rewriteInProgress {
+		activity = append(activity, "aof_rewrite")
+	}
+
+	switch {
+	case info.bgsaveInProgress && !last.bgsaveInProgress:
+		m.stalled = false
+		m.logger.Info("RDB save started")
+	case !info.bgsaveInProgress && last.bgsaveInProgress:
+		m.logFinished("RDB save finished", info.bgsaveLastStatus, info.bgsaveLastSeconds)
+	}
+	if info.bgsaveInProgress && !m.stalled && time.Duration(info.bgsaveSeconds)*time.Second >= m.stallThreshold {
+		m.stalled = true
+		m.logger.Warn("RDB save stalled", zap.Duration("elapsed", time.Duration(info.bgsaveSeconds)*time.Second))
+	}
+
+	switch {
+	case info.rewriteInProgress && !last.rewriteInProgress:
+		m.logger.Info("AOF rewrite started")
+	case !info.rewriteInProgress && last.rewriteInProgress:
+		m.logFinished("AOF rewrite finished", info.rewriteLastStatus, info.rewriteLastSecs)
+	}
+
+	fork := time.Duration(info.latestForkUsec) * time.Microsecond
+	if info.totalForks > last.totalForks {
+		activity = append(activity, "fork")
+		if fork >= m.forkThreshold {
+			m.logger.Warn("Long fork", zap.Duration("fork_time", fork),
+				zap.Int64("forks", info.totalForks-last.totalForks))
+		}
+	}
+
+	if slowReplies > 0 && len(activity) > 0 {
+		m.logger.Warn("Latency spike during persistence activity",
+			zap.Strings("activity", activity),
+			zap.Duration("max_latency", maxLatency),
+			zap.Uint64("slow_replies", slowReplies),
+			zap.Duration("latest_fork_time", fork),
+		)
+	}
+}
+
+func (m *persistenceMonitor) logFinished(msg, status string, seconds int64) {
+	fields := []zap.Field{
+		zap.String("status", status),
+		zap.Duration("duration", time.Duration(seconds)*time.Second),
+	}
+	if status != "ok" {
+		m.logger.Warn(msg, fields...)
+		return
+	}
+	m.logger.Info(msg, fields...)
+}
+
+// parseInfo adds the "field:value" lines of an INFO reply to fields
+func parseInfo(info string, fields map[string]string) {
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name] = value
+		}
+	}
+}
+
+func infoInt(fields map[string]string, name string) int64 {
+	n, _ := strconv.ParseInt(fields[name], 10, 64)
+	return n
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// pluginSymbol is the function a plugin exports to create its interceptor
+const pluginSymbol = "NewInterceptor"
+
+// loadPlugins adds the interceptors of the plugins in plugin_dir, after
+// those added with Use
+func (p *Proxy) loadPlugins() error {
+	if p.config.PluginDir == "" {
+		return nil
+	}
+	// Glob returns the matches in lexical order
+	paths, err := filepath.Glob(filepath.Join(p.config.PluginDir, "*.so"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		interceptor, err := openPlugin(path)
+		if err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", path, err)
+		}
+		p.interceptors = append(p.interceptors, interceptor)
+		p.logger.Info("Loaded interceptor plugin", zap.String("path", path))
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package proxy
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// openPlugin opens a Go plugin and creates its interceptor with the
+// NewInterceptor function it exports
+func openPlugin(path string) (Interceptor, error) {
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := plug.Lookup(pluginSymbol)
+	if err != nil {
+		return nil, err
+	}
+	newInterceptor, ok := sym.(func() (Interceptor, error))
+	if !ok {
+		return nil, fmt.Errorf("%s is a %T, not a func() (proxy.Interceptor, error)", pluginSymbol, sym)
+	}
+	return newInterceptor()
+}
@@ -0,0 +1,9 @@
+//go:build !(cgo && (linux || darwin || freebsd))
+
+package proxy
+
+import "errors"
+
+func openPlugin(path string) (Interceptor, error) {
+	return nil, errors.New("Go plugins require a cgo build on Linux, macOS or FreeBSD")
+}
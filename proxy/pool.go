@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// backendRetryDelay is how long a backend that failed to accept a
+// connection is skipped before it is tried again
+const backendRetryDelay = 5 * time.Second
+
+// backendProbeDelay gives a backend that closed a connection time to stop
+// listening if it is shutting down, before it is probed
+const backendProbeDelay = 500 * time.Millisecond
+
+// pool spreads new connections across several interchangeable Redis
+// backends, such as read replicas serving stateless traffic
+type pool struct {
+	proxy    *Proxy
+	logger   *zap.Logger
+	strategy string
+	backends []*backend
+
+	mu   sync.Mutex
+	next int
+	// serving is the backend new connections last went to under the
+	// failover strategy
+	serving *backend
+}
+
+// backend is a pool member and its health state
+type backend struct {
+	addr   string
+	weight int
+	active atomic.Int64
+
+	// current is the running total of the smooth weighted round robin,
+	// guarded by the pool's mutex
+	current int
+
+	probing atomic.Bool
+
+	mu        sync.Mutex
+	down      bool
+	retryAt   time.Time
+	lastError string
+	// failures and unhealthy are kept by the active health checker
+	failures  int
+	unhealthy bool
+}
+
+func newPool(p *Proxy, cfg *config.Config) *pool {
+	if len(cfg.Backends) < 2 || cfg.Sharding != nil {
+		return nil
+	}
+	pl := &pool{
+		proxy:    p,
+		logger:   p.logger.With(zap.String("component", "pool")),
+		strategy: cfg.Balance,
+	}
+	if pl.strategy == "" {
+		pl.strategy = "round_robin"
+	}
+	for _, b := range cfg.Backends {
+		pl.backends = append(pl.backends, &backend{addr: b.Addr, weight: b.Weight})
+	}
+	pl.serving = pl.backends[0]
+	return pl
+}
+
+// dial connects to a backend chosen by the balancing strategy, moving on
+// to the next one when a backend refuses the connection
+func (pl *pool) dial(ctx context.Context, header []byte) (net.Conn, error) {
+	tried := make(map[*backend]bool)
+	var lastErr error
+	for len(tried) < len(pl.backends) {
+		b := pl.pick(tried)
+		tried[b] = true
+
+		conn, err := pl.proxy.dialAddr(ctx, b.addr, header)
+		if err != nil {
+			b.active.Add(-1)
+			pl.markDown(b, err)
+			lastErr = err
+			continue
+		}
+		pl.markUp(b)
+		if pl.strategy == "failover" {
+			pl.serve(b)
+		}
+		return &backendConn{Conn: conn, backend: b}, nil
+	}
+	return nil, fmt.Errorf("no backend accepted the connection: %w", lastErr)
+}
+
+// pick chooses among the untried backends, preferring healthy ones
+func (pl *pool) pick(tried map[*backend]bool) *backend {
+	now := time.Now()
+	candidates := make([]*backend, 0, len(pl.backends))
+	for _, b := range pl.backends {
+		if !tried[b] && b.available(now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		// Every backend is down, so try them anyway rather than refuse
+		for _, b := range pl.backends {
+			if !tried[b] {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	b := pl.choose(candidates)
+	// Counted before dialing so concurrent picks see each other
+	b.active.Add(1)
+	return b
+}
+
+// choose applies the balancing strategy; the caller holds the pool's mutex
+func (pl *pool) choose(candidates []*backend) *backend {
+	switch pl.strategy {
+	case "weighted":
+		// Smooth weighted round robin spreads a backend's share evenly
+		// instead of sending its connections in bursts
+		var best *backend
+		total := 0
+		for _, b := range candidates {
+			b.current += b.weight
+			total += b.weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		best.current -= total
+		return best
+	case "failover":
+		// Backends are in order of preference, the first being the primary
+		return candidates[0]
+	case "least_connections":
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	default:
+		b := candidates[pl.next%len(candidates)]
+		pl.next++
+		return b
+	}
+}
+
+// serve records the backend new connections are going to, logging a
+// failover away from the primary and the failback once it recovers
+func (pl *pool) serve(b *backend) {
+	pl.mu.Lock()
+	previous := pl.serving
+	pl.serving = b
+	pl.mu.Unlock()
+
+	switch {
+	case previous == b:
+	case b == pl.backends[0]:
+		pl.logger.Info("Failed back to primary backend",
+			zap.String("backend", b.addr),
+			zap.String("standby", previous.addr),
+		)
+	default:
+		pl.logger.Warn("Failed over to standby backend",
+			zap.String("backend", b.addr),
+			zap.String("previous", previous.addr),
+		)
+	}
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.unhealthy && (!b.down || !now.Before(b.retryAt))
+}
+
+func (pl *pool) markDown(b *backend, err error) {
+	b.mu.Lock()
+	wasDown := b.down
+	b.down = true
+	b.retryAt = time.Now().Add(backendRetryDelay)
+	b.lastError = err.Error()
+	b.mu.Unlock()
+
+	if !wasDown {
+		pl.logger.Warn("Backend marked down", zap.String("backend", b.addr), zap.Error(err))
+	}
+}
+
+func (pl *pool) markUp(b *backend) {
+	b.mu.Lock()
+	wasDown := b.down
+	b.down = false
+	b.lastError = ""
+	b.mu.Unlock()
+
+	if wasDown {
+		pl.logger.Info("Backend recovered", zap.String("backend", b.addr))
+	}
+}
+
+// probe dials a backend that closed a connection, marking it down if it no
+// longer accepts connections
+func (pl *pool) probe(b *backend) {
+	if !b.probing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer b.probing.Store(false)
+		time.Sleep(backendProbeDelay)
+		conn, err := pl.proxy.dialAddr(context.Background(), b.addr, nil)
+		if err != nil {
+			pl.markDown(b, err)
+			return
+		}
+		conn.Close()
+	}()
+}
+
+// backendStatus is the health state of a backend reported by the admin API
+type backendStatus struct {
+	Addr              string `json:"addr"`
+	Weight            int    `json:"weight"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int64  `json:"active_connections"`
+	LastError         string `json:"last_error,omitempty"`
+	Labels            labels `json:"labels,omitempty"`
+}
+
+func (pl *pool) status() []backendStatus {
+	status := make([]backendStatus, 0, len(pl.backends))
+	for _, b := range pl.backends {
+		b.mu.Lock()
+		status = append(status, backendStatus{
+			Addr:              b.addr,
+			Weight:            b.weight,
+			Healthy:           !b.down && !b.unhealthy,
+			ActiveConnections: b.active.Load(),
+			LastError:         b.lastError,
+			Labels:            pl.proxy.labels.upstream(b.addr),
+		})
+		b.mu.Unlock()
+	}
+	return status
+}
+
+func (pl *pool) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"strategy": pl.strategy,
+		"backends": pl.status(),
+	})
+}
+
+// backendConn counts a connection against its backend until closed
+type backendConn struct {
+	net.Conn
+	backend *backend
+	closed  atomic.Bool
+}
+
+func (c *backendConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.backend.active.Add(-1)
+	}
+	return c.Conn.Close()
+}
@@ -2,191 +2,504 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
-	"redislogger/config"
-	"redislogger/protocol"
+	"github.com/gregyjames/RedisLogger/config"
 )
 
 // Proxy represents a Redis proxy server
 type Proxy struct {
 	config *config.Config
 	logger *zap.Logger
+
+	serverTLS   *tls.Config
+	acme        *acmeManager
+	upstreamTLS *tls.Config
+	proxyProto  *proxyProtocol
+	ipAccess    *ipAccess
+	throttle    *throttle
+	chaos       *chaos
+	mirror      *mirror
+	dualWrite   *dualWrite
+	shadowReads *shadowReads
+	cache       *responseCache
+	hotKeys     *hotKeys
+	bigKeys     *bigKeys
+	slowlog     *slowlog
+	latencies   *latencies
+	summary     *summary
+	sentinel    *sentinel
+	cluster     *cluster
+	shards      *shards
+	pool        *pool
+	mux         *multiplexer
+	connLimit   *connLimit
+	partitions  *partitioner
+	legalHold   *legalHold
+
+	auth         *clientAuth
+	userACLs     map[string]*userACL
+	blocked      map[string]bool
+	flags        *featureFlags
+	labels       *labelSet
+	journal      *journal
+	identityACLs map[string]*commandACL
+	health       *healthChecker
+	persistence  *persistenceMonitor
+	canary       *canary
+	functions    *functionInventory
+	approvals    *approvals
+	webhooks     webhooks
+	auditStream  *auditStream
+	clickHouse   *clickHouse
+	elastic      *elasticsearch
+	s3           *s3Archive
+	nats         *natsPublisher
+	otlp         *otlpExporter
+	events       *eventHub
+	elevations   *elevations
+	mode         *proxyMode
+	timeouts     *commandTimeouts
+	interceptors []Interceptor
+	// subscribers receive the events published on the event bus
+	subscribers []Subscriber
+	values      *valuePolicy
+	sampler     *sampler
+	logFilter   *logFilter
+	// commandLevel is the level received commands are logged at
+	commandLevel zapcore.Level
+
+	// runID identifies the process in request IDs
+	runID string
+	// started is set at the top of Start, before the listeners open, and
+	// is the uptime PROXY.INFO reports
+	started    time.Time
+	nextID     atomic.Uint64
+	mu         sync.Mutex
+	sessions   map[uint64]*session
+	protoStats protocolStats
+
+	// listeners are every listener opened, by address, which a socket
+	// handoff passes on, and inherited those taken over from the previous
+	// process
+	listeners map[string]net.Listener
+	inherited map[string]net.Listener
+	draining  bool
+
+	checksumMismatches atomic.Uint64
 }
 
 // New creates a new Redis proxy
 func New(cfg *config.Config, logger *zap.Logger) *Proxy {
-	return &Proxy{
-		config: cfg,
-		logger: logger,
+	p := &Proxy{
+		config:       cfg,
+		logger:       logger,
+		runID:        newRunID(),
+		partitions:   newPartitioner(cfg.Partition),
+		legalHold:    newLegalHold(cfg.LegalHold),
+		auth:         newClientAuth(cfg.Auth),
+		userACLs:     newUserACLs(cfg.Auth),
+		blocked:      newBlockedCommands(cfg.BlockCommands),
+		flags:        newFeatureFlags(logger, cfg),
+		labels:       newLabelSet(cfg),
+		journal:      newJournal(logger, cfg.Journal),
+		identityACLs: newIdentityACLs(cfg.IdentityACLs),
+		proxyProto:   newProxyProtocol(cfg.ProxyProtocol),
+		ipAccess:     newIPAccess(cfg.IPAccess),
+		throttle:     newThrottle(cfg.Throttle),
+		connLimit:    newConnLimit(cfg.MaxConnections, cfg.MaxConnectionsWaitMs),
+		chaos:        newChaos(cfg.Chaos),
+		dualWrite:    newDualWrite(cfg.DualWrite),
+		shadowReads:  newShadowReads(cfg.ShadowReads),
+		cache:        newResponseCache(cfg.Cache),
+		hotKeys:      newHotKeys(logger, cfg.HotKeys),
+		bigKeys:      newBigKeys(cfg.BigKeys),
+		slowlog:      newSlowlog(cfg.Slowlog),
+		latencies:    newLatencies(cfg.LatencyHistograms),
+		summary:      newSummary(logger, cfg.Summary),
+		sentinel:     newSentinel(logger, cfg.Sentinel),
+		functions:    newFunctionInventory(),
+		approvals:    newApprovals(logger, cfg.Approvals),
+		webhooks:     newWebhooks(logger, cfg.Webhooks),
+		auditStream:  newAuditStream(logger, cfg.AuditStream),
+		clickHouse:   newClickHouse(logger, cfg.ClickHouse),
+		elastic:      newElasticsearch(logger, cfg.Elasticsearch),
+		s3:           newS3Archive(logger, cfg.S3),
+		nats:         newNATSPublisher(logger, cfg.NATS),
+		otlp:         newOTLPExporter(logger, cfg.OTLP),
+		elevations:   newElevations(logger),
+		mode:         newProxyMode(logger, cfg),
+		timeouts:     newCommandTimeouts(cfg),
+		values:       newValuePolicy(cfg),
+		sampler:      newSampler(cfg.Sampling),
+		logFilter:    newLogFilter(cfg.LogFilter),
+		commandLevel: commandLevel(cfg.Log),
+		sessions:     make(map[uint64]*session),
+	}
+	p.persistence = newPersistenceMonitor(p, cfg.PersistenceMonitor)
+	p.canary = newCanary(p, cfg.Canary)
+	p.cluster = newCluster(p, cfg.Cluster)
+	p.shards = newShards(cfg)
+	p.pool = newPool(p, cfg)
+	p.mux = newMultiplexer(p, cfg.Multiplex)
+	p.subscribers = []Subscriber{logSink{}}
+	if len(p.webhooks) > 0 {
+		p.subscribers = append(p.subscribers, p.webhooks)
+	}
+	if p.auditStream != nil {
+		p.subscribers = append(p.subscribers, p.auditStream)
+	}
+	if p.clickHouse != nil {
+		p.subscribers = append(p.subscribers, p.clickHouse)
+	}
+	if p.elastic != nil {
+		p.subscribers = append(p.subscribers, p.elastic)
+	}
+	if p.s3 != nil {
+		p.subscribers = append(p.subscribers, p.s3)
+	}
+	if p.nats != nil {
+		p.subscribers = append(p.subscribers, p.nats)
+	}
+	if p.otlp != nil {
+		p.subscribers = append(p.subscribers, p.otlp)
+	}
+	if p.summary != nil {
+		p.subscribers = append(p.subscribers, p.summary)
 	}
+	if cfg.GRPC != nil || cfg.Admin != nil {
+		p.events = newEventHub()
+		p.subscribers = append(p.subscribers, p.events)
+	}
+	p.inheritListeners()
+	p.health = newHealthChecker(p)
+	p.mirror = newMirror(p)
+	if cfg.TLSListen != nil {
+		p.acme = newACMEManager(logger, cfg.TLSListen.ACME)
+		if p.acme != nil {
+			p.acme.listen = p.listen
+		}
+	}
+	return p
 }
 
 // Start starts the Redis proxy server
 func (p *Proxy) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp", p.config.ListenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %w", err)
+	p.started = time.Now()
+	p.restoreState()
+
+	if err := p.loadPlugins(); err != nil {
+		return err
+	}
+	if err := p.loadWASMPlugins(); err != nil {
+		return err
+	}
+	if err := p.loadLua(); err != nil {
+		return err
+	}
+
+	if p.config.RedisTLS != nil {
+		addr := p.config.RedisAddr
+		if p.routed() || p.pool != nil || p.listenerBackends() {
+			// Each node's server name is taken from its own address
+			addr = ""
+		}
+		tlsConfig, err := clientTLSConfig(p.config.RedisTLS, addr)
+		if err != nil {
+			return err
+		}
+		p.upstreamTLS = tlsConfig
+	}
+
+	if p.sentinel != nil {
+		if err := p.sentinel.discover(); err != nil {
+			return err
+		}
+		go p.sentinel.watch(ctx)
 	}
-	defer listener.Close()
 
-	p.logger.Info("Redis proxy started", zap.String("listen_addr", p.config.ListenAddr))
+	if p.cluster != nil {
+		if err := p.cluster.refresh(); err != nil {
+			return err
+		}
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				p.logger.Error("Failed to accept connection", zap.Error(err))
-				continue
+	if p.acme != nil {
+		if err := p.acme.start(ctx); err != nil {
+			return err
+		}
+	}
+	if p.config.TLSListen != nil {
+		tlsConfig, err := serverTLSConfig(p.config.TLSListen, p.acme)
+		if err != nil {
+			return err
+		}
+		p.serverTLS = tlsConfig
+	}
+
+	if p.journal != nil {
+		if err := p.journal.open(); err != nil {
+			return err
+		}
+		go p.journal.run(ctx)
+	}
+
+	eps := p.endpoints()
+	listeners := make([]net.Listener, 0, len(eps))
+	for _, ep := range eps {
+		listener, err := p.listen(ep.addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
 			}
-			go p.handleConnection(conn)
+			return fmt.Errorf("failed to start listener %s: %w", ep.addr, err)
 		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, ep := range eps {
+		fields := []zap.Field{zap.String("listen_addr", ep.addr), zap.Bool("tls", ep.tls != nil)}
+		if ep.redisAddr != "" {
+			fields = append(fields, zap.String("redis_addr", ep.redisAddr))
+		}
+		p.logger.Info("Redis proxy started", fields...)
+	}
+
+	if p.config.ProtocolReportInterval > 0 {
+		go p.reportProtocols(ctx, time.Duration(p.config.ProtocolReportInterval)*time.Second)
+	}
+	if p.hotKeys != nil {
+		go p.hotKeys.run(ctx)
+	}
+	if p.summary != nil {
+		go p.summary.run(ctx)
+	}
+	if p.health != nil {
+		go p.health.run(ctx)
+	}
+	if p.persistence != nil {
+		go p.persistence.run(ctx)
+	}
+	if p.canary != nil {
+		go p.canary.run(ctx)
+	}
+	if p.mirror != nil {
+		go p.mirror.run(ctx)
+	}
+	p.webhooks.run(ctx)
+	if p.auditStream != nil {
+		go p.auditStream.run(ctx)
+	}
+	if p.clickHouse != nil {
+		go p.clickHouse.run(ctx)
 	}
+	if p.elastic != nil {
+		go p.elastic.run(ctx)
+	}
+	if p.s3 != nil {
+		go p.s3.run(ctx)
+	}
+	if p.nats != nil {
+		go p.nats.run(ctx)
+	}
+	if p.otlp != nil {
+		go p.otlp.run(ctx)
+	}
+	if p.config.Admin != nil {
+		p.startAdmin(ctx)
+	}
+	if p.config.GRPC != nil {
+		p.startGRPC(ctx)
+	}
+	p.signalReady()
+
+	return p.serveEndpoints(ctx, eps, listeners)
 }
 
-func (p *Proxy) handleConnection(conn net.Conn) {
+func (p *Proxy) handleConnection(ctx context.Context, ep *endpoint, conn net.Conn) {
 	defer conn.Close()
 
-	clientAddr := conn.RemoteAddr().String()
+	// Counted from accept, as every connection holds a file descriptor
+	// whether or not it is served
+	if !p.connLimit.admit() {
+		p.logger.Warn("Connection refused, max_connections reached",
+			zap.String("peer_addr", conn.RemoteAddr().String()),
+			zap.Int("max_connections", p.connLimit.max),
+		)
+		p.refuse(conn, ep.tls)
+		return
+	}
+	defer p.connLimit.release()
+
+	// A PROXY protocol header precedes any TLS handshake
+	peerAddr := ep.remoteAddr(conn)
+	conn, err := p.proxyProto.wrap(conn)
+	if err != nil {
+		p.logger.Warn("Invalid PROXY protocol header", zap.String("peer_addr", peerAddr), zap.Error(err))
+		return
+	}
+
+	clientAddr := ep.remoteAddr(conn)
+	// Checked after any PROXY protocol header, so that clients behind a
+	// load balancer are checked rather than the load balancer
+	if !p.ipAccess.permits(remoteIP(conn)) {
+		p.logger.Warn("Connection rejected by IP access list",
+			zap.String("client_addr", clientAddr),
+			zap.String("peer_addr", peerAddr),
+		)
+		return
+	}
 	connLogger := p.logger.With(zap.String("client_addr", clientAddr))
+	if clientAddr != peerAddr {
+		connLogger = connLogger.With(zap.String("proxy_addr", peerAddr))
+	}
+	if len(p.config.Listeners) > 0 {
+		connLogger = connLogger.With(zap.String("listen_addr", ep.addr))
+	}
+	if len(ep.labels) > 0 {
+		connLogger = connLogger.With(zap.Object("labels", ep.labels))
+	}
 	connLogger.Info("New connection established")
 
-	redisConn, err := net.Dial("tcp", p.config.RedisAddr)
+	// Throttled below TLS, so that the limits apply to the bytes on the wire
+	throttled := p.throttle.wrap(conn)
+	if throttled != nil {
+		conn = throttled
+	}
+	stats := &connStats{started: time.Now()}
+	stats.lastActive.Store(stats.started.UnixNano())
+	conn = &countingConn{Conn: conn, stats: stats}
+
+	var identity string
+	if ep.tls != nil {
+		tlsConn := tls.Server(conn, ep.tls)
+		conn = tlsConn
+		if err := tlsConn.Handshake(); err != nil {
+			connLogger.Warn("TLS handshake failed", zap.Error(err))
+			return
+		}
+		identity = clientIdentity(tlsConn.ConnectionState(), p.config.TLSListen.IdentitySource)
+		if identity != "" {
+			connLogger = connLogger.With(zap.String("client_identity", identity))
+			connLogger.Info("Client certificate verified")
+		}
+	}
+
+	flags := p.flags.evaluate(remoteIP(conn), identity)
+	defer p.flags.release(flags)
+	if len(flags) > 0 {
+		connLogger = connLogger.With(zap.Strings("feature_flags", flags))
+	}
+
+	// Cluster and sharded mode sessions dial each node as commands are
+	// routed to it, and multiplexed sessions share connections
+	var redisConn net.Conn
+	var backend string
+	multiplexed := p.mux != nil && slices.Contains(flags, flagMultiplex)
+	if multiplexed {
+		redisConn = p.mux.stream()
+		defer redisConn.Close()
+	} else if !p.routed() {
+		redisConn, err = p.dialRetry(ctx, connLogger, ep.redisAddr, p.proxyProto.header(conn))
+		if err != nil {
+			connLogger.Error("Failed to connect to Redis", zap.Error(err))
+			return
+		}
+		defer redisConn.Close()
+		addr := p.redisAddr()
+		if ep.redisAddr != "" {
+			addr = ep.redisAddr
+			connLogger = connLogger.With(zap.String("redis_addr", addr))
+		} else if bc, ok := redisConn.(*backendConn); ok {
+			addr = bc.backend.addr
+			connLogger = connLogger.With(zap.String("backend", addr))
+		}
+		if l := p.labels.upstream(addr); len(l) > 0 {
+			connLogger = connLogger.With(zap.Object("upstream_labels", l))
+		}
+		backend = addr
+	}
+
+	target, err := p.dialTarget(ctx)
 	if err != nil {
-		connLogger.Error("Failed to connect to Redis", zap.Error(err))
+		connLogger.Error("Failed to connect to target", zap.String("target_addr", p.targetAddr()), zap.Error(err))
 		return
 	}
-	defer redisConn.Close()
-
-	parser := protocol.New(conn)
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Forward commands from client to Redis
-	go func() {
-		defer wg.Done()
-		for {
-			cmd, err := parser.ReadCommand()
-			if err != nil {
-				if err != io.EOF {
-					connLogger.Error("Failed to read command", zap.Error(err))
-				}
-				return
-			}
 
-			// Log command details with appropriate fields based on command type
-			fields := []zap.Field{
-				zap.String("command", cmd.Name),
-			}
+	s := p.newSession(conn, redisConn, connLogger)
+	s.identity = identity
+	s.flags = flags
+	s.multiplexed = multiplexed
+	s.target = target
+	s.stats = stats
+	s.listener = ep.addr
+	s.labels = ep.labels
+	s.backend = backend
+	s.info = &ConnInfo{
+		ID:         s.id,
+		ClientAddr: clientAddr,
+		Listener:   s.listener,
+		Identity:   s.identity,
+	}
+	if reply := p.onConnect(s); reply != nil {
+		conn.Write(reply)
+		return
+	}
+	defer p.onClose(s)
+	p.register(s)
+	defer p.unregister(s)
+	p.publish(&ConnectionEvent{Time: time.Now(), Conn: s.info, session: s})
 
-			// Add command-specific fields
-			if len(cmd.Args) > 0 {
-				switch strings.ToUpper(cmd.Name) {
-				case "SET":
-					if len(cmd.Args) >= 2 {
-						fields = append(fields,
-							zap.String("key", cmd.Args[0]),
-							zap.String("value", cmd.Args[1]),
-						)
-						// Add SET options if present
-						if len(cmd.Args) > 2 {
-							options := make([]string, 0)
-							for i := 2; i < len(cmd.Args); i++ {
-								opt := strings.ToUpper(cmd.Args[i])
-								switch opt {
-								case "EX", "PX", "EXAT", "PXAT":
-									if i+1 < len(cmd.Args) {
-										options = append(options, fmt.Sprintf("%s=%s", opt, cmd.Args[i+1]))
-										i++ // Skip the next argument as it's the value for this option
-									}
-								case "NX", "XX", "KEEPTTL":
-									options = append(options, opt)
-								}
-							}
-							if len(options) > 0 {
-								fields = append(fields, zap.Strings("options", options))
-							}
-						}
-					}
-				case "GET", "MGET":
-					fields = append(fields, zap.Strings("keys", cmd.Args))
-				case "DEL", "EXISTS", "EXPIRE", "TTL", "PTTL", "PERSIST", "TYPE":
-					fields = append(fields, zap.String("key", cmd.Args[0]))
-				case "INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT":
-					if len(cmd.Args) >= 2 {
-						fields = append(fields,
-							zap.String("key", cmd.Args[0]),
-							zap.String("amount", cmd.Args[1]),
-						)
-					}
-				case "HSET", "HGET", "HDEL", "HEXISTS", "HINCRBY", "HINCRBYFLOAT":
-					if len(cmd.Args) >= 2 {
-						fields = append(fields,
-							zap.String("key", cmd.Args[0]),
-							zap.String("field", cmd.Args[1]),
-						)
-						if len(cmd.Args) > 2 {
-							fields = append(fields, zap.String("value", cmd.Args[2]))
-						}
-					}
-				case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
-					if len(cmd.Args) >= 2 {
-						fields = append(fields,
-							zap.String("key", cmd.Args[0]),
-							zap.Strings("values", cmd.Args[1:]),
-						)
-					}
-				case "SADD", "SREM", "SISMEMBER", "SCARD", "SPOP", "SRANDMEMBER":
-					if len(cmd.Args) >= 1 {
-						fields = append(fields, zap.String("key", cmd.Args[0]))
-						if len(cmd.Args) > 1 {
-							if cmd.Name == "SPOP" || cmd.Name == "SRANDMEMBER" {
-								fields = append(fields, zap.String("count", cmd.Args[1]))
-							} else {
-								fields = append(fields, zap.Strings("members", cmd.Args[1:]))
-							}
-						}
-					}
-				case "ZADD":
-					if len(cmd.Args) >= 3 {
-						fields = append(fields, zap.String("key", cmd.Args[0]))
-						pairs := make([]string, 0)
-						for i := 1; i < len(cmd.Args); i += 2 {
-							if i+1 < len(cmd.Args) {
-								pairs = append(pairs, fmt.Sprintf("%s=%s", cmd.Args[i], cmd.Args[i+1]))
-							}
-						}
-						fields = append(fields, zap.Strings("score_member_pairs", pairs))
-					}
-				default:
-					fields = append(fields, zap.Strings("args", cmd.Args))
-				}
-			}
+	if p.config.IdleTimeoutSeconds > 0 {
+		go s.watchIdle(time.Duration(p.config.IdleTimeoutSeconds) * time.Second)
+	}
 
-			connLogger.Info("Received command", fields...)
+	s.serve()
+	if throttled != nil {
+		throttled.report(connLogger)
+	}
+	p.publish(&ConnectionEvent{Time: time.Now(), Conn: s.info, Closed: true, Fields: stats.fields(), session: s})
+}
 
-			if _, err := redisConn.Write(cmd.Message); err != nil {
-				connLogger.Error("Failed to write to Redis", zap.Error(err))
-				return
-			}
-		}
-	}()
+func (p *Proxy) register(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s.id] = s
+	// Sessions set up while draining start out draining too
+	if p.draining {
+		s.stopReading()
+	}
+}
+
+func (p *Proxy) unregister(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s.id)
+	p.journal.release(s.id)
+}
 
-	// Forward responses from Redis to client
-	go func() {
-		defer wg.Done()
-		io.Copy(conn, redisConn)
-	}()
+// CloseJournal marks a clean shutdown in the journal of in-flight writes,
+// so that the next start does not report a crash
+func (p *Proxy) CloseJournal() {
+	p.journal.close()
+}
 
-	wg.Wait()
-	connLogger.Info("Connection closed")
-} 
\ No newline at end of file
+// activeSessions returns a snapshot of the connected sessions
+func (p *Proxy) activeSessions() []*session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := make([]*session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// checkProxyInfo answers PROXY.INFO and INFO proxy from the proxy itself,
+// when proxy_info_command is enabled, in the format of Redis's INFO
+func (p *Proxy) checkProxyInfo(s *session, req *request) []byte {
+	if !p.config.ProxyInfoCommand {
+		return nil
+	}
+	switch {
+	case req.name == "PROXY.INFO" && len(req.cmd.Args) == 0:
+	case req.name == "INFO" && len(req.cmd.Args) == 1 && strings.EqualFold(req.cmd.Args[0], "proxy"):
+	default:
+		return nil
+	}
+	if s.multi {
+		return []byte(fmt.Sprintf("-ERR %s is not allowed in a transaction\r\n", req.name))
+	}
+	info := p.proxyInfo()
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info))
+}
+
+// proxyInfo renders the proxy's uptime, version, connections and backends
+// as INFO sections
+func (p *Proxy) proxyInfo() string {
+	var b strings.Builder
+	line := func(name string, value any) {
+		fmt.Fprintf(&b, "%s:%v\r\n", name, value)
+	}
+
+	version := "unknown"
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	uptime := time.Since(p.started)
+	listeners := make([]string, 0, len(p.config.Listeners)+1)
+	for _, ep := range p.endpoints() {
+		listeners = append(listeners, ep.addr)
+	}
+	b.WriteString("# Proxy\r\n")
+	line("proxy_version", version)
+	line("go_version", runtime.Version())
+	line("os", runtime.GOOS+" "+runtime.GOARCH)
+	line("process_id", os.Getpid())
+	line("uptime_in_seconds", int64(uptime.Seconds()))
+	line("uptime_in_days", int64(uptime.Hours()/24))
+	line("mode", p.mode.status()["mode"])
+	line("listeners", strings.Join(listeners, ","))
+
+	b.WriteString("\r\n# Clients\r\n")
+	line("connected_clients", p.connLimit.current.Load())
+	line("peak_connected_clients", p.connLimit.peak.Load())
+	line("max_clients", p.connLimit.max)
+	line("rejected_connections", p.connLimit.rejected.Load())
+	line("total_connections_received", p.nextID.Load())
+
+	b.WriteString("\r\n# Backends\r\n")
+	switch {
+	case p.cluster != nil:
+		nodes := p.cluster.nodes()
+		line("topology", "cluster")
+		line("backends", len(nodes))
+		for i, addr := range nodes {
+			line(fmt.Sprintf("backend%d", i), "addr="+addr)
+		}
+	case p.shards != nil:
+		line("topology", "sharded")
+		line("backends", len(p.shards.backends))
+		for i, addr := range p.shards.backends {
+			line(fmt.Sprintf("backend%d", i), "addr="+addr)
+		}
+	case p.pool != nil:
+		status := p.pool.status()
+		line("topology", "pool")
+		line("balance", p.pool.strategy)
+		line("backends", len(status))
+		for i, st := range status {
+			healthy := 0
+			if st.Healthy {
+				healthy = 1
+			}
+			line(fmt.Sprintf("backend%d", i), fmt.Sprintf("addr=%s,weight=%d,healthy=%d,active_connections=%d",
+				st.Addr, st.Weight, healthy, st.ActiveConnections))
+		}
+	case p.sentinel != nil:
+		line("topology", "sentinel")
+		line("backends", 1)
+		line("backend0", "addr="+p.sentinel.addr())
+	default:
+		line("topology", "single")
+		line("backends", 1)
+		line("backend0", "addr="+p.config.RedisAddr)
+	}
+	return b.String()
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send its PROXY
+// protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxySignature starts every PROXY protocol v2 header
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a client connection whose addresses were taken from a PROXY
+// protocol header sent by a load balancer
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	source net.Addr
+	dest   net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// proxyProtocol accepts and emits PROXY protocol headers
+type proxyProtocol struct {
+	accept  bool
+	trusted []*net.IPNet
+	send    string
+}
+
+func newProxyProtocol(cfg *config.ProxyProtocolConfig) *proxyProtocol {
+	if cfg == nil {
+		return nil
+	}
+	pp := &proxyProtocol{accept: cfg.Accept, send: cfg.Send}
+	for _, cidr := range cfg.TrustedCIDRs {
+		// CIDRs are validated when the config is loaded
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			pp.trusted = append(pp.trusted, network)
+		}
+	}
+	return pp
+}
+
+// wrap reads the PROXY protocol header of a new client connection. It
+// returns the connection unchanged when headers are not expected from its
+// peer.
+func (pp *proxyProtocol) wrap(conn net.Conn) (net.Conn, error) {
+	if pp == nil || !pp.accept || !pp.trusts(remoteIP(conn)) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	source, dest, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: reader, source: source, dest: dest}, nil
+}
+
+func (pp *proxyProtocol) trusts(ip net.IP) bool {
+	for _, network := range pp.trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns the header to send to Redis ahead of a client's traffic,
+// or nil when emission is disabled
+func (pp *proxyProtocol) header(client net.Conn) []byte {
+	if pp == nil || pp.send == "" {
+		return nil
+	}
+	source, _ := client.RemoteAddr().(*net.TCPAddr)
+	dest, _ := client.LocalAddr().(*net.TCPAddr)
+	if pp.send == "v2" {
+		return proxyHeaderV2(source, dest)
+	}
+	return proxyHeaderV1(source, dest)
+}
+
+// readProxyHeader parses a v1 or v2 header, returning nil addresses for
+// connections the load balancer made on its own behalf
+func readProxyHeader(reader *bufio.Reader) (source, dest net.Addr, err error) {
+	prefix, err := reader.Peek(len(proxySignature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(prefix, proxySignature):
+		return readProxyHeaderV2(reader)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyHeaderV1(reader)
+	}
+	return nil, nil, fmt.Errorf("missing PROXY protocol header")
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY protocol v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	source, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dest, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, dest, nil
+}
+
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address: %q", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	// LOCAL connections, such as load balancer health checks, carry no
+	// client address
+	if header[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	var size int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("truncated PROXY protocol v2 addresses")
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	dest := &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return source, dest, nil
+}
+
+func proxyHeaderV1(source, dest *net.TCPAddr) []byte {
+	if source == nil || dest == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if source.IP.To4() != nil && dest.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, source.IP, dest.IP, source.Port, dest.Port))
+}
+
+func proxyHeaderV2(source, dest *net.TCPAddr) []byte {
+	header := append([]byte{}, proxySignature...)
+	if source == nil || dest == nil {
+		// LOCAL command with no address
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	var body []byte
+	family := byte(0x21)
+	if src, dst := source.IP.To4(), dest.IP.To4(); src != nil && dst != nil {
+		family = 0x11
+		body = append(append(body, src...), dst...)
+	} else {
+		body = append(append(body, source.IP.To16()...), dest.IP.To16()...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(source.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(dest.Port))
+
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
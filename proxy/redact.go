@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// redactedValue replaces the values kept out of log output
+const redactedValue = "[REDACTED]"
+
+// hashPairCommands take field/value pairs after their key
+var hashPairCommands = map[string]bool{"HSET": true, "HMSET": true, "HSETNX": true}
+
+// valuePolicy decides how the values commands carry are logged. With
+// redact_values, only key names and value lengths are logged, and
+// redact_rules do the same for the values of some keys, hash fields or
+// arguments. Values longer than max_value_log_bytes are truncated, and
+// binary values encoded as binary_value_encoding sets.
+type valuePolicy struct {
+	redactAll      bool
+	rules          []redactRule
+	maxBytes       int
+	binaryEncoding string
+}
+
+// redactRule is a compiled redact_rules entry
+type redactRule struct {
+	command string
+	key     *regexp.Regexp
+	field   *regexp.Regexp
+	// args are the positions of the arguments redacted, counting from 1
+	// after the command name
+	args []int
+}
+
+func newValuePolicy(cfg *config.Config) *valuePolicy {
+	if !cfg.RedactValues && len(cfg.RedactRules) == 0 && cfg.MaxValueLogBytes == 0 && cfg.BinaryValueEncoding == "" {
+		return nil
+	}
+	v := &valuePolicy{
+		redactAll:      cfg.RedactValues,
+		maxBytes:       cfg.MaxValueLogBytes,
+		binaryEncoding: cfg.BinaryValueEncoding,
+	}
+	for _, r := range cfg.RedactRules {
+		// Validated when the config is loaded
+		rule := redactRule{command: strings.ToUpper(r.Command), args: r.Args}
+		if r.Key != "" {
+			rule.key = regexp.MustCompile(r.Key)
+		}
+		if r.Field != "" {
+			rule.field = regexp.MustCompile(r.Field)
+		}
+		v.rules = append(v.rules, rule)
+	}
+	return v
+}
+
+// commandValues is how the values of one command are logged
+type commandValues struct {
+	policy *valuePolicy
+	name   string
+	orig   *protocol.Command
+	// cmd has the arguments redacted by position replaced
+	cmd       *protocol.Command
+	positions []int
+	// credentials is set when cmd carries masked credentials
+	credentials bool
+}
+
+// forCommand returns how the values of cmd are logged, or nil when they
+// are logged verbatim. Credentials are masked whatever the policy.
+func (v *valuePolicy) forCommand(cmd *protocol.Command) *commandValues {
+	name := strings.ToUpper(cmd.Name)
+	credentials := credentialArgs(name, cmd.Args)
+	if v == nil && len(credentials) == 0 {
+		return nil
+	}
+	cv := &commandValues{policy: v, name: name, orig: cmd, cmd: cmd, credentials: len(credentials) > 0}
+	mask := func(i int) {
+		if cv.cmd == cmd {
+			masked := *cmd
+			masked.Args = slices.Clone(cmd.Args)
+			cv.cmd = &masked
+		}
+		cv.cmd.Args[i] = redactedValue
+	}
+	for _, i := range credentials {
+		mask(i)
+	}
+	if v != nil {
+		for _, rule := range v.rules {
+			if len(rule.args) == 0 || rule.command != cv.name {
+				continue
+			}
+			for _, pos := range rule.args {
+				if pos <= len(cmd.Args) {
+					mask(pos - 1)
+				}
+			}
+		}
+	}
+	cv.positions = cv.cmd.KeyPositions()
+	return cv
+}
+
+// credentialArgs returns the positions of the passwords among a command's
+// arguments: those of AUTH, HELLO AUTH, MIGRATE AUTH and AUTH2, CONFIG SET
+// requirepass and masterauth, and the password rules of ACL SETUSER
+func credentialArgs(name string, args []string) []int {
+	var positions []int
+	switch name {
+	case "AUTH":
+		if len(args) == 2 {
+			return []int{1}
+		}
+		// Malformed, so the password can't be told apart
+		for i := range args {
+			positions = append(positions, i)
+		}
+	case "HELLO":
+		for i := 1; i+2 < len(args); i++ {
+			if strings.EqualFold(args[i], "AUTH") {
+				positions = append(positions, i+2)
+				i += 2
+			}
+		}
+	case "MIGRATE":
+		// Options follow host, port, key, db and timeout, up to KEYS
+		for i := 5; i < len(args) && !strings.EqualFold(args[i], "KEYS"); i++ {
+			switch {
+			case strings.EqualFold(args[i], "AUTH") && i+1 < len(args):
+				positions = append(positions, i+1)
+				i++
+			case strings.EqualFold(args[i], "AUTH2") && i+2 < len(args):
+				positions = append(positions, i+2)
+				i += 2
+			}
+		}
+	case "CONFIG":
+		if len(args) == 0 || !strings.EqualFold(args[0], "SET") {
+			return nil
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.EqualFold(args[i], "requirepass") || strings.EqualFold(args[i], "masterauth") {
+				positions = append(positions, i+1)
+			}
+		}
+	case "ACL":
+		if len(args) < 2 || !strings.EqualFold(args[0], "SETUSER") {
+			return nil
+		}
+		for i := 2; i < len(args); i++ {
+			// >password and <password add and remove a password, #hash and
+			// !hash the same by its SHA-256
+			if args[i] != "" && strings.ContainsRune("><#!", rune(args[i][0])) {
+				positions = append(positions, i)
+			}
+		}
+	}
+	return positions
+}
+
+// redacts reports whether a value stored under key, in the hash field
+// field when set, is redacted
+func (cv *commandValues) redacts(key, field string) bool {
+	if cv == nil || cv.policy == nil {
+		return false
+	}
+	if cv.policy.redactAll {
+		return true
+	}
+	for _, rule := range cv.policy.rules {
+		switch {
+		case len(rule.args) > 0:
+		case rule.command != "" && rule.command != cv.name:
+		case rule.key != nil && !rule.key.MatchString(key):
+		case rule.field != nil && (field == "" || !rule.field.MatchString(field)):
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// logged returns a value stored under key as logged, the encoding it is
+// logged in when binary, and whether it was redacted or truncated
+func (cv *commandValues) logged(key, field, value string) (string, string, bool) {
+	if cv.redacts(key, field) {
+		return redactedValue, "", true
+	}
+	if cv == nil || cv.policy == nil {
+		return value, "", false
+	}
+	p := cv.policy
+	encoding := ""
+	if p.binaryEncoding != "" && isBinary(value) {
+		encoding = p.binaryEncoding
+	}
+	n := len(value)
+	if p.maxBytes > 0 && n > p.maxBytes {
+		n = p.maxBytes
+		// Keep multi-byte characters of text whole
+		for encoding == "" && n > 0 && !utf8.RuneStart(value[n]) {
+			n--
+		}
+	}
+	logged := encode(value[:n], encoding)
+	if n == len(value) {
+		return logged, encoding, false
+	}
+	return fmt.Sprintf("%s...(+%d bytes)", logged, len(value)-n), encoding, true
+}
+
+// isBinary reports whether a value is not printable text: invalid UTF-8,
+// or holding control characters other than whitespace
+func isBinary(value string) bool {
+	for _, r := range value {
+		if r == utf8.RuneError || unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(value, encoding string) string {
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString([]byte(value))
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+// value returns the fields logging a value stored under key, with its
+// encoding when binary and its length when redacted or truncated
+func (cv *commandValues) value(name, key, value string) []zap.Field {
+	return cv.fieldValue(name, key, "", value)
+}
+
+// fieldValue returns the fields logging the value of a hash field
+func (cv *commandValues) fieldValue(name, key, field, value string) []zap.Field {
+	logged, encoding, changed := cv.logged(key, field, value)
+	fields := []zap.Field{zap.String(name, logged)}
+	if encoding != "" {
+		fields = append(fields, zap.String(name+"_encoding", encoding))
+	}
+	if changed {
+		fields = append(fields, zap.Int(name+"_length", len(value)))
+	}
+	return fields
+}
+
+// loggedList returns values stored under key as logged, with the encoding
+// of each when any is binary and the length of each when any is redacted
+// or truncated
+func (cv *commandValues) loggedList(key string, values []string) (logged, encodings []string, lengths []int) {
+	if cv == nil {
+		return values, nil, nil
+	}
+	logged = make([]string, len(values))
+	all := make([]int, len(values))
+	changed := false
+	for i, value := range values {
+		var encoding string
+		var ok bool
+		logged[i], encoding, ok = cv.logged(key, "", value)
+		all[i], changed = len(value), changed || ok
+		if encoding != "" {
+			if encodings == nil {
+				encodings = make([]string, len(values))
+			}
+			encodings[i] = encoding
+		}
+	}
+	if changed {
+		lengths = all
+	}
+	return logged, encodings, lengths
+}
+
+// listFields returns the fields logging a list of values as name, and
+// their encodings and lengths, when set, as element_encodings and
+// element_lengths
+func listFields(name, element string, logged, encodings []string, lengths []int) []zap.Field {
+	fields := []zap.Field{zap.Strings(name, logged)}
+	if encodings != nil {
+		fields = append(fields, zap.Strings(element+"_encodings", encodings))
+	}
+	if lengths != nil {
+		fields = append(fields, zap.Ints(element+"_lengths", lengths))
+	}
+	return fields
+}
+
+// values returns the fields logging values stored under key, with the
+// encodings and lengths of each element as loggedList decides
+func (cv *commandValues) values(name, element, key string, values []string) []zap.Field {
+	logged, encodings, lengths := cv.loggedList(key, values)
+	return listFields(name, element, logged, encodings, lengths)
+}
+
+// pairs renders score/member or similar pairs as "a=b", with the
+// encodings and lengths of the second of each as loggedList decides
+func (cv *commandValues) pairs(name, element, key string, args []string) []zap.Field {
+	seconds := make([]string, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		seconds = append(seconds, args[i])
+	}
+	logged, encodings, lengths := cv.loggedList(key, seconds)
+	pairs := make([]string, len(logged))
+	for i, second := range logged {
+		pairs[i] = fmt.Sprintf("%s=%s", args[2*i], second)
+	}
+	return listFields(name, element, pairs, encodings, lengths)
+}
+
+// argFields returns the fields logging a command's arguments, with the
+// encoding of each when any is binary and the length of each when any is
+// redacted or truncated, unless the lengths would give away those of
+// credentials
+func (cv *commandValues) argFields(cmd *protocol.Command) []zap.Field {
+	args, encodings, changed := cv.redactArgs(cmd)
+	var lengths []int
+	if changed && !cv.credentials {
+		lengths = make([]int, len(cv.orig.Args))
+		for i, arg := range cv.orig.Args {
+			lengths[i] = len(arg)
+		}
+	}
+	return listFields("args", "arg", args, encodings, lengths)
+}
+
+// redactArgs returns a command's arguments as logged, keeping its keys,
+// their encodings when any is binary, and whether any were redacted or
+// truncated. Arguments are redacted when the values of the key preceding
+// them are, such as those of MSET, or of the first key when none precedes
+// them, and for hash commands when the values of the field preceding them
+// are.
+func (cv *commandValues) redactArgs(cmd *protocol.Command) ([]string, []string, bool) {
+	if cv == nil {
+		return cmd.Args, nil, false
+	}
+	key := ""
+	if len(cv.positions) > 0 {
+		key = cv.cmd.Args[cv.positions[0]]
+	}
+	args := cv.cmd.Args
+	var encodings []string
+	changed, cloned := cv.cmd != cv.orig, false
+	for i := range args {
+		if slices.Contains(cv.positions, i) {
+			key = args[i]
+			continue
+		}
+		if args[i] == redactedValue {
+			continue
+		}
+		field := ""
+		if hashPairCommands[cv.name] && i >= 2 && i%2 == 0 {
+			field = args[i-1]
+		}
+		logged, encoding, ok := cv.logged(key, field, args[i])
+		if encoding != "" {
+			if encodings == nil {
+				encodings = make([]string, len(args))
+			}
+			encodings[i] = encoding
+		}
+		if logged == args[i] {
+			continue
+		}
+		if !cloned {
+			args, cloned = slices.Clone(args), true
+		}
+		args[i], changed = logged, changed || ok
+	}
+	return args, encodings, changed
+}
+
+// args returns a command's arguments as logged
+func (v *valuePolicy) args(cmd *protocol.Command) []string {
+	args, _, _ := v.forCommand(cmd).redactArgs(cmd)
+	return args
+}
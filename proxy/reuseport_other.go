@@ -0,0 +1,12 @@
+//go:build !unix
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
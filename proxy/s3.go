@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// s3Archive uploads every command to S3-compatible storage in
+// gzip-compressed NDJSON objects. Commands are queued and compressed into
+// the current object by a single writer, which uploads it once it reaches
+// its maximum size or age.
+type s3Archive struct {
+	*batcher[*sinkRecord]
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	token     string
+	host      string
+	maxSize   int
+	attempts  int
+	spoolDir  string
+	logger    *zap.Logger
+	client    *http.Client
+	seq       int
+	// obj is the object being written
+	obj *s3Object
+}
+
+// s3Object is the object being written
+type s3Object struct {
+	started time.Time
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	records int
+	size    int
+}
+
+func newS3Archive(logger *zap.Logger, cfg *config.S3Config) *s3Archive {
+	if cfg == nil {
+		return nil
+	}
+	a := &s3Archive{
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		prefix:    cfg.Prefix,
+		pathStyle: cfg.PathStyle,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		token:     cfg.SessionToken,
+		host:      "redislogger",
+		maxSize:   cfg.MaxObjectMB * 1024 * 1024,
+		attempts:  cfg.MaxAttempts,
+		spoolDir:  cfg.SpoolDir,
+		logger:    logger.With(zap.String("s3_bucket", cfg.Bucket)),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	// Validated when the config is loaded
+	a.endpoint, _ = url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if a.accessKey == "" {
+		a.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		a.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		a.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if a.accessKey == "" || a.secretKey == "" {
+		a.logger.Warn("No S3 credentials configured, uploads will be unsigned")
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		a.host = hostname
+	}
+	if a.maxSize == 0 {
+		a.maxSize = 64 * 1024 * 1024
+	}
+	interval := time.Duration(cfg.UploadIntervalSeconds) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+	if a.attempts == 0 {
+		a.attempts = 5
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = 100000
+	}
+	a.batcher = newBatcher(a.logger, a, queueSize, interval, "S3 queue full, records dropped")
+	return a
+}
+
+// run archives the queued commands until the context is cancelled, then
+// uploads the object being written. Objects spooled by an earlier run are
+// uploaded first.
+func (a *s3Archive) run(ctx context.Context) {
+	a.unspool(ctx)
+	a.batcher.run(ctx)
+}
+
+// OnEvent queues a command for archival, dropping it when the queue is
+// full
+func (a *s3Archive) OnEvent(e Event) {
+	if ce, ok := e.(*CommandEvent); ok {
+		a.enqueue(commandRecord(ce))
+	}
+}
+
+// add compresses a command into the object being written, reporting
+// whether the object reached its maximum size
+func (a *s3Archive) add(record *sinkRecord) bool {
+	line, err := json.Marshal(record)
+	if err != nil {
+		a.logger.Warn("Failed to encode S3 record", zap.Error(err))
+		return false
+	}
+	if a.obj == nil {
+		a.obj = &s3Object{started: time.Now().UTC()}
+		a.obj.gz = gzip.NewWriter(&a.obj.buf)
+	}
+	a.obj.gz.Write(append(line, '\n'))
+	a.obj.records++
+	a.obj.size += len(line) + 1
+	return a.obj.size >= a.maxSize
+}
+
+// send completes the object being written and puts it, retrying with
+// exponential backoff after network errors, 429s and 5xx responses
+func (a *s3Archive) send(ctx context.Context) {
+	obj := a.obj
+	a.obj = nil
+	if obj == nil {
+		return
+	}
+	obj.gz.Close()
+	a.seq++
+	key := fmt.Sprintf("%s%s/%s-%s-%d.ndjson.gz",
+		a.prefix, obj.started.Format("2006/01/02"), obj.started.Format("20060102T150405Z"), a.host, a.seq)
+	body := obj.buf.Bytes()
+
+	attempts, err := retry(ctx, a.attempts, time.Second, time.Minute, func() (bool, error) {
+		return a.put(ctx, key, body)
+	})
+	if err != nil {
+		a.logger.Error("Failed to upload S3 object",
+			zap.String("key", key),
+			zap.Int("records", obj.records),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		a.spool(key, body)
+		return
+	}
+	a.logger.Info("S3 object uploaded",
+		zap.String("key", key),
+		zap.Int("records", obj.records),
+		zap.Int("bytes", len(body)),
+	)
+	a.sent()
+	a.unspool(ctx)
+}
+
+// spool writes an object that could not be uploaded to the spool
+// directory, named by its escaped key. It is written to a temporary file
+// first, so that only complete objects are uploaded again.
+func (a *s3Archive) spool(key string, body []byte) {
+	if a.spoolDir == "" {
+		return
+	}
+	if err := os.MkdirAll(a.spoolDir, 0o750); err != nil {
+		a.logger.Error("Failed to create S3 spool directory", zap.Error(err))
+		return
+	}
+	path := filepath.Join(a.spoolDir, url.PathEscape(key))
+	if err := os.WriteFile(path+".tmp", body, 0o640); err != nil {
+		a.logger.Error("Failed to spool S3 object", zap.String("key", key), zap.Error(err))
+		os.Remove(path + ".tmp")
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		a.logger.Error("Failed to spool S3 object", zap.String("key", key), zap.Error(err))
+		return
+	}
+	a.logger.Info("S3 object spooled", zap.String("key", key), zap.String("file", path))
+}
+
+// unspool uploads the spooled objects, oldest first, and removes each once
+// uploaded. It stops at the first failure, leaving the rest for later.
+func (a *s3Archive) unspool(ctx context.Context) {
+	if a.spoolDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(a.spoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.logger.Error("Failed to read S3 spool directory", zap.Error(err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(a.spoolDir, name)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			a.logger.Error("Failed to read spooled S3 object", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		if _, err := a.put(ctx, key, body); err != nil {
+			a.logger.Warn("Failed to upload spooled S3 objects, retrying later", zap.String("key", key), zap.Error(err))
+			return
+		}
+		os.Remove(path)
+		a.logger.Info("Spooled S3 object uploaded", zap.String("key", key), zap.Int("bytes", len(body)))
+	}
+}
+
+// put uploads an object once, reporting whether a failure is worth
+// retrying
+func (a *s3Archive) put(ctx context.Context, key string, body []byte) (bool, error) {
+	u := *a.endpoint
+	path := "/" + key
+	if a.pathStyle {
+		path = "/" + a.bucket + path
+	} else {
+		u.Host = a.bucket + "." + u.Host
+	}
+	u.Path += path
+	u.RawPath = a.endpoint.EscapedPath() + s3Escape(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	a.sign(req, body, time.Now().UTC())
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// S3 explains the failure in an XML body
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return false, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request, unless there
+// are no credentials
+func (a *s3Archive) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.token != "" {
+		req.Header.Set("X-Amz-Security-Token", a.token)
+	}
+	if a.accessKey == "" || a.secretKey == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), a.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + a.secretKey)
+	for _, part := range []string{now.Format("20060102"), a.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape percent-encodes a path as signatures expect, leaving only
+// unreserved characters and slashes as they are
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
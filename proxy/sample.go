@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// sampler logs a share of the commands that don't modify the dataset, to
+// bound log volume on busy deployments. Writes and commands under legal
+// hold are always logged.
+type sampler struct {
+	rate  int
+	rates map[string]int
+}
+
+func newSampler(cfg *config.SamplingConfig) *sampler {
+	if cfg == nil {
+		return nil
+	}
+	s := &sampler{rate: max(cfg.Rate, 1), rates: make(map[string]int)}
+	for _, rule := range cfg.Rules {
+		for _, name := range rule.Commands {
+			// The first rule naming a command wins
+			name = strings.ToUpper(name)
+			if _, ok := s.rates[name]; !ok {
+				s.rates[name] = rule.Rate
+			}
+		}
+	}
+	return s
+}
+
+// sample rolls whether a command is logged, returning the rate it is
+// sampled at: 1 in rate commands like it are logged
+func (s *sampler) sample(req *request) (rate int, logged bool) {
+	if s == nil || req.held || req.cmd.IsWrite() {
+		return 1, true
+	}
+	rate, ok := s.rates[req.name]
+	if !ok {
+		rate = s.rate
+	}
+	return rate, rate <= 1 || rand.Intn(rate) == 0
+}
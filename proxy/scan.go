@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// maxScansPerConnection bounds how many concurrent iterations a single
+// connection may have tracked
+const maxScansPerConnection = 64
+
+// scanTracker aggregates the iterations of SCAN, HSCAN, SSCAN and ZSCAN on
+// a connection into a single log entry per completed scan
+type scanTracker struct {
+	logger *zap.Logger
+	// scans are keyed by command, key and the cursor expected next
+	scans map[string]*scanSession
+}
+
+type scanSession struct {
+	command    string
+	key        string
+	match      string
+	keyType    string
+	iterations int
+	returned   int
+	started    time.Time
+}
+
+func newScanTracker(logger *zap.Logger) *scanTracker {
+	return &scanTracker{logger: logger, scans: make(map[string]*scanSession)}
+}
+
+func isScan(name string) bool {
+	switch name {
+	case "SCAN", "HSCAN", "SSCAN", "ZSCAN":
+		return true
+	}
+	return false
+}
+
+// track records the reply to a SCAN-family command
+func (t *scanTracker) track(req *request, reply *protocol.Reply) {
+	args := req.cmd.Args
+	var key string
+	if req.name != "SCAN" {
+		if len(args) == 0 {
+			return
+		}
+		key, args = args[0], args[1:]
+	}
+	if len(args) == 0 || reply.IsError() || len(reply.Elems) != 2 {
+		return
+	}
+	cursor, next := args[0], reply.Elems[0].Str
+
+	id := scanID(req.name, key, cursor)
+	scan := t.scans[id]
+	delete(t.scans, id)
+	if scan == nil {
+		if cursor != "0" && len(t.scans) >= maxScansPerConnection {
+			return
+		}
+		// Scans already in progress when tracking began are still counted
+		// from the first iteration seen
+		scan = &scanSession{command: req.name, key: key, started: time.Now()}
+		scan.match, scan.keyType = scanOptions(args[1:])
+	}
+
+	scan.iterations++
+	returned := len(reply.Elems[1].Elems)
+	if (req.name == "HSCAN" && !hasOption(args[1:], "NOVALUES")) || req.name == "ZSCAN" {
+		// Hash and sorted set scans return field/value pairs
+		returned /= 2
+	}
+	scan.returned += returned
+
+	if next == "0" {
+		t.log("Scan completed", scan)
+		return
+	}
+	if len(t.scans) < maxScansPerConnection {
+		t.scans[scanID(req.name, key, next)] = scan
+	}
+}
+
+// abandon logs every scan left unfinished when the connection closes
+func (t *scanTracker) abandon() {
+	for id, scan := range t.scans {
+		t.log("Scan abandoned", scan)
+		delete(t.scans, id)
+	}
+}
+
+func (t *scanTracker) log(msg string, scan *scanSession) {
+	fields := []zap.Field{
+		zap.String("command", scan.command),
+		zap.Int("iterations", scan.iterations),
+		zap.Int("keys_returned", scan.returned),
+		zap.Duration("duration", time.Since(scan.started)),
+	}
+	if scan.key != "" {
+		fields = append(fields, zap.String("key", scan.key))
+	}
+	if scan.match != "" {
+		fields = append(fields, zap.String("match", scan.match))
+	}
+	if scan.keyType != "" {
+		fields = append(fields, zap.String("type", scan.keyType))
+	}
+	t.logger.Info(msg, fields...)
+}
+
+func scanID(name, key, cursor string) string {
+	return name + "\x00" + key + "\x00" + cursor
+}
+
+// scanOptions returns the MATCH pattern and TYPE filter of a scan
+func scanOptions(options []string) (match, keyType string) {
+	for i := 0; i+1 < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "MATCH":
+			match = options[i+1]
+			i++
+		case "TYPE":
+			keyType = options[i+1]
+			i++
+		case "COUNT":
+			i++
+		}
+	}
+	return match, keyType
+}
+
+func hasOption(options []string, name string) bool {
+	for _, option := range options {
+		if strings.EqualFold(option, name) {
+			return true
+		}
+	}
+	return false
+}
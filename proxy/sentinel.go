@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// sentinelTimeout bounds dialing and querying a single sentinel
+const sentinelTimeout = 2 * time.Second
+
+// sentinelRetryDelay is how long the watcher waits after losing every
+// sentinel before trying them again
+const sentinelRetryDelay = time.Second
+
+// sentinel discovers the current master from Redis Sentinel and follows
+// failovers so new connections are dialed to the promoted master
+type sentinel struct {
+	logger   *zap.Logger
+	addrs    []string
+	master   string
+	password string
+
+	mu      sync.RWMutex
+	current string
+	// healthy is the index of the last sentinel that answered
+	healthy int
+
+	discovering atomic.Bool
+}
+
+func newSentinel(logger *zap.Logger, cfg *config.SentinelConfig) *sentinel {
+	if cfg == nil {
+		return nil
+	}
+	return &sentinel{
+		logger:   logger.With(zap.String("master_name", cfg.MasterName)),
+		addrs:    cfg.Addrs,
+		master:   cfg.MasterName,
+		password: cfg.Password,
+	}
+}
+
+// addr returns the address of the current master
+func (s *sentinel) addr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+func (s *sentinel) setAddr(addr string) (previous string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, s.current = s.current, addr
+	return previous
+}
+
+// discover asks each sentinel in turn for the address of the master
+func (s *sentinel) discover() error {
+	var lastErr error
+	for i, sentinelAddr := range s.addrs {
+		addr, err := s.query(sentinelAddr)
+		if err != nil {
+			s.logger.Warn("Failed to query sentinel", zap.String("sentinel", sentinelAddr), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		s.mu.Lock()
+		s.healthy = i
+		s.mu.Unlock()
+		if previous := s.setAddr(addr); previous != addr {
+			s.logger.Info("Redis master discovered",
+				zap.String("sentinel", sentinelAddr),
+				zap.String("master_addr", addr),
+			)
+		}
+		return nil
+	}
+	return fmt.Errorf("no sentinel returned the address of master %s: %w", s.master, lastErr)
+}
+
+// discoverAsync rediscovers the master in the background unless a
+// discovery is already running
+func (s *sentinel) discoverAsync() {
+	if s.discovering.CompareAndSwap(false, true) {
+		go func() {
+			defer s.discovering.Store(false)
+			if err := s.discover(); err != nil {
+				s.logger.Error("Failed to rediscover Redis master", zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (s *sentinel) query(sentinelAddr string) (string, error) {
+	client := &upstreamClient{dial: s.dialer(sentinelAddr), timeout: sentinelTimeout}
+	defer client.close()
+
+	if err := s.auth(client); err != nil {
+		return "", err
+	}
+	reply, err := client.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", s.master)
+	if err != nil {
+		return "", err
+	}
+	if reply.IsError() {
+		return "", fmt.Errorf("%s", reply.Str)
+	}
+	if reply.Null || len(reply.Elems) != 2 {
+		return "", fmt.Errorf("unknown master %s", s.master)
+	}
+	return net.JoinHostPort(reply.Elems[0].Str, reply.Elems[1].Str), nil
+}
+
+func (s *sentinel) auth(client *upstreamClient) error {
+	if s.password == "" {
+		return nil
+	}
+	reply, err := client.do("AUTH", s.password)
+	if err != nil {
+		return err
+	}
+	if reply.IsError() {
+		return fmt.Errorf("sentinel AUTH failed: %s", reply.Str)
+	}
+	return nil
+}
+
+func (s *sentinel) dialer(addr string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, sentinelTimeout)
+	}
+}
+
+// watch follows +switch-master events until the context is cancelled,
+// moving on to the next sentinel whenever a subscription is lost
+func (s *sentinel) watch(ctx context.Context) {
+	s.mu.RLock()
+	next := s.healthy
+	s.mu.RUnlock()
+
+	for ; ; next++ {
+		sentinelAddr := s.addrs[next%len(s.addrs)]
+		err := s.subscribe(ctx, sentinelAddr)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("Lost sentinel subscription", zap.String("sentinel", sentinelAddr), zap.Error(err))
+
+		// Failovers may have happened while unsubscribed
+		if err := s.discover(); err != nil {
+			s.logger.Error("Failed to rediscover Redis master", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sentinelRetryDelay):
+		}
+	}
+}
+
+func (s *sentinel) subscribe(ctx context.Context, sentinelAddr string) error {
+	client := &upstreamClient{dial: s.dialer(sentinelAddr), timeout: sentinelTimeout}
+	defer client.close()
+
+	if err := s.auth(client); err != nil {
+		return err
+	}
+	reply, err := client.do("SUBSCRIBE", "+switch-master")
+	if err != nil {
+		return err
+	}
+	if reply.IsError() {
+		return fmt.Errorf("%s", reply.Str)
+	}
+
+	// Messages arrive at unpredictable times, so unblock the read by
+	// closing the connection instead of using a deadline
+	conn := client.conn
+	conn.SetDeadline(time.Time{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		message, err := client.reader.ReadReply()
+		if err != nil {
+			return err
+		}
+		s.switchMaster(message)
+	}
+}
+
+// switchMaster handles a +switch-master message, whose payload is
+// "<master name> <old ip> <old port> <new ip> <new port>"
+func (s *sentinel) switchMaster(message *protocol.Reply) {
+	if len(message.Elems) != 3 || message.Elems[0].Str != "message" {
+		return
+	}
+	fields := strings.Fields(message.Elems[2].Str)
+	if len(fields) != 5 || fields[0] != s.master {
+		return
+	}
+
+	addr := net.JoinHostPort(fields[3], fields[4])
+	previous := s.setAddr(addr)
+	s.logger.Warn("Redis master switched",
+		zap.String("old_master_addr", previous),
+		zap.String("master_addr", addr),
+	)
+}
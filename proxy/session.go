@@ -0,0 +1,817 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// request tracks a command that is waiting for its reply
+type request struct {
+	cmd  *protocol.Command
+	name string
+	// checksum is taken from the raw bytes when verify_checksums is enabled
+	checksum *frameChecksum
+
+	tenant  string
+	service string
+	// user is the proxy user the client had authenticated as when it sent
+	// the command
+	user string
+	// db is the database selected when the command was received, or -1
+	// until the client sends SELECT
+	db int64
+	// shard and slot are the node and hash slot in cluster and sharded mode
+	shard string
+	slot  int
+	// held marks commands under legal hold, which are always logged
+	held bool
+	// elevation is the operator grant allowing a command the identity ACL
+	// would otherwise deny
+	elevation *elevation
+	// sent is when the command was forwarded to Redis
+	sent time.Time
+	// reply is set when the proxy answers the command itself instead of
+	// forwarding it to Redis
+	reply []byte
+	// journal is the id of the write in the journal of in-flight writes
+	journal uint64
+	// internal marks commands the proxy sends on its own, whose replies
+	// are not passed to the client
+	internal bool
+	// target receives the target's reply to a dual write or shadow read
+	target chan *protocol.Reply
+	// prevDB is the database selected before a SELECT, restored if it
+	// fails
+	prevDB int64
+	// cacheScope is the cache scope of the session that sent a GET or
+	// MGET, which its reply is cached under
+	cacheScope string
+	// cacheGens are the cache generations of a GET or MGET's keys when it
+	// was forwarded, which its reply is cached under
+	cacheGens []uint64
+	// namespace is the prefix the command's keys were placed under, which
+	// is stripped from keys named in the reply
+	namespace string
+	// call is the command as seen by interceptors
+	call *Call
+	// failureFields are the fields of a command held back by errors_only,
+	// logged if it fails
+	failureFields []zap.Field
+	// seq numbers the command among those received on its connection, and
+	// id identifies it across proxies when correlation_ids is enabled
+	seq uint64
+	id  string
+	// logged is whether the command was logged when received
+	logged bool
+}
+
+// received is a reply read from Redis
+type received struct {
+	reply    *protocol.Reply
+	checksum *frameChecksum
+}
+
+// session represents a single proxied client connection
+type session struct {
+	id       uint64
+	proxy    *Proxy
+	client   net.Conn
+	upstream net.Conn
+	logger   *zap.Logger
+	// target is the connection to the dual-write or shadow-read target,
+	// and targetPending the commands awaiting its reply
+	target        net.Conn
+	targetPending chan *request
+	// multi is whether the client is queueing a transaction, which only
+	// the command reader reads and writes
+	multi bool
+	// seq counts the commands received, which only the command reader
+	// reads and writes
+	seq uint64
+	// backend is the address of the Redis the session is connected to, or
+	// "" when its commands are routed or multiplexed
+	backend string
+	// multiWrites are the keys written by the commands of the transaction
+	// being queued, and multiClears whether any of them may write any key,
+	// which the cache invalidates once EXEC runs them. Only the command
+	// reader reads and writes them.
+	multiWrites []string
+	multiClears bool
+	// redisAuth is set once the client sends AUTH to Redis itself, which
+	// only the command reader reads and writes
+	redisAuth bool
+	// db is the database the client selected, or -1 until it sends SELECT
+	db atomic.Int64
+	// identity is taken from the client certificate when mutual TLS is
+	// enabled
+	identity string
+	// user is the name the client authenticated as with the proxy's own
+	// auth, which only the command reader reads and writes
+	user          string
+	authenticated bool
+	// flags are the feature flags enabled for the connection
+	flags []string
+	// multiplexed is set when the session shares the multiplexer's
+	// connections rather than having its own
+	multiplexed bool
+	stats       *connStats
+	// listener is the address the client connected to, and labels the
+	// labels of its connections
+	listener string
+	labels   labels
+	// info describes the connection to interceptors and subscribers
+	info *ConnInfo
+
+	pending chan *request
+	done    chan struct{}
+	once    sync.Once
+
+	scans *scanTracker
+
+	// nodes and handshake hold the per-node connections of a cluster mode
+	// session and the session commands replayed on each new one
+	nodes     map[string]*clusterNode
+	handshake [][]byte
+
+	protocol   atomic.Int32
+	requested  atomic.Int32
+	subscribed atomic.Bool
+	// pubsub is set once the client subscribes in either protocol, and
+	// inFlight counts the forwarded commands awaiting a reply; both keep
+	// the connection from being closed as idle
+	pubsub     atomic.Bool
+	inFlight   atomic.Int64
+	monitoring atomic.Bool
+	replyMode  string
+}
+
+func (p *Proxy) newSession(client, upstream net.Conn, logger *zap.Logger) *session {
+	s := &session{
+		id:       p.nextID.Add(1),
+		proxy:    p,
+		client:   client,
+		upstream: upstream,
+		logger:   logger,
+		pending:  make(chan *request, 128),
+		done:     make(chan struct{}),
+	}
+	if p.config.TrackScans {
+		s.scans = newScanTracker(logger)
+	}
+	if p.routed() {
+		s.nodes = make(map[string]*clusterNode)
+	}
+	if p.targetAddr() != "" {
+		s.targetPending = make(chan *request, 128)
+	}
+	s.protocol.Store(2)
+	s.db.Store(-1)
+	return s
+}
+
+// serve forwards commands and replies until either side disconnects
+func (s *session) serve() {
+	if s.proxy.routed() {
+		s.serveCluster()
+		return
+	}
+
+	if s.target != nil {
+		go s.readTargetReplies()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Forward commands from client to Redis
+	go func() {
+		defer wg.Done()
+		s.readCommands()
+	}()
+
+	// Forward replies from Redis to client
+	go func() {
+		defer wg.Done()
+		s.writeReplies()
+	}()
+
+	wg.Wait()
+
+	if s.scans != nil {
+		s.scans.abandon()
+	}
+}
+
+// close tears down both connections so that blocked reads return
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.client.Close()
+		if s.upstream != nil {
+			s.upstream.Close()
+		}
+		if s.target != nil {
+			s.target.Close()
+		}
+		for _, node := range s.nodes {
+			node.conn.Close()
+		}
+	})
+}
+
+func (s *session) readCommands() {
+	defer close(s.pending)
+
+	var source io.Reader = s.client
+	var capture *captureReader
+	if s.proxy.config.VerifyChecksums {
+		capture = &captureReader{reader: s.client}
+		source = capture
+	}
+
+	parser := s.newCommandReader(source)
+	for {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			if err != io.EOF && !s.closed() && !s.proxy.isDraining() {
+				s.logger.Error("Failed to read command", zap.Error(err))
+			}
+			return
+		}
+
+		req := &request{cmd: cmd, name: strings.ToUpper(cmd.Name)}
+		if capture != nil {
+			sum := checksumOf(capture.take(parser.Buffered()))
+			req.checksum = &sum
+		}
+		s.intercept(req)
+		cmd = req.cmd
+		s.publishCommand(req)
+
+		reply := s.check(req)
+		if reply == nil {
+			reply = s.proxy.cache.lookup(s, req)
+		}
+		if reply == nil && s.multiplexed {
+			if req.name == "QUIT" {
+				// Redis would close the shared connection
+				req.reply = []byte("+OK\r\n")
+				s.enqueue(req)
+				return
+			}
+			if multiplexUnsupported(req) {
+				reply = []byte(fmt.Sprintf("-ERR %s is not supported by the proxy in multiplexing mode\r\n", req.name))
+			}
+		}
+		if reply != nil {
+			if s.closed() {
+				return
+			}
+			req.reply = reply
+			s.logAnswer(req, reply)
+			if !s.enqueue(req) {
+				return
+			}
+			continue
+		}
+
+		// Set before queueing, as the reply goroutine reads them
+		req.sent = time.Now()
+		req.journal = s.proxy.journal.begin(s, req)
+		expectsReply := s.expectsReply(req)
+		s.routeTarget(req, expectsReply)
+		s.proxy.cache.observe(s, req)
+		s.trackTransaction(req)
+		s.trackDB(req)
+		if expectsReply {
+			s.inFlight.Add(1)
+			if !s.enqueue(req) {
+				return
+			}
+		}
+
+		if req.checksum != nil {
+			s.verify("request", cmd.Name, *req.checksum, cmd.Message)
+		}
+		if _, err := s.upstream.Write(cmd.Message); err != nil {
+			s.logger.Error("Failed to write to Redis", zap.Error(err))
+			s.close()
+			return
+		}
+		if req.target != nil && !s.writeTarget(req) {
+			return
+		}
+		s.proxy.mirror.send(req)
+		if req.name == "RESET" && !s.reauthenticate() {
+			return
+		}
+	}
+}
+
+// reauthenticate restores the configured Redis credentials after RESET,
+// which logs the upstream connection out
+func (s *session) reauthenticate() bool {
+	if s.proxy.config.RedisPassword == "" {
+		return true
+	}
+	auth := s.proxy.authCommand()
+	req := &request{cmd: &protocol.Command{Name: "AUTH", Message: auth}, name: "AUTH", sent: time.Now(), internal: true}
+	if !s.enqueue(req) {
+		return false
+	}
+	if _, err := s.upstream.Write(auth); err != nil {
+		s.logger.Error("Failed to write to Redis", zap.Error(err))
+		s.close()
+		return false
+	}
+	return true
+}
+
+// publishCommand publishes a command received from the client, with the
+// fields it is logged with
+func (s *session) publishCommand(req *request) {
+	req.tenant, req.service = s.proxy.partitions.resolve(remoteIP(s.client), req.cmd)
+	req.held = s.proxy.legalHold.matches(req.tenant, req.cmd)
+	req.elevation = s.proxy.elevationFor(s, req)
+	req.user = s.user
+	req.db = s.db.Load()
+	s.seq++
+	req.seq = s.seq
+	if s.proxy.config.CorrelationIDs {
+		req.id = fmt.Sprintf("%s-%d-%d", s.proxy.runID, s.id, req.seq)
+	}
+	s.stats.commands.Add(1)
+	s.proxy.hotKeys.observe(req)
+	s.proxy.bigKeys.checkRequest(s, req)
+
+	fields := append(commandFields(req.cmd, s.proxy.values), partitionFields(req.tenant, req.service)...)
+	if req.db >= 0 {
+		fields = append(fields, zap.Int64("db", req.db))
+	}
+	if req.shard != "" {
+		fields = append(fields, zap.String("shard", req.shard))
+		if req.slot >= 0 {
+			fields = append(fields, zap.Int("slot", req.slot))
+		}
+		if l := s.proxy.labels.upstream(req.shard); len(l) > 0 {
+			fields = append(fields, zap.Object("upstream_labels", l))
+		}
+	}
+	if req.name == "FCALL" || req.name == "FCALL_RO" {
+		if len(req.cmd.Args) > 0 {
+			if library := s.proxy.functions.library(req.cmd.Args[0]); library != "" {
+				fields = append(fields, zap.String("library", library))
+			}
+		}
+	}
+	if s.proxy.config.CommandHash {
+		fields = append(fields, zap.String("command_hash", req.cmd.Hash()))
+	}
+	fields = append(fields, s.correlationFields(req)...)
+	if s.user != "" {
+		fields = append(fields, zap.String("user", s.user))
+	}
+	if req.held {
+		fields = append(fields, zap.Bool("legal_hold", true))
+	}
+	if req.elevation != nil {
+		fields = append(fields, zap.String("elevation_id", req.elevation.ID))
+	}
+	if req.call != nil {
+		fields = append(fields, req.call.fields...)
+	}
+	logged := s.proxy.logFilter.logs(req)
+	if logged && s.proxy.logFilter.deferred(req) {
+		req.failureFields, logged = fields, false
+	} else if logged {
+		var rate int
+		rate, logged = s.proxy.sampler.sample(req)
+		if rate > 1 {
+			fields = append(fields, zap.Int("sample_rate", rate))
+		}
+	}
+	if logged && s.proxy.summary.suppresses(req) {
+		logged = false
+	}
+	req.logged = logged
+
+	s.proxy.publish(&CommandEvent{
+		Time:      time.Now(),
+		Conn:      s.info,
+		Command:   req.cmd,
+		DB:        req.db,
+		User:      req.user,
+		Tenant:    req.tenant,
+		Service:   req.service,
+		Shard:     req.shard,
+		Held:      req.held,
+		Logged:    logged,
+		Fields:    fields,
+		Seq:       req.seq,
+		RequestID: req.id,
+		session:   s,
+		req:       req,
+	})
+}
+
+// check runs the policies that may answer a command instead of Redis,
+// returning the error reply of the first one that rejects it
+func (s *session) check(req *request) []byte {
+	if reply := s.proxy.checkAuth(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.checkIntercepted(req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkProxyInfo(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.mode.check(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkUserACL(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkProtocol(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkKeyRules(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkBlocked(s, req); reply != nil {
+		return reply
+	}
+	if reply := s.proxy.checkIdentityACL(s, req); reply != nil {
+		return reply
+	}
+	// Approval comes last so operators are never asked about commands
+	// that would be rejected anyway
+	if reply := s.proxy.approvals.await(s, req); reply != nil {
+		return reply
+	}
+	// Faults stand in for Redis, so only commands about to be forwarded
+	// get them
+	if reply := s.proxy.injectFault(s, req); reply != nil {
+		return reply
+	}
+	// Keys are rewritten last, so that the policies above see the keys
+	// the client sent
+	return s.proxy.rewriteKeys(s, req)
+}
+
+// trackTransaction follows whether the client is queueing a transaction
+func (s *session) trackTransaction(req *request) {
+	switch req.name {
+	case "MULTI":
+		s.multi = true
+	case "EXEC", "DISCARD", "RESET":
+		s.multi = false
+	}
+}
+
+// trackDB follows the database the client selects. SELECT is assumed to
+// succeed so that the commands pipelined after it are logged with the new
+// database, and undone if it fails.
+func (s *session) trackDB(req *request) {
+	switch req.name {
+	case "SELECT":
+		if db, ok := selectedDB(req); ok {
+			req.prevDB = s.db.Swap(db)
+		}
+	case "RESET":
+		if s.db.Load() >= 0 {
+			s.db.Store(0)
+		}
+	}
+}
+
+// selectedDB returns the database a SELECT command selects
+func selectedDB(req *request) (int64, bool) {
+	if len(req.cmd.Args) == 0 {
+		return 0, false
+	}
+	db, err := strconv.ParseInt(req.cmd.Args[0], 10, 64)
+	return db, err == nil && db >= 0
+}
+
+// expectsReply reports whether Redis will answer the command with exactly
+// one reply, tracking the connection states in which it does not
+func (s *session) expectsReply(req *request) bool {
+	switch req.name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE",
+		"UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+		// Confirmations arrive as pub/sub messages, one per channel, and
+		// Redis confirms unsubscribing even when nothing was subscribed.
+		// RESP3 sends them as push replies, which need no tracking.
+		if s.protocol.Load() == 2 {
+			s.subscribed.Store(true)
+		}
+		s.pubsub.Store(true)
+		return false
+	case "CLIENT":
+		if len(req.cmd.Args) >= 2 && strings.EqualFold(req.cmd.Args[0], "REPLY") {
+			mode := strings.ToUpper(req.cmd.Args[1])
+			s.replyMode = mode
+			// CLIENT REPLY ON is acknowledged, OFF and SKIP are not
+			return mode == "ON"
+		}
+	case "RESET":
+		s.subscribed.Store(false)
+		s.pubsub.Store(false)
+		s.replyMode = ""
+	}
+
+	switch s.replyMode {
+	case "OFF":
+		return false
+	case "SKIP":
+		s.replyMode = ""
+		return false
+	}
+	return true
+}
+
+func (s *session) enqueue(req *request) bool {
+	select {
+	case s.pending <- req:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) writeReplies() {
+	defer s.close()
+
+	replies := make(chan received)
+	errs := make(chan error, 1)
+	go func() {
+		var source io.Reader = s.upstream
+		var capture *captureReader
+		if s.proxy.config.VerifyChecksums {
+			capture = &captureReader{reader: s.upstream}
+			source = capture
+		}
+
+		reader := protocol.NewReplyReader(source)
+		for {
+			reply, err := reader.ReadReply()
+			if err != nil {
+				errs <- err
+				return
+			}
+			r := received{reply: reply}
+			if capture != nil {
+				sum := checksumOf(capture.take(reader.Buffered()))
+				r.checksum = &sum
+			}
+			select {
+			case replies <- r:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	// timer runs for the command at the head of the queue, the one Redis
+	// is answering
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	var timed *request
+	var timeout time.Duration
+
+	var queue []*request
+	var last string
+	pending := s.pending
+	for {
+		var ok bool
+		if queue, ok = s.flushLocal(queue); !ok {
+			return
+		}
+		if pending == nil && len(queue) == 0 {
+			return
+		}
+
+		var expired <-chan time.Time
+		if len(queue) > 0 {
+			if queue[0] != timed {
+				timed, timeout = queue[0], s.proxy.timeouts.of(queue[0])
+				if timeout > 0 {
+					timer.Reset(time.Until(timed.sent.Add(timeout)))
+				}
+			}
+			if timeout > 0 {
+				expired = timer.C
+			}
+		}
+
+		select {
+		case req, ok := <-pending:
+			if !ok {
+				pending = nil
+				continue
+			}
+			queue = append(queue, req)
+		case r := <-replies:
+			reply := r.reply
+			// The command is always queued before it is written upstream,
+			// so collect everything queued so far before matching
+			if pending != nil {
+				queue, pending = drain(queue, pending)
+			}
+			if queue, ok = s.flushLocal(queue); !ok {
+				return
+			}
+
+			var command string
+			message := reply.Message
+			if !s.isPush(reply) && len(queue) > 0 {
+				req := queue[0]
+				queue = queue[1:]
+				if req.internal {
+					if reply.IsError() {
+						s.logger.Error("Redis AUTH failed", zap.String("error", reply.Str))
+					}
+					continue
+				}
+				command, last = req.cmd.Name, req.name
+				s.inFlight.Add(-1)
+				s.proxy.journal.end(req.journal)
+				s.proxy.persistence.observe(req)
+				s.handleReply(req, reply)
+				s.onResponse(req, reply)
+				s.proxy.cache.fill(req, reply)
+				s.proxy.bigKeys.checkReply(s, req, len(reply.Message))
+				s.proxy.slowlog.observe(s, req, time.Since(req.sent))
+				s.proxy.latencies.observe(s, req, time.Since(req.sent))
+				s.publishResponse(req, time.Since(req.sent), reply.Message)
+				chosen := reply
+				if req.target != nil {
+					if chosen, ok = s.resolveTarget(req, reply); !ok {
+						return
+					}
+					message = chosen.Message
+				}
+				if stripped := stripNamespace(req, chosen); stripped != nil {
+					message = stripped
+				}
+			}
+			s.logAttributes(command, reply)
+
+			if r.checksum != nil {
+				s.verify("reply", command, *r.checksum, reply.Message)
+			}
+			s.stats.countReply(message)
+			if _, err := s.client.Write(message); err != nil {
+				s.logger.Error("Failed to write to client", zap.Error(err))
+				return
+			}
+		case <-expired:
+			if pending != nil {
+				queue, _ = drain(queue, pending)
+			}
+			s.timeOut(queue, timeout)
+			return
+		case err := <-errs:
+			if s.closed() {
+				return
+			}
+			if pending != nil {
+				queue, _ = drain(queue, pending)
+			}
+			s.upstreamEnded(err, last, queue)
+			return
+		}
+	}
+}
+
+// upstreamEnded reports why the connection to Redis ended. A close from the
+// Redis side, such as after SHUTDOWN, CLIENT KILL or a failover, is logged
+// as an upstream event with the last command sent on the connection.
+func (s *session) upstreamEnded(err error, last string, queue []*request) {
+	if !isConnClosed(err) {
+		s.logger.Error("Failed to read reply", zap.Error(err))
+		return
+	}
+
+	var inFlight int
+	for _, req := range queue {
+		if req.reply == nil {
+			inFlight++
+			last = req.name
+		}
+	}
+	if last == "QUIT" && inFlight == 0 {
+		return
+	}
+
+	reason := "closed"
+	if last == "SHUTDOWN" {
+		reason = "shutdown"
+	} else if errors.Is(err, syscall.ECONNRESET) {
+		reason = "reset"
+	}
+	s.logger.Warn("Upstream closed connection",
+		zap.String("reason", reason),
+		zap.String("last_command", last),
+		zap.Int("in_flight", inFlight),
+	)
+	s.proxy.upstreamClosed(s.upstream)
+}
+
+// flushLocal writes the replies produced by the proxy at the head of the
+// queue; they are sent once every command ahead of them has been answered,
+// preserving pipeline order
+func (s *session) flushLocal(queue []*request) ([]*request, bool) {
+	for len(queue) > 0 && queue[0].reply != nil {
+		s.stats.countReply(queue[0].reply)
+		if _, err := s.client.Write(queue[0].reply); err != nil {
+			s.logger.Error("Failed to write to client", zap.Error(err))
+			return queue, false
+		}
+		queue = queue[1:]
+	}
+	return queue, true
+}
+
+// drain moves every request currently buffered in pending onto the queue
+func drain(queue []*request, pending chan *request) ([]*request, chan *request) {
+	for {
+		select {
+		case req, ok := <-pending:
+			if !ok {
+				return queue, nil
+			}
+			queue = append(queue, req)
+		default:
+			return queue, pending
+		}
+	}
+}
+
+// isPush reports whether a reply was sent without a matching command, such
+// as pub/sub messages and MONITOR output
+func (s *session) isPush(reply *protocol.Reply) bool {
+	if reply.Type == '>' || s.monitoring.Load() {
+		return true
+	}
+	if !s.subscribed.Load() || reply.Type != '*' || len(reply.Elems) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(reply.Elems[0].Str) {
+	case "message", "pmessage", "smessage", "subscribe", "psubscribe", "ssubscribe":
+		return true
+	case "unsubscribe", "punsubscribe", "sunsubscribe":
+		// The last unsubscribe confirmation reports zero subscriptions
+		if len(reply.Elems) == 3 && reply.Elems[2].Str == "0" {
+			s.subscribed.Store(false)
+		}
+		return true
+	}
+	return false
+}
+
+// handleReply inspects the reply to a forwarded command
+func (s *session) handleReply(req *request, reply *protocol.Reply) {
+	switch req.name {
+	case "MONITOR":
+		if !reply.IsError() {
+			s.monitoring.Store(true)
+		}
+	case "HELLO":
+		s.proxy.helloReply(s, req, reply)
+	case "SELECT":
+		if db, ok := selectedDB(req); ok && reply.IsError() {
+			s.db.CompareAndSwap(db, req.prevDB)
+		}
+	case "FUNCTION":
+		s.proxy.functions.track(s, req, reply)
+	case "SCAN", "HSCAN", "SSCAN", "ZSCAN":
+		if s.scans != nil {
+			s.scans.track(req, reply)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+const (
+	parserLegacy   = "legacy"
+	parserBuffered = "buffered"
+	parserShadow   = "shadow"
+)
+
+const (
+	// shadowQueueSize bounds how many commands may await comparison
+	shadowQueueSize = 4096
+	// shadowBufferSize bounds how many bytes the shadow parser may fall
+	// behind before the comparison is abandoned for the connection
+	shadowBufferSize = 4 << 20
+)
+
+// commandReader is implemented by the protocol parsers
+type commandReader interface {
+	ReadCommand() (*protocol.Command, error)
+	Buffered() int
+}
+
+// newCommandReader returns the parser selected by the parser setting
+func (s *session) newCommandReader(source io.Reader) commandReader {
+	switch s.proxy.config.Parser {
+	case parserBuffered:
+		return protocol.NewBuffered(source)
+	case parserShadow:
+		return newShadowParser(source, s.logger)
+	default:
+		if s.enabled(flagBufferedParser) {
+			return protocol.NewBuffered(source)
+		}
+		return protocol.New(source)
+	}
+}
+
+// shadowParser forwards the commands of the legacy parser while the
+// buffered parser reads a copy of the same byte stream, logging any
+// divergence between the two
+type shadowParser struct {
+	primary *protocol.Parser
+	logger  *zap.Logger
+
+	stream   *shadowStream
+	parsed   chan *protocol.Command
+	disabled atomic.Bool
+
+	compared atomic.Uint64
+	diverged atomic.Uint64
+}
+
+type shadowResult struct {
+	cmd *protocol.Command
+	err error
+}
+
+func newShadowParser(source io.Reader, logger *zap.Logger) *shadowParser {
+	p := &shadowParser{
+		logger: logger,
+		stream: newShadowStream(),
+		parsed: make(chan *protocol.Command, shadowQueueSize),
+	}
+	p.primary = protocol.New(&teeReader{reader: source, shadow: p})
+
+	results := make(chan shadowResult, shadowQueueSize)
+	go func() {
+		defer close(results)
+		shadow := protocol.NewBuffered(p.stream)
+		for {
+			cmd, err := shadow.ReadCommand()
+			results <- shadowResult{cmd: cmd, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go p.compare(results)
+	return p
+}
+
+func (p *shadowParser) Buffered() int {
+	return 0
+}
+
+func (p *shadowParser) ReadCommand() (*protocol.Command, error) {
+	cmd, err := p.primary.ReadCommand()
+	if err != nil {
+		p.finish()
+		return nil, err
+	}
+	if !p.disabled.Load() {
+		select {
+		case p.parsed <- cmd:
+		default:
+			p.disable("comparison queue full")
+		}
+	}
+	return cmd, nil
+}
+
+// finish stops feeding the shadow parser once the primary stream ends
+func (p *shadowParser) finish() {
+	if p.disabled.CompareAndSwap(false, true) {
+		p.stream.Close()
+		close(p.parsed)
+	}
+}
+
+func (p *shadowParser) disable(reason string) {
+	if p.disabled.CompareAndSwap(false, true) {
+		p.logger.Warn("Shadow parser comparison disabled", zap.String("reason", reason))
+		p.stream.Close()
+		close(p.parsed)
+	}
+}
+
+// compare pairs each command of the primary parser with the shadow
+// parser's result for the same position in the stream
+func (p *shadowParser) compare(results chan shadowResult) {
+	var index uint64
+	for cmd := range p.parsed {
+		index++
+		result, ok := <-results
+		if !ok {
+			p.divergence(index, "framing", zap.String("legacy", cmd.Name), zap.String("buffered", "shadow stream ended"))
+			break
+		}
+		if result.err != nil {
+			p.divergence(index, "error", zap.String("legacy", cmd.Name), zap.String("buffered", result.err.Error()))
+			break
+		}
+		p.compared.Add(1)
+		p.check(index, cmd, result.cmd)
+	}
+
+	// Drain so the shadow goroutine can exit
+	for range results {
+	}
+	p.logger.Debug("Shadow parser summary",
+		zap.Uint64("compared", p.compared.Load()),
+		zap.Uint64("diverged", p.diverged.Load()),
+	)
+}
+
+// check compares the parsers' results for a command. Arguments and raw
+// frames may hold passwords and values, so where they differ only their
+// position and lengths are logged.
+func (p *shadowParser) check(index uint64, primary, shadow *protocol.Command) {
+	switch {
+	case primary.Name != shadow.Name:
+		p.divergence(index, "name", zap.String("legacy", primary.Name), zap.String("buffered", shadow.Name))
+	case len(primary.Args) != len(shadow.Args):
+		p.divergence(index, "arg_count", zap.Int("legacy", len(primary.Args)), zap.Int("buffered", len(shadow.Args)))
+	case !bytes.Equal(primary.Message, shadow.Message):
+		p.divergence(index, "message",
+			zap.Int("offset", commonPrefix(primary.Message, shadow.Message)),
+			zap.Int("legacy_bytes", len(primary.Message)),
+			zap.Int("buffered_bytes", len(shadow.Message)),
+		)
+	default:
+		for i := range primary.Args {
+			if primary.Args[i] != shadow.Args[i] {
+				p.divergence(index, "args",
+					zap.Int("arg", i),
+					zap.Int("legacy_bytes", len(primary.Args[i])),
+					zap.Int("buffered_bytes", len(shadow.Args[i])),
+				)
+				return
+			}
+		}
+	}
+}
+
+func (p *shadowParser) divergence(index uint64, field string, fields ...zap.Field) {
+	p.diverged.Add(1)
+	p.logger.Warn("Parser divergence", append([]zap.Field{
+		zap.Uint64("command_index", index),
+		zap.String("field", field),
+	}, fields...)...)
+}
+
+// commonPrefix returns the length of the longest common prefix of a and b
+func commonPrefix(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// teeReader copies everything the primary parser reads to the shadow
+// parser without ever blocking the primary
+type teeReader struct {
+	reader io.Reader
+	shadow *shadowParser
+}
+
+func (t *teeReader) Read(b []byte) (int, error) {
+	n, err := t.reader.Read(b)
+	if n > 0 && !t.shadow.disabled.Load() && !t.shadow.stream.write(b[:n]) {
+		t.shadow.disable("shadow parser fell behind")
+	}
+	return n, err
+}
+
+// shadowStream is a bounded in-memory pipe whose writes never block
+type shadowStream struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func newShadowStream() *shadowStream {
+	s := &shadowStream{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// write appends b, reporting false when the buffer limit is exceeded
+func (s *shadowStream) write(b []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf)+len(b) > shadowBufferSize {
+		return false
+	}
+	s.buf = append(s.buf, b...)
+	s.cond.Signal()
+	return true
+}
+
+func (s *shadowStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *shadowStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// maxDiffValue bounds how much of a differing value is logged
+const maxDiffValue = 256
+
+// maxDiffMembers bounds how many differing members of an unordered reply
+// are logged
+const maxDiffMembers = 10
+
+// unorderedReplies are the reads whose replies come in no defined order,
+// mapped to the number of elements that make up one member
+var unorderedReplies = map[string]int{
+	"SMEMBERS": 1,
+	"SINTER":   1,
+	"SUNION":   1,
+	"SDIFF":    1,
+	"KEYS":     1,
+	"HKEYS":    1,
+	"HVALS":    1,
+	"HGETALL":  2,
+}
+
+// uncomparedReads differ between two servers holding the same data, so
+// they are never compared
+var uncomparedReads = map[string]bool{
+	"RANDOMKEY":   true,
+	"SRANDMEMBER": true,
+	"HRANDFIELD":  true,
+	"ZRANDMEMBER": true,
+	"SCAN":        true,
+	"SSCAN":       true,
+	"HSCAN":       true,
+	"ZSCAN":       true,
+	"TTL":         true,
+	"PTTL":        true,
+	"TIME":        true,
+}
+
+// shadowReads is the compare mode: a share of the reads is also sent to a
+// shadow backend, over the session's target connection, and the replies
+// are diffed
+type shadowReads struct {
+	addr    string
+	percent float64
+}
+
+func newShadowReads(cfg *config.ShadowReadsConfig) *shadowReads {
+	if cfg == nil {
+		return nil
+	}
+	sr := &shadowReads{addr: cfg.Addr, percent: cfg.Percent}
+	if sr.percent == 0 {
+		sr.percent = 100
+	}
+	return sr
+}
+
+// compares reports whether a read is sent to the shadow
+func (sr *shadowReads) compares(s *session, req *request) bool {
+	if sr == nil || s.multi || uncomparedReads[req.name] {
+		return false
+	}
+	spec := protocol.LookupCommand(req.name)
+	if spec == nil || spec.Flags&protocol.FlagReadOnly == 0 || spec.Flags&protocol.FlagBlocking != 0 {
+		return false
+	}
+	return sr.percent >= 100 || rand.Float64()*100 < sr.percent
+}
+
+// diffShadowRead logs where the shadow's reply to a read differs from the
+// primary's
+func (s *session) diffShadowRead(req *request, primary, shadow *protocol.Reply) {
+	if bytes.Equal(primary.Message, shadow.Message) {
+		return
+	}
+	fields := []zap.Field{zap.String("command", req.cmd.Name)}
+	var key string
+	if keys := req.cmd.Keys(); len(keys) > 0 {
+		key = keys[0]
+		fields = append(fields, zap.String("key", key))
+	}
+	// Values the policy redacts are logged as their lengths and hashes
+	redacted := s.proxy.values.forCommand(req.cmd).redacts(key, "")
+
+	if group := unorderedReplies[req.name]; group > 0 && !primary.IsError() && !shadow.IsError() {
+		missing, extra := diffMembers(members(primary, group), members(shadow, group))
+		if len(missing) == 0 && len(extra) == 0 {
+			return
+		}
+		if redacted {
+			missing, extra = hashMembers(missing), hashMembers(extra)
+		}
+		s.logger.Warn("Shadow read differs", append(fields,
+			zap.Strings("missing_on_shadow", truncateMembers(missing)),
+			zap.Strings("extra_on_shadow", truncateMembers(extra)),
+		)...)
+		return
+	}
+
+	path, a, b := diffReply(primary, shadow, "$")
+	fields = append(fields, zap.String("path", path))
+	if redacted {
+		fields = append(fields,
+			zap.Int("primary_length", len(a)), zap.String("primary_hash", hashValue(a)),
+			zap.Int("shadow_length", len(b)), zap.String("shadow_hash", hashValue(b)),
+		)
+	} else {
+		fields = append(fields,
+			zap.String("primary", truncateValue(a)),
+			zap.String("shadow", truncateValue(b)),
+		)
+	}
+	s.logger.Warn("Shadow read differs", fields...)
+}
+
+// hashValue identifies a redacted value by the start of its SHA-256 hash,
+// so that differences can be told apart without logging it
+func hashValue(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashMembers replaces redacted members with their hashes
+func hashMembers(list []string) []string {
+	hashed := make([]string, len(list))
+	for i, m := range list {
+		hashed[i] = hashValue(m)
+	}
+	return hashed
+}
+
+// diffReply returns the path of the first difference between two replies
+// and how each side renders there
+func diffReply(a, b *protocol.Reply, path string) (string, string, string) {
+	if !isAggregate(a) || !isAggregate(b) || a.Type != b.Type {
+		return path, renderReply(a), renderReply(b)
+	}
+	for i := range min(len(a.Elems), len(b.Elems)) {
+		if !equalReplies(a.Elems[i], b.Elems[i]) {
+			return diffReply(a.Elems[i], b.Elems[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	return path + ".length", fmt.Sprint(len(a.Elems)), fmt.Sprint(len(b.Elems))
+}
+
+// renderReply renders a reply compactly for the log
+func renderReply(r *protocol.Reply) string {
+	switch {
+	case r.Null:
+		return "(nil)"
+	case r.IsError():
+		return "(error) " + r.Str
+	case isAggregate(r):
+		elems := make([]string, len(r.Elems))
+		for i, e := range r.Elems {
+			elems[i] = renderReply(e)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	default:
+		return r.Str
+	}
+}
+
+// equalReplies compares replies by value, as only top-level replies keep
+// their raw bytes
+func equalReplies(a, b *protocol.Reply) bool {
+	if a.Type != b.Type || a.Null != b.Null || a.Str != b.Str || len(a.Elems) != len(b.Elems) {
+		return false
+	}
+	for i := range a.Elems {
+		if !equalReplies(a.Elems[i], b.Elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAggregate(r *protocol.Reply) bool {
+	return !r.Null && (r.Type == '*' || r.Type == '%' || r.Type == '~' || r.Type == '>')
+}
+
+// members groups the elements of an unordered reply into its members
+func members(r *protocol.Reply, group int) []string {
+	var list []string
+	for i := 0; i+group <= len(r.Elems); i += group {
+		parts := make([]string, group)
+		for j := range group {
+			parts[j] = renderReply(r.Elems[i+j])
+		}
+		list = append(list, strings.Join(parts, " => "))
+	}
+	return list
+}
+
+// diffMembers returns the members only the primary and only the shadow
+// have, counting duplicates
+func diffMembers(primary, shadow []string) (missing, extra []string) {
+	counts := make(map[string]int, len(primary))
+	for _, m := range primary {
+		counts[m]++
+	}
+	for _, m := range shadow {
+		if counts[m] > 0 {
+			counts[m]--
+		} else {
+			extra = append(extra, m)
+		}
+	}
+	for m, n := range counts {
+		for range n {
+			missing = append(missing, m)
+		}
+	}
+	slices.Sort(missing)
+	slices.Sort(extra)
+	return missing, extra
+}
+
+func truncateMembers(list []string) []string {
+	if len(list) <= maxDiffMembers {
+		return list
+	}
+	return append(list[:maxDiffMembers:maxDiffMembers], fmt.Sprintf("... %d more", len(list)-maxDiffMembers))
+}
+
+func truncateValue(v string) string {
+	if len(v) <= maxDiffValue {
+		return v
+	}
+	return v[:maxDiffValue] + "..."
+}
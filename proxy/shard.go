@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// ketamaPointsPerServer is the number of ring points an average weighted
+// backend receives, as in libketama and twemproxy
+const ketamaPointsPerServer = 160
+
+// shards routes keys across independent Redis servers, twemproxy style, so
+// the proxy can front a sharded deployment that is not a Redis Cluster
+type shards struct {
+	hash     string
+	backends []string
+	ring     []ketamaPoint
+	// routes are sorted longest prefix first
+	routes []config.PrefixRoute
+}
+
+type ketamaPoint struct {
+	hash uint32
+	node string
+}
+
+func newShards(cfg *config.Config) *shards {
+	if cfg.Sharding == nil {
+		return nil
+	}
+	s := &shards{hash: cfg.Sharding.Hash}
+	if s.hash == "" {
+		s.hash = "ketama"
+	}
+	for _, b := range cfg.Backends {
+		s.backends = append(s.backends, b.Addr)
+	}
+	if s.hash == "ketama" {
+		s.ring = ketamaRing(cfg.Backends)
+	}
+	s.routes = slices.Clone(cfg.Sharding.Routes)
+	sort.SliceStable(s.routes, func(i, j int) bool { return len(s.routes[i].Prefix) > len(s.routes[j].Prefix) })
+	return s
+}
+
+// ketamaRing places points for each backend on the ring in proportion to
+// its weight, four points per MD5 digest of "<addr>-<n>"
+func ketamaRing(backends []config.Backend) []ketamaPoint {
+	var total int
+	for _, b := range backends {
+		total += b.Weight
+	}
+
+	var ring []ketamaPoint
+	for _, b := range backends {
+		share := float64(b.Weight) / float64(total)
+		digests := int(share * ketamaPointsPerServer / 4 * float64(len(backends)))
+		for n := 0; n < digests; n++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", b.Addr, n)))
+			for i := 0; i < 4; i++ {
+				ring = append(ring, ketamaPoint{
+					hash: binary.LittleEndian.Uint32(digest[i*4:]),
+					node: b.Addr,
+				})
+			}
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// node returns the backend owning a key, and its hash slot under crc16.
+// Keys matching a prefix route go to the route's Redis.
+func (s *shards) node(key string) (slot int, node string) {
+	for _, route := range s.routes {
+		if strings.HasPrefix(key, route.Prefix) {
+			return -1, route.Addr
+		}
+	}
+	if s.hash == "crc16" {
+		slot = protocol.KeySlot(key)
+		return slot, s.backends[slot%len(s.backends)]
+	}
+
+	digest := md5.Sum([]byte(protocol.HashTag(key)))
+	hash := binary.LittleEndian.Uint32(digest[:4])
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= hash })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return -1, s.ring[i].node
+}
+
+// route returns the slot and backend for a command. Commands without keys
+// are sent to the first backend, and commands whose keys live on different
+// backends are rejected.
+func (s *shards) route(cmd *protocol.Command) (slot int, node string, reply []byte) {
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return -1, s.backends[0], nil
+	}
+	slot, node = s.node(keys[0])
+	for _, key := range keys[1:] {
+		if _, other := s.node(key); other != node {
+			return slot, "", []byte("-ERR Keys in request don't hash to the same shard\r\n")
+		}
+	}
+	return slot, node, nil
+}
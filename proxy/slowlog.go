@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// slowlog records the commands whose round trip to Redis took longer than
+// a threshold, keeping the most recent ones in a ring for the admin API
+type slowlog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []slowEntry
+	next    int
+	total   uint64
+}
+
+// slowEntry is a slow command as reported by the admin API
+type slowEntry struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Key        string    `json:"key,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+	ClientAddr string    `json:"client_addr"`
+	Identity   string    `json:"client_identity,omitempty"`
+	User       string    `json:"user,omitempty"`
+}
+
+func newSlowlog(cfg *config.SlowlogConfig) *slowlog {
+	if cfg == nil {
+		return nil
+	}
+	l := &slowlog{threshold: 100 * time.Millisecond}
+	if cfg.ThresholdMs > 0 {
+		l.threshold = time.Duration(cfg.ThresholdMs) * time.Millisecond
+	}
+	size := cfg.MaxEntries
+	if size == 0 {
+		size = 128
+	}
+	l.entries = make([]slowEntry, 0, size)
+	return l
+}
+
+// observe records a command if its round trip was slow. Blocking commands
+// are skipped since their time reflects waiting for data.
+func (l *slowlog) observe(s *session, req *request, elapsed time.Duration) {
+	if l == nil || elapsed < l.threshold {
+		return
+	}
+	if spec := protocol.LookupCommand(req.name); spec != nil && spec.Flags&protocol.FlagBlocking != 0 {
+		return
+	}
+
+	e := slowEntry{
+		Time:       req.sent,
+		Command:    req.cmd.Name,
+		DurationMs: float64(elapsed) / float64(time.Millisecond),
+		ClientAddr: s.client.RemoteAddr().String(),
+		Identity:   s.identity,
+		User:       req.user,
+	}
+	if keys := req.cmd.Keys(); len(keys) > 0 {
+		e.Key = keys[0]
+	}
+	s.logger.Warn("Slow command",
+		zap.String("command", e.Command),
+		zap.String("key", e.Key),
+		zap.Duration("duration", elapsed),
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total++
+	e.ID = l.total
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+	l.next = (l.next + 1) % cap(l.entries)
+}
+
+// recent returns the kept entries, newest first
+func (l *slowlog) recent() []slowEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]slowEntry, 0, len(l.entries))
+	for i := range len(l.entries) {
+		list = append(list, l.entries[(l.next-1-i+len(l.entries))%len(l.entries)])
+	}
+	return list
+}
+
+func (l *slowlog) handleList(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	total := l.total
+	l.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"threshold_ms": l.threshold.Milliseconds(),
+		"total":        total,
+		"entries":      l.recent(),
+	})
+}
+
+// handleReset empties the ring, as SLOWLOG RESET does in Redis
+func (l *slowlog) handleReset(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	l.entries = l.entries[:0]
+	l.next = 0
+	l.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
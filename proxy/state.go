@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// proxyState is persisted on shutdown and restored on start so that a
+// restart does not reset cumulative counters, nor empty the response
+// cache and hot-key sketches
+type proxyState struct {
+	SavedAt time.Time       `json:"saved_at"`
+	Stats   cumulativeStats `json:"stats"`
+	Cache   []cachedEntry   `json:"cache,omitempty"`
+	HotKeys *hotKeysState   `json:"hot_keys,omitempty"`
+}
+
+type cumulativeStats struct {
+	Hello2             uint64 `json:"hello2"`
+	Hello3             uint64 `json:"hello3"`
+	ProtocolRejected   uint64 `json:"protocol_rejected"`
+	ChecksumMismatches uint64 `json:"checksum_mismatches"`
+	// CanaryRuns and CanaryFailures are the totals of files saved before
+	// the canary ran against each upstream
+	CanaryRuns     uint64 `json:"canary_runs,omitempty"`
+	CanaryFailures uint64 `json:"canary_failures,omitempty"`
+	// Canary holds the totals of each upstream's canary
+	Canary map[string]canaryTotals `json:"canary,omitempty"`
+}
+
+type canaryTotals struct {
+	Runs     uint64 `json:"runs"`
+	Failures uint64 `json:"failures"`
+}
+
+// SaveState writes the proxy state to the configured state file. It is a
+// no-op when no state file is configured.
+func (p *Proxy) SaveState() error {
+	path := p.config.StateFile
+	if path == "" {
+		return nil
+	}
+
+	state := proxyState{
+		SavedAt: time.Now(),
+		Stats: cumulativeStats{
+			Hello2:             p.protoStats.hello2.Load(),
+			Hello3:             p.protoStats.hello3.Load(),
+			ProtocolRejected:   p.protoStats.rejected.Load(),
+			ChecksumMismatches: p.checksumMismatches.Load(),
+		},
+	}
+	if p.canary != nil {
+		state.Stats.Canary = make(map[string]canaryTotals, len(p.canary.targets))
+		for _, t := range p.canary.targets {
+			state.Stats.Canary[t.upstream] = canaryTotals{Runs: t.runs.Load(), Failures: t.failures.Load()}
+		}
+	}
+	if p.cache != nil {
+		state.Cache = p.cache.save()
+	}
+	if p.hotKeys != nil {
+		state.HotKeys = p.hotKeys.save()
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// restoreState loads the state saved by a previous run. A missing or
+// unreadable state file only means starting from scratch.
+func (p *Proxy) restoreState() {
+	path := p.config.StateFile
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state proxyState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		p.logger.Warn("Failed to restore proxy state", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	p.protoStats.hello2.Add(state.Stats.Hello2)
+	p.protoStats.hello3.Add(state.Stats.Hello3)
+	p.protoStats.rejected.Add(state.Stats.ProtocolRejected)
+	p.checksumMismatches.Add(state.Stats.ChecksumMismatches)
+	if p.canary != nil {
+		for upstream, totals := range state.Stats.Canary {
+			if t := p.canary.target(upstream); t != nil {
+				t.runs.Add(totals.Runs)
+				t.failures.Add(totals.Failures)
+			}
+		}
+		if len(p.canary.targets) == 1 {
+			p.canary.targets[0].runs.Add(state.Stats.CanaryRuns)
+			p.canary.targets[0].failures.Add(state.Stats.CanaryFailures)
+		}
+	}
+	fields := []zap.Field{zap.String("path", path), zap.Time("saved_at", state.SavedAt)}
+	if p.cache != nil {
+		fields = append(fields, zap.Int("cache_entries", p.cache.restore(state.Cache)))
+	}
+	// Sketches saved with other dimensions are discarded
+	if p.hotKeys != nil && state.HotKeys != nil {
+		fields = append(fields, zap.Bool("hot_keys", p.hotKeys.restore(state.HotKeys, state.SavedAt)))
+	}
+
+	p.logger.Info("Restored proxy state", fields...)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// streamHandler pushes command events as JSON text messages over a
+// WebSocket, limited to the commands in the command query parameter and
+// the keys matching the key parameter's patterns, each repeatable or
+// comma-separated
+func (p *Proxy) streamHandler() http.Handler {
+	return websocket.Server{
+		// The admin token authorizes streams, but as a page on another site
+		// could open one with a token the browser holds, its origin is
+		// checked too
+		Handshake: func(_ *websocket.Config, r *http.Request) error { return p.checkOrigin(r) },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			r := ws.Request()
+			query := r.URL.Query()
+			commands, keys := splitParams(query["command"]), splitParams(query["key"])
+			sub := p.events.subscribe(newEventFilter(commands, keys), 0)
+			defer p.events.unsubscribe(sub)
+
+			logger := p.logger.With(zap.String("subscriber_addr", r.RemoteAddr))
+			logger.Info("Event stream subscribed",
+				zap.Strings("commands", commands),
+				zap.Strings("key_patterns", keys),
+			)
+			defer func() {
+				logger.Info("Event stream closed", zap.Uint64("dropped", sub.dropped.Load()))
+			}()
+
+			// Messages from the client are ignored, but reading them is how
+			// a close is noticed
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, ws)
+				close(closed)
+			}()
+			for {
+				select {
+				case <-closed:
+					return
+				case <-r.Context().Done():
+					return
+				case ev := <-sub.events:
+					if err := websocket.JSON.Send(ws, ev); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+}
+
+// checkOrigin allows WebSocket requests from pages of the admin API's own
+// origin or of admin.allowed_origins. Clients other than browsers send no
+// Origin and are allowed.
+func (p *Proxy) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(u.Host, r.Host) || slices.Contains(p.config.Admin.AllowedOrigins, origin) {
+		return nil
+	}
+	p.logger.Warn("Event stream refused for origin", zap.String("origin", origin), zap.String("subscriber_addr", r.RemoteAddr))
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+// splitParams splits repeated, comma-separated query parameter values
+func splitParams(values []string) []string {
+	var params []string
+	for _, v := range values {
+		for _, param := range strings.Split(v, ",") {
+			if param = strings.TrimSpace(param); param != "" {
+				params = append(params, param)
+			}
+		}
+	}
+	return params
+}
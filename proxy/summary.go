@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// summary logs aggregate statistics of the traffic every interval: the
+// commands received by name, and the error replies, latency quantiles and
+// reply bytes of those forwarded to Redis. It can stand in for the log
+// line of each command on high-throughput deployments.
+type summary struct {
+	logger   *zap.Logger
+	interval time.Duration
+	suppress bool
+
+	mu      sync.Mutex
+	started time.Time
+	current *summaryWindow
+}
+
+// summaryWindow is the traffic of an interval
+type summaryWindow struct {
+	commands map[string]*commandSummary
+	latency  histogram
+	count    uint64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+type commandSummary struct {
+	count   uint64
+	errors  uint64
+	latency *histogram
+}
+
+func newSummary(logger *zap.Logger, cfg *config.SummaryConfig) *summary {
+	if cfg == nil {
+		return nil
+	}
+	s := &summary{
+		logger:   logger.With(zap.String("component", "summary")),
+		interval: time.Duration(cfg.Interval) * time.Second,
+		suppress: cfg.SuppressCommands,
+		started:  time.Now(),
+		current:  newSummaryWindow(),
+	}
+	if s.interval == 0 {
+		s.interval = time.Minute
+	}
+	return s
+}
+
+func newSummaryWindow() *summaryWindow {
+	return &summaryWindow{commands: make(map[string]*commandSummary)}
+}
+
+// suppresses reports whether a command is left out of the log in favour
+// of the summaries
+func (s *summary) suppresses(req *request) bool {
+	return s != nil && s.suppress && !req.held
+}
+
+// OnEvent counts commands as they are received and their replies as they
+// arrive
+func (s *summary) OnEvent(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.current
+	switch e := e.(type) {
+	case *CommandEvent:
+		w.count++
+		w.bytesIn += uint64(len(e.Command.Message))
+		w.command(e.req.name).count++
+	case *ResponseEvent:
+		c := w.command(e.req.name)
+		if e.Error != "" {
+			w.errors++
+			c.errors++
+		}
+		w.bytesOut += uint64(len(e.Reply))
+		w.latency.record(e.Latency)
+		if c.latency == nil {
+			c.latency = &histogram{}
+		}
+		c.latency.record(e.Latency)
+	}
+}
+
+// command returns a command's share of the window. Past
+// maxLatencyCommands names, as clients may send any, commands are counted
+// as OTHER.
+func (w *summaryWindow) command(name string) *commandSummary {
+	c := w.commands[name]
+	if c == nil {
+		if len(w.commands) >= maxLatencyCommands {
+			name = "OTHER"
+		}
+		if c = w.commands[name]; c == nil {
+			c = &commandSummary{}
+			w.commands[name] = c
+		}
+	}
+	return c
+}
+
+// run logs a summary every interval until the context is cancelled, then
+// one for the interval cut short
+func (s *summary) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.report()
+			return
+		case <-ticker.C:
+			s.report()
+		}
+	}
+}
+
+func (s *summary) report() {
+	s.mu.Lock()
+	w, started := s.current, s.started
+	s.current, s.started = newSummaryWindow(), time.Now()
+	s.mu.Unlock()
+
+	s.logger.Info("Traffic summary",
+		zap.Duration("interval", time.Since(started).Round(time.Millisecond)),
+		zap.Uint64("commands", w.count),
+		zap.Uint64("errors", w.errors),
+		zap.Uint64("bytes_in", w.bytesIn),
+		zap.Uint64("bytes_out", w.bytesOut),
+		zap.Duration("p50", w.latency.quantile(0.50)),
+		zap.Duration("p95", w.latency.quantile(0.95)),
+		zap.Duration("p99", w.latency.quantile(0.99)),
+		zap.Object("by_command", commandSummaries(w.commands)),
+	)
+}
+
+// commandSummaries logs each command's share of a summary
+type commandSummaries map[string]*commandSummary
+
+func (m commandSummaries) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		enc.AddObject(name, m[name])
+	}
+	return nil
+}
+
+func (c *commandSummary) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddUint64("count", c.count)
+	enc.AddUint64("errors", c.errors)
+	// Commands the proxy answered itself have no latency
+	if c.latency != nil {
+		enc.AddDuration("p50", c.latency.quantile(0.50))
+		enc.AddDuration("p95", c.latency.quantile(0.95))
+		enc.AddDuration("p99", c.latency.quantile(0.99))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// throttle limits the byte rate of every client connection, so that one
+// bulk-loading client cannot saturate the link to Redis
+type throttle struct {
+	ingress int64
+	egress  int64
+	burst   int64
+}
+
+func newThrottle(cfg *config.ThrottleConfig) *throttle {
+	if cfg == nil {
+		return nil
+	}
+	return &throttle{ingress: cfg.IngressBytesPerSec, egress: cfg.EgressBytesPerSec, burst: cfg.BurstBytes}
+}
+
+// wrap returns the connection with its own rate limits, or nil when
+// throttling is disabled
+func (t *throttle) wrap(conn net.Conn) *throttledConn {
+	if t == nil {
+		return nil
+	}
+	return &throttledConn{
+		Conn: conn,
+		in:   newTokenBucket(t.ingress, t.burst),
+		out:  newTokenBucket(t.egress, t.burst),
+	}
+}
+
+// throttledConn is a client connection whose reads and writes are limited
+// by token buckets
+type throttledConn struct {
+	net.Conn
+	in  *tokenBucket
+	out *tokenBucket
+}
+
+// Read consumes tokens for the bytes read after the fact, so that a slow
+// client is never made to wait for bytes it has yet to send
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if c.in != nil && int64(len(b)) > c.in.burst {
+		b = b[:c.in.burst]
+	}
+	n, err := c.Conn.Read(b)
+	if c.in != nil && n > 0 {
+		c.in.wait(n)
+	}
+	return n, err
+}
+
+// Write sends at most a burst at a time, waiting for the tokens first
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.out == nil {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if int64(len(chunk)) > c.out.burst {
+			chunk = chunk[:c.out.burst]
+		}
+		c.out.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// report logs how long the connection was held back, if at all
+func (c *throttledConn) report(logger *zap.Logger) {
+	ingress, egress := c.in.waited(), c.out.waited()
+	if ingress == 0 && egress == 0 {
+		return
+	}
+	logger.Info("Connection was throttled",
+		zap.Duration("ingress_wait", ingress),
+		zap.Duration("egress_wait", egress),
+	)
+}
+
+// tokenBucket allows rate bytes per second with bursts of up to burst bytes
+type tokenBucket struct {
+	rate  float64
+	burst int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	total  time.Duration
+}
+
+// newTokenBucket returns nil for an unlimited rate
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes n tokens, sleeping until the bucket has refilled enough to
+// cover them
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.total += delay
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (b *tokenBucket) waited() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// timeoutReply answers a command Redis did not reply to in time
+var timeoutReply = []byte("-ERR proxy timeout\r\n")
+
+// commandTimeouts bound how long Redis may take to answer each command
+type commandTimeouts struct {
+	fallback time.Duration
+	commands map[string]time.Duration
+}
+
+func newCommandTimeouts(cfg *config.Config) *commandTimeouts {
+	if cfg.CommandTimeoutMs == 0 && len(cfg.CommandTimeouts) == 0 {
+		return nil
+	}
+	t := &commandTimeouts{
+		fallback: time.Duration(cfg.CommandTimeoutMs) * time.Millisecond,
+		commands: make(map[string]time.Duration, len(cfg.CommandTimeouts)),
+	}
+	for name, ms := range cfg.CommandTimeouts {
+		t.commands[strings.ToUpper(name)] = time.Duration(ms) * time.Millisecond
+	}
+	return t
+}
+
+// of returns the timeout of a forwarded command, or 0 when Redis may take
+// as long as it needs
+func (t *commandTimeouts) of(req *request) time.Duration {
+	if t == nil || req.internal {
+		return 0
+	}
+	if timeout, ok := t.commands[req.name]; ok {
+		return timeout
+	}
+	// Blocking commands carry timeouts of their own
+	if blocks(req) {
+		return 0
+	}
+	return t.fallback
+}
+
+// logTimeout reports a command Redis did not answer in time
+func (s *session) logTimeout(req *request, timeout time.Duration, fields ...zap.Field) {
+	fields = append(fields, zap.String("command", req.cmd.Name), zap.Duration("timeout", timeout))
+	if keys := req.cmd.Keys(); len(keys) > 0 {
+		fields = append(fields, zap.String("key", keys[0]))
+	}
+	s.logger.Warn("Command timed out", fields...)
+}
+
+// timeOut answers the command Redis did not reply to in time, and every
+// command pipelined after it, with an error. The connection to Redis is
+// closed, since a late reply would otherwise be taken for the answer to
+// the next command, which ends the session.
+func (s *session) timeOut(queue []*request, timeout time.Duration) {
+	var fields []zap.Field
+	if len(queue) > 1 {
+		fields = append(fields, zap.Int("pipelined", len(queue)-1))
+	}
+	s.logTimeout(queue[0], timeout, fields...)
+	s.upstream.Close()
+
+	for _, req := range queue {
+		reply := req.reply
+		if reply == nil {
+			if req.internal {
+				continue
+			}
+			reply = timeoutReply
+			s.logAnswer(req, reply)
+		}
+		s.stats.countReply(reply)
+		if _, err := s.client.Write(reply); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig builds the TLS configuration for the client listener,
+// taking the certificate from the ACME manager when one is configured
+func serverTLSConfig(cfg *config.TLSListenConfig, acme *acmeManager) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if acme != nil {
+		tlsConfig.GetCertificate = acme.getCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load listener certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %q", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(cfg.CipherSuites) > 0 {
+		suites, err := cipherSuites(cfg.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.ClientAuth == "optional" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientIdentity extracts the identity of a verified client certificate,
+// returning an empty string when the client presented none
+func clientIdentity(state tls.ConnectionState, source string) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+
+	if source == "san" {
+		switch {
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		case len(cert.IPAddresses) > 0:
+			return cert.IPAddresses[0].String()
+		}
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// cipherSuites resolves cipher suite names such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" to their IDs
+func cipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// defaultDialTimeout bounds connecting to Redis, including the TLS
+// handshake, unless dial_timeout_ms is set
+const defaultDialTimeout = 5 * time.Second
+
+// dialStagger delays each parallel dial attempt after the first, so the
+// resolver's preferred address usually wins without waiting on the others
+const dialStagger = 250 * time.Millisecond
+
+// dialUpstream opens a connection to the Redis server
+func (p *Proxy) dialUpstream() (net.Conn, error) {
+	return p.dial(context.Background(), nil)
+}
+
+// redisAddr returns the address of the Redis server, as discovered through
+// Sentinel when configured
+func (p *Proxy) redisAddr() string {
+	if p.sentinel != nil {
+		return p.sentinel.addr()
+	}
+	return p.config.RedisAddr
+}
+
+// dial opens a connection to the Redis server, or to a backend of the pool,
+// writing header ahead of any TLS handshake
+func (p *Proxy) dial(ctx context.Context, header []byte) (net.Conn, error) {
+	if p.pool != nil {
+		return p.pool.dial(ctx, header)
+	}
+	return p.dialAddr(ctx, p.redisAddr(), header)
+}
+
+// dialAddr opens a connection to the Redis server at addr, writing header
+// ahead of any TLS handshake. The whole sequence is bounded by the dial
+// timeout and abandoned when ctx is cancelled.
+func (p *Proxy) dialAddr(ctx context.Context, addr string, header []byte) (net.Conn, error) {
+	timeout := defaultDialTimeout
+	if p.config.DialTimeoutMs > 0 {
+		timeout = time.Duration(p.config.DialTimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network, address := upstreamAddr(addr)
+	var conn net.Conn
+	var err error
+	if network == "tcp" {
+		conn, err = dialParallel(ctx, address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		deadline, _ := ctx.Deadline()
+		conn.SetWriteDeadline(deadline)
+		_, err := conn.Write(header)
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if p.upstreamTLS != nil {
+		tlsConfig := p.upstreamTLS
+		if tlsConfig.ServerName == "" && network == "tcp" {
+			// Masters discovered through Sentinel and cluster nodes are only
+			// known at dial time
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if p.config.RedisPassword != "" {
+		if err := p.authenticate(ctx, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authCommand is the AUTH command carrying the configured Redis credentials
+func (p *Proxy) authCommand() []byte {
+	if p.config.RedisUsername != "" {
+		return encodeCommand("AUTH", p.config.RedisUsername, p.config.RedisPassword)
+	}
+	return encodeCommand("AUTH", p.config.RedisPassword)
+}
+
+// authenticate sends the configured credentials on a new connection before
+// it carries any client command
+func (p *Proxy) authenticate(ctx context.Context, conn net.Conn) error {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(p.authCommand()); err != nil {
+		return err
+	}
+	// Nothing else is sent before the reply, so the reader cannot buffer
+	// past it
+	reply, err := protocol.NewReplyReader(conn).ReadReply()
+	if err != nil {
+		return err
+	}
+	if reply.IsError() {
+		return fmt.Errorf("Redis AUTH failed: %s", reply.Str)
+	}
+	return nil
+}
+
+// dialParallel resolves a host and races connections to its addresses, so
+// that a single black-holed address cannot stall the dial until it times
+// out. The first connection established wins and the others are closed.
+func dialParallel(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ips[0].String(), port))
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan result, len(ips))
+	for i, ip := range ips {
+		go func() {
+			select {
+			case <-time.After(time.Duration(i) * dialStagger):
+			case <-ctx.Done():
+				results <- result{err: ctx.Err()}
+				return
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	for remaining := len(ips); remaining > 0; remaining-- {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		cancel()
+		go func() {
+			for ; remaining > 1; remaining-- {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}()
+		return r.conn, nil
+	}
+	cancel()
+	return nil, firstErr
+}
+
+// upstreamClosed reacts to Redis closing a connection, which may mean the
+// server is going away: a pool backend is probed so new connections skip
+// it if it is down, and Sentinel is asked whether the master has moved
+func (p *Proxy) upstreamClosed(conn net.Conn) {
+	if bc, ok := conn.(*backendConn); ok {
+		p.pool.probe(bc.backend)
+	}
+	if p.sentinel != nil {
+		p.sentinel.discoverAsync()
+	}
+}
+
+// isConnClosed reports read errors caused by the peer closing the
+// connection
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// upstreamAddr splits a Redis address into the network and address to dial;
+// "unix:///var/run/redis.sock" selects a Unix domain socket
+func upstreamAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "unix", path
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// clientTLSConfig builds the TLS configuration used to connect to Redis
+func clientTLSConfig(cfg *config.RedisTLSConfig, addr string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if network, _ := upstreamAddr(addr); tlsConfig.ServerName == "" && network == "tcp" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/glob"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// categoryFlags map ACL categories to the command flags they select
+var categoryFlags = map[string]int{
+	"read":     protocol.FlagReadOnly,
+	"write":    protocol.FlagWrite,
+	"admin":    protocol.FlagAdmin,
+	"pubsub":   protocol.FlagPubSub,
+	"blocking": protocol.FlagBlocking,
+}
+
+// userACL is a user's compiled Redis ACL rules. As in Redis, a user starts
+// with no commands and no keys, and rules apply in order so that a later
+// rule overrides an earlier one.
+type userACL struct {
+	commands []commandRule
+	keys     []keyPattern
+}
+
+// commandRule allows or denies every command, a category, a command or a
+// command|subcommand
+type commandRule struct {
+	allow bool
+	all   bool
+	flag  int
+	name  string
+}
+
+// keyPattern grants read and/or write access to matching keys
+type keyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+func newUserACLs(cfg *config.AuthConfig) map[string]*userACL {
+	if cfg == nil {
+		return nil
+	}
+	acls := make(map[string]*userACL, len(cfg.ACL))
+	for user, rules := range cfg.ACL {
+		acls[user] = parseUserACL(rules)
+	}
+	return acls
+}
+
+// parseUserACL compiles rules that config validation has already checked
+func parseUserACL(rules string) *userACL {
+	acl := &userACL{}
+	for _, rule := range strings.Fields(rules) {
+		switch lower := strings.ToLower(rule); {
+		case lower == "allcommands":
+			acl.commands = append(acl.commands, commandRule{allow: true, all: true})
+		case lower == "nocommands":
+			acl.commands = append(acl.commands, commandRule{all: true})
+		case lower == "allkeys":
+			acl.keys = append(acl.keys, keyPattern{pattern: "*", read: true, write: true})
+		case lower == "resetkeys":
+			acl.keys = nil
+		case strings.HasPrefix(rule, "%RW~"):
+			acl.keys = append(acl.keys, keyPattern{pattern: rule[4:], read: true, write: true})
+		case strings.HasPrefix(rule, "%R~"):
+			acl.keys = append(acl.keys, keyPattern{pattern: rule[3:], read: true})
+		case strings.HasPrefix(rule, "%W~"):
+			acl.keys = append(acl.keys, keyPattern{pattern: rule[3:], write: true})
+		case strings.HasPrefix(rule, "~"):
+			acl.keys = append(acl.keys, keyPattern{pattern: rule[1:], read: true, write: true})
+		default:
+			r := commandRule{allow: rule[0] == '+'}
+			if category, ok := strings.CutPrefix(lower[1:], "@"); ok {
+				r.all = category == "all"
+				r.flag = categoryFlags[category]
+			} else {
+				r.name = strings.ToUpper(rule[1:])
+			}
+			acl.commands = append(acl.commands, r)
+		}
+	}
+	return acl
+}
+
+func (r commandRule) matches(cmd *protocol.Command, name string) bool {
+	switch {
+	case r.all:
+		return true
+	case r.flag != 0:
+		spec := protocol.LookupCommand(name)
+		return spec != nil && spec.Flags&r.flag != 0
+	case strings.Contains(r.name, "|"):
+		return len(cmd.Args) > 0 && r.name == name+"|"+strings.ToUpper(cmd.Args[0])
+	default:
+		return r.name == name
+	}
+}
+
+// permitsCommand applies the last command rule matching the command
+func (a *userACL) permitsCommand(cmd *protocol.Command, name string) bool {
+	for i := len(a.commands) - 1; i >= 0; i-- {
+		if a.commands[i].matches(cmd, name) {
+			return a.commands[i].allow
+		}
+	}
+	return false
+}
+
+// deniedKey returns the first key of the command the user may not access.
+// Write commands need write access and every other command read access.
+// Commands whose keys are not known are denied, with no key, unless the
+// user may read and write every key.
+func (a *userACL) deniedKey(cmd *protocol.Command) (string, bool) {
+	if protocol.LookupCommand(cmd.Name) == nil {
+		return "", !a.allKeys()
+	}
+	write := cmd.IsWrite()
+	for _, key := range cmd.Keys() {
+		permitted := false
+		for _, p := range a.keys {
+			if (write && p.write || !write && p.read) && glob.Match(p.pattern, key) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// allKeys reports whether the user may read and write every key
+func (a *userACL) allKeys() bool {
+	var read, write bool
+	for _, p := range a.keys {
+		if p.pattern == "*" {
+			read, write = read || p.read, write || p.write
+		}
+	}
+	return read && write
+}
+
+// checkUserACL applies the ACL rules of the user the client authenticated
+// as with the proxy, auditing every denial
+func (p *Proxy) checkUserACL(s *session, req *request) []byte {
+	acl := p.userACLs[s.user]
+	if acl == nil {
+		return nil
+	}
+	switch req.name {
+	case "AUTH", "HELLO", "QUIT", "RESET":
+		return nil
+	}
+
+	if !acl.permitsCommand(req.cmd, req.name) {
+		s.logger.Warn("Command denied by user ACL",
+			zap.String("user", s.user),
+			zap.String("command", req.cmd.Name),
+		)
+		return noPermission(s.user, req.cmd.Name)
+	}
+	if key, denied := acl.deniedKey(req.cmd); denied {
+		s.logger.Warn("Key access denied by user ACL",
+			zap.String("user", s.user),
+			zap.String("command", req.cmd.Name),
+			zap.String("key", key),
+		)
+		return []byte("-NOPERM No permissions to access a key\r\n")
+	}
+	return nil
+}
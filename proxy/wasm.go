@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/protocol"
+)
+
+// Defaults for the limits of a WebAssembly plugin
+const (
+	defaultWASMMemoryLimitMB = 16
+	defaultWASMTimeout       = 10 * time.Millisecond
+	defaultWASMInstances     = 4
+)
+
+// wasmPlugin is an interceptor compiled to WebAssembly. The module exports
+// alloc(size) returning a pointer to size bytes it owns, and
+// on_command(ptr, len) taking a JSON call and returning the pointer and
+// length of a JSON verdict packed as ptr<<32|len, or 0 to let the command
+// through unchanged. It may also export on_response(ptr, len), which
+// receives each reply from Redis as JSON, and import log(ptr, len) from
+// the "redislogger" module to log a message.
+type wasmPlugin struct {
+	NopInterceptor
+	name       string
+	logger     *zap.Logger
+	runtime    wazero.Runtime
+	compiled   wazero.CompiledModule
+	timeout    time.Duration
+	failClosed bool
+	// onResponse is whether the module exports on_response
+	onResponse bool
+
+	// idle holds instances free to take a call, and slots a token per
+	// instance that may be created
+	idle  chan *wasmInstance
+	slots chan struct{}
+}
+
+type wasmInstance struct {
+	mod        api.Module
+	alloc      api.Function
+	onCommand  api.Function
+	onResponse api.Function
+}
+
+// wasmCall is the JSON a plugin's on_command receives
+type wasmCall struct {
+	Connection *ConnInfo `json:"connection"`
+	Command    []string  `json:"command"`
+}
+
+// wasmResponse is the JSON a plugin's on_response receives
+type wasmResponse struct {
+	Connection *ConnInfo `json:"connection"`
+	Command    []string  `json:"command"`
+	Reply      wasmReply `json:"reply"`
+	LatencyMs  float64   `json:"latency_ms"`
+}
+
+// wasmReply describes a reply by its RESP type, size and error, if any,
+// rather than its value
+type wasmReply struct {
+	Type  string `json:"type"`
+	Bytes int    `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// wasmVerdict is the JSON on_command returns. Deny rejects the command
+// with its message, Command replaces the command forwarded and Fields are
+// logged with it.
+type wasmVerdict struct {
+	Deny    string         `json:"deny"`
+	Command []string       `json:"command"`
+	Fields  map[string]any `json:"fields"`
+}
+
+// wasmConnKey carries the connection a call is made for to the log host
+// function
+type wasmConnKey struct{}
+
+// loadWASMPlugins adds the interceptors of wasm_plugins, after the Go
+// plugins
+func (p *Proxy) loadWASMPlugins() error {
+	for _, cfg := range p.config.WASMPlugins {
+		plugin, err := newWASMPlugin(p.logger, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to load WebAssembly plugin %s: %w", cfg.Path, err)
+		}
+		p.interceptors = append(p.interceptors, plugin)
+		p.logger.Info("Loaded WebAssembly plugin", zap.String("path", cfg.Path))
+	}
+	return nil
+}
+
+func newWASMPlugin(logger *zap.Logger, cfg config.WASMPluginConfig) (*wasmPlugin, error) {
+	code, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	memoryMB := cfg.MemoryLimitMB
+	if memoryMB == 0 {
+		memoryMB = defaultWASMMemoryLimitMB
+	}
+	timeout := defaultWASMTimeout
+	if cfg.TimeoutMs > 0 {
+		timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	instances := cfg.Instances
+	if instances == 0 {
+		instances = defaultWASMInstances
+	}
+
+	w := &wasmPlugin{
+		name:       filepath.Base(cfg.Path),
+		timeout:    timeout,
+		failClosed: cfg.FailClosed,
+		idle:       make(chan *wasmInstance, instances),
+		slots:      make(chan struct{}, instances),
+	}
+	w.logger = logger.With(zap.String("plugin", w.name))
+
+	ctx := context.Background()
+	// Memory is counted in 64KiB pages. Calls are interrupted when their
+	// context is done, which bounds their run time.
+	w.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(memoryMB)*16).
+		WithCloseOnContextDone(true))
+	// WASI without any mounts or environment, for toolchains that need it
+	wasi_snapshot_preview1.MustInstantiate(ctx, w.runtime)
+	_, err = w.runtime.NewHostModuleBuilder("redislogger").
+		NewFunctionBuilder().WithFunc(w.log).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+
+	if w.compiled, err = w.runtime.CompileModule(ctx, code); err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+	exports := w.compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "on_command"} {
+		if _, ok := exports[name]; !ok {
+			w.runtime.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+	_, w.onResponse = exports["on_response"]
+	// Calls are passed through the module's memory, which it must export
+	if len(w.compiled.ExportedMemories()) == 0 {
+		w.runtime.Close(ctx)
+		return nil, errors.New("module does not export its memory")
+	}
+
+	// Instantiated once up front, so that a module failing to start stops
+	// the proxy rather than every command
+	w.slots <- struct{}{}
+	inst, err := w.instantiate()
+	if err != nil {
+		w.runtime.Close(ctx)
+		return nil, err
+	}
+	w.idle <- inst
+	return w, nil
+}
+
+func (w *wasmPlugin) instantiate() (*wasmInstance, error) {
+	// Unnamed, so that the module can be instantiated more than once
+	mod, err := w.runtime.InstantiateModule(context.Background(), w.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	return &wasmInstance{
+		mod:        mod,
+		alloc:      mod.ExportedFunction("alloc"),
+		onCommand:  mod.ExportedFunction("on_command"),
+		onResponse: mod.ExportedFunction("on_response"),
+	}, nil
+}
+
+// acquire takes an idle instance, creating one while under the limit and
+// otherwise waiting for one to be released
+func (w *wasmPlugin) acquire() (*wasmInstance, error) {
+	select {
+	case inst := <-w.idle:
+		return inst, nil
+	default:
+	}
+	select {
+	case inst := <-w.idle:
+		return inst, nil
+	case w.slots <- struct{}{}:
+		inst, err := w.instantiate()
+		if err != nil {
+			<-w.slots
+		}
+		return inst, err
+	}
+}
+
+// release returns an instance after a call, discarding one the call
+// failed in, as its state can no longer be trusted
+func (w *wasmPlugin) release(inst *wasmInstance, failed bool) {
+	if failed {
+		inst.mod.Close(context.Background())
+		<-w.slots
+		return
+	}
+	w.idle <- inst
+}
+
+func (w *wasmPlugin) OnCommand(conn *ConnInfo, call *Call) error {
+	verdict, err := w.call(conn, call)
+	if err != nil {
+		w.logger.Error("WebAssembly plugin failed",
+			zap.Uint64("connection_id", conn.ID),
+			zap.String("command", call.Command.Name),
+			zap.Error(err),
+		)
+		if w.failClosed {
+			return fmt.Errorf("plugin %s failed", w.name)
+		}
+		return nil
+	}
+	if verdict == nil {
+		return nil
+	}
+
+	for key, value := range verdict.Fields {
+		call.Annotate(zap.Any(key, value))
+	}
+	if len(verdict.Command) > 0 {
+		call.Command.Name, call.Command.Args = verdict.Command[0], verdict.Command[1:]
+	}
+	if verdict.Deny != "" {
+		return errors.New(verdict.Deny)
+	}
+	return nil
+}
+
+// OnResponse passes Redis's reply to on_response, for modules exporting
+// it. The reply has been sent by then, so failures are only logged.
+func (w *wasmPlugin) OnResponse(conn *ConnInfo, call *Call, reply *protocol.Reply) {
+	if !w.onResponse {
+		return
+	}
+	response := wasmResponse{
+		Connection: conn,
+		Command:    append([]string{call.Command.Name}, call.Command.Args...),
+		Reply:      wasmReply{Type: string(reply.Type), Bytes: len(reply.Message)},
+	}
+	if reply.IsError() {
+		response.Reply.Error = reply.Str
+	}
+	if !call.Sent.IsZero() {
+		response.LatencyMs = ms(time.Since(call.Sent))
+	}
+	input, err := json.Marshal(response)
+	if err == nil {
+		_, err = w.invoke(conn, func(inst *wasmInstance) api.Function { return inst.onResponse }, input)
+	}
+	if err != nil {
+		w.logger.Error("WebAssembly plugin failed",
+			zap.Uint64("connection_id", conn.ID),
+			zap.String("command", call.Command.Name),
+			zap.Error(err),
+		)
+	}
+}
+
+// call passes a command to on_command and decodes the verdict
+func (w *wasmPlugin) call(conn *ConnInfo, call *Call) (*wasmVerdict, error) {
+	input, err := json.Marshal(wasmCall{
+		Connection: conn,
+		Command:    append([]string{call.Command.Name}, call.Command.Args...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	output, err := w.invoke(conn, func(inst *wasmInstance) api.Function { return inst.onCommand }, input)
+	if err != nil || output == nil {
+		return nil, err
+	}
+	var verdict wasmVerdict
+	if err := json.Unmarshal(output, &verdict); err != nil {
+		return nil, fmt.Errorf("invalid verdict: %w", err)
+	}
+	return &verdict, nil
+}
+
+// invoke calls an export of an instance with input, within the timeout
+func (w *wasmPlugin) invoke(conn *ConnInfo, export func(*wasmInstance) api.Function, input []byte) ([]byte, error) {
+	inst, err := w.acquire()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmConnKey{}, conn), w.timeout)
+	defer cancel()
+
+	output, err := inst.invoke(ctx, export(inst), input)
+	w.release(inst, err != nil)
+	return output, err
+}
+
+// invoke copies input into the instance's memory, calls fn and copies out
+// its output, if it returns any
+func (inst *wasmInstance) invoke(ctx context.Context, fn api.Function, input []byte) ([]byte, error) {
+	results, err := inst.alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if !inst.mod.Memory().Write(ptr, input) {
+		return nil, fmt.Errorf("alloc returned %d bytes out of range", len(input))
+	}
+
+	results, err = fn.Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || results[0] == 0 {
+		return nil, nil
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := inst.mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("%s returned %d bytes out of range", fn.Definition().Name(), outLen)
+	}
+	// Read returns a view of memory the next call may overwrite
+	return append([]byte(nil), output...), nil
+}
+
+// log is the host function plugins log messages through
+func (w *wasmPlugin) log(ctx context.Context, mod api.Module, ptr, size uint32) {
+	message, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return
+	}
+	fields := []zap.Field{zap.String("message", string(message))}
+	if conn, ok := ctx.Value(wasmConnKey{}).(*ConnInfo); ok {
+		fields = append(fields, zap.Uint64("connection_id", conn.ID), zap.String("client_addr", conn.ClientAddr))
+	}
+	w.logger.Info("WebAssembly plugin log", fields...)
+}
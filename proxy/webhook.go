@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/glob"
+)
+
+// webhooks notify HTTP endpoints of the commands matching their rules.
+// Each has its own queue and sender, so that a slow endpoint delays only
+// its own notifications.
+type webhooks []*webhook
+
+type webhook struct {
+	name     string
+	url      string
+	format   string
+	commands [][]string
+	keys     []string
+	attempts int
+	logger   *zap.Logger
+	client   *http.Client
+	queue    chan *webhookEvent
+}
+
+// webhookEvent is the JSON posted for a matched command
+type webhookEvent struct {
+	Webhook      string    `json:"webhook"`
+	Time         time.Time `json:"time"`
+	ConnectionID uint64    `json:"connection_id"`
+	ClientAddr   string    `json:"client_addr"`
+	Identity     string    `json:"client_identity,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Command      string    `json:"command"`
+	Args         []string  `json:"args"`
+	// Keys are the command's keys matching the webhook's patterns
+	Keys []string `json:"keys,omitempty"`
+}
+
+func newWebhooks(logger *zap.Logger, cfgs []config.WebhookConfig) webhooks {
+	var hooks webhooks
+	for _, cfg := range cfgs {
+		w := &webhook{
+			name:     cfg.Name,
+			url:      cfg.URL,
+			format:   cfg.Format,
+			keys:     cfg.Keys,
+			attempts: cfg.MaxAttempts,
+			logger:   logger.With(zap.String("webhook", cfg.Name)),
+			client:   &http.Client{Timeout: 5 * time.Second},
+		}
+		queueSize := cfg.QueueSize
+		if queueSize == 0 {
+			queueSize = 100
+		}
+		w.queue = make(chan *webhookEvent, queueSize)
+		if w.attempts == 0 {
+			w.attempts = 4
+		}
+		for _, rule := range cfg.Commands {
+			w.commands = append(w.commands, strings.Fields(strings.ToUpper(rule)))
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks
+}
+
+// run delivers each webhook's notifications until the context is cancelled
+func (hooks webhooks) run(ctx context.Context) {
+	for _, w := range hooks {
+		go w.run(ctx)
+	}
+}
+
+// OnEvent queues a notification to every webhook a command matches,
+// dropping it when a webhook's queue is full rather than holding up the
+// client
+func (hooks webhooks) OnEvent(e Event) {
+	ce, ok := e.(*CommandEvent)
+	if !ok {
+		return
+	}
+	req := ce.req
+	for _, w := range hooks {
+		keys, ok := w.matches(req)
+		if !ok {
+			continue
+		}
+		event := &webhookEvent{
+			Webhook:      w.name,
+			Time:         time.Now(),
+			ConnectionID: ce.Conn.ID,
+			ClientAddr:   ce.Conn.ClientAddr,
+			Identity:     ce.Conn.Identity,
+			User:         ce.User,
+			Command:      req.name,
+			Args:         slices.Clone(ce.session.proxy.values.args(req.cmd)),
+			Keys:         keys,
+		}
+		select {
+		case w.queue <- event:
+		default:
+			w.logger.Warn("Webhook queue full, notification dropped", zap.String("command", req.name))
+		}
+	}
+}
+
+// matches reports whether a command matches the webhook's command rules
+// and, when it has key patterns, returns the keys matching them
+func (w *webhook) matches(req *request) ([]string, bool) {
+	if len(w.commands) > 0 && !matchesCommandRule(w.commands, req) {
+		return nil, false
+	}
+	if len(w.keys) == 0 {
+		return nil, true
+	}
+	var matched []string
+	for _, key := range req.cmd.Keys() {
+		for _, pattern := range w.keys {
+			if glob.Match(pattern, key) {
+				matched = append(matched, key)
+				break
+			}
+		}
+	}
+	return matched, len(matched) > 0
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver posts a notification, retrying with exponential backoff after
+// network errors, 429s and 5xx responses
+func (w *webhook) deliver(ctx context.Context, event *webhookEvent) {
+	body, err := w.encode(event)
+	if err != nil {
+		w.logger.Warn("Failed to encode webhook notification", zap.Error(err))
+		return
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			w.logger.Debug("Webhook delivered", zap.String("command", event.Command), zap.Int("attempts", attempt))
+			return
+		}
+		if !retry || attempt >= w.attempts {
+			w.logger.Warn("Failed to deliver webhook",
+				zap.String("command", event.Command),
+				zap.Int("attempts", attempt),
+				zap.Error(err),
+			)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// post sends a notification once, reporting whether a failure is worth
+// retrying
+func (w *webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// encode renders a notification as the webhook's JSON, or as a Slack
+// message
+func (w *webhook) encode(event *webhookEvent) ([]byte, error) {
+	if w.format != "slack" {
+		return json.Marshal(event)
+	}
+	text := fmt.Sprintf("[%s] `%s` from %s", w.name, event.Command, event.ClientAddr)
+	if event.User != "" {
+		text += " as " + event.User
+	} else if event.Identity != "" {
+		text += " as " + event.Identity
+	}
+	if len(event.Keys) > 0 {
+		text += " on `" + strings.Join(event.Keys, "`, `") + "`"
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
@@ -0,0 +1,197 @@
+// Package redislogger embeds the Redis logging proxy in a Go program, for
+// services that would rather run it in-process than as a separate binary:
+//
+//	cfg, err := config.Load("config.json")
+//	if err != nil {
+//		return err
+//	}
+//	srv, err := redislogger.NewServer(cfg, redislogger.WithLogger(logger))
+//	if err != nil {
+//		return err
+//	}
+//	defer srv.Close()
+//	go srv.ListenAndServe(ctx)
+//	...
+//	srv.Shutdown(shutdownCtx)
+//
+// The config, protocol and proxy packages can be used on their own too.
+package redislogger
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/proxy"
+	"github.com/gregyjames/RedisLogger/sink"
+)
+
+// Server is a proxy serving the listeners of its configuration
+type Server struct {
+	proxy        *proxy.Proxy
+	logger       *zap.Logger
+	interceptors []proxy.Interceptor
+	subscribers  []proxy.Subscriber
+	sinks        []interface{ Close() error }
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithLogger sets the logger commands and events are logged to, which
+// defaults to the outputs of the log configuration, or a zap production
+// logger without one
+func WithLogger(logger *zap.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithInterceptors adds interceptors running custom code on every
+// connection's traffic, in the order given
+func WithInterceptors(interceptors ...proxy.Interceptor) Option {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// WithSubscribers adds subscribers to the events the proxy publishes for
+// connections, commands and replies, in the order given
+func WithSubscribers(subs ...proxy.Subscriber) Option {
+	return func(s *Server) {
+		s.subscribers = append(s.subscribers, subs...)
+	}
+}
+
+// NewServer creates a server for cfg, as returned by config.Load. The log,
+// partitioned log output and legal hold files it configures are opened
+// here and tee'd off the logger.
+func NewServer(cfg *config.Config, opts ...Option) (*Server, error) {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil && cfg.Log != nil {
+		logger, closeOutputs, err := NewLogger(cfg.Log)
+		if err != nil {
+			return nil, err
+		}
+		s.logger = logger
+		s.sinks = append(s.sinks, closer(closeOutputs))
+	}
+	if s.logger == nil {
+		logger, err := zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+		s.logger = logger
+	}
+
+	// Split log output into per-tenant files when configured
+	if cfg.Partition != nil {
+		partitioned := sink.NewPartitioned(cfg.Partition)
+		s.tee(partitioned)
+		s.logger.Debug("Partitioned log output enabled", zap.String("path", cfg.Partition.Path))
+	}
+
+	// Write log output to a rotated file when configured
+	if cfg.LogFile != nil {
+		file, err := sink.NewFile(cfg.LogFile)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.tee(file)
+		s.logger.Debug("Log file enabled", zap.String("path", cfg.LogFile.Path))
+	}
+
+	// Send log output to syslog when configured
+	if cfg.Syslog != nil {
+		syslog, err := sink.NewSyslog(cfg.Syslog)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.tee(syslog)
+		s.logger.Debug("Syslog output enabled", zap.String("network", cfg.Syslog.Network), zap.String("addr", cfg.Syslog.Addr))
+	}
+
+	// Copy records under legal hold to the hold file
+	if cfg.LegalHold != nil {
+		hold, err := sink.NewHold(cfg.LegalHold.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.tee(hold)
+		s.logger.Debug("Legal hold enabled", zap.String("path", cfg.LegalHold.Path))
+	}
+
+	s.proxy = proxy.New(cfg, s.logger)
+	s.proxy.Use(s.interceptors...)
+	s.proxy.Subscribe(s.subscribers...)
+	return s, nil
+}
+
+// closer adapts a function closing outputs to the sinks Close closes
+type closer func()
+
+func (c closer) Close() error {
+	c()
+	return nil
+}
+
+// tee copies the logger's records to a sink, which Close closes
+func (s *Server) tee(core interface {
+	zapcore.Core
+	Close() error
+}) {
+	s.logger = s.logger.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	}))
+	s.sinks = append(s.sinks, core)
+}
+
+// ListenAndServe accepts clients until Shutdown drains the server, when it
+// returns nil, or until ctx is cancelled, which closes the listeners
+// without draining and returns ctx.Err()
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	return s.proxy.Start(ctx)
+}
+
+// Shutdown stops accepting clients and waits for the open connections to
+// finish the commands they have in flight, closing those still open when
+// the drain timeout passes or ctx is cancelled. The proxy state and write
+// journal are then saved.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.proxy.Drain(ctx)
+	err := s.proxy.SaveState()
+	s.proxy.CloseJournal()
+	return err
+}
+
+// Handoff starts a new process of the running binary on the server's
+// listening sockets, after which this one should be shut down. See
+// proxy.Proxy.Handoff.
+func (s *Server) Handoff() error {
+	return s.proxy.Handoff()
+}
+
+// Logger returns the logger the server logs to, including its sinks
+func (s *Server) Logger() *zap.Logger {
+	return s.logger
+}
+
+// Close closes the log, partitioned log output and legal hold files and
+// the syslog connection
+func (s *Server) Close() error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Hold is a zapcore.Core that appends entries marked with a true
+// legal_hold field to a single file. The file is never rotated or purged.
+type Hold struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	fields  []zapcore.Field
+	held    bool
+	file    *holdFile
+}
+
+type holdFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewHold opens the hold file for appending
+func NewHold(path string) (*Hold, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create hold directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hold file: %w", err)
+	}
+	return &Hold{
+		LevelEnabler: zap.DebugLevel,
+		encoder:      zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		file:         &holdFile{file: file},
+	}, nil
+}
+
+func (h *Hold) With(fields []zapcore.Field) zapcore.Core {
+	clone := *h
+	clone.encoder = h.encoder.Clone()
+	clone.fields = append(append([]zapcore.Field{}, h.fields...), fields...)
+	clone.held = h.held || isHeld(fields)
+	return &clone
+}
+
+func (h *Hold) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if h.Enabled(entry.Level) {
+		return checked.AddCore(entry, h)
+	}
+	return checked
+}
+
+func (h *Hold) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if !h.held && !isHeld(fields) {
+		return nil
+	}
+
+	buf, err := h.encoder.EncodeEntry(entry, append(append([]zapcore.Field{}, h.fields...), fields...))
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	_, err = h.file.file.Write(buf.Bytes())
+	return err
+}
+
+func (h *Hold) Sync() error {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	return h.file.file.Sync()
+}
+
+// Close syncs and closes the hold file
+func (h *Hold) Close() error {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	h.file.file.Sync()
+	return h.file.file.Close()
+}
+
+func isHeld(fields []zapcore.Field) bool {
+	for _, field := range fields {
+		if field.Key == "legal_hold" && field.Type == zapcore.BoolType && field.Integer == 1 {
+			return true
+		}
+	}
+	return false
+}
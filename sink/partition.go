@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// Partitioned is a zapcore.Core that writes each entry to a file chosen by
+// rendering the configured path template with the entry's tenant, service
+// and date. Every partition rotates independently.
+type Partitioned struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	fields  []zapcore.Field
+	files   *partitionFiles
+}
+
+type partitionFiles struct {
+	mu       sync.Mutex
+	template string
+	fallback string
+	maxSize  int64
+	open     map[string]*partitionFile
+}
+
+// partitionFile is the file currently receiving a partition's entries
+type partitionFile struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// NewPartitioned creates a partitioned JSON file core
+func NewPartitioned(cfg *config.PartitionConfig) *Partitioned {
+	fallback := cfg.Default
+	if fallback == "" {
+		fallback = "default"
+	}
+	return &Partitioned{
+		LevelEnabler: zap.InfoLevel,
+		encoder:      zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		files: &partitionFiles{
+			template: cfg.Path,
+			fallback: fallback,
+			maxSize:  int64(cfg.MaxSizeMB) * 1024 * 1024,
+			open:     make(map[string]*partitionFile),
+		},
+	}
+}
+
+func (p *Partitioned) With(fields []zapcore.Field) zapcore.Core {
+	clone := *p
+	clone.encoder = p.encoder.Clone()
+	clone.fields = append(append([]zapcore.Field{}, p.fields...), fields...)
+	return &clone
+}
+
+func (p *Partitioned) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if p.Enabled(entry.Level) {
+		return checked.AddCore(entry, p)
+	}
+	return checked
+}
+
+func (p *Partitioned) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	all := append(append([]zapcore.Field{}, p.fields...), fields...)
+	tenant, service := p.files.fallback, p.files.fallback
+	for _, field := range all {
+		if field.Type != zapcore.StringType {
+			continue
+		}
+		switch field.Key {
+		case "tenant":
+			tenant = field.String
+		case "service":
+			service = field.String
+		}
+	}
+
+	buf, err := p.encoder.EncodeEntry(entry, all)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	return p.files.write(tenant, service, entry.Time, buf.Bytes())
+}
+
+func (p *Partitioned) Sync() error {
+	p.files.mu.Lock()
+	defer p.files.mu.Unlock()
+	for _, f := range p.files.open {
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every open partition file
+func (p *Partitioned) Close() error {
+	p.files.mu.Lock()
+	defer p.files.mu.Unlock()
+	for key, f := range p.files.open {
+		f.file.Close()
+		delete(p.files.open, key)
+	}
+	return nil
+}
+
+func (f *partitionFiles) write(tenant, service string, at time.Time, data []byte) error {
+	path := renderPath(f.template, tenant, service, at)
+	key := tenant + "/" + service
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := f.open[key]
+	var rotateErr error
+	// The rendered path changes when the date rolls over
+	if current != nil && current.path != path {
+		current.file.Close()
+		current = nil
+	}
+	if current != nil && f.maxSize > 0 && current.size+int64(len(data)) > f.maxSize {
+		if err := current.rotate(at); err != nil {
+			if current.file == nil {
+				// Opened again by the next write
+				delete(f.open, key)
+				return err
+			}
+			rotateErr = err
+		}
+	}
+	if current == nil {
+		opened, err := openPartitionFile(path)
+		if err != nil {
+			return err
+		}
+		current = opened
+		f.open[key] = current
+	}
+
+	n, err := current.file.Write(data)
+	current.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+func openPartitionFile(path string) (*partitionFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &partitionFile{path: path, file: file, size: info.Size()}, nil
+}
+
+// rotate moves the full file aside with a timestamp suffix and reopens the
+// original path. When the move fails, the full file is reopened to be
+// appended to; when reopening fails too, file is left nil.
+func (f *partitionFile) rotate(at time.Time) error {
+	f.file.Close()
+	ext := filepath.Ext(f.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), at.Format("20060102T150405.000"), ext)
+	renameErr := os.Rename(f.path, rotated)
+	reopened, err := openPartitionFile(f.path)
+	if err != nil {
+		f.file = nil
+		return err
+	}
+	*f = *reopened
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate log file: %w", renameErr)
+	}
+	return nil
+}
+
+// renderPath substitutes the partition placeholders of a path template,
+// keeping values from escaping their directory
+func renderPath(template, tenant, service string, at time.Time) string {
+	return strings.NewReplacer(
+		"{tenant}", sanitize(tenant),
+		"{service}", sanitize(service),
+		"{date}", at.Format("2006-01-02"),
+	).Replace(template)
+}
+
+func sanitize(value string) string {
+	value = strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(value)
+	if value == "" {
+		return "_"
+	}
+	return value
+}
@@ -0,0 +1,269 @@
+package sink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// rotatedTimeFormat is the timestamp suffix of rotated files
+const rotatedTimeFormat = "20060102T150405.000"
+
+// defaultMaxSizeMB is the size a log file is rotated at unless configured
+// otherwise
+const defaultMaxSizeMB = 100
+
+// File is a zapcore.Core that writes JSON entries to a log file rotated by
+// size and age
+type File struct {
+	zapcore.Core
+	file *RotatingFile
+}
+
+// NewFile opens the log file of cfg
+func NewFile(cfg *config.LogFileConfig) (*File, error) {
+	file, err := NewRotatingFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return &File{Core: zapcore.NewCore(encoder, file, zap.InfoLevel), file: file}, nil
+}
+
+// Close closes the log file
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// RotatingFile is a zapcore.WriteSyncer appending to a file that is moved
+// aside with a timestamp suffix once it reaches its maximum size or age.
+// Rotated files are optionally gzip-compressed, and the oldest are removed
+// beyond the configured count and age, in the background.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// mill serializes the compression and removal of rotated files
+	mill sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// NewRotatingFile opens the file of cfg for appending
+func NewRotatingFile(cfg *config.LogFileConfig) (*RotatingFile, error) {
+	maxSize := cfg.MaxSizeMB
+	if maxSize == 0 {
+		maxSize = defaultMaxSizeMB
+	}
+	r := &RotatingFile{
+		path:       cfg.Path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		interval:   time.Duration(cfg.RotateHours) * time.Hour,
+		maxBackups: cfg.MaxBackups,
+		maxAge:     time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+		compress:   cfg.Compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	// Clear out what an earlier run left beyond the limits
+	r.millAsync()
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	full := r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	expired := r.interval > 0 && r.size > 0 && time.Since(r.opened) >= r.interval
+	if full || expired {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and reopens the path, which keeps
+// receiving entries if the file can't be moved
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	ext := filepath.Ext(r.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().Format(rotatedTimeFormat), ext)
+	renameErr := os.Rename(r.path, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate log file: %w", renameErr)
+	}
+	r.millAsync()
+	return nil
+}
+
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the file once the rotated files are compressed and cleaned
+// up
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	file := r.file
+	r.file = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+	if file == nil {
+		return nil
+	}
+	file.Sync()
+	return file.Close()
+}
+
+func (r *RotatingFile) millAsync() {
+	if !r.compress && r.maxBackups == 0 && r.maxAge == 0 {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.mill.Lock()
+		defer r.mill.Unlock()
+		r.millRun()
+	}()
+}
+
+// rotatedFile is a file rotated out of the path
+type rotatedFile struct {
+	path string
+	at   time.Time
+}
+
+// millRun compresses rotated files and removes those beyond the limits.
+// Failures are reported to stderr, as the log is what failed.
+func (r *RotatingFile) millRun() {
+	files, err := r.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		return
+	}
+	// Newest first
+	slices.SortFunc(files, func(a, b rotatedFile) int { return b.at.Compare(a.at) })
+	for i, f := range files {
+		expired := r.maxAge > 0 && time.Since(f.at) > r.maxAge
+		if r.maxBackups > 0 && i >= r.maxBackups || expired {
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+			}
+			continue
+		}
+		if r.compress && !strings.HasSuffix(f.path, ".gz") {
+			if err := compressFile(f.path); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// rotatedFiles lists the files rotated out of the path, compressed or not
+func (r *RotatingFile) rotatedFiles() ([]rotatedFile, error) {
+	dir := filepath.Dir(r.path)
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(name, ".gz"), prefix)
+		if entry.IsDir() || !ok || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		at, err := time.ParseInLocation(rotatedTimeFormat, strings.TrimSuffix(stamp, ext), time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{path: filepath.Join(dir, name), at: at})
+	}
+	return files, nil
+}
+
+// compressFile gzips a file in place, removing the original once the
+// compressed copy is complete
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
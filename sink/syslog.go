@@ -0,0 +1,328 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gregyjames/RedisLogger/config"
+)
+
+// defaultSyslogSocket is the local syslog socket
+const defaultSyslogSocket = "/dev/log"
+
+// syslogTimeout bounds connecting and writing to the syslog server
+const syslogTimeout = 5 * time.Second
+
+// defaultSyslogQueueSize is the number of messages waiting to be sent
+// beyond which further ones are dropped
+const defaultSyslogQueueSize = 10000
+
+// Syslog is a zapcore.Core that sends entries to a syslog server as RFC
+// 5424 messages carrying the JSON-encoded entry, over the local socket or
+// UDP, TCP or TLS. Messages are queued and sent in the background, so a
+// slow or unreachable server drops them rather than holding up logging.
+type Syslog struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	fields  []zapcore.Field
+	conn    *syslogConn
+}
+
+type syslogConn struct {
+	network  string
+	addr     string
+	tls      *tls.Config
+	facility int
+	hostname string
+	tag      string
+	pid      string
+	conn     net.Conn
+	// framed is set for stream connections, which prefix each message
+	// with its length
+	framed bool
+
+	encoder zapcore.Encoder
+	queue   chan []byte
+	dropped atomic.Uint64
+	stop    chan struct{}
+	stopped sync.Once
+	done    chan struct{}
+	// deadline bounds the sends left once the output is closed
+	deadline time.Time
+}
+
+// NewSyslog connects to the syslog server of cfg
+func NewSyslog(cfg *config.SyslogConfig) (*Syslog, error) {
+	c := &syslogConn{
+		network:  cfg.Network,
+		addr:     cfg.Addr,
+		facility: config.SyslogFacilities["local0"],
+		hostname: "-",
+		tag:      cfg.Tag,
+		pid:      strconv.Itoa(os.Getpid()),
+		encoder:  zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultSyslogQueueSize
+	}
+	c.queue = make(chan []byte, queueSize)
+	if c.network == "" {
+		c.network = "unix"
+	}
+	if c.addr == "" && c.network == "unix" {
+		c.addr = defaultSyslogSocket
+	}
+	if cfg.Facility != "" {
+		c.facility = config.SyslogFacilities[cfg.Facility]
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		c.hostname = hostname
+	}
+	if c.tag == "" {
+		c.tag = "redislogger"
+	}
+	if c.network == "tls" {
+		tlsConfig, err := syslogTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.tls = tlsConfig
+	}
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+	go c.run()
+
+	level := zap.InfoLevel
+	if cfg.Level != "" {
+		// Validated when the config is loaded
+		level, _ = zapcore.ParseLevel(cfg.Level)
+	}
+	return &Syslog{
+		LevelEnabler: level,
+		encoder:      c.encoder,
+		conn:         c,
+	}, nil
+}
+
+func syslogTLSConfig(cfg *config.SyslogConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if host, _, err := net.SplitHostPort(cfg.Addr); err == nil {
+		tlsConfig.ServerName = host
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read syslog CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in syslog CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load syslog client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// dial connects to the server. The local socket is a datagram socket on
+// most systems and a stream socket on some.
+func (c *syslogConn) dial() error {
+	var conn net.Conn
+	var err error
+	switch c.network {
+	case "unix":
+		conn, err = net.DialTimeout("unixgram", c.addr, syslogTimeout)
+		c.framed = false
+		if err != nil {
+			conn, err = net.DialTimeout("unix", c.addr, syslogTimeout)
+			c.framed = true
+		}
+	case "tls":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: syslogTimeout}, "tcp", c.addr, c.tls)
+		c.framed = true
+	default:
+		conn, err = net.DialTimeout(c.network, c.addr, syslogTimeout)
+		c.framed = c.network == "tcp"
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	c.conn = conn
+	return nil
+}
+
+func (s *Syslog) With(fields []zapcore.Field) zapcore.Core {
+	clone := *s
+	clone.encoder = s.encoder.Clone()
+	clone.fields = append(append([]zapcore.Field{}, s.fields...), fields...)
+	return &clone
+}
+
+func (s *Syslog) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if s.Enabled(entry.Level) {
+		return checked.AddCore(entry, s)
+	}
+	return checked
+}
+
+func (s *Syslog) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := s.encoder.EncodeEntry(entry, append(append([]zapcore.Field{}, s.fields...), fields...))
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	select {
+	case s.conn.queue <- s.conn.format(entry, buf.Bytes()):
+	default:
+		s.conn.dropped.Add(1)
+	}
+	return nil
+}
+
+// format makes an RFC 5424 message of an encoded entry
+func (c *syslogConn) format(entry zapcore.Entry, msg []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - - ",
+		c.facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		c.hostname, c.tag, c.pid,
+	)
+	b.Write(bytes.TrimSuffix(msg, []byte("\n")))
+	return b.Bytes()
+}
+
+// run sends the queued messages until the output is closed, then those
+// still queued for as long as syslogTimeout allows
+func (c *syslogConn) run() {
+	defer close(c.done)
+	for {
+		select {
+		case msg := <-c.queue:
+			c.deliver(msg)
+		case <-c.stop:
+			c.deadline = time.Now().Add(syslogTimeout)
+			for time.Now().Before(c.deadline) {
+				select {
+				case msg := <-c.queue:
+					c.deliver(msg)
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+// deliver sends a message, counting it as dropped if it can't be sent.
+// Once a message gets through, the messages dropped before it are
+// reported in one of their own.
+func (c *syslogConn) deliver(msg []byte) {
+	if err := c.send(msg); err != nil {
+		c.dropped.Add(1)
+		return
+	}
+	n := c.dropped.Swap(0)
+	if n == 0 {
+		return
+	}
+	entry := zapcore.Entry{Level: zapcore.WarnLevel, Time: time.Now(), Message: "Syslog queue full or server unreachable, entries dropped"}
+	buf, err := c.encoder.EncodeEntry(entry, []zapcore.Field{zap.Uint64("dropped", n)})
+	if err != nil {
+		return
+	}
+	defer buf.Free()
+	if err := c.send(c.format(entry, buf.Bytes())); err != nil {
+		c.dropped.Add(n)
+	}
+}
+
+// send writes a message, reconnecting once if the connection was lost
+func (c *syslogConn) send(msg []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			// Not reconnecting once closed, where the deadline is short
+			if !c.deadline.IsZero() {
+				return errors.New("syslog connection lost")
+			}
+			if err = c.dial(); err != nil {
+				continue
+			}
+		}
+		message := msg
+		if c.framed {
+			// Octet counting, as in RFC 6587
+			message = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		deadline := time.Now().Add(syslogTimeout)
+		if !c.deadline.IsZero() {
+			deadline = c.deadline
+		}
+		c.conn.SetWriteDeadline(deadline)
+		if _, err = c.conn.Write(message); err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// syslogSeverity maps a zap level to a syslog severity
+func syslogSeverity(level zapcore.Level) int {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return 7
+	case level == zapcore.InfoLevel:
+		return 6
+	case level == zapcore.WarnLevel:
+		return 4
+	case level == zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+func (s *Syslog) Sync() error {
+	return nil
+}
+
+// Close sends the messages still queued and closes the connection to the
+// syslog server
+func (s *Syslog) Close() error {
+	s.conn.stopped.Do(func() { close(s.conn.stop) })
+	<-s.conn.done
+	if s.conn.conn == nil {
+		return nil
+	}
+	err := s.conn.conn.Close()
+	s.conn.conn = nil
+	return err
+}
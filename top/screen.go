@@ -0,0 +1,146 @@
+package top
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// screen draws the dashboard, redrawing it in place on a terminal and
+// printing one frame after another otherwise
+type screen struct {
+	out io.Writer
+	fd  int
+	tty bool
+}
+
+func newScreen(out *os.File) *screen {
+	fd := int(out.Fd())
+	return &screen{out: out, fd: fd, tty: term.IsTerminal(fd)}
+}
+
+// open switches to the alternate screen and hides the cursor
+func (s *screen) open() {
+	if s.tty {
+		io.WriteString(s.out, "\x1b[?1049h\x1b[?25l")
+	}
+}
+
+// close restores the screen and cursor the dashboard started from
+func (s *screen) close() {
+	if s.tty {
+		io.WriteString(s.out, "\x1b[?25h\x1b[?1049l")
+	}
+}
+
+// size is the terminal's, or a fixed frame when output isn't a terminal
+func (s *screen) size() (int, int) {
+	if s.tty {
+		if width, height, err := term.GetSize(s.fd); err == nil {
+			return width, height
+		}
+	}
+	return 100, 30
+}
+
+func (s *screen) render(addr string, started time.Time, status string, snap *snapshot) {
+	width, height := s.size()
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, printable(fmt.Sprintf(format, args...)))
+	}
+
+	uptime := time.Since(started).Truncate(time.Second)
+	add("redislogger top  %s  %s  up %s  %s", addr, status, uptime, time.Now().Format("15:04:05"))
+	add("ops/s %.1f   errors/s %.1f   reply KB/s %.1f", snap.ops, snap.errs, snap.bytes/1024)
+	add("")
+
+	// The commands get half of the rows below the header, the top keys
+	// and clients the rest
+	rows := max((height-len(lines)-4)/2, 1)
+	add("%-24s %10s %9s %9s %9s %9s %9s", "COMMAND", "OPS/S", "ERR/S", "P50 ms", "P90 ms", "P99 ms", "MAX ms")
+	for _, c := range snap.commands[:min(rows, len(snap.commands))] {
+		add("%-24s %10.1f %9.1f %9.2f %9.2f %9.2f %9.2f",
+			truncate(c.name, 24), c.ops, c.errs, ms(c.p50), ms(c.p90), ms(c.p99), ms(c.max))
+	}
+	add("")
+
+	rows = max(height-len(lines)-2, 1)
+	half := max(width/2-1, 20)
+	span := snap.span.Round(time.Second)
+	add("%-*s %10s  %-*s %10s", half-11, fmt.Sprintf("TOP KEYS (%s)", span), "OPS/S", half-11, fmt.Sprintf("TOP CLIENTS (%s)", span), "OPS/S")
+	for i := 0; i < rows && (i < len(snap.keys) || i < len(snap.clients)); i++ {
+		left := strings.Repeat(" ", half)
+		if i < len(snap.keys) {
+			left = fmt.Sprintf("%-*s %10.1f", half-11, truncate(snap.keys[i].name, half-11), snap.keys[i].ops)
+		}
+		right := ""
+		if i < len(snap.clients) {
+			right = fmt.Sprintf("%-*s %10.1f", half-11, truncate(snap.clients[i].name, half-11), snap.clients[i].ops)
+		}
+		add("%s  %s", left, right)
+	}
+
+	var b strings.Builder
+	if s.tty {
+		// Redraw from the top left, clearing what the last frame left
+		b.WriteString("\x1b[H")
+		for i, line := range lines[:min(len(lines), height-1)] {
+			line = truncate(line, width)
+			if i == 0 {
+				// The title bar is shown in reverse video
+				line = "\x1b[7m" + padRight(line, width) + "\x1b[0m"
+			}
+			b.WriteString(line + "\x1b[K\r\n")
+		}
+		b.WriteString("\x1b[J" + truncate("q to quit", width))
+	} else {
+		for _, line := range lines {
+			b.WriteString(strings.TrimRight(line, " ") + "\n")
+		}
+		b.WriteString("\n")
+	}
+	io.WriteString(s.out, b.String())
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// printable replaces the characters of s a terminal would act on rather
+// than print, since key names and client names come from clients, which
+// could otherwise move the cursor or rewrite the screen. Each becomes a
+// single ?, keeping the columns aligned.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// truncate shortens s to n characters, ending it with ~ when cut
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:max(n, 0)])
+	}
+	return string(r[:n-1]) + "~"
+}
+
+func padRight(s string, n int) string {
+	if pad := n - len([]rune(s)); pad > 0 {
+		return s + strings.Repeat(" ", pad)
+	}
+	return s
+}
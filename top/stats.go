@@ -0,0 +1,195 @@
+package top
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gregyjames/RedisLogger/eventpb"
+)
+
+// maxSamples bounds the latencies kept per command and interval; beyond it
+// they are reservoir sampled, so percentiles stay cheap at any rate
+const maxSamples = 10000
+
+// tick is what the stream delivered during one refresh interval
+type tick struct {
+	commands map[string]*commandTick
+	keys     map[string]int
+	clients  map[string]int
+}
+
+type commandTick struct {
+	count     int
+	errors    int
+	bytes     uint64
+	latencies []time.Duration
+}
+
+func newTick() *tick {
+	return &tick{
+		commands: make(map[string]*commandTick),
+		keys:     make(map[string]int),
+		clients:  make(map[string]int),
+	}
+}
+
+// stats accumulates the events of the current interval and keeps the past
+// ones for the top keys and clients
+type stats struct {
+	mu      sync.Mutex
+	current *tick
+	since   time.Time
+	// history holds the last ticks, newest last, for the top lists
+	history []*tick
+	window  int
+}
+
+func newStats(window int) *stats {
+	return &stats{current: newTick(), since: time.Now(), window: window}
+}
+
+func (s *stats) add(e *eventpb.CommandEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.current.commands[e.Command]
+	if c == nil {
+		c = &commandTick{}
+		s.current.commands[e.Command] = c
+	}
+	c.count++
+	if e.Error != "" {
+		c.errors++
+	}
+	c.bytes += e.ReplyBytes
+	latency := e.Latency.AsDuration()
+	if len(c.latencies) < maxSamples {
+		c.latencies = append(c.latencies, latency)
+	} else if i := rand.IntN(c.count); i < maxSamples {
+		c.latencies[i] = latency
+	}
+	for _, key := range e.Keys {
+		s.current.keys[key]++
+	}
+	s.current.clients[clientName(e)]++
+}
+
+// clientName is how a client is shown: its identity or user when it has
+// one, with its address
+func clientName(e *eventpb.CommandEvent) string {
+	switch {
+	case e.ClientIdentity != "":
+		return e.ClientIdentity + " " + e.ClientAddr
+	case e.User != "":
+		return e.User + "@" + e.ClientAddr
+	}
+	return e.ClientAddr
+}
+
+// commandRow is a line of the command table
+type commandRow struct {
+	name          string
+	ops, errs     float64
+	bytes         float64
+	p50, p90, p99 time.Duration
+	max           time.Duration
+}
+
+// rankedRow is a line of the top keys or clients
+type rankedRow struct {
+	name string
+	ops  float64
+}
+
+// snapshot is a frame of the dashboard
+type snapshot struct {
+	ops, errs, bytes float64
+	commands         []commandRow
+	keys             []rankedRow
+	clients          []rankedRow
+	// span is how long the top lists were gathered over
+	span time.Duration
+}
+
+// rotate closes the current interval and summarizes it, along with the
+// top keys and clients over the window
+func (s *stats) rotate() *snapshot {
+	s.mu.Lock()
+	t, since := s.current, s.since
+	s.current, s.since = newTick(), time.Now()
+	s.history = append(s.history, t)
+	if len(s.history) > s.window {
+		s.history = s.history[1:]
+	}
+	history := slices.Clone(s.history)
+	s.mu.Unlock()
+
+	elapsed := time.Since(since).Seconds()
+	snap := &snapshot{}
+	for name, c := range t.commands {
+		row := commandRow{
+			name:  name,
+			ops:   float64(c.count) / elapsed,
+			errs:  float64(c.errors) / elapsed,
+			bytes: float64(c.bytes) / elapsed,
+		}
+		slices.Sort(c.latencies)
+		row.p50 = percentile(c.latencies, 0.50)
+		row.p90 = percentile(c.latencies, 0.90)
+		row.p99 = percentile(c.latencies, 0.99)
+		if len(c.latencies) > 0 {
+			row.max = c.latencies[len(c.latencies)-1]
+		}
+		snap.ops += row.ops
+		snap.errs += row.errs
+		snap.bytes += row.bytes
+		snap.commands = append(snap.commands, row)
+	}
+	sort.Slice(snap.commands, func(i, j int) bool {
+		if snap.commands[i].ops != snap.commands[j].ops {
+			return snap.commands[i].ops > snap.commands[j].ops
+		}
+		return snap.commands[i].name < snap.commands[j].name
+	})
+
+	// The window is made of ticks of roughly the refresh interval
+	snap.span = time.Duration(elapsed * float64(len(history)) * float64(time.Second))
+	keys := make(map[string]int)
+	clients := make(map[string]int)
+	for _, h := range history {
+		for k, n := range h.keys {
+			keys[k] += n
+		}
+		for c, n := range h.clients {
+			clients[c] += n
+		}
+	}
+	snap.keys = ranked(keys, snap.span.Seconds())
+	snap.clients = ranked(clients, snap.span.Seconds())
+	return snap
+}
+
+// percentile picks the p quantile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+func ranked(counts map[string]int, seconds float64) []rankedRow {
+	rows := make([]rankedRow, 0, len(counts))
+	for name, n := range counts {
+		rows = append(rows, rankedRow{name: name, ops: float64(n) / seconds})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].ops != rows[j].ops {
+			return rows[i].ops > rows[j].ops
+		}
+		return rows[i].name < rows[j].name
+	})
+	return rows
+}
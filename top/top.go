@@ -0,0 +1,200 @@
+// Package top implements "redislogger top", a terminal dashboard of the
+// traffic a running proxy streams over gRPC, in the manner of redis-stat
+package top
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/gregyjames/RedisLogger/config"
+	"github.com/gregyjames/RedisLogger/eventpb"
+)
+
+// Run shows the dashboard with the given command line arguments until the
+// user quits
+func Run(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	configPath := flags.String("config", "config.json", "proxy configuration, used for the gRPC address and token")
+	addr := flags.String("addr", "", "gRPC event stream address; defaults to grpc.addr")
+	token := flags.String("token", "", "bearer token; defaults to grpc.token")
+	interval := flags.Duration("interval", time.Second, "refresh interval")
+	window := flags.Duration("window", 10*time.Second, "period the top keys and clients are ranked over")
+	commands := flags.String("commands", "", "comma-separated commands to limit the stream to")
+	keys := flags.String("keys", "", "comma-separated key patterns to limit the stream to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("-interval must be positive")
+	}
+
+	if *addr == "" || *token == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if cfg.GRPC == nil {
+			return fmt.Errorf("%s has no grpc section; set -addr", *configPath)
+		}
+		if *addr == "" {
+			*addr = dialableAddr(cfg.GRPC.Addr)
+		}
+		if *token == "" {
+			*token = cfg.GRPC.Token
+		}
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", *addr, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+	}
+	st := newStats(max(int(*window / *interval), 1))
+	stream := &streamState{}
+	go subscribe(ctx, eventpb.NewEventStreamClient(conn), &eventpb.SubscribeRequest{
+		Commands:    splitList(*commands),
+		KeyPatterns: splitList(*keys),
+	}, st, stream)
+
+	scr := newScreen(os.Stdout)
+	quit := make(chan struct{})
+	if fd := int(os.Stdin.Fd()); scr.tty && term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		go readKeys(os.Stdin, quit)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	scr.open()
+	defer scr.close()
+	started := time.Now()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+			scr.render(*addr, started, stream.get(), st.rotate())
+		}
+	}
+}
+
+// streamState is the connection status shown in the header
+type streamState struct {
+	mu  sync.Mutex
+	err error
+	up  bool
+}
+
+func (s *streamState) set(up bool, err error) {
+	s.mu.Lock()
+	s.up, s.err = up, err
+	s.mu.Unlock()
+}
+
+func (s *streamState) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.up:
+		return "streaming"
+	case s.err != nil:
+		return "disconnected: " + s.err.Error()
+	}
+	return "connecting"
+}
+
+// subscribe feeds the stream's events into the stats, subscribing again
+// with backoff whenever the stream ends
+func subscribe(ctx context.Context, client eventpb.EventStreamClient, req *eventpb.SubscribeRequest, st *stats, state *streamState) {
+	backoff := 500 * time.Millisecond
+	for ctx.Err() == nil {
+		stream, err := client.Subscribe(ctx, req)
+		for err == nil {
+			var e *eventpb.CommandEvent
+			if e, err = stream.Recv(); err == nil {
+				state.set(true, nil)
+				backoff = 500 * time.Millisecond
+				st.add(e)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("stream closed by the proxy")
+		}
+		state.set(false, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// readKeys closes quit when q, Q, Ctrl-C or Ctrl-D is pressed
+func readKeys(r io.Reader, quit chan struct{}) {
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, b := range buf[:n] {
+			if b == 'q' || b == 'Q' || b == 3 || b == 4 {
+				close(quit)
+				return
+			}
+		}
+	}
+}
+
+// dialableAddr turns a listen address such as ":8089" into one to connect to
+func dialableAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || (host != "" && host != "0.0.0.0" && host != "::") {
+		return listen
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}